@@ -0,0 +1,121 @@
+// block.go - end to end encrypted message blocks
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package block implements the end to end encryption of the messages
+// delivered to the spool of a user.
+//
+// A block is a one-way Noise X handshake message from the sender to the
+// recipient, which authenticates the sender with its link key. The plaintext
+// is the length prefixed message padded to fill the user forward payload.
+package block
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/noise"
+)
+
+const (
+	// noiseOverhead is the length of the ephemeral key, the encrypted
+	// static key and the payload tag of a Noise X handshake message.
+	noiseOverhead = ecdh.PublicKeySize + (ecdh.PublicKeySize + 16) + 16
+
+	// lengthPrefixLength is the length of the message length prefix.
+	lengthPrefixLength = 4
+
+	// BlockLength is the length of an encrypted block.
+	BlockLength = constants.UserForwardPayloadLength
+
+	// MaxMessageLength is the maximum length of a message carried by a
+	// block.
+	MaxMessageLength = BlockLength - noiseOverhead - lengthPrefixLength
+)
+
+var (
+	// ErrInvalidBlock is the error returned when the block is malformed.
+	ErrInvalidBlock = errors.New("block: invalid block")
+
+	cipherSuite = noise.NewCipherSuite(noise.DH25519, noise.CipherChaChaPoly, noise.HashBLAKE2b)
+)
+
+// EncryptBlock encrypts the message to the recipient, authenticated by the
+// link key of the sender.
+func EncryptBlock(message []byte, sender *ecdh.PrivateKey, recipient *ecdh.PublicKey) ([]byte, error) {
+	if len(message) > MaxMessageLength {
+		return nil, fmt.Errorf("block: invalid message size: %v", len(message))
+	}
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite: cipherSuite,
+		Random:      rand.Reader,
+		Pattern:     noise.HandshakeX,
+		Initiator:   true,
+		StaticKeypair: noise.DHKey{
+			Private: sender.Bytes(),
+			Public:  sender.PublicKey().Bytes(),
+		},
+		PeerStatic: recipient.Bytes(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	plaintext := make([]byte, BlockLength-noiseOverhead)
+	binary.BigEndian.PutUint32(plaintext[:lengthPrefixLength], uint32(len(message)))
+	copy(plaintext[lengthPrefixLength:], message)
+	b, _, _, err := hs.WriteMessage(nil, plaintext)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// DecryptBlock decrypts the block with the link key of the recipient, and
+// returns the message along with the link key of the sender.
+func DecryptBlock(b []byte, recipient *ecdh.PrivateKey) ([]byte, *ecdh.PublicKey, error) {
+	if len(b) != BlockLength {
+		return nil, nil, ErrInvalidBlock
+	}
+	hs, err := noise.NewHandshakeState(noise.Config{
+		CipherSuite: cipherSuite,
+		Random:      rand.Reader,
+		Pattern:     noise.HandshakeX,
+		Initiator:   false,
+		StaticKeypair: noise.DHKey{
+			Private: recipient.Bytes(),
+			Public:  recipient.PublicKey().Bytes(),
+		},
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	plaintext, _, _, err := hs.ReadMessage(nil, b)
+	if err != nil {
+		return nil, nil, err
+	}
+	length := binary.BigEndian.Uint32(plaintext[:lengthPrefixLength])
+	if length > MaxMessageLength {
+		return nil, nil, ErrInvalidBlock
+	}
+	sender := new(ecdh.PublicKey)
+	if err = sender.FromBytes(hs.PeerStatic()); err != nil {
+		return nil, nil, err
+	}
+	return plaintext[lengthPrefixLength : lengthPrefixLength+length], sender, nil
+}
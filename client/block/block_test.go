@@ -0,0 +1,63 @@
+// block_test.go - end to end encrypted message block tests
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package block
+
+import (
+	"testing"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBlock(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	sender, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+	recipient, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+
+	message := []byte("payment request")
+	b, err := EncryptBlock(message, sender, recipient.PublicKey())
+	require.NoError(err)
+	assert.Len(b, BlockLength)
+
+	// the recipient decrypts and authenticates the sender
+	plaintext, senderKey, err := DecryptBlock(b, recipient)
+	require.NoError(err)
+	assert.Equal(message, plaintext)
+	assert.True(sender.PublicKey().Equal(senderKey))
+
+	// other keys cannot decrypt
+	_, _, err = DecryptBlock(b, sender)
+	assert.Error(err)
+
+	// tampered and truncated blocks are rejected
+	b[len(b)-1] ^= 0xff
+	_, _, err = DecryptBlock(b, recipient)
+	assert.Error(err)
+	_, _, err = DecryptBlock(b[:len(b)-1], recipient)
+	assert.Equal(ErrInvalidBlock, err)
+
+	// the message fills at most a block
+	_, err = EncryptBlock(make([]byte, MaxMessageLength), sender, recipient.PublicKey())
+	assert.NoError(err)
+	_, err = EncryptBlock(make([]byte, MaxMessageLength+1), sender, recipient.PublicKey())
+	assert.Error(err)
+}
@@ -5,10 +5,12 @@ package client
 import (
 	"context"
 	"encoding/binary"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	mrand "math/rand"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -18,11 +20,14 @@ import (
 
 	"github.com/hashcloak/Meson/client/config"
 	"github.com/hashcloak/Meson/client/pkiclient/epochtime"
+	mRegistration "github.com/hashcloak/Meson/server/registration"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/crypto/rand"
 	"github.com/katzenpost/core/log"
 	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/utils"
 	registration "github.com/katzenpost/registration_client"
+	"golang.org/x/net/proxy"
 	"gopkg.in/op/go-logging.v1"
 )
 
@@ -30,34 +35,56 @@ const (
 	initialPKIConsensusTimeout = 10 * time.Second
 )
 
-func AutoRegisterRandomClient(cfg *config.Config) *ecdh.PrivateKey {
-	// Retrieve a copy of the PKI consensus document.
+// AutoRegisterRandomClient registers a new link key under a random user name
+// with a random registration Provider, and returns the link key.
+func AutoRegisterRandomClient(cfg *config.Config) (*ecdh.PrivateKey, error) {
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	if err = registerRandomAccount(cfg, linkKey); err != nil {
+		return nil, err
+	}
+	return linkKey, nil
+}
+
+// currentDocument retrieves a copy of the PKI consensus document of the
+// current epoch.
+func currentDocument(cfg *config.Config) (*pki.Document, error) {
 	logFile, err := ioutil.TempFile("", "meson-client-registration-log")
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	defer os.Remove(logFile.Name())
 	backendLog, err := log.New(logFile.Name(), "ERROR", false)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	proxyCfg := cfg.UpstreamProxyConfig()
 	pkiClient, err := cfg.NewPKIClient(backendLog, proxyCfg)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	// have to shutdown pkiclient and release database
 	// maybe find better solution?
 	defer pkiClient.Shutdown()
 	currentEpoch, _, _, err := epochtime.Now(pkiClient)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
 	ctx, cancel := context.WithTimeout(context.Background(), initialPKIConsensusTimeout)
 	defer cancel()
 	doc, _, err := pkiClient.GetDoc(ctx, currentEpoch)
+	return doc, err
+}
+
+// registerRandomAccount registers the link key under a random user name with
+// a random registration Provider, and sets the Account and Registration
+// sections of cfg.
+func registerRandomAccount(cfg *config.Config, linkKey *ecdh.PrivateKey) error {
+	doc, err := currentDocument(cfg)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
 	// Pick a registration Provider.
@@ -68,28 +95,35 @@ func AutoRegisterRandomClient(cfg *config.Config) *ecdh.PrivateKey {
 		}
 	}
 	if len(registerProviders) == 0 {
-		panic("zero registration Providers found in the consensus")
+		return errors.New("zero registration Providers found in the consensus")
 	}
 	mrand.Seed(time.Now().UTC().UnixNano())
 	registrationProvider := registerProviders[mrand.Intn(len(registerProviders))]
 
 	// Register with that Provider.
 	// "registering client with mixnet Provider"
-	linkKey, err := ecdh.NewKeypair(rand.Reader)
-	if err != nil {
-		panic(err)
-	}
 	account := &config.Account{
 		User:           fmt.Sprintf("%s.%s", linkKey.PublicKey().String()[:6], cfg.UpstreamProxy.User),
 		Provider:       registrationProvider.Name,
 		ProviderKeyPin: registrationProvider.IdentityKey,
 	}
+	cfgRegistration, err := newRegistration(cfg, registrationProvider.RegistrationHTTPAddresses[0])
+	if err != nil {
+		return err
+	}
+	cfg.Account = account
+	cfg.Registration = cfgRegistration
+	return RegisterClient(cfg, linkKey.PublicKey())
+}
 
-	u, err := url.Parse(registrationProvider.RegistrationHTTPAddresses[0])
+// newRegistration returns the Registration section for the registration
+// address of a Provider.
+func newRegistration(cfg *config.Config, address string) (*config.Registration, error) {
+	u, err := url.Parse(address)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	cfgRegistration := &config.Registration{
+	return &config.Registration{
 		Address: u.Host,
 		Options: &registration.Options{
 			Scheme:       u.Scheme,
@@ -97,14 +131,7 @@ func AutoRegisterRandomClient(cfg *config.Config) *ecdh.PrivateKey {
 			SocksNetwork: cfg.UpstreamProxy.Network,
 			SocksAddress: cfg.UpstreamProxy.Address,
 		},
-	}
-	cfg.Account = account
-	cfg.Registration = cfgRegistration
-	err = RegisterClient(cfg, linkKey.PublicKey())
-	if err != nil {
-		panic(err)
-	}
-	return linkKey
+	}, nil
 }
 
 func RegisterClient(cfg *config.Config, linkKey *ecdh.PublicKey) error {
@@ -116,6 +143,49 @@ func RegisterClient(cfg *config.Config, linkKey *ecdh.PublicKey) error {
 	return err
 }
 
+// UpdateClientLinkKey replaces the registered link key of the account by
+// newLinkKey, proving the ownership of the registered linkKey to the Provider
+// with the Provider link key.
+func UpdateClientLinkKey(cfg *config.Config, linkKey *ecdh.PrivateKey, newLinkKey, providerLinkKey *ecdh.PublicKey) error {
+	options := cfg.Registration.Options
+	if options == nil {
+		options = &registration.Options{Scheme: "https"}
+	}
+	httpClient := new(http.Client)
+	if options.UseSocks {
+		dialer, err := proxy.SOCKS5(options.SocksNetwork, options.SocksAddress, nil, proxy.Direct)
+		if err != nil {
+			return err
+		}
+		httpClient.Transport = &http.Transport{Dial: dialer.Dial}
+	}
+
+	var sharedSecret [ecdh.GroupElementLength]byte
+	defer utils.ExplicitBzero(sharedSecret[:])
+	linkKey.Exp(&sharedSecret, providerLinkKey)
+	formData := url.Values{
+		mRegistration.VersionField:    {mRegistration.Version},
+		mRegistration.CommandField:    {mRegistration.UpdateLinkCommand},
+		mRegistration.UserField:       {cfg.Account.User},
+		mRegistration.NewLinkKeyField: {newLinkKey.String()},
+		mRegistration.ProofField:      {hex.EncodeToString(mRegistration.LinkUpdateProof(sharedSecret[:], cfg.Account.User, newLinkKey))},
+	}
+	u := &url.URL{
+		Scheme: options.Scheme,
+		Host:   cfg.Registration.Address,
+		Path:   mRegistration.URLBase,
+	}
+	response, err := httpClient.PostForm(u.String(), formData)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("Link key update failure: received status code %d", response.StatusCode)
+	}
+	return nil
+}
+
 type Client struct {
 	cfg        *config.Config
 	logBackend *log.Backend
@@ -135,7 +205,10 @@ type Client struct {
 func (c *Client) Start() error {
 	var err error
 	// Retrieve PKI consensus documents and related info
-	c.linkKey = AutoRegisterRandomClient(c.cfg)
+	c.linkKey, err = LoadOrRegisterClient(c.cfg)
+	if err != nil {
+		return err
+	}
 	c.session, err = c.NewSession(c.linkKey)
 	return err
 }
@@ -0,0 +1,93 @@
+// main.go - Meson JSON-RPC gateway
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+
+	client "github.com/hashcloak/Meson/client"
+	"github.com/hashcloak/Meson/client/config"
+	"github.com/hashcloak/Meson/client/currency"
+	"github.com/hashcloak/Meson/client/gateway"
+)
+
+func main() {
+	var configFile string
+	var service string
+	var ticker string
+	var address string
+	flag.StringVar(&configFile, "c", "client.toml", "configuration file")
+	flag.StringVar(&ticker, "t", "", "chain ticker")
+	flag.StringVar(&service, "s", "", "service name, the chain ticker by default")
+	flag.StringVar(&address, "l", "127.0.0.1:8545", "JSON-RPC listen address")
+	flag.Parse()
+
+	if ticker == "" {
+		fmt.Fprintln(os.Stderr, "must specify chain ticker with -t")
+		os.Exit(1)
+	}
+	if service == "" {
+		service = ticker
+	}
+
+	cfg, err := config.LoadFile(configFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load config file '%v': %v\n", configFile, err)
+		os.Exit(1)
+	}
+	linkKey, err := client.LoadOrRegisterClient(cfg)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to register client: %v\n", err)
+		os.Exit(1)
+	}
+
+	// create a client and connect to the mixnet Provider
+	c, err := client.NewFromConfig(cfg, service)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to create client: %v\n", err)
+		os.Exit(1)
+	}
+	defer c.Shutdown()
+	s, err := c.NewSession(linkKey)
+	if err != nil {
+		c.Shutdown()
+		fmt.Fprintf(os.Stderr, "Failed to create session: %v\n", err)
+		os.Exit(1)
+	}
+
+	log := c.GetLogger("gateway")
+	server := &http.Server{
+		Addr:    address,
+		Handler: gateway.New(currency.WrapSession(s), service, ticker, log),
+	}
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+		<-sigCh
+		_ = server.Close()
+	}()
+
+	log.Noticef("JSON-RPC gateway for %v listening on %v", ticker, address)
+	if err = server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Errorf("Failed to serve: %v", err)
+	}
+}
@@ -23,10 +23,12 @@ import (
 	"io/ioutil"
 	"net/mail"
 	"os"
+	"path/filepath"
 	"strings"
 
 	"github.com/BurntSushi/toml"
 	"github.com/hashcloak/Meson/client/internal/proxy"
+	"github.com/hashcloak/Meson/client/minclient"
 	mpki "github.com/hashcloak/Meson/client/pkiclient"
 	"github.com/katzenpost/core/crypto/eddsa"
 	"github.com/katzenpost/core/log"
@@ -42,6 +44,7 @@ const (
 	defaultPollingInterval             = 10
 	defaultInitialMaxPKIRetrievalDelay = 30
 	defaultSessionDialTimeout          = 30
+	defaultMaxRetransmissions          = 3
 )
 
 var defaultLogging = Logging{
@@ -101,6 +104,33 @@ type Debug struct {
 	// PreferedTransports is a list of the transports will be used to make
 	// outgoing network connections, with the most prefered first.
 	PreferedTransports []cpki.Transport
+
+	// MaxRetransmissions is the maximum number of times a reliable message
+	// is retransmitted before giving up, 0 disables the retransmissions.
+	// By default this is 3.
+	MaxRetransmissions *int
+
+	// EnableProviderFailover enables the failover to another Provider when
+	// connecting to the account Provider fails repeatedly.  The account is
+	// registered with the Provider it fails over to, and the session fails
+	// back to the account Provider after FailbackInterval.
+	EnableProviderFailover bool
+
+	// FailoverProviderKeyPins are the pinned signing keys of the Providers
+	// the session may fail over to, by Provider name.  If the account has
+	// a ProviderKeyPin, the session only fails over to the Providers
+	// pinned here.
+	FailoverProviderKeyPins map[string]*eddsa.PublicKey
+
+	// MaxConnectAttempts is the number of consecutive failed connect
+	// attempts after which the session fails over to another Provider.
+	// By default this is 3.
+	MaxConnectAttempts int
+
+	// FailbackInterval is the time in seconds after a failover at which
+	// the session connects to the account Provider again.  By default this
+	// is 30 minutes.
+	FailbackInterval int
 }
 
 func (d *Debug) fixup() {
@@ -113,6 +143,10 @@ func (d *Debug) fixup() {
 	if d.SessionDialTimeout == 0 {
 		d.SessionDialTimeout = defaultSessionDialTimeout
 	}
+	if d.MaxRetransmissions == nil {
+		maxRetransmissions := defaultMaxRetransmissions
+		d.MaxRetransmissions = &maxRetransmissions
+	}
 }
 
 // Katzenmint is a tendermint client configuration.
@@ -192,6 +226,130 @@ func (p *Panda) validate() error {
 	return nil
 }
 
+// Persistence is the configuration of the on-disk store of the session state,
+// which lets a restarted client resume sending and matching replies.
+type Persistence struct {
+	// File is the path of the store database.
+	File string
+
+	// PassphraseFile is the path of a file holding the passphrase the store
+	// is encrypted with, which keeps it out of the configuration file.
+	PassphraseFile string
+
+	// Passphrase is the passphrase the store is encrypted with, if no
+	// PassphraseFile is configured.
+	Passphrase string
+}
+
+func (p *Persistence) validate() error {
+	if p.File == "" {
+		return errors.New("file is missing")
+	}
+	if !filepath.IsAbs(p.File) {
+		return errors.New("file path must be absolute path")
+	}
+	switch {
+	case p.PassphraseFile != "" && p.Passphrase != "":
+		return errors.New("both a passphrase file and a passphrase are set")
+	case p.PassphraseFile != "":
+		if !filepath.IsAbs(p.PassphraseFile) {
+			return errors.New("passphrase file path must be absolute path")
+		}
+	case p.Passphrase == "":
+		return errors.New("passphrase is missing")
+	}
+	return nil
+}
+
+// GetPassphrase returns the passphrase the store is encrypted with, read
+// from the PassphraseFile if any.
+func (p *Persistence) GetPassphrase() (string, error) {
+	if p.PassphraseFile == "" {
+		return p.Passphrase, nil
+	}
+	raw, err := ioutil.ReadFile(p.PassphraseFile)
+	if err != nil {
+		return "", err
+	}
+	passphrase := strings.TrimRight(string(raw), "\r\n")
+	if passphrase == "" {
+		return "", fmt.Errorf("config: Persistence passphrase file '%v' is empty", p.PassphraseFile)
+	}
+	return passphrase, nil
+}
+
+// State is the client state configuration.
+type State struct {
+	// Directory is the path of the directory holding the link key and the
+	// Provider account of the client.
+	Directory string
+}
+
+func (s *State) validate() error {
+	if s.Directory == "" {
+		return errors.New("directory is missing")
+	}
+	if !filepath.IsAbs(s.Directory) {
+		return errors.New("directory path must be absolute path")
+	}
+	return nil
+}
+
+// Path is the path selection configuration.
+type Path struct {
+	// ExcludeNodes is the list of the names of the mixes never used in
+	// the packet paths.
+	ExcludeNodes []string
+
+	// PinnedNodes is the list of the names of the mixes always used in
+	// their layer, whichever it is.
+	PinnedNodes []string
+
+	// EntryNodes is the list of the names of the mixes always used as the
+	// first mix after a Provider, such as a trusted entry mix, when the
+	// topology assigns them to the first layer.
+	EntryNodes []string
+
+	// Operators maps the names of the mixes and Providers to their
+	// operators.
+	Operators map[string]string
+
+	// DiverseOperators requires the nodes of a path to be run by distinct
+	// operators, as listed in Operators.
+	DiverseOperators bool
+
+	// DiverseNetworks requires the nodes of a path to be reachable in
+	// distinct networks, as derived from their descriptor addresses.
+	DiverseNetworks bool
+}
+
+func (p *Path) validate() error {
+	excluded := make(map[string]bool)
+	for _, name := range p.ExcludeNodes {
+		if name == "" {
+			return errors.New("excluded node name is empty")
+		}
+		excluded[name] = true
+	}
+	for _, name := range p.PinnedNodes {
+		if name == "" {
+			return errors.New("pinned node name is empty")
+		}
+		if excluded[name] {
+			return fmt.Errorf("node '%v' is both pinned and excluded", name)
+		}
+	}
+	for _, name := range p.EntryNodes {
+		if name == "" {
+			return errors.New("entry node name is empty")
+		}
+		if excluded[name] {
+			return fmt.Errorf("node '%v' is both an entry node and excluded", name)
+		}
+	}
+	return nil
+}
+
 // Account is a provider account configuration.
 type Account struct {
 	// User is the account user name.
@@ -294,6 +452,9 @@ type Config struct {
 	Registration  *Registration
 	Panda         *Panda
 	Reunion       *Reunion
+	Persistence   *Persistence
+	State         *State
+	Path          *Path
 	upstreamProxy *proxy.Config
 }
 
@@ -303,6 +464,31 @@ func (c *Config) UpstreamProxyConfig() *proxy.Config {
 	return c.upstreamProxy
 }
 
+// PathSelector returns the path selection policy of the Path configuration.
+func (c *Config) PathSelector() minclient.PathSelector {
+	if c.Path == nil {
+		return minclient.RandomSelector{}
+	}
+	p := &minclient.PolicySelector{
+		Exclude:          make(map[string]bool),
+		Pinned:           make(map[string]bool),
+		Entry:            make(map[string]bool),
+		Operators:        c.Path.Operators,
+		DiverseOperators: c.Path.DiverseOperators,
+		DiverseNetworks:  c.Path.DiverseNetworks,
+	}
+	for _, name := range c.Path.ExcludeNodes {
+		p.Exclude[name] = true
+	}
+	for _, name := range c.Path.PinnedNodes {
+		p.Pinned[name] = true
+	}
+	for _, name := range c.Path.EntryNodes {
+		p.Entry[name] = true
+	}
+	return p
+}
+
 // FixupAndMinimallyValidate applies defaults to config entries and validates the
 // all but the Account and Registration configuration sections.
 func (c *Config) FixupAndMinimallyValidate() error {
@@ -311,9 +497,11 @@ func (c *Config) FixupAndMinimallyValidate() error {
 		c.Logging = &defaultLogging
 	}
 	if c.Debug == nil {
+		maxRetransmissions := defaultMaxRetransmissions
 		c.Debug = &Debug{
 			PollingInterval:             defaultPollingInterval,
 			InitialMaxPKIRetrievalDelay: defaultInitialMaxPKIRetrievalDelay,
+			MaxRetransmissions:          &maxRetransmissions,
 		}
 	} else {
 		c.Debug.fixup()
@@ -348,6 +536,30 @@ func (c *Config) FixupAndMinimallyValidate() error {
 		}
 	}
 
+	// Persistence is optional
+	if c.Persistence != nil {
+		err := c.Persistence.validate()
+		if err != nil {
+			return fmt.Errorf("config: Persistence config is invalid: %v", err)
+		}
+	}
+
+	// State is optional
+	if c.State != nil {
+		err := c.State.validate()
+		if err != nil {
+			return fmt.Errorf("config: State config is invalid: %v", err)
+		}
+	}
+
+	// Path is optional
+	if c.Path != nil {
+		err := c.Path.validate()
+		if err != nil {
+			return fmt.Errorf("config: Path config is invalid: %v", err)
+		}
+	}
+
 	return nil
 }
 
@@ -0,0 +1,224 @@
+// currency.go - currency Kaetzchen client
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package currency provides a typed client of the currency Kaetzchen
+// service, which relays cryptocurrency transactions and queries to the
+// RPC endpoints of the chains.
+package currency
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	client "github.com/hashcloak/Meson/client"
+	"github.com/hashcloak/Meson/plugin/pkg/chain"
+	"github.com/hashcloak/Meson/plugin/pkg/command"
+	"github.com/hashcloak/Meson/plugin/pkg/common"
+	"github.com/katzenpost/client/utils"
+	"github.com/ugorji/go/codec"
+)
+
+// ErrInvalidResponse is the error returned when the reply of the service
+// cannot be decoded.
+var ErrInvalidResponse = errors.New("currency: invalid service response")
+
+// ServiceError is the error returned by the service when it fails to handle
+// a request, such as a transaction rejected by the chain.
+type ServiceError struct {
+	// Message is the error message of the service.
+	Message string
+}
+
+// Error implements the error interface.
+func (e *ServiceError) Error() string {
+	return fmt.Sprintf("currency: service error: %v", e.Message)
+}
+
+// Request is a request sent to the service, awaiting its reply.
+type Request interface {
+	// Done returns a channel closed when the request is completed.
+	Done() <-chan struct{}
+
+	// Reply waits until the request is completed, and returns the reply.
+	Reply() ([]byte, error)
+
+	// Cancel abandons the request, discarding its reply.
+	Cancel()
+}
+
+// Session is the client session the requests are sent with.
+type Session interface {
+	// GetService returns a Provider of the service.
+	GetService(serviceName string) (*utils.ServiceDescriptor, error)
+
+	// SendRequest sends the message to the service, and returns the
+	// Request awaiting the reply.
+	SendRequest(ctx context.Context, recipient, provider string, message []byte) (Request, error)
+}
+
+type clientSession struct {
+	*client.Session
+}
+
+func (s clientSession) SendRequest(ctx context.Context, recipient, provider string, message []byte) (Request, error) {
+	r, err := s.Session.SendRequest(ctx, recipient, provider, message)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// WrapSession returns the Session sending the requests with the client
+// session s.
+func WrapSession(s *client.Session) Session {
+	return clientSession{s}
+}
+
+// Client sends the requests to the currency service.
+type Client struct {
+	session Session
+	service string
+}
+
+// New returns a Client sending the requests to the service.  If service is
+// empty, the requests are sent to the service named after the chain ticker.
+func New(session Session, service string) *Client {
+	return &Client{
+		session: session,
+		service: service,
+	}
+}
+
+// Do sends the command, with its JSON encoded payload, for the chain
+// identified by ticker, and returns the message of the service response.
+func (c *Client) Do(ctx context.Context, ticker string, cmd uint8, payload []byte) ([]byte, error) {
+	service := c.service
+	if service == "" {
+		service = ticker
+	}
+	desc, err := c.session.GetService(service)
+	if err != nil {
+		return nil, err
+	}
+
+	request := common.NewRequest(cmd, ticker, payload).ToJson()
+	r, err := c.session.SendRequest(ctx, desc.Name, desc.Provider, request)
+	if err != nil {
+		return nil, err
+	}
+	select {
+	case <-ctx.Done():
+		// Forget the request, so that its late reply is discarded.
+		r.Cancel()
+		return nil, ctx.Err()
+	case <-r.Done():
+	}
+	reply, err := r.Reply()
+	if err != nil {
+		return nil, err
+	}
+
+	// The reply is padded to the SURB payload length.
+	var resp common.CurrencyResponse
+	dec := codec.NewDecoderBytes(bytes.TrimRight(reply, "\x00"), new(codec.JsonHandle))
+	if err = dec.Decode(&resp); err != nil || resp.Version != common.CurrencyVersion {
+		return nil, ErrInvalidResponse
+	}
+	if resp.Error != "" {
+		return nil, &ServiceError{Message: resp.Error}
+	}
+	return []byte(resp.Message), nil
+}
+
+func (c *Client) query(ctx context.Context, ticker string, cmd uint8, req, resp interface{}) error {
+	payload, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	message, err := c.Do(ctx, ticker, cmd, payload)
+	if err != nil {
+		return err
+	}
+	if err = json.Unmarshal(message, resp); err != nil {
+		return ErrInvalidResponse
+	}
+	return nil
+}
+
+// PostTransaction posts the signed raw transaction txHex to the chain, and
+// returns the transaction hash.
+func (c *Client) PostTransaction(ctx context.Context, ticker, txHex string) (string, error) {
+	var resp command.PostTransactionResponse
+	if err := c.query(ctx, ticker, command.PostTransaction, &command.PostTransactionRequest{TxHex: txHex}, &resp); err != nil {
+		return "", err
+	}
+	return resp.TxHash, nil
+}
+
+// EthQuery queries the nonce of the sender, the gas price, the gas estimate
+// and the call result of the Ethereum call.
+func (c *Client) EthQuery(ctx context.Context, ticker string, req *command.EthQueryRequest) (*command.EthQueryResponse, error) {
+	resp := new(command.EthQueryResponse)
+	if err := c.query(ctx, ticker, command.EthQuery, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// EthQueryTransaction queries the receipt of the Ethereum transaction txHash
+// along with the current block number.
+func (c *Client) EthQueryTransaction(ctx context.Context, ticker, txHash string) (*command.EthQueryTransactionResponse, error) {
+	resp := new(command.EthQueryTransactionResponse)
+	if err := c.query(ctx, ticker, command.EthQueryTransaction, &command.EthQueryTransactionRequest{TxHash: txHash}, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// BtcQuery queries the unspent outputs of the Bitcoin address.
+func (c *Client) BtcQuery(ctx context.Context, ticker string, req *command.BtcQueryRequest) (*command.BtcQueryResponse, error) {
+	resp := new(command.BtcQueryResponse)
+	if err := c.query(ctx, ticker, command.BtcQuery, req, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// BtcQueryTransaction queries the Bitcoin transaction txHash.
+func (c *Client) BtcQueryTransaction(ctx context.Context, ticker, txHash string) (*command.BtcQueryTransactionResponse, error) {
+	resp := new(command.BtcQueryTransactionResponse)
+	if err := c.query(ctx, ticker, command.BtcQueryTransaction, &command.BtcQueryTransactionRequest{TxHash: txHash}, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// DirectPost posts the JSON-RPC request body as is to the RPC endpoint of
+// the chain, and returns the RPC responses.
+func (c *Client) DirectPost(ctx context.Context, ticker string, body []byte) ([]chain.RPCResponse, error) {
+	message, err := c.Do(ctx, ticker, command.DirectPost, body)
+	if err != nil {
+		return nil, err
+	}
+	var resps []chain.RPCResponse
+	if err = json.Unmarshal(message, &resps); err != nil {
+		return nil, ErrInvalidResponse
+	}
+	return resps, nil
+}
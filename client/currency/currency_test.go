@@ -0,0 +1,221 @@
+// currency_test.go - currency Kaetzchen client tests
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package currency
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson/plugin/pkg/chain"
+	"github.com/hashcloak/Meson/plugin/pkg/command"
+	"github.com/hashcloak/Meson/plugin/pkg/config"
+	"github.com/hashcloak/Meson/plugin/pkg/proxy"
+	"github.com/katzenpost/client/utils"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type rpcCall struct {
+	ID     uint            `json:"id"`
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params"`
+}
+
+// chainServer is a chain RPC endpoint answering with the results of the
+// methods.
+func chainServer(assert *assert.Assertions, results map[string]chain.RPCResponse) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(err)
+		var calls []rpcCall
+		if json.Unmarshal(body, &calls) != nil {
+			var call rpcCall
+			assert.NoError(json.Unmarshal(body, &call))
+			calls = append(calls, call)
+		}
+		var resps []chain.RPCResponse
+		for _, call := range calls {
+			resp, ok := results[call.Method]
+			if !ok {
+				resp = chain.RPCResponse{Error: &chain.RPCError{Code: -32601, Message: "method not found"}}
+			}
+			resp.Version = "2.0"
+			resp.ID = call.ID
+			resps = append(resps, resp)
+		}
+		assert.NoError(json.NewEncoder(w).Encode(resps))
+	}))
+}
+
+type mockRequest struct {
+	done     chan struct{}
+	reply    []byte
+	err      error
+	canceled bool
+}
+
+func (r *mockRequest) Done() <-chan struct{} {
+	return r.done
+}
+
+func (r *mockRequest) Reply() ([]byte, error) {
+	<-r.done
+	return r.reply, r.err
+}
+
+func (r *mockRequest) Cancel() {
+	r.canceled = true
+}
+
+// mockSession hands the requests to the currency Kaetzchen, and pads the
+// replies as the Provider does.
+type mockSession struct {
+	currency *proxy.Currency
+	logDir   string
+	services map[string]bool
+	block    bool
+	pending  *mockRequest
+	reply    []byte
+}
+
+func (s *mockSession) GetService(serviceName string) (*utils.ServiceDescriptor, error) {
+	if !s.services[serviceName] {
+		return nil, errors.New("service not found")
+	}
+	return &utils.ServiceDescriptor{Name: serviceName, Provider: "provider"}, nil
+}
+
+func (s *mockSession) SendRequest(ctx context.Context, recipient, provider string, message []byte) (Request, error) {
+	r := &mockRequest{done: make(chan struct{})}
+	if s.block {
+		s.pending = r
+		return r, nil
+	}
+	defer close(r.done)
+	if s.reply != nil {
+		r.reply = s.reply
+		return r, nil
+	}
+	reply, err := s.currency.OnRequest(1, message, true)
+	if err != nil {
+		r.err = err
+		return r, nil
+	}
+	r.reply = append(reply, make([]byte, 64)...)
+	return r, nil
+}
+
+func newMockSession(require *require.Assertions, rpcURL string) *mockSession {
+	logDir, err := ioutil.TempDir("", "currency_test")
+	require.NoError(err)
+	cfg := &config.Config{
+		RPC:      map[string]config.RPCMetadata{"GOR": {Url: rpcURL}},
+		LogDir:   logDir,
+		LogLevel: "DEBUG",
+	}
+	require.NoError(cfg.Validate())
+	currency, err := proxy.New(cfg)
+	require.NoError(err)
+	return &mockSession{
+		currency: currency,
+		logDir:   logDir,
+		services: map[string]bool{"GOR": true, "currency": true},
+	}
+}
+
+func TestClient(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	server := chainServer(assert, map[string]chain.RPCResponse{
+		"eth_sendRawTransaction":    {Result: "0x1234"},
+		"eth_blockNumber":           {Result: "0x10"},
+		"eth_getTransactionReceipt": {Result: `{"status":"0x1"}`},
+		"eth_getTransactionCount":   {Result: "0x2"},
+		"eth_gasPrice":              {Result: "0x3b9aca00"},
+		"eth_estimateGas":           {Result: "0x5208"},
+		"eth_call":                  {Result: "0x"},
+	})
+	defer server.Close()
+	session := newMockSession(require, server.URL)
+	defer os.RemoveAll(session.logDir)
+	ctx := context.Background()
+
+	// the service is named after the ticker by default
+	c := New(session, "")
+	txHash, err := c.PostTransaction(ctx, "GOR", "0xdeadbeef")
+	require.NoError(err)
+	assert.Equal("0x1234", txHash)
+
+	c = New(session, "currency")
+	tx, err := c.EthQueryTransaction(ctx, "GOR", "0x1234")
+	require.NoError(err)
+	assert.Equal("0x10", tx.BlockNumber)
+	assert.Equal(`{"status":"0x1"}`, tx.Tx)
+
+	query, err := c.EthQuery(ctx, "GOR", &command.EthQueryRequest{From: "0x01", To: "0x02"})
+	require.NoError(err)
+	assert.Equal("0x2", query.Nonce)
+	assert.Equal("0x5208", query.GasLimit)
+
+	resps, err := c.DirectPost(ctx, "GOR", []byte(`{"jsonrpc":"2.0","id":5,"method":"eth_blockNumber"}`))
+	require.NoError(err)
+	require.Len(resps, 1)
+	assert.Equal(uint(5), resps[0].ID)
+	assert.Equal("0x10", resps[0].Result)
+
+	_, err = New(session, "unknown").PostTransaction(ctx, "GOR", "0xdeadbeef")
+	assert.Error(err)
+}
+
+func TestClientErrors(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	server := chainServer(assert, map[string]chain.RPCResponse{
+		"eth_sendRawTransaction": {Error: &chain.RPCError{Code: -32000, Message: "nonce too low"}},
+	})
+	defer server.Close()
+	session := newMockSession(require, server.URL)
+	defer os.RemoveAll(session.logDir)
+	c := New(session, "GOR")
+	ctx := context.Background()
+
+	// errors of the chain are mapped to service errors
+	_, err := c.PostTransaction(ctx, "GOR", "0xdeadbeef")
+	var serviceErr *ServiceError
+	require.True(errors.As(err, &serviceErr))
+	assert.Contains(serviceErr.Message, "nonce too low")
+
+	// replies which are not service responses are rejected
+	session.reply = append([]byte("garbage"), make([]byte, 16)...)
+	_, err = c.PostTransaction(ctx, "GOR", "0xdeadbeef")
+	assert.Equal(ErrInvalidResponse, err)
+
+	// the requests are canceled when the context is done
+	session.block = true
+	ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	_, err = c.PostTransaction(ctx, "GOR", "0xdeadbeef")
+	assert.Equal(context.DeadlineExceeded, err)
+	assert.True(session.pending.canceled)
+}
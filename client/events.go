@@ -22,6 +22,7 @@ import (
 	"time"
 
 	cConstants "github.com/katzenpost/client/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/pki"
 )
 
@@ -38,15 +39,20 @@ type ConnectionStatusEvent struct {
 	IsConnected bool
 
 	// Err is the error encountered when connecting or by the connection if any.
+	// It is a *minclient.FailoverError when the account switched Provider,
+	// with minclient.ErrFailback when it switched back to its own Provider.
 	Err error
+
+	// Provider is the Provider the account connects to.
+	Provider string
 }
 
 // String returns a string representation of the ConnectionStatusEvent.
 func (e *ConnectionStatusEvent) String() string {
 	if !e.IsConnected {
-		return fmt.Sprintf("ConnectionStatus: %v (%v)", e.IsConnected, e.Err)
+		return fmt.Sprintf("ConnectionStatus: %v %v (%v)", e.IsConnected, e.Provider, e.Err)
 	}
-	return fmt.Sprintf("ConnectionStatus: %v", e.IsConnected)
+	return fmt.Sprintf("ConnectionStatus: %v %v", e.IsConnected, e.Provider)
 }
 
 // MessageReplyEvent is the event sent when a new message is received.
@@ -70,6 +76,25 @@ func (e *MessageReplyEvent) String() string {
 	return fmt.Sprintf("KaetzchenReply: %v (%v bytes)", hex.EncodeToString(e.MessageID[:]), len(e.Payload))
 }
 
+// MessageReceivedEvent is the event sent when a message delivered to the
+// spool of the account is received.
+type MessageReceivedEvent struct {
+	// Sender is the link key of the sender, authenticated by the end to end
+	// encryption.
+	Sender *ecdh.PublicKey
+
+	// Payload is the decrypted message.
+	Payload []byte
+
+	// ReceivedAt contains the time the message was received.
+	ReceivedAt time.Time
+}
+
+// String returns a string representation of the MessageReceivedEvent.
+func (e *MessageReceivedEvent) String() string {
+	return fmt.Sprintf("MessageReceived: from %v (%v bytes)", e.Sender, len(e.Payload))
+}
+
 // MessageSentEvent is the event sent when a message has been fully transmitted.
 type MessageSentEvent struct {
 	// MessageID is the local unique identifier for the message, generated
@@ -0,0 +1,203 @@
+// gateway.go - JSON-RPC gateway to the currency service
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package gateway provides a local JSON-RPC endpoint which tunnels the
+// wallet RPC calls through the mixnet to the currency service.
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net"
+	"net/http"
+
+	"github.com/hashcloak/Meson/client/currency"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// JSON-RPC error codes.
+const (
+	errCodeParse          = -32700
+	errCodeInvalidRequest = -32600
+	errCodeInvalidParams  = -32602
+	errCodeServer         = -32000
+)
+
+// maxRequestSize is the maximum size of a JSON-RPC request body.
+const maxRequestSize = 1 << 20
+
+// Gateway is the JSON-RPC endpoint, mapping the calls onto the commands of
+// the currency service.
+type Gateway struct {
+	currency *currency.Client
+	ticker   string
+	log      *logging.Logger
+}
+
+// New returns a Gateway sending the requests for the chain identified by
+// ticker to the currency service.
+func New(session currency.Session, service, ticker string, log *logging.Logger) *Gateway {
+	return &Gateway{
+		currency: currency.New(session, service),
+		ticker:   ticker,
+		log:      log,
+	}
+}
+
+type rpcRequest struct {
+	JSONRPC string            `json:"jsonrpc"`
+	ID      json.RawMessage   `json:"id,omitempty"`
+	Method  string            `json:"method"`
+	Params  []json.RawMessage `json:"params,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type rpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+func newRPCError(code int, f string, a ...interface{}) *rpcError {
+	return &rpcError{Code: code, Message: fmt.Sprintf(f, a...)}
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// isLocalHost returns true if the Host header of the request names the
+// loopback interface, so that web pages can not reach the gateway by
+// rebinding their own domain names to it.
+func isLocalHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (g *Gateway) ServeHTTP(response http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		response.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if !isLocalHost(request.Host) {
+		response.WriteHeader(http.StatusForbidden)
+		return
+	}
+	// Browsers can only send cross-origin requests without a preflight
+	// with the form and plain text content types.
+	if mediaType, _, err := mime.ParseMediaType(request.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		response.WriteHeader(http.StatusUnsupportedMediaType)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(response, request.Body, maxRequestSize))
+	if err != nil {
+		response.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	var reply interface{}
+	body = bytes.TrimSpace(body)
+	if len(body) > 0 && body[0] == '[' {
+		var reqs []*rpcRequest
+		if err := json.Unmarshal(body, &reqs); err != nil || len(reqs) == 0 {
+			reply = g.errorResponse(nil, newRPCError(errCodeParse, "parse error"))
+		} else {
+			var replies []*rpcResponse
+			for _, req := range reqs {
+				if resp := g.handle(request.Context(), req); resp != nil {
+					replies = append(replies, resp)
+				}
+			}
+			if len(replies) > 0 {
+				reply = replies
+			}
+		}
+	} else {
+		req := new(rpcRequest)
+		if err := json.Unmarshal(body, req); err != nil {
+			reply = g.errorResponse(nil, newRPCError(errCodeParse, "parse error"))
+		} else if resp := g.handle(request.Context(), req); resp != nil {
+			reply = resp
+		}
+	}
+
+	// Notifications are not replied to.
+	if reply == nil {
+		response.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	response.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(response).Encode(reply); err != nil {
+		g.log.Errorf("Failed to write the response: %v", err)
+	}
+}
+
+func (g *Gateway) errorResponse(id json.RawMessage, err error) *rpcResponse {
+	var rpcErr *rpcError
+	switch e := err.(type) {
+	case *rpcError:
+		rpcErr = e
+	case *currency.ServiceError:
+		rpcErr = newRPCError(errCodeServer, "%v", e.Message)
+	default:
+		rpcErr = newRPCError(errCodeServer, "%v", err)
+	}
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	return &rpcResponse{JSONRPC: "2.0", ID: id, Error: rpcErr}
+}
+
+// handle calls the method of the request, and returns its response, or nil
+// if the request is a notification.
+func (g *Gateway) handle(ctx context.Context, req *rpcRequest) *rpcResponse {
+	if req == nil || req.Method == "" {
+		return g.errorResponse(nil, newRPCError(errCodeInvalidRequest, "invalid request"))
+	}
+	g.log.Debugf("Handling %v", req.Method)
+	result, err := g.call(ctx, req)
+	if err != nil {
+		g.log.Debugf("Failed %v: %v", req.Method, err)
+	}
+	if req.ID == nil {
+		return nil
+	}
+	if err != nil {
+		return g.errorResponse(req.ID, err)
+	}
+	raw, err := json.Marshal(result)
+	if err != nil {
+		return g.errorResponse(req.ID, err)
+	}
+	return &rpcResponse{JSONRPC: "2.0", ID: req.ID, Result: raw}
+}
@@ -0,0 +1,206 @@
+// gateway_test.go - JSON-RPC gateway tests
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/hashcloak/Meson/client/currency"
+	"github.com/hashcloak/Meson/plugin/pkg/chain"
+	"github.com/hashcloak/Meson/plugin/pkg/command"
+	"github.com/hashcloak/Meson/plugin/pkg/common"
+	"github.com/katzenpost/client/utils"
+	"github.com/katzenpost/core/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// mockSession replies to the currency requests as the currency service.
+type mockSession struct {
+	requests []*common.CurrencyRequest
+	onReq    func(req *common.CurrencyRequest) ([]byte, error)
+}
+
+func (s *mockSession) GetService(serviceName string) (*utils.ServiceDescriptor, error) {
+	return &utils.ServiceDescriptor{Name: serviceName, Provider: "provider"}, nil
+}
+
+func (s *mockSession) SendRequest(ctx context.Context, recipient, provider string, message []byte) (currency.Request, error) {
+	req, err := common.RequestFromJson(message)
+	if err != nil {
+		return nil, err
+	}
+	s.requests = append(s.requests, req)
+	var response []byte
+	if result, err := s.onReq(req); err != nil {
+		response = common.RespondFailure(err)
+	} else {
+		response = common.RespondSuccess(string(result))
+	}
+	return &mockRequest{reply: append(response, make([]byte, 16)...)}, nil
+}
+
+// mockRequest is a request already replied to.
+type mockRequest struct {
+	reply []byte
+}
+
+func (r *mockRequest) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+
+func (r *mockRequest) Reply() ([]byte, error) {
+	return r.reply, nil
+}
+
+func (r *mockRequest) Cancel() {}
+
+func post(g *Gateway, host, contentType, body string) *httptest.ResponseRecorder {
+	request := httptest.NewRequest(http.MethodPost, "/", strings.NewReader(body))
+	request.Host = host
+	request.Header.Set("Content-Type", contentType)
+	recorder := httptest.NewRecorder()
+	g.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func rpcCall(require *require.Assertions, g *Gateway, body string) map[string]interface{} {
+	recorder := post(g, "127.0.0.1:8545", "application/json", body)
+	require.Equal(http.StatusOK, recorder.Code)
+	var resp map[string]interface{}
+	require.NoError(json.Unmarshal(recorder.Body.Bytes(), &resp))
+	return resp
+}
+
+func TestGateway(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	session := new(mockSession)
+	g := New(session, "gor", "gor", logBackend.GetLogger("gateway_test"))
+
+	// raw transactions are posted with PostTransaction
+	session.onReq = func(req *common.CurrencyRequest) ([]byte, error) {
+		var postReq command.PostTransactionRequest
+		require.NoError(json.Unmarshal(req.Payload, &postReq))
+		assert.Equal("0xdeadbeef", postReq.TxHex)
+		return json.Marshal(command.PostTransactionResponse{TxHash: "0x1234"})
+	}
+	resp := rpcCall(require, g, `{"jsonrpc":"2.0","id":7,"method":"eth_sendRawTransaction","params":["0xdeadbeef"]}`)
+	assert.Equal(float64(7), resp["id"])
+	assert.Equal("0x1234", resp["result"])
+	require.Len(session.requests, 1)
+	assert.Equal(command.PostTransaction, session.requests[0].Command)
+	assert.Equal("gor", session.requests[0].Ticker)
+
+	// receipts are queried with EthQueryTransaction
+	session.onReq = func(req *common.CurrencyRequest) ([]byte, error) {
+		assert.Equal(command.EthQueryTransaction, req.Command)
+		return json.Marshal(command.EthQueryTransactionResponse{BlockNumber: "0x10", Tx: `{"status":"0x1"}`})
+	}
+	resp = rpcCall(require, g, `{"jsonrpc":"2.0","id":"a","method":"eth_getTransactionReceipt","params":["0x1234"]}`)
+	assert.Equal("a", resp["id"])
+	assert.Equal(map[string]interface{}{"status": "0x1"}, resp["result"])
+
+	// service errors are returned as JSON-RPC errors
+	session.onReq = func(req *common.CurrencyRequest) ([]byte, error) {
+		return nil, errors.New("nonce too low")
+	}
+	resp = rpcCall(require, g, `{"jsonrpc":"2.0","id":1,"method":"sendrawtransaction","params":["00"]}`)
+	assert.Nil(resp["result"])
+	assert.Equal("nonce too low", resp["error"].(map[string]interface{})["message"])
+
+	// other calls are posted as is
+	session.onReq = func(req *common.CurrencyRequest) ([]byte, error) {
+		assert.Equal(command.DirectPost, req.Command)
+		assert.True(bytes.Contains(req.Payload, []byte(`"method":"eth_blockNumber"`)))
+		return json.Marshal([]chain.RPCResponse{{Version: "2.0", ID: 1, Result: "0x10"}})
+	}
+	resp = rpcCall(require, g, `{"jsonrpc":"2.0","id":2,"method":"eth_blockNumber","params":[]}`)
+	assert.Equal(float64(2), resp["id"])
+	assert.Equal("0x10", resp["result"])
+
+	// malformed calls are rejected without reaching the service
+	n := len(session.requests)
+	resp = rpcCall(require, g, `{"jsonrpc":"2.0","id":3,"method":"eth_sendRawTransaction","params":[]}`)
+	assert.Equal(float64(errCodeInvalidParams), resp["error"].(map[string]interface{})["code"])
+	resp = rpcCall(require, g, `{"jsonrpc":`)
+	assert.Equal(float64(errCodeParse), resp["error"].(map[string]interface{})["code"])
+	assert.Len(session.requests, n)
+}
+
+func TestGatewayNotifications(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	session := new(mockSession)
+	session.onReq = func(req *common.CurrencyRequest) ([]byte, error) {
+		return json.Marshal([]chain.RPCResponse{{Version: "2.0", ID: 1, Result: "0x10"}})
+	}
+	g := New(session, "gor", "gor", logBackend.GetLogger("gateway_test"))
+
+	// notifications are sent but not replied to
+	recorder := post(g, "localhost:8545", "application/json", `{"jsonrpc":"2.0","method":"eth_blockNumber"}`)
+	assert.Equal(http.StatusNoContent, recorder.Code)
+	assert.Empty(recorder.Body.Bytes())
+	assert.Len(session.requests, 1)
+
+	// the calls with a null id are replied to
+	resp := rpcCall(require, g, `{"jsonrpc":"2.0","id":null,"method":"eth_blockNumber"}`)
+	assert.Nil(resp["id"])
+	assert.Equal("0x10", resp["result"])
+
+	// only the calls of a batch are replied to
+	recorder = post(g, "[::1]:8545", "application/json; charset=utf-8", `[{"jsonrpc":"2.0","method":"eth_blockNumber"},{"jsonrpc":"2.0","id":4,"method":"eth_blockNumber"}]`)
+	require.Equal(http.StatusOK, recorder.Code)
+	var resps []map[string]interface{}
+	require.NoError(json.Unmarshal(recorder.Body.Bytes(), &resps))
+	require.Len(resps, 1)
+	assert.Equal(float64(4), resps[0]["id"])
+	recorder = post(g, "localhost", "application/json", `[{"jsonrpc":"2.0","method":"eth_blockNumber"}]`)
+	assert.Equal(http.StatusNoContent, recorder.Code)
+}
+
+func TestGatewayRejectsCrossOrigin(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	session := new(mockSession)
+	g := New(session, "gor", "gor", logBackend.GetLogger("gateway_test"))
+	body := `{"jsonrpc":"2.0","id":1,"method":"eth_sendRawTransaction","params":["0xdeadbeef"]}`
+
+	// the requests must be sent to the loopback interface
+	assert.Equal(http.StatusForbidden, post(g, "evil.example:8545", "application/json", body).Code)
+	assert.Equal(http.StatusForbidden, post(g, "10.0.0.1:8545", "application/json", body).Code)
+
+	// the requests must be JSON
+	assert.Equal(http.StatusUnsupportedMediaType, post(g, "localhost:8545", "text/plain", body).Code)
+	assert.Equal(http.StatusUnsupportedMediaType, post(g, "localhost:8545", "", body).Code)
+	assert.Empty(session.requests)
+}
@@ -0,0 +1,166 @@
+// methods.go - JSON-RPC method mapping
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+
+	"github.com/hashcloak/Meson/plugin/pkg/command"
+)
+
+// call maps the JSON-RPC call onto a command of the currency service.  The
+// calls without a dedicated command are posted as is to the RPC endpoint of
+// the service.
+func (g *Gateway) call(ctx context.Context, req *rpcRequest) (interface{}, error) {
+	switch req.Method {
+	case "eth_sendRawTransaction", "sendrawtransaction":
+		txHex, err := stringParam(req, 0)
+		if err != nil {
+			return nil, err
+		}
+		return g.currency.PostTransaction(ctx, g.ticker, txHex)
+
+	case "eth_getTransactionReceipt":
+		txHash, err := stringParam(req, 0)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := g.currency.EthQueryTransaction(ctx, g.ticker, txHash)
+		if err != nil {
+			return nil, err
+		}
+		return rawResult(resp.Tx), nil
+
+	case "eth_call", "eth_estimateGas":
+		var call struct {
+			From  string `json:"from"`
+			To    string `json:"to"`
+			Value string `json:"value"`
+			Data  string `json:"data"`
+			Input string `json:"input"`
+		}
+		if len(req.Params) == 0 || json.Unmarshal(req.Params[0], &call) != nil {
+			return nil, newRPCError(errCodeInvalidParams, "invalid call object")
+		}
+		if call.From == "" {
+			// The service queries the nonce of the sender along.
+			return g.directPost(ctx, req)
+		}
+		value := new(big.Int)
+		if call.Value != "" {
+			if _, ok := value.SetString(strings.TrimPrefix(call.Value, "0x"), 16); !ok {
+				return nil, newRPCError(errCodeInvalidParams, "invalid value: %v", call.Value)
+			}
+		}
+		if call.Data == "" {
+			call.Data = call.Input
+		}
+		resp, err := g.currency.EthQuery(ctx, g.ticker, &command.EthQueryRequest{
+			From:  call.From,
+			To:    call.To,
+			Value: value,
+			Data:  call.Data,
+		})
+		if err != nil {
+			return nil, err
+		}
+		if req.Method == "eth_call" {
+			return resp.CallResult, nil
+		}
+		return resp.GasLimit, nil
+
+	case "getrawtransaction":
+		txHash, err := stringParam(req, 0)
+		if err != nil {
+			return nil, err
+		}
+		resp, err := g.currency.BtcQueryTransaction(ctx, g.ticker, txHash)
+		if err != nil {
+			return nil, err
+		}
+		return rawResult(resp.Tx), nil
+
+	case "listunspent":
+		var minConf, maxConf int64
+		var addresses []string
+		if len(req.Params) < 3 ||
+			json.Unmarshal(req.Params[0], &minConf) != nil ||
+			json.Unmarshal(req.Params[1], &maxConf) != nil ||
+			json.Unmarshal(req.Params[2], &addresses) != nil ||
+			len(addresses) != 1 {
+			// The service queries the outputs of a single address.
+			return g.directPost(ctx, req)
+		}
+		resp, err := g.currency.BtcQuery(ctx, g.ticker, &command.BtcQueryRequest{
+			Min:    big.NewInt(minConf),
+			Max:    big.NewInt(maxConf),
+			Target: addresses[0],
+		})
+		if err != nil {
+			return nil, err
+		}
+		return rawResult(resp.Utxo), nil
+	}
+	return g.directPost(ctx, req)
+}
+
+// directPost posts the JSON-RPC call as is to the RPC endpoint of the
+// currency service.
+func (g *Gateway) directPost(ctx context.Context, req *rpcRequest) (interface{}, error) {
+	payload, err := json.Marshal(&rpcRequest{
+		JSONRPC: "2.0",
+		ID:      json.RawMessage("1"),
+		Method:  req.Method,
+		Params:  req.Params,
+	})
+	if err != nil {
+		return nil, err
+	}
+	resps, err := g.currency.DirectPost(ctx, g.ticker, payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(resps) != 1 {
+		return nil, errors.New("invalid RPC response")
+	}
+	if resps[0].Error != nil {
+		return nil, &rpcError{Code: resps[0].Error.Code, Message: resps[0].Error.Message}
+	}
+	return rawResult(resps[0].Result), nil
+}
+
+func stringParam(req *rpcRequest, i int) (string, error) {
+	var s string
+	if len(req.Params) <= i || json.Unmarshal(req.Params[i], &s) != nil {
+		return "", newRPCError(errCodeInvalidParams, "invalid params")
+	}
+	return s, nil
+}
+
+// rawResult returns the JSON objects and arrays returned as strings by the
+// currency service as is.
+func rawResult(s string) interface{} {
+	trimmed := strings.TrimSpace(s)
+	if (strings.HasPrefix(trimmed, "{") || strings.HasPrefix(trimmed, "[")) && json.Valid([]byte(trimmed)) {
+		return json.RawMessage(trimmed)
+	}
+	return s
+}
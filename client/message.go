@@ -63,6 +63,13 @@ type Message struct {
 	// Specifies if this message is a decoy.
 	IsDecoy bool
 
+	// Reliable indicates whether or not the message is retransmitted until
+	// its SURB reply is received.
+	Reliable bool
+
+	// Retransmissions is the number of times the message was retransmitted.
+	Retransmissions int
+
 	// Priority controls the dwell time in the current AQM.
 	QueuePriority uint64
 }
@@ -90,6 +90,30 @@ type ClientConfig struct {
 	// new directory document is retreived for the current epoch.
 	OnDocumentFn func(*cpki.Document)
 
+	// RegisterFn is the optional callback function that will be called to
+	// register the user with another Provider, before failing over to it.
+	// If left unset, the client will only connect to Provider.
+	RegisterFn func(*cpki.MixDescriptor) error
+
+	// FailoverKeyPins are the optional pinned provider EdDSA signing keys
+	// of the Providers the client may fail over to, by Provider name.  If
+	// ProviderKeyPin is specified, the client will only fail over to the
+	// Providers pinned here.
+	FailoverKeyPins map[string]*eddsa.PublicKey
+
+	// MaxConnectAttempts is the number of consecutive failed connect
+	// attempts after which the client fails over to the next Provider.
+	// If left unset, 3 attempts will be used.
+	MaxConnectAttempts int
+
+	// FailbackInterval is the time after a failover at which the client
+	// connects to Provider again.  If left unset, 30 minutes will be used.
+	FailbackInterval time.Duration
+
+	// PathSelector is the optional policy used to select the mixes of the
+	// packet paths.  If left unset, a random mix of each layer will be used.
+	PathSelector PathSelector
+
 	// DialContextFn is the optional alternative Dialer.DialContext function
 	// to be used when creating outgoing network connections.
 	DialContextFn func(ctx context.Context, network, address string) (net.Conn, error)
@@ -108,6 +132,14 @@ type ClientConfig struct {
 	EnableTimeSync bool
 }
 
+// providerKeyPin returns the pinned signing key of the Provider, if any.
+func (cfg *ClientConfig) providerKeyPin(provider string) *eddsa.PublicKey {
+	if provider == cfg.Provider {
+		return cfg.ProviderKeyPin
+	}
+	return cfg.FailoverKeyPins[provider]
+}
+
 func (cfg *ClientConfig) validate() error {
 	if cfg.User == "" || len(cfg.User) > wire.MaxAdditionalDataLength {
 		return fmt.Errorf("minclient: invalid User: '%v'", cfg.User)
@@ -124,6 +156,12 @@ func (cfg *ClientConfig) validate() error {
 	if cfg.PKIClient == nil {
 		return fmt.Errorf("minclient: no PKIClient provided")
 	}
+	if cfg.MaxConnectAttempts < 0 {
+		return fmt.Errorf("minclient: invalid MaxConnectAttempts: %v", cfg.MaxConnectAttempts)
+	}
+	if cfg.FailbackInterval < 0 {
+		return fmt.Errorf("minclient: invalid FailbackInterval: %v", cfg.FailbackInterval)
+	}
 	return nil
 }
 
@@ -139,6 +177,20 @@ func (c *Client) GetPollInterval() time.Duration {
 	return c.cfg.MessagePollInterval
 }
 
+// Provider returns the identifier of the Provider the client connects to,
+// which differs from the configured Provider after a failover.
+func (c *Client) Provider() string {
+	c.RLock()
+	defer c.RUnlock()
+	return c.provider
+}
+
+func (c *Client) setProvider(provider string) {
+	c.Lock()
+	c.provider = provider
+	c.Unlock()
+}
+
 // Client is a client instance.
 type Client struct {
 	sync.RWMutex
@@ -149,6 +201,8 @@ type Client struct {
 	pki  *pki
 	conn *connection
 
+	provider string
+
 	displayName string
 
 	haltedCh chan interface{}
@@ -193,8 +247,16 @@ func New(cfg *ClientConfig) (*Client, error) {
 		return nil, err
 	}
 
+	if cfg.MaxConnectAttempts == 0 {
+		cfg.MaxConnectAttempts = defaultMaxConnectAttempts
+	}
+	if cfg.FailbackInterval == 0 {
+		cfg.FailbackInterval = defaultFailbackInterval
+	}
+
 	c := new(Client)
 	c.cfg = cfg
+	c.provider = cfg.Provider
 	c.displayName = fmt.Sprintf("%v@%v", c.cfg.User, c.cfg.Provider)
 	c.log = cfg.LogBackend.GetLogger("minclient:" + c.displayName)
 	c.haltedCh = make(chan interface{})
@@ -22,6 +22,7 @@ import (
 	"errors"
 	"fmt"
 	"net"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -44,6 +45,10 @@ var (
 	// a call to Shutdown().
 	ErrShutdown = errors.New("shutdown requested")
 
+	// ErrFailback is the error returned when the connection to the Provider
+	// failed over to is closed, to connect to the configured Provider again.
+	ErrFailback = errors.New("minclient/conn: failing back to the Provider")
+
 	defaultDialer = net.Dialer{
 		KeepAlive: keepAliveInterval,
 		Timeout:   connectTimeout,
@@ -54,6 +59,11 @@ var (
 	pkiFlushInterval  = 3 * time.Minute
 )
 
+const (
+	defaultMaxConnectAttempts = 3
+	defaultFailbackInterval   = 30 * time.Minute
+)
+
 // TODO: replace panic code with other error code or recover pattern?
 // ConnectError is the error used to indicate that a connect attempt has failed.
 type ConnectError struct {
@@ -70,6 +80,24 @@ func newConnectError(f string, a ...interface{}) error {
 	return &ConnectError{Err: fmt.Errorf(f, a...)}
 }
 
+// FailoverError is the error used to indicate that the client failed over to
+// another Provider, after repeatedly failing to connect to the Provider.
+type FailoverError struct {
+	// Provider is the Provider the client failed to connect to.
+	Provider string
+
+	// NextProvider is the Provider the client will connect to.
+	NextProvider string
+
+	// Err is the error that caused the last connect attempt to fail.
+	Err error
+}
+
+// Error implements the error interface.
+func (e *FailoverError) Error() string {
+	return fmt.Sprintf("minclient/conn: failover from %v to %v: %v", e.Provider, e.NextProvider, e.Err)
+}
+
 // PKIError is the error used to indicate PKI related failures.
 type PKIError struct {
 	// Err is the original PKI error.
@@ -118,6 +146,13 @@ type connection struct {
 
 	retryDelay  int64 // used as atomic time.Duration
 	isConnected bool
+
+	// Only accessed by the connect worker, which also runs the connection
+	// from onTCPConn and onWireConn, hence not guarded by the lock.
+	attempts     int
+	failures     map[string]int
+	registered   map[string]bool
+	failedOverAt time.Time
 }
 
 type getConsensusCtx struct {
@@ -156,12 +191,13 @@ func (c *connection) getDescriptor() error {
 		c.log.Debugf("No PKI document for current epoch.")
 		return newPKIError("no PKI document for current epoch")
 	}
-	desc, err := doc.GetProvider(c.c.cfg.Provider)
+	provider := c.c.Provider()
+	desc, err := doc.GetProvider(provider)
 	if err != nil {
 		c.log.Debugf("Failed to find descriptor for Provider: %v", err)
 		return newPKIError("failed to find descriptor for Provider: %v", err)
 	}
-	if c.c.cfg.ProviderKeyPin != nil && !c.c.cfg.ProviderKeyPin.Equal(desc.IdentityKey) {
+	if pin := c.c.cfg.providerKeyPin(provider); pin != nil && !pin.Equal(desc.IdentityKey) {
 		c.log.Errorf("Provider identity key does not match pinned key: %v", desc.IdentityKey)
 		return newPKIError("identity key for Provider does not match pinned key: %v", desc.IdentityKey)
 	}
@@ -200,9 +236,15 @@ func (c *connection) connectWorker() {
 		}
 
 		// Only need to update PKI when seeing a new epoch
+		c.failback()
 		if now, _, _, _ := epochtime.Now(c.c.cfg.PKIClient); now != c.pkiEpoch {
 			// Query the PKI for the current descriptor.
-			if err := c.getDescriptor(); err == nil {
+			err := c.getDescriptor()
+			if err != nil && c.failover(err) {
+				// The Provider is no longer listed, try the next one.
+				err = c.getDescriptor()
+			}
+			if err == nil {
 				// Attempt to connect.
 				c.doConnect(dialCtx)
 			} else if c.c.cfg.OnConnFn != nil {
@@ -237,9 +279,13 @@ func (c *connection) doConnect(dialCtx context.Context) {
 	}()
 
 	for {
+		c.failback()
 		if connErr = c.getDescriptor(); connErr != nil {
-			c.log.Debugf("Aborting connect loop, descriptor no longer present.")
-			return
+			if !c.failover(connErr) {
+				c.log.Debugf("Aborting connect loop, descriptor no longer present.")
+				return
+			}
+			continue
 		}
 
 		// Build the list of candidate addresses, in decreasing order of
@@ -255,12 +301,16 @@ func (c *connection) doConnect(dialCtx context.Context) {
 			}
 		}
 		if len(dstAddrs) == 0 {
+			connErr = newConnectError("no suitable addreses found")
+			if c.failover(connErr) {
+				continue
+			}
 			c.log.Warningf("Aborting connect loop, no suitable addresses found.")
 			c.descriptor = nil // Give up till the next PKI fetch.
-			connErr = newConnectError("no suitable addreses found")
 			return
 		}
 
+	addrLoop:
 		for _, addrPort := range dstAddrs {
 			select {
 			case <-time.After(time.Duration(atomic.LoadInt64(&c.retryDelay))):
@@ -287,15 +337,22 @@ func (c *connection) doConnect(dialCtx context.Context) {
 			default:
 				if err != nil {
 					c.log.Warningf("Failed to connect to %v: %v", addrPort, err)
+					connErr = &ConnectError{Err: err}
 					if c.c.cfg.OnConnFn != nil {
-						c.c.cfg.OnConnFn(&ConnectError{Err: err})
+						c.c.cfg.OnConnFn(connErr)
+					}
+					c.attempts++
+					if c.attempts >= c.c.cfg.MaxConnectAttempts && c.failover(connErr) {
+						break addrLoop
 					}
 					continue
 				}
 			}
 			c.log.Debugf("TCP connection established.")
 
-			// Do something with the connection.
+			// Do something with the connection, the attempt counter is
+			// reset once the connection is established.
+			c.attempts++
 			c.onTCPConn(conn)
 
 			// Re-iterate through the address/ports on a sucessful connect.
@@ -303,11 +360,141 @@ func (c *connection) doConnect(dialCtx context.Context) {
 
 			// Emit a ConnectError when disconnected.
 			c.onConnStatusChange(ErrNotConnected)
+			if c.attempts >= c.c.cfg.MaxConnectAttempts {
+				_ = c.failover(newConnectError("handshake failed"))
+			}
 			break
 		}
 	}
 }
 
+// rankProviders returns the Providers of the PKI document the client can fail
+// over to, ranked by increasing number of failovers from them, the configured
+// Provider first.  Providers which do not accept registrations are skipped,
+// except for the configured Provider.
+func rankProviders(doc *cpki.Document, provider string, failures map[string]int) []*cpki.MixDescriptor {
+	ranked := make([]*cpki.MixDescriptor, 0, len(doc.Providers))
+	for _, desc := range doc.Providers {
+		if desc.Name == provider || len(desc.RegistrationHTTPAddresses) > 0 {
+			ranked = append(ranked, desc)
+		}
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		if failures[ranked[i].Name] != failures[ranked[j].Name] {
+			return failures[ranked[i].Name] < failures[ranked[j].Name]
+		}
+		if ranked[i].Name == provider || ranked[j].Name == provider {
+			return ranked[i].Name == provider
+		}
+		return ranked[i].Name < ranked[j].Name
+	})
+	return ranked
+}
+
+// failover switches to the best ranked pinned Provider other than the
+// current one the user is registered with, registering the user with it first
+// if needed, and returns true iff it switched.
+func (c *connection) failover(connErr error) bool {
+	if c.c.cfg.RegisterFn == nil {
+		return false
+	}
+	doc := c.c.CurrentDocument()
+	if doc == nil {
+		return false
+	}
+	provider := c.c.Provider()
+	c.failures[provider]++
+	var next *cpki.MixDescriptor
+	for _, desc := range rankProviders(doc, c.c.cfg.Provider, c.failures) {
+		if desc.Name == provider || !c.isPinned(desc) {
+			continue
+		}
+		if desc.Name == c.c.cfg.Provider || c.registered[desc.Name] {
+			next = desc
+			break
+		}
+		if err := c.c.cfg.RegisterFn(desc); err != nil {
+			c.log.Warningf("Failed to register with Provider %v: %v", desc.Name, err)
+			continue
+		}
+		c.registered[desc.Name] = true
+		next = desc
+		break
+	}
+	if next == nil {
+		c.log.Warningf("No Provider to fail over to from %v.", provider)
+		return false
+	}
+
+	c.log.Warningf("Failing over from Provider %v to %v: %v", provider, next.Name, connErr)
+	c.switchProvider(next.Name)
+	if next.Name == c.c.cfg.Provider {
+		c.failedOverAt = time.Time{}
+	} else {
+		c.failedOverAt = time.Now()
+	}
+
+	if c.c.cfg.OnConnFn != nil {
+		c.c.cfg.OnConnFn(&FailoverError{
+			Provider:     provider,
+			NextProvider: next.Name,
+			Err:          connErr,
+		})
+	}
+	return true
+}
+
+// isPinned returns whether the Provider descriptor matches its pinned key.
+// Once the configured Provider is pinned, the Providers without a pinned key
+// are not trusted either.
+func (c *connection) isPinned(desc *cpki.MixDescriptor) bool {
+	pin := c.c.cfg.providerKeyPin(desc.Name)
+	if pin == nil {
+		return c.c.cfg.ProviderKeyPin == nil
+	}
+	return pin.Equal(desc.IdentityKey)
+}
+
+// failback switches back to the configured Provider once the failover is
+// FailbackInterval old, and returns true iff it switched.
+func (c *connection) failback() bool {
+	if c.failbackDelay() != 0 {
+		return false
+	}
+	provider := c.c.Provider()
+	c.log.Noticef("Failing back from Provider %v to %v.", provider, c.c.cfg.Provider)
+	c.switchProvider(c.c.cfg.Provider)
+	c.failedOverAt = time.Time{}
+
+	if c.c.cfg.OnConnFn != nil {
+		c.c.cfg.OnConnFn(&FailoverError{
+			Provider:     provider,
+			NextProvider: c.c.cfg.Provider,
+			Err:          ErrFailback,
+		})
+	}
+	return true
+}
+
+// failbackDelay returns the time until the client fails back to the
+// configured Provider, or a negative duration if it did not fail over.
+func (c *connection) failbackDelay() time.Duration {
+	if c.failedOverAt.IsZero() {
+		return -1
+	}
+	if d := time.Until(c.failedOverAt.Add(c.c.cfg.FailbackInterval)); d > 0 {
+		return d
+	}
+	return 0
+}
+
+func (c *connection) switchProvider(provider string) {
+	c.c.setProvider(provider)
+	c.attempts = 0
+	c.pkiEpoch = 0
+	c.descriptor = nil
+}
+
 func (c *connection) onTCPConn(conn net.Conn) {
 	const handshakeTimeout = 10 * time.Second
 	var err error
@@ -351,6 +538,9 @@ func (c *connection) onTCPConn(conn net.Conn) {
 }
 
 func (c *connection) onWireConn(w *wire.Session) {
+	// The Provider is reachable, reset the failover state.
+	c.attempts = 0
+	delete(c.failures, c.c.Provider())
 	c.onConnStatusChange(nil)
 
 	var wireErr error
@@ -433,6 +623,12 @@ func (c *connection) onWireConn(w *wire.Session) {
 		}
 		return nil
 	}
+	var failbackCh <-chan time.Time
+	if d := c.failbackDelay(); d >= 0 {
+		failbackTimer := time.NewTimer(d)
+		defer failbackTimer.Stop()
+		failbackCh = failbackTimer.C
+	}
 	nrReqs, nrResps := 0, 0
 	for {
 		var rawCmd commands.Command
@@ -494,6 +690,9 @@ func (c *connection) onWireConn(w *wire.Session) {
 		case <-c.HaltCh():
 			wireErr = ErrShutdown
 			return
+		case <-failbackCh:
+			wireErr = ErrFailback
+			return
 		case wireErr = <-closeConnCh:
 			c.log.Debugf("Closing connection due to callback error: %v", wireErr)
 			return
@@ -686,6 +885,8 @@ func newConnection(c *Client) *connection {
 	k.fetchCh = make(chan interface{}, 1)
 	k.sendCh = make(chan *connSendCtx)
 	k.getConsensusCh = make(chan *getConsensusCtx)
+	k.failures = make(map[string]int)
+	k.registered = make(map[string]bool)
 	return k
 }
 
@@ -0,0 +1,170 @@
+// connection_test.go - Client to provider connection tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minclient
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson/client/pkiclient"
+	"github.com/hashcloak/Meson/katzenmint"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRankProviders(t *testing.T) {
+	assert := assert.New(t)
+
+	registration := []string{"http://127.0.0.1:36968"}
+	doc := &cpki.Document{
+		Providers: []*cpki.MixDescriptor{
+			{Name: "provider3", RegistrationHTTPAddresses: registration},
+			{Name: "provider2", RegistrationHTTPAddresses: registration},
+			{Name: "provider1"},
+			{Name: "closed"},
+		},
+	}
+	names := func(ranked []*cpki.MixDescriptor) []string {
+		s := make([]string, 0, len(ranked))
+		for _, desc := range ranked {
+			s = append(s, desc.Name)
+		}
+		return s
+	}
+
+	// the configured Provider comes first, Providers without registration
+	// are skipped
+	failures := make(map[string]int)
+	assert.Equal([]string{"provider1", "provider2", "provider3"}, names(rankProviders(doc, "provider1", failures)))
+
+	// Providers which failed are ranked last
+	failures["provider1"] = 1
+	assert.Equal([]string{"provider2", "provider3", "provider1"}, names(rankProviders(doc, "provider1", failures)))
+	failures["provider2"] = 2
+	assert.Equal([]string{"provider3", "provider1", "provider2"}, names(rankProviders(doc, "provider1", failures)))
+}
+
+type mockPKIClient struct {
+	pkiclient.Client
+}
+
+func (m *mockPKIClient) GetEpoch(ctx context.Context) (*katzenmint.EpochInfo, error) {
+	return &katzenmint.EpochInfo{Epoch: 2, StartTime: time.Now(), Duration: time.Hour}, nil
+}
+
+func TestFailover(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	registration := []string{"http://127.0.0.1:36968"}
+	doc := &cpki.Document{
+		Epoch: 1,
+		Providers: []*cpki.MixDescriptor{
+			{Name: "provider1"},
+			{Name: "provider2", RegistrationHTTPAddresses: registration},
+			{Name: "provider3", RegistrationHTTPAddresses: registration},
+		},
+	}
+	registered := make(map[string]int)
+	var events []*FailoverError
+	c := &Client{
+		cfg: &ClientConfig{
+			Provider:   "provider1",
+			LogBackend: logBackend,
+			PKIClient:  &mockPKIClient{},
+			RegisterFn: func(desc *cpki.MixDescriptor) error {
+				if desc.Name == "provider2" {
+					return errors.New("registration closed")
+				}
+				registered[desc.Name]++
+				return nil
+			},
+			OnConnFn: func(err error) {
+				if e, ok := err.(*FailoverError); ok {
+					events = append(events, e)
+				}
+			},
+			FailbackInterval: time.Hour,
+		},
+		provider: "provider1",
+	}
+	c.pki = &pki{c: c, log: logBackend.GetLogger("pki")}
+	c.pki.docs.Store(doc.Epoch, doc)
+	conn := newConnection(c)
+
+	// the Providers the user fails to register with are skipped
+	require.True(conn.failover(ErrNotConnected))
+	assert.Equal("provider3", c.Provider())
+	assert.Equal(1, registered["provider3"])
+	require.Len(events, 1)
+	assert.Equal("provider1", events[0].Provider)
+	assert.Equal("provider3", events[0].NextProvider)
+
+	// the client fails back to the configured Provider after the interval
+	assert.False(conn.failback())
+	assert.True(conn.failbackDelay() > 0)
+	conn.failedOverAt = time.Now().Add(-time.Hour)
+	assert.Equal(time.Duration(0), conn.failbackDelay())
+	require.True(conn.failback())
+	assert.Equal("provider1", c.Provider())
+	require.Len(events, 2)
+	assert.Equal(ErrFailback, events[1].Err)
+	assert.True(conn.failbackDelay() < 0)
+
+	// the user is only registered once with each Provider
+	require.True(conn.failover(ErrNotConnected))
+	assert.Equal("provider3", c.Provider())
+	assert.Equal(1, registered["provider3"])
+
+	// the configured Provider needs no registration
+	require.True(conn.failover(ErrNotConnected))
+	assert.Equal("provider1", c.Provider())
+	assert.True(conn.failbackDelay() < 0)
+
+	// the switch is aborted if the user can not register with any Provider
+	c.cfg.RegisterFn = func(*cpki.MixDescriptor) error { return errors.New("registration closed") }
+	delete(conn.registered, "provider3")
+	assert.False(conn.failover(ErrNotConnected))
+	assert.Equal("provider1", c.Provider())
+
+	// a pinned client only fails over to the pinned Providers
+	c.cfg.RegisterFn = func(*cpki.MixDescriptor) error { return nil }
+	keys := make([]*eddsa.PublicKey, len(doc.Providers))
+	for i, desc := range doc.Providers {
+		key, err := eddsa.NewKeypair(rand.Reader)
+		require.NoError(err)
+		keys[i] = key.PublicKey()
+		desc.IdentityKey = keys[i]
+	}
+	c.cfg.ProviderKeyPin = keys[0]
+	assert.False(conn.failover(ErrNotConnected))
+	c.cfg.FailoverKeyPins = map[string]*eddsa.PublicKey{"provider2": keys[1], "provider3": keys[0]}
+	require.True(conn.failover(ErrNotConnected))
+	assert.Equal("provider2", c.Provider())
+	require.NoError(conn.getDescriptor())
+
+	// and checks their key once it failed over
+	c.cfg.FailoverKeyPins["provider2"] = keys[2]
+	assert.Error(conn.getDescriptor())
+}
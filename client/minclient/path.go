@@ -37,16 +37,22 @@ var errMaxAttempts = errors.New("path: max path selection attempts exceeded")
 // NewPath creates a new path suitable for use in creating a Sphinx packet with the
 // specified parameters.
 //
+// The mixes are selected by selector, or at random if selector is nil.
+//
 // Note: Forward packets originating from a client have slightly different
 // path requirements than internally sourced packets or response packets as it
 // includes the 0th hop.
-func NewPath(rng *mRand.Rand, doc *kpki.Document, recipient []byte, src, dst *kpki.MixDescriptor, surbID *[constants.SURBIDLength]byte, baseTime time.Time, isFromClient, isForward bool, epoch uint64) ([]*sphinx.PathHop, time.Time, error) {
+func NewPath(rng *mRand.Rand, selector PathSelector, doc *kpki.Document, recipient []byte, src, dst *kpki.MixDescriptor, surbID *[constants.SURBIDLength]byte, baseTime time.Time, isFromClient, isForward bool, epoch uint64) ([]*sphinx.PathHop, time.Time, error) {
+
+	if selector == nil {
+		selector = RandomSelector{}
+	}
 
 	var then time.Time
 	var path []*sphinx.PathHop
 selectLoop:
 	for attempts := 0; attempts < maxAttempts; attempts++ {
-		descs, err := selectHops(rng, doc, src, dst, isFromClient, isForward)
+		descs, err := selectHops(rng, selector, doc, src, dst, isFromClient, isForward)
 		if err != nil {
 			return nil, time.Time{}, err
 		}
@@ -101,7 +107,7 @@ selectLoop:
 	return nil, time.Time{}, errMaxAttempts
 }
 
-func selectHops(rng *mRand.Rand, doc *kpki.Document, src, dst *kpki.MixDescriptor, isFromClient, isForward bool) ([]*kpki.MixDescriptor, error) {
+func selectHops(rng *mRand.Rand, selector PathSelector, doc *kpki.Document, src, dst *kpki.MixDescriptor, isFromClient, isForward bool) ([]*kpki.MixDescriptor, error) {
 	var hops []*kpki.MixDescriptor
 
 	var startLayer, nHops int
@@ -153,7 +159,11 @@ func selectHops(rng *mRand.Rand, doc *kpki.Document, src, dst *kpki.MixDescripto
 		if len(nodes) == 0 {
 			return nil, fmt.Errorf("path: layer %v has no nodes", i)
 		}
-		hops = append(hops, nodes[rng.Intn(len(nodes))])
+		hop, err := selector.SelectHop(rng, startLayer+i, nodes, hops[len(hops)-i:], src, dst)
+		if err != nil {
+			return nil, err
+		}
+		hops = append(hops, hop)
 	}
 	hops = append(hops, dst)
 
@@ -174,10 +174,10 @@ func (p *pki) worker() {
 			d, err := p.getDocumentDirect(pkiCtx, epoch)
 			if err != nil {
 				p.log.Warningf("Failed to fetch PKI for epoch %v: %v", epoch, err)
-				switch err {
-				case cpki.ErrNoDocument:
+				switch {
+				case errors.Is(err, cpki.ErrNoDocument):
 					p.failedFetches[epoch] = err
-				case errGetConsensusCanceled:
+				case err == errGetConsensusCanceled:
 					return
 				default:
 				}
@@ -0,0 +1,180 @@
+// selector.go - Path selection policies.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minclient
+
+import (
+	"fmt"
+	mRand "math/rand"
+	"net"
+	"sort"
+	"strings"
+
+	kpki "github.com/katzenpost/core/pki"
+)
+
+// PathSelector selects the mix of each layer of a path.
+type PathSelector interface {
+	// SelectHop returns the node of the layer among nodes, given the mixes
+	// of the path selected so far, and the source and destination of the
+	// path.
+	SelectHop(rng *mRand.Rand, layer int, nodes, path []*kpki.MixDescriptor, src, dst *kpki.MixDescriptor) (*kpki.MixDescriptor, error)
+}
+
+// RandomSelector is the PathSelector selecting a uniformly random node of
+// each layer.
+type RandomSelector struct{}
+
+// SelectHop implements the PathSelector interface.
+func (RandomSelector) SelectHop(rng *mRand.Rand, layer int, nodes, path []*kpki.MixDescriptor, src, dst *kpki.MixDescriptor) (*kpki.MixDescriptor, error) {
+	return nodes[rng.Intn(len(nodes))], nil
+}
+
+// PolicySelector is the PathSelector selecting a random node of each layer
+// among the nodes allowed by its policies.
+type PolicySelector struct {
+	// Exclude is the set of the names of the nodes never selected.
+	Exclude map[string]bool
+
+	// Pinned is the set of the names of the nodes always selected in their
+	// layer, whichever it is.
+	Pinned map[string]bool
+
+	// Entry is the set of the names of the nodes always selected as the
+	// first mix of the paths leaving a Provider, such as a trusted entry
+	// mix.  Unlike the Pinned nodes, they are selected as any other node
+	// when the topology assigns them to another layer.
+	Entry map[string]bool
+
+	// Operators maps the names of the nodes to their operators.  The nodes
+	// without an operator are assumed to be run by operators of their own.
+	Operators map[string]string
+
+	// DiverseOperators requires the nodes of a path to be run by distinct
+	// operators.
+	DiverseOperators bool
+
+	// DiverseNetworks requires the nodes of a path to be reachable in
+	// distinct networks, that is the /16 IPv4 and /32 IPv6 prefixes, or the
+	// host names, of their addresses.
+	DiverseNetworks bool
+
+	// Deterministic selects the first allowed node by name instead of a
+	// random one, which is only useful for testing.
+	Deterministic bool
+}
+
+// SelectHop implements the PathSelector interface.
+func (p *PolicySelector) SelectHop(rng *mRand.Rand, layer int, nodes, path []*kpki.MixDescriptor, src, dst *kpki.MixDescriptor) (*kpki.MixDescriptor, error) {
+	// The entry nodes, or else the pinned nodes, of the layer are the only
+	// candidates.
+	isEntry := len(path) == 0 && src.Layer == kpki.LayerProvider
+	candidates := make([]*kpki.MixDescriptor, 0, len(nodes))
+	if isEntry {
+		for _, node := range nodes {
+			if p.Entry[node.Name] {
+				candidates = append(candidates, node)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		for _, node := range nodes {
+			if p.Pinned[node.Name] {
+				candidates = append(candidates, node)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = append(candidates, nodes...)
+	}
+
+	// The source is checked as well, as it is not one of the hops of the
+	// reply paths.
+	others := append(path[:len(path):len(path)], src, dst)
+	allowed := make([]*kpki.MixDescriptor, 0, len(candidates))
+	for _, node := range candidates {
+		if p.allows(node, others) {
+			allowed = append(allowed, node)
+		}
+	}
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("path: no node of layer %v allowed by the path selection policies", layer)
+	}
+	if p.Deterministic {
+		sort.Slice(allowed, func(i, j int) bool {
+			return allowed[i].Name < allowed[j].Name
+		})
+		return allowed[0], nil
+	}
+	return allowed[rng.Intn(len(allowed))], nil
+}
+
+func (p *PolicySelector) allows(node *kpki.MixDescriptor, others []*kpki.MixDescriptor) bool {
+	if p.Exclude[node.Name] {
+		return false
+	}
+	for _, other := range others {
+		if p.DiverseOperators && p.sameOperator(node, other) {
+			return false
+		}
+		if p.DiverseNetworks && sameNetwork(node, other) {
+			return false
+		}
+	}
+	return true
+}
+
+func (p *PolicySelector) sameOperator(a, b *kpki.MixDescriptor) bool {
+	opA, okA := p.Operators[a.Name]
+	opB, okB := p.Operators[b.Name]
+	if okA && okB {
+		return opA == opB
+	}
+	return a.Name == b.Name
+}
+
+func sameNetwork(a, b *kpki.MixDescriptor) bool {
+	networksB := networks(b)
+	for network := range networks(a) {
+		if networksB[network] {
+			return true
+		}
+	}
+	return false
+}
+
+// networks returns the networks the addresses of the node belong to.
+func networks(desc *kpki.MixDescriptor) map[string]bool {
+	m := make(map[string]bool)
+	for _, addrs := range desc.Addresses {
+		for _, addr := range addrs {
+			host, _, err := net.SplitHostPort(addr)
+			if err != nil {
+				host = addr
+			}
+			ip := net.ParseIP(host)
+			switch {
+			case ip == nil:
+				m[strings.ToLower(host)] = true
+			case ip.To4() != nil:
+				m[ip.Mask(net.CIDRMask(16, 32)).String()+"/16"] = true
+			default:
+				m[ip.Mask(net.CIDRMask(32, 128)).String()+"/32"] = true
+			}
+		}
+	}
+	return m
+}
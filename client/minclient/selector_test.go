@@ -0,0 +1,109 @@
+// selector_test.go - Path selection policy tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package minclient
+
+import (
+	mRand "math/rand"
+	"testing"
+
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPolicySelector(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	node := func(name, addr string, layer uint8) *cpki.MixDescriptor {
+		return &cpki.MixDescriptor{
+			Name:      name,
+			Layer:     layer,
+			Addresses: map[cpki.Transport][]string{cpki.TransportTCPv4: {addr}},
+		}
+	}
+	provider := node("provider", "10.0.0.1:29483", cpki.LayerProvider)
+	doc := &cpki.Document{
+		Topology: [][]*cpki.MixDescriptor{
+			{node("a1", "10.0.0.2:29483", 0), node("a2", "10.1.0.1:29483", 0), node("a3", "10.2.0.1:29483", 0)},
+			{node("b1", "10.1.0.2:29483", 1), node("b2", "10.3.0.1:29483", 1)},
+		},
+		Providers: []*cpki.MixDescriptor{provider},
+	}
+	rng := mRand.New(mRand.NewSource(1))
+	names := func(selector PathSelector) []string {
+		hops, err := selectHops(rng, selector, doc, provider, provider, true, true)
+		require.NoError(err)
+		s := make([]string, 0, len(hops))
+		for _, hop := range hops {
+			s = append(s, hop.Name)
+		}
+		return s
+	}
+
+	// the first allowed node by name is selected deterministically
+	p := &PolicySelector{Deterministic: true}
+	assert.Equal([]string{"provider", "a1", "b1", "provider"}, names(p))
+
+	// excluded nodes are never selected, pinned nodes always are
+	p.Exclude = map[string]bool{"a1": true}
+	p.Pinned = map[string]bool{"b2": true}
+	assert.Equal([]string{"provider", "a2", "b2", "provider"}, names(p))
+
+	// entry nodes are only favoured as the first mix
+	p = &PolicySelector{Deterministic: true, Entry: map[string]bool{"a3": true, "b2": true}}
+	assert.Equal([]string{"provider", "a3", "b1", "provider"}, names(p))
+	p.Pinned = map[string]bool{"a2": true}
+	assert.Equal([]string{"provider", "a3", "b1", "provider"}, names(p))
+
+	// nodes sharing a network or an operator with another hop are skipped
+	p = &PolicySelector{Deterministic: true, DiverseNetworks: true}
+	assert.Equal([]string{"provider", "a2", "b2", "provider"}, names(p))
+	p = &PolicySelector{
+		Deterministic:    true,
+		DiverseOperators: true,
+		Operators:        map[string]string{"provider": "op1", "a1": "op1", "a2": "op2", "b1": "op2"},
+	}
+	assert.Equal([]string{"provider", "a2", "b2", "provider"}, names(p))
+
+	// the source of the reply paths is checked as well
+	replySrc := node("provider2", "10.0.1.1:29483", cpki.LayerProvider)
+	p = &PolicySelector{Deterministic: true, DiverseNetworks: true}
+	hops, err := selectHops(rng, p, doc, replySrc, node("provider3", "10.4.0.1:29483", cpki.LayerProvider), true, false)
+	require.NoError(err)
+	require.Len(hops, 3)
+	assert.Equal("a2", hops[0].Name)
+	assert.Equal("b2", hops[1].Name)
+
+	// random selection only picks allowed nodes
+	p = &PolicySelector{Exclude: map[string]bool{"a1": true, "a2": true}}
+	for i := 0; i < 10; i++ {
+		assert.Equal("a3", names(p)[1])
+	}
+
+	// paths fail when a layer has no allowed node
+	p.Exclude["a3"] = true
+	_, err = selectHops(rng, p, doc, provider, provider, true, true)
+	assert.Error(err)
+	p = &PolicySelector{Pinned: map[string]bool{"a1": true}, DiverseNetworks: true}
+	_, err = selectHops(rng, p, doc, provider, provider, true, true)
+	assert.Error(err)
+
+	// the default selector picks any node
+	hops, err = selectHops(rng, RandomSelector{}, doc, provider, provider, true, true)
+	require.NoError(err)
+	assert.Len(hops, 4)
+}
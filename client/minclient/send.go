@@ -83,7 +83,7 @@ func (c *Client) ComposeSphinxPacket(recipient, provider string, surbID *[sConst
 		// It is possible, but unlikely that a series of delays exceeding
 		// the PKI publication imposted limitations will be selected.  When
 		// that happens, the path selection must be redone.
-		if then.Sub(now) < epochtime.TestPeriod*2 {
+		if then.Sub(now) < epochtime.Period(c.cfg.PKIClient)*2 {
 			if surbID != nil {
 				payload := make([]byte, 2, 2+sphinx.SURBLength+len(b))
 				payload[0] = 1 // Packet has a SURB.
@@ -134,7 +134,7 @@ func (c *Client) SendCiphertext(recipient, provider string, surbID *[sConstants.
 }
 
 func (c *Client) makePath(recipient, provider string, surbID *[sConstants.SURBIDLength]byte, baseTime time.Time, isForward bool, epoch uint64) ([]*sphinx.PathHop, time.Time, error) {
-	srcProvider, dstProvider := c.cfg.Provider, provider
+	srcProvider, dstProvider := c.Provider(), provider
 	if !isForward {
 		srcProvider, dstProvider = dstProvider, srcProvider
 	}
@@ -155,7 +155,7 @@ func (c *Client) makePath(recipient, provider string, surbID *[sConstants.SURBID
 		return nil, time.Time{}, fmt.Errorf("minclient: failed to find destination Provider: %v", err)
 	}
 
-	p, t, err := NewPath(c.rng, doc, []byte(recipient), src, dst, surbID, baseTime, true, isForward, epoch)
+	p, t, err := NewPath(c.rng, c.cfg.PathSelector, doc, []byte(recipient), src, dst, surbID, baseTime, true, isForward, epoch)
 	if err == nil {
 		_ = c.logPath(doc, p)
 	}
@@ -25,7 +25,7 @@ import (
 	"sync"
 	"time"
 
-	"github.com/hashcloak/Meson/katzenmint"
+	kpki "github.com/hashcloak/Meson/katzenmint"
 	"github.com/katzenpost/core/crypto/eddsa"
 	"github.com/katzenpost/core/pki"
 	"github.com/katzenpost/core/worker"
@@ -51,9 +51,8 @@ type Cache struct {
 	docs map[uint64]*list.Element
 	lru  list.List
 
-	timer     *time.Timer
-	memEpoch  uint64
-	memHeight uint64
+	timer   *time.Timer
+	memInfo kpki.EpochInfo
 
 	fetchQueue chan *fetchOp
 }
@@ -81,10 +80,11 @@ func (c *Cache) Halt() {
 }
 
 // GetEpoch returns the epoch information of PKI.
-func (c *Cache) GetEpoch(ctx context.Context) (epoch uint64, ellapsedHeight uint64, err error) {
+func (c *Cache) GetEpoch(ctx context.Context) (*kpki.EpochInfo, error) {
 	c.Lock()
 	defer c.Unlock()
-	return c.memEpoch, c.memHeight, nil
+	info := c.memInfo
+	return &info, nil
 }
 
 // GetDoc returns the PKI document for the provided epoch.
@@ -124,6 +124,12 @@ func (c *Cache) Post(ctx context.Context, epoch uint64, signingKey *eddsa.Privat
 	return c.impl.Post(ctx, epoch, signingKey, d)
 }
 
+// PostReliabilityReport posts the loop results measured by the node during the
+// epoch of the report.
+func (c *Cache) PostReliabilityReport(ctx context.Context, signingKey *eddsa.PrivateKey, report *kpki.ReliabilityReport) error {
+	return c.impl.PostReliabilityReport(ctx, signingKey, report)
+}
+
 // Deserialize returns PKI document given the raw bytes.
 func (c *Cache) Deserialize(raw []byte) (*pki.Document, error) {
 	return c.impl.Deserialize(raw) // I hope impl.Deserialize is re-entrant.
@@ -157,37 +163,49 @@ func (c *Cache) insertLRU(newEntry *cacheEntry) {
 	}
 }
 
+// verifyTopology checks the layer assignment of the document against the
+// cached documents of the adjacent epochs, as the assignment of an epoch is
+// derived from the document of the previous one.
+func (c *Cache) verifyTopology(d *pki.Document) error {
+	if prev := c.cacheGet(d.Epoch - 1); prev != nil {
+		if err := kpki.VerifyTopology(d, prev.doc); err != nil {
+			return fmt.Errorf("pkiclient: invalid topology for epoch %d: %v", d.Epoch, err)
+		}
+	}
+	if next := c.cacheGet(d.Epoch + 1); next != nil {
+		if err := kpki.VerifyTopology(next.doc, d); err != nil {
+			return fmt.Errorf("pkiclient: invalid topology for epoch %d: %v", next.doc.Epoch, err)
+		}
+	}
+	return nil
+}
+
 func (c *Cache) worker() {
 	// TODO: maybe implement backoff delay?
 	const retryTime = time.Second / 2
 
-	var epoch, height uint64
+	var epoch uint64
 	var ctx context.Context
-	var err error
 	for {
 		var op *fetchOp
 		select {
 		case <-c.HaltCh():
 			return
 		case <-c.timer.C:
+			// The epoch ends with the first block past its end, poll until
+			// the next epoch is started.
 			c.Lock()
-			if c.memHeight < uint64(katzenmint.EpochInterval) {
-				c.memHeight++
-				c.Unlock()
-				c.timer.Reset(katzenmint.HeightPeriod)
-				continue
-			}
 			ctx = context.Background()
-			epoch, height, err = c.impl.GetEpoch(context.Background())
-			if err != nil || epoch == c.memEpoch {
+			info, err := c.impl.GetEpoch(ctx)
+			if err != nil || info.Epoch == c.memInfo.Epoch {
 				c.timer.Reset(retryTime)
 				c.Unlock()
 				continue
 			}
-			c.memEpoch = epoch
-			c.memHeight = height
+			c.memInfo = *info
+			epoch = info.Epoch
 			c.Unlock()
-			c.timer.Reset(katzenmint.HeightPeriod)
+			c.timer.Reset(info.Till(time.Now()))
 		case op = <-c.fetchQueue:
 			ctx = op.ctx
 			epoch = op.epoch
@@ -207,6 +225,9 @@ func (c *Cache) worker() {
 		// TODO: This could allow concurrent fetches at some point, but for
 		// most common client use cases, this shouldn't matter much.
 		d, _, err := c.impl.GetDoc(ctx, epoch)
+		if err == nil {
+			err = c.verifyTopology(d)
+		}
 		if err != nil {
 			if op != nil {
 				op.doneCh <- err
@@ -223,16 +244,16 @@ func (c *Cache) worker() {
 
 // New constructs a new Client backed by an existing pki.Client instance.
 func NewCacheClient(impl Client) (*Cache, error) {
-	var err error
 	c := new(Cache)
 	c.impl = impl
 	c.docs = make(map[uint64]*list.Element)
 	c.fetchQueue = make(chan *fetchOp, fetchBacklog)
-	c.memEpoch, c.memHeight, err = c.impl.GetEpoch(context.Background())
+	info, err := c.impl.GetEpoch(context.Background())
 	if err != nil {
 		return nil, err
 	}
-	c.timer = time.NewTimer(katzenmint.HeightPeriod)
+	c.memInfo = *info
+	c.timer = time.NewTimer(info.Till(time.Now()))
 
 	c.Go(c.worker)
 	return c, nil
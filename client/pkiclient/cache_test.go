@@ -0,0 +1,72 @@
+package pkiclient
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	kpki "github.com/hashcloak/Meson/katzenmint"
+	"github.com/hashcloak/Meson/katzenmint/testutil"
+	"github.com/katzenpost/core/crypto/eddsa"
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/require"
+)
+
+type mockClient struct {
+	docs   map[uint64]*cpki.Document
+	pruned uint64
+}
+
+func (m *mockClient) GetEpoch(ctx context.Context) (*kpki.EpochInfo, error) {
+	return &kpki.EpochInfo{Epoch: 1, StartTime: time.Now(), Duration: time.Hour}, nil
+}
+
+func (m *mockClient) GetDoc(ctx context.Context, epoch uint64) (*cpki.Document, []byte, error) {
+	if epoch <= m.pruned {
+		return nil, nil, ErrDocumentPruned
+	}
+	if doc, ok := m.docs[epoch]; ok {
+		return doc, nil, nil
+	}
+	return nil, nil, cpki.ErrNoDocument
+}
+
+func (m *mockClient) Post(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, d *cpki.MixDescriptor) error {
+	return nil
+}
+
+func (m *mockClient) PostReliabilityReport(ctx context.Context, signingKey *eddsa.PrivateKey, report *kpki.ReliabilityReport) error {
+	return nil
+}
+
+func (m *mockClient) Deserialize(raw []byte) (*cpki.Document, error) {
+	return nil, nil
+}
+
+func (m *mockClient) Shutdown() {}
+
+func TestCacheVerifyTopology(t *testing.T) {
+	require := require.New(t)
+
+	a, _, _ := testutil.CreateTestDescriptor(require, 0, 0, 1)
+	b, _, _ := testutil.CreateTestDescriptor(require, 1, 0, 1)
+	srv := make([]byte, kpki.SharedRandomLength)
+	impl := &mockClient{docs: map[uint64]*cpki.Document{
+		1: {Epoch: 1, Topology: [][]*cpki.MixDescriptor{{a}, {b}}, SharedRandomValue: srv},
+		2: {Epoch: 2, Topology: [][]*cpki.MixDescriptor{{a}, {b}}, SharedRandomValue: srv},
+		3: {Epoch: 3, Topology: [][]*cpki.MixDescriptor{{b}, {a}}, SharedRandomValue: srv},
+	}}
+	c, err := NewCacheClient(impl)
+	require.NoError(err)
+	defer c.Halt()
+
+	// the nodes keep their layers from one epoch to the next
+	_, _, err = c.GetDoc(context.Background(), 1)
+	require.NoError(err)
+	_, _, err = c.GetDoc(context.Background(), 2)
+	require.NoError(err)
+
+	// swapping the layers of the nodes is detected
+	_, _, err = c.GetDoc(context.Background(), 3)
+	require.Error(err)
+}
@@ -4,6 +4,7 @@ package pkiclient
 import (
 	"context"
 
+	kpki "github.com/hashcloak/Meson/katzenmint"
 	"github.com/katzenpost/core/crypto/eddsa"
 	cpki "github.com/katzenpost/core/pki"
 )
@@ -11,7 +12,7 @@ import (
 // Client is the abstract interface used for PKI interaction.
 type Client interface {
 	// GetEpoch returns the epoch information of PKI.
-	GetEpoch(ctx context.Context) (epoch uint64, ellapsedHeight uint64, err error)
+	GetEpoch(ctx context.Context) (*kpki.EpochInfo, error)
 
 	// GetDoc returns the PKI document along with the raw serialized form for the provided epoch.
 	GetDoc(ctx context.Context, epoch uint64) (*cpki.Document, []byte, error)
@@ -19,6 +20,10 @@ type Client interface {
 	// Post posts the node's descriptor to the PKI for the provided epoch.
 	Post(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, d *cpki.MixDescriptor) error
 
+	// PostReliabilityReport posts the loop results measured by the node
+	// during the epoch of the report.
+	PostReliabilityReport(ctx context.Context, signingKey *eddsa.PrivateKey, report *kpki.ReliabilityReport) error
+
 	// Deserialize returns PKI document given the raw bytes.
 	Deserialize(raw []byte) (*cpki.Document, error)
 
@@ -0,0 +1,330 @@
+// katzenmint pkiclient document diff
+
+package pkiclient
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	kpki "github.com/hashcloak/Meson/katzenmint"
+	cpki "github.com/katzenpost/core/pki"
+)
+
+// NodeChange represents a mix listed in both documents whose layer or keys
+// changed.
+type NodeChange struct {
+	// Name is the name of the mix in the newer document.
+	Name string
+
+	// IdentityKey is the identity key of the mix.
+	IdentityKey []byte
+
+	// FromLayer and ToLayer are the layers of the mix in each document.
+	FromLayer uint8
+	ToLayer   uint8
+
+	// LinkKeyChanged is whether the link key changed.
+	LinkKeyChanged bool
+
+	// MixKeysChanged is whether the mix keys of the epochs listed in both
+	// descriptors changed.
+	MixKeysChanged bool
+}
+
+// Moved returns whether the mix changed layer.
+func (c *NodeChange) Moved() bool {
+	return c.FromLayer != c.ToLayer
+}
+
+// ProviderChange represents a provider listed in both documents whose keys
+// or Kaetzchen services changed.
+type ProviderChange struct {
+	// Name is the name of the provider in the newer document.
+	Name string
+
+	// IdentityKey is the identity key of the provider.
+	IdentityKey []byte
+
+	// LinkKeyChanged is whether the link key changed.
+	LinkKeyChanged bool
+
+	// MixKeysChanged is whether the mix keys of the epochs listed in both
+	// descriptors changed.
+	MixKeysChanged bool
+
+	// AddedServices, RemovedServices and ChangedServices are the
+	// capabilities of the Kaetzchen services which were added, removed or
+	// whose parameters changed, sorted by name.
+	AddedServices   []string
+	RemovedServices []string
+	ChangedServices []string
+}
+
+// DocumentDiff represents the changes of the network between two documents.
+type DocumentDiff struct {
+	FromEpoch uint64
+	ToEpoch   uint64
+
+	// AddedNodes and RemovedNodes are the mixes which joined or left the
+	// topology, sorted by identity key.
+	AddedNodes   []*cpki.MixDescriptor
+	RemovedNodes []*cpki.MixDescriptor
+
+	// ChangedNodes are the mixes which moved to another layer or changed
+	// keys, sorted by identity key.
+	ChangedNodes []*NodeChange
+
+	// AddedProviders and RemovedProviders are the providers which joined or
+	// left the network, sorted by identity key.
+	AddedProviders   []*cpki.MixDescriptor
+	RemovedProviders []*cpki.MixDescriptor
+
+	// ChangedProviders are the providers which changed keys or Kaetzchen
+	// services, sorted by identity key.
+	ChangedProviders []*ProviderChange
+}
+
+// IsEmpty returns whether the documents list the same network.
+func (d *DocumentDiff) IsEmpty() bool {
+	return len(d.AddedNodes) == 0 && len(d.RemovedNodes) == 0 && len(d.ChangedNodes) == 0 &&
+		len(d.AddedProviders) == 0 && len(d.RemovedProviders) == 0 && len(d.ChangedProviders) == 0
+}
+
+// String returns a human readable summary of the diff.
+func (d *DocumentDiff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Epoch %d -> %d\n", d.FromEpoch, d.ToEpoch)
+	for _, desc := range d.AddedNodes {
+		fmt.Fprintf(&b, "+ mix %s (%x)\n", desc.Name, desc.IdentityKey.Bytes())
+	}
+	for _, desc := range d.RemovedNodes {
+		fmt.Fprintf(&b, "- mix %s (%x)\n", desc.Name, desc.IdentityKey.Bytes())
+	}
+	for _, c := range d.ChangedNodes {
+		fmt.Fprintf(&b, "~ mix %s (%x)", c.Name, c.IdentityKey)
+		if c.Moved() {
+			fmt.Fprintf(&b, " layer %d -> %d", c.FromLayer, c.ToLayer)
+		}
+		if c.LinkKeyChanged {
+			b.WriteString(" link key changed")
+		}
+		if c.MixKeysChanged {
+			b.WriteString(" mix keys changed")
+		}
+		b.WriteString("\n")
+	}
+	for _, desc := range d.AddedProviders {
+		fmt.Fprintf(&b, "+ provider %s (%x)\n", desc.Name, desc.IdentityKey.Bytes())
+	}
+	for _, desc := range d.RemovedProviders {
+		fmt.Fprintf(&b, "- provider %s (%x)\n", desc.Name, desc.IdentityKey.Bytes())
+	}
+	for _, c := range d.ChangedProviders {
+		fmt.Fprintf(&b, "~ provider %s (%x)", c.Name, c.IdentityKey)
+		if c.LinkKeyChanged {
+			b.WriteString(" link key changed")
+		}
+		if c.MixKeysChanged {
+			b.WriteString(" mix keys changed")
+		}
+		if len(c.AddedServices) > 0 {
+			fmt.Fprintf(&b, " services added %v", c.AddedServices)
+		}
+		if len(c.RemovedServices) > 0 {
+			fmt.Fprintf(&b, " services removed %v", c.RemovedServices)
+		}
+		if len(c.ChangedServices) > 0 {
+			fmt.Fprintf(&b, " services changed %v", c.ChangedServices)
+		}
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// DiffDocuments returns the changes of the network from one document to
+// another.
+func DiffDocuments(from, to *cpki.Document) *DocumentDiff {
+	diff := &DocumentDiff{
+		FromEpoch: from.Epoch,
+		ToEpoch:   to.Epoch,
+	}
+
+	// Mixes, along with their layer in the topology
+	fromNodes, fromLayers := indexTopology(from)
+	toNodes, toLayers := indexTopology(to)
+	for id, desc := range toNodes {
+		prev, ok := fromNodes[id]
+		if !ok {
+			diff.AddedNodes = append(diff.AddedNodes, desc)
+			continue
+		}
+		c := &NodeChange{
+			Name:           desc.Name,
+			IdentityKey:    desc.IdentityKey.Bytes(),
+			FromLayer:      fromLayers[id],
+			ToLayer:        toLayers[id],
+			LinkKeyChanged: !bytes.Equal(prev.LinkKey.Bytes(), desc.LinkKey.Bytes()),
+			MixKeysChanged: mixKeysChanged(prev, desc),
+		}
+		if c.Moved() || c.LinkKeyChanged || c.MixKeysChanged {
+			diff.ChangedNodes = append(diff.ChangedNodes, c)
+		}
+	}
+	for id, desc := range fromNodes {
+		if _, ok := toNodes[id]; !ok {
+			diff.RemovedNodes = append(diff.RemovedNodes, desc)
+		}
+	}
+
+	// Providers, along with their Kaetzchen services
+	fromProviders := indexProviders(from)
+	toProviders := indexProviders(to)
+	for id, desc := range toProviders {
+		prev, ok := fromProviders[id]
+		if !ok {
+			diff.AddedProviders = append(diff.AddedProviders, desc)
+			continue
+		}
+		c := &ProviderChange{
+			Name:           desc.Name,
+			IdentityKey:    desc.IdentityKey.Bytes(),
+			LinkKeyChanged: !bytes.Equal(prev.LinkKey.Bytes(), desc.LinkKey.Bytes()),
+			MixKeysChanged: mixKeysChanged(prev, desc),
+		}
+		for capa, params := range desc.Kaetzchen {
+			prevParams, ok := prev.Kaetzchen[capa]
+			if !ok {
+				c.AddedServices = append(c.AddedServices, capa)
+			} else if !reflect.DeepEqual(prevParams, params) {
+				c.ChangedServices = append(c.ChangedServices, capa)
+			}
+		}
+		for capa := range prev.Kaetzchen {
+			if _, ok := desc.Kaetzchen[capa]; !ok {
+				c.RemovedServices = append(c.RemovedServices, capa)
+			}
+		}
+		sort.Strings(c.AddedServices)
+		sort.Strings(c.RemovedServices)
+		sort.Strings(c.ChangedServices)
+		if c.LinkKeyChanged || c.MixKeysChanged || len(c.AddedServices) > 0 || len(c.RemovedServices) > 0 || len(c.ChangedServices) > 0 {
+			diff.ChangedProviders = append(diff.ChangedProviders, c)
+		}
+	}
+	for id, desc := range fromProviders {
+		if _, ok := toProviders[id]; !ok {
+			diff.RemovedProviders = append(diff.RemovedProviders, desc)
+		}
+	}
+
+	sortDescriptors(diff.AddedNodes)
+	sortDescriptors(diff.RemovedNodes)
+	sortDescriptors(diff.AddedProviders)
+	sortDescriptors(diff.RemovedProviders)
+	sort.Slice(diff.ChangedNodes, func(i, j int) bool {
+		return bytes.Compare(diff.ChangedNodes[i].IdentityKey, diff.ChangedNodes[j].IdentityKey) < 0
+	})
+	sort.Slice(diff.ChangedProviders, func(i, j int) bool {
+		return bytes.Compare(diff.ChangedProviders[i].IdentityKey, diff.ChangedProviders[j].IdentityKey) < 0
+	})
+	return diff
+}
+
+func indexTopology(doc *cpki.Document) (map[string]*cpki.MixDescriptor, map[string]uint8) {
+	nodes := make(map[string]*cpki.MixDescriptor)
+	layers := make(map[string]uint8)
+	for layer, descs := range doc.Topology {
+		for _, desc := range descs {
+			id := string(desc.IdentityKey.Bytes())
+			nodes[id] = desc
+			layers[id] = uint8(layer)
+		}
+	}
+	return nodes, layers
+}
+
+func indexProviders(doc *cpki.Document) map[string]*cpki.MixDescriptor {
+	providers := make(map[string]*cpki.MixDescriptor)
+	for _, desc := range doc.Providers {
+		providers[string(desc.IdentityKey.Bytes())] = desc
+	}
+	return providers
+}
+
+func mixKeysChanged(from, to *cpki.MixDescriptor) bool {
+	for epoch, key := range to.MixKeys {
+		if prev, ok := from.MixKeys[epoch]; ok && !bytes.Equal(prev.Bytes(), key.Bytes()) {
+			return true
+		}
+	}
+	return false
+}
+
+func sortDescriptors(descs []*cpki.MixDescriptor) {
+	sort.Slice(descs, func(i, j int) bool {
+		return bytes.Compare(descs[i].IdentityKey.Bytes(), descs[j].IdentityKey.Bytes()) < 0
+	})
+}
+
+// getDocUncached returns the document of the epoch, fetching it without
+// caching it if it is not cached yet, so that walking the history does not
+// evict the documents of the current epochs.
+func (c *Cache) getDocUncached(ctx context.Context, epoch uint64) (*cpki.Document, error) {
+	if d := c.cacheGet(epoch); d != nil {
+		return d.doc, nil
+	}
+	doc, _, err := c.impl.GetDoc(ctx, epoch)
+	if errors.Is(err, ErrDocumentPruned) {
+		return nil, fmt.Errorf("document for epoch %d has been pruned by the PKI", epoch)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get document for epoch %d: %v", epoch, err)
+	}
+	return doc, nil
+}
+
+// GetDocDiff returns the changes of the network between the documents of two
+// epochs, fetching the documents which are not cached.
+func (c *Cache) GetDocDiff(ctx context.Context, fromEpoch, toEpoch uint64) (*DocumentDiff, error) {
+	from, err := c.getDocUncached(ctx, fromEpoch)
+	if err != nil {
+		return nil, err
+	}
+	to, err := c.getDocUncached(ctx, toEpoch)
+	if err != nil {
+		return nil, err
+	}
+	return DiffDocuments(from, to), nil
+}
+
+// GetDocHistory returns the changes of the network from each epoch to the
+// next, from fromEpoch to toEpoch, fetching the documents which are not
+// cached.  The layer assignment of each document is verified against the
+// document of the previous epoch.
+func (c *Cache) GetDocHistory(ctx context.Context, fromEpoch, toEpoch uint64) ([]*DocumentDiff, error) {
+	if fromEpoch >= toEpoch {
+		return nil, fmt.Errorf("epoch %d is not before epoch %d", fromEpoch, toEpoch)
+	}
+	prev, err := c.getDocUncached(ctx, fromEpoch)
+	if err != nil {
+		return nil, err
+	}
+	diffs := make([]*DocumentDiff, 0, toEpoch-fromEpoch)
+	for epoch := fromEpoch + 1; epoch <= toEpoch; epoch++ {
+		doc, err := c.getDocUncached(ctx, epoch)
+		if err != nil {
+			return nil, err
+		}
+		if err = kpki.VerifyTopology(doc, prev); err != nil {
+			return nil, fmt.Errorf("pkiclient: invalid topology for epoch %d: %v", epoch, err)
+		}
+		diffs = append(diffs, DiffDocuments(prev, doc))
+		prev = doc
+	}
+	return diffs, nil
+}
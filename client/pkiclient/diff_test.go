@@ -0,0 +1,132 @@
+package pkiclient
+
+import (
+	"context"
+	"testing"
+
+	kpki "github.com/hashcloak/Meson/katzenmint"
+	"github.com/hashcloak/Meson/katzenmint/testutil"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffDocuments(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	// create the descriptors of the first document
+	epoch := uint64(1)
+	mixes := make([]*cpki.MixDescriptor, 4)
+	for i := range mixes {
+		mixes[i], _, _ = testutil.CreateTestDescriptor(require, i, 0, epoch)
+	}
+	providers := make([]*cpki.MixDescriptor, 2)
+	for i := range providers {
+		providers[i], _, _ = testutil.CreateTestDescriptor(require, i, cpki.LayerProvider, epoch)
+	}
+	from := &cpki.Document{
+		Epoch:     epoch,
+		Topology:  [][]*cpki.MixDescriptor{{mixes[0], mixes[1]}, {mixes[2]}},
+		Providers: providers,
+	}
+
+	// the same network has no change
+	diff := DiffDocuments(from, from)
+	assert.True(diff.IsEmpty())
+
+	// mix 0 stays, mix 1 moves, mix 2 leaves, mix 3 joins and mix 0 rotates its link key
+	newProvider, _, _ := testutil.CreateTestDescriptor(require, 2, cpki.LayerProvider, epoch+1)
+	moved := *mixes[0]
+	linkPriv, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+	moved.LinkKey = linkPriv.PublicKey()
+	changedProvider := *providers[0]
+	changedProvider.Kaetzchen = map[string]map[string]interface{}{
+		"loop": {"endpoint": "+loop"},
+	}
+	to := &cpki.Document{
+		Epoch:     epoch + 1,
+		Topology:  [][]*cpki.MixDescriptor{{&moved, mixes[3]}, {mixes[1]}},
+		Providers: []*cpki.MixDescriptor{&changedProvider, newProvider},
+	}
+	diff = DiffDocuments(from, to)
+	assert.False(diff.IsEmpty())
+	assert.Equal(epoch, diff.FromEpoch)
+	assert.Equal(epoch+1, diff.ToEpoch)
+	require.Len(diff.AddedNodes, 1)
+	assert.Equal(mixes[3].IdentityKey.Bytes(), diff.AddedNodes[0].IdentityKey.Bytes())
+	require.Len(diff.RemovedNodes, 1)
+	assert.Equal(mixes[2].IdentityKey.Bytes(), diff.RemovedNodes[0].IdentityKey.Bytes())
+	require.Len(diff.ChangedNodes, 2)
+	for _, c := range diff.ChangedNodes {
+		switch string(c.IdentityKey) {
+		case string(mixes[0].IdentityKey.Bytes()):
+			assert.False(c.Moved())
+			assert.True(c.LinkKeyChanged)
+		case string(mixes[1].IdentityKey.Bytes()):
+			assert.True(c.Moved())
+			assert.Equal(uint8(0), c.FromLayer)
+			assert.Equal(uint8(1), c.ToLayer)
+			assert.False(c.LinkKeyChanged)
+		default:
+			t.Fatalf("unexpected changed node %x", c.IdentityKey)
+		}
+		assert.False(c.MixKeysChanged)
+	}
+
+	// provider 1 leaves, a provider joins and provider 0 changes services
+	require.Len(diff.AddedProviders, 1)
+	assert.Equal(newProvider.IdentityKey.Bytes(), diff.AddedProviders[0].IdentityKey.Bytes())
+	require.Len(diff.RemovedProviders, 1)
+	assert.Equal(providers[1].IdentityKey.Bytes(), diff.RemovedProviders[0].IdentityKey.Bytes())
+	require.Len(diff.ChangedProviders, 1)
+	assert.Equal([]string{"loop"}, diff.ChangedProviders[0].AddedServices)
+	assert.Equal([]string{"miau"}, diff.ChangedProviders[0].RemovedServices)
+	assert.Empty(diff.ChangedProviders[0].ChangedServices)
+	assert.Contains(diff.String(), "layer 0 -> 1")
+}
+
+func TestCacheGetDocHistory(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	a, _, _ := testutil.CreateTestDescriptor(require, 0, 0, 1)
+	b, _, _ := testutil.CreateTestDescriptor(require, 1, 0, 1)
+	srv := make([]byte, kpki.SharedRandomLength)
+	impl := &mockClient{docs: make(map[uint64]*cpki.Document), pruned: 1}
+	for epoch := uint64(2); epoch <= 2*uint64(lruMaxSize)+2; epoch++ {
+		topology := [][]*cpki.MixDescriptor{{a}, {b}}
+		if epoch == 5 {
+			topology = [][]*cpki.MixDescriptor{{a, b}, {}}
+		}
+		impl.docs[epoch] = &cpki.Document{Epoch: epoch, Topology: topology, SharedRandomValue: srv}
+	}
+	c, err := NewCacheClient(impl)
+	require.NoError(err)
+	defer c.Halt()
+	_, _, err = c.GetDoc(context.Background(), 2)
+	require.NoError(err)
+
+	// the history spans more epochs than the cache without evicting them
+	last := 2*uint64(lruMaxSize) + 2
+	diffs, err := c.GetDocHistory(context.Background(), 5, last)
+	require.NoError(err)
+	require.Len(diffs, int(last-5))
+	for i, diff := range diffs {
+		assert.Equal(uint64(5+i), diff.FromEpoch)
+		assert.Equal(uint64(6+i), diff.ToEpoch)
+	}
+	assert.Len(diffs[0].ChangedNodes, 1)
+	assert.True(diffs[1].IsEmpty())
+	assert.NotNil(c.cacheGet(2))
+	assert.Nil(c.cacheGet(last))
+
+	// the layer assignments are verified
+	_, err = c.GetDocHistory(context.Background(), 2, 6)
+	assert.Error(err)
+
+	// the pruned epochs are reported
+	_, err = c.GetDocDiff(context.Background(), 1, 2)
+	assert.EqualError(err, "document for epoch 1 has been pruned by the PKI")
+}
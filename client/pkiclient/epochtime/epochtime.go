@@ -5,16 +5,30 @@ import (
 	"time"
 
 	kpki "github.com/hashcloak/Meson/client/pkiclient"
-	"github.com/hashcloak/Meson/katzenmint"
+	"github.com/hashcloak/Meson/katzenmint/config"
 )
 
-// ! The duration of a katzenmint epoch. Should refer to katzenmint PKI.
-var TestPeriod = katzenmint.HeightPeriod * time.Duration(katzenmint.EpochInterval)
-
+// Now returns the current epoch, along with the time ellapsed since its start
+// and the time left until the next one, according to the epoch start time
+// recorded by katzenmint.
 func Now(client kpki.Client) (epoch uint64, ellapsed, till time.Duration, err error) {
-	preparingEpoch, ellapsedHeight, err := client.GetEpoch(context.Background())
-	epoch = preparingEpoch - 1
-	ellapsed = katzenmint.SinceEpochStart(int64(ellapsedHeight))
-	till = katzenmint.TillEpochFinish(int64(ellapsedHeight))
+	info, err := client.GetEpoch(context.Background())
+	if err != nil {
+		return
+	}
+	now := time.Now()
+	epoch = info.Epoch - 1
+	ellapsed = info.Ellapsed(now)
+	till = info.Till(now)
 	return
 }
+
+// Period returns the duration of the epochs according to katzenmint, or the
+// default duration if it cannot be retrieved.
+func Period(client kpki.Client) time.Duration {
+	info, err := client.GetEpoch(context.Background())
+	if err != nil || info.Duration <= 0 {
+		return config.DefaultEpochDuration
+	}
+	return info.Duration
+}
@@ -3,8 +3,8 @@
 package pkiclient
 
 import (
+	"bytes"
 	"context"
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"math"
@@ -41,6 +41,10 @@ func (e BroadcastTxError) Error() string {
 	return fmt.Sprintf("send transaction failed at delivering tx: %v", e.Resp.DeliverTx.Log)
 }
 
+// ErrDocumentPruned is the error returned when the document of the epoch has
+// been pruned by the PKI nodes.  It wraps cpki.ErrNoDocument.
+var ErrDocumentPruned = fmt.Errorf("%w: document has been pruned", cpki.ErrNoDocument)
+
 type PKIClientConfig struct {
 	LogBackend         *log.Backend
 	ChainID            string
@@ -62,13 +66,13 @@ type PKIClient struct {
 	db dbm.DB
 }
 
-func (p *PKIClient) query(ctx context.Context, epoch uint64, command kpki.Command) (*ctypes.ResultABCIQuery, error) {
+func (p *PKIClient) query(ctx context.Context, epoch uint64, command kpki.Command, payload string) (*ctypes.ResultABCIQuery, error) {
 	// Form the abci query
 	query := kpki.Query{
 		Version: protocolVersion,
 		Epoch:   epoch,
 		Command: command,
-		Payload: "",
+		Payload: payload,
 	}
 	data, err := kpki.EncodeJson(query)
 	if err != nil {
@@ -86,27 +90,22 @@ func (p *PKIClient) query(ctx context.Context, epoch uint64, command kpki.Comman
 }
 
 // GetEpoch returns the epoch information of PKI.
-func (p *PKIClient) GetEpoch(ctx context.Context) (epoch uint64, ellapsedHeight uint64, err error) {
-	resp, err := p.query(ctx, 0, kpki.GetEpoch)
+func (p *PKIClient) GetEpoch(ctx context.Context) (*kpki.EpochInfo, error) {
+	resp, err := p.query(ctx, 0, kpki.GetEpoch, "")
 	if err != nil {
-		return
+		return nil, err
 	}
 	if resp.Response.Code != 0 {
-		err = errors.New(resp.Response.Log)
-		return
+		return nil, errors.New(resp.Response.Log)
 	}
-	if len(resp.Response.Value) != 16 {
-		err = fmt.Errorf("retrieved epoch information has incorrect format")
-		return
+	info, err := kpki.ParseEpochInfo(resp.Response.Value)
+	if err != nil {
+		return nil, fmt.Errorf("retrieved epoch information has incorrect format")
 	}
-	epoch, _ = binary.Uvarint(resp.Response.Value[:8])
-	startingHeight, _ := binary.Varint(resp.Response.Value[8:16])
-	if startingHeight > resp.Response.Height {
-		err = fmt.Errorf("retrieved starting height is more than the corresponding block height")
-		return
+	if info.StartHeight > resp.Response.Height {
+		return nil, fmt.Errorf("retrieved starting height is more than the corresponding block height")
 	}
-	ellapsedHeight = uint64(resp.Response.Height - startingHeight)
-	return
+	return info, nil
 }
 
 // GetDoc returns the PKI document along with the raw serialized form for the provided epoch.
@@ -114,11 +113,14 @@ func (p *PKIClient) GetDoc(ctx context.Context, epoch uint64) (*cpki.Document, [
 	p.log.Debugf("Get document for epoch %d", epoch)
 
 	// Make the query
-	resp, err := p.query(ctx, epoch, kpki.GetConsensus)
+	resp, err := p.query(ctx, epoch, kpki.GetConsensus, "")
 	if err != nil {
 		return nil, nil, err
 	}
 	if resp.Response.Code != 0 {
+		if resp.Response.Code == kpki.ErrQueryDocumentPruned.Code {
+			return nil, nil, ErrDocumentPruned
+		}
 		if resp.Response.Code == kpki.ErrQueryNoDocument.Code {
 			return nil, nil, cpki.ErrNoDocument
 		}
@@ -156,6 +158,69 @@ func (p *PKIClient) GetDoc(ctx context.Context, epoch uint64) (*cpki.Document, [
 	return doc, resp.Response.Value, nil
 }
 
+// GetAuthorities returns the authorities of PKI along with their voting power.
+func (p *PKIClient) GetAuthorities(ctx context.Context) ([]kpki.Authority, error) {
+	resp, err := p.query(ctx, 0, kpki.GetAuthorities, "")
+	if err != nil {
+		return nil, err
+	}
+	if resp.Response.Code != 0 {
+		return nil, errors.New(resp.Response.Log)
+	}
+	var auths []kpki.Authority
+	if err = kpki.DecodeJson(resp.Response.Value, &auths); err != nil {
+		return nil, fmt.Errorf("failed to extract authorities: %v", err)
+	}
+	return auths, nil
+}
+
+// GetDescriptors returns the raw descriptors uploaded for the provided epoch.
+func (p *PKIClient) GetDescriptors(ctx context.Context, epoch uint64) ([][]byte, error) {
+	resp, err := p.query(ctx, epoch, kpki.GetDescriptors, "")
+	if err != nil {
+		return nil, err
+	}
+	if resp.Response.Code != 0 {
+		if resp.Response.Code == kpki.ErrQueryNoDescriptor.Code {
+			return [][]byte{}, nil
+		}
+		return nil, errors.New(resp.Response.Log)
+	}
+	identityKeys := make([][]byte, 0)
+	if err = kpki.DecodeJson(resp.Response.Value, &identityKeys); err != nil {
+		return nil, fmt.Errorf("failed to extract descriptor index: %v", err)
+	}
+	descs := make([][]byte, 0, len(identityKeys))
+	for _, identityKey := range identityKeys {
+		_, raw, err := p.GetDescriptor(ctx, identityKey, epoch)
+		if err != nil {
+			return nil, err
+		}
+		descs = append(descs, raw)
+	}
+	return descs, nil
+}
+
+// GetDescriptor returns the descriptor along with the raw serialized form
+// uploaded by the node of the identity key for the provided epoch.
+func (p *PKIClient) GetDescriptor(ctx context.Context, identityKey []byte, epoch uint64) (*cpki.MixDescriptor, []byte, error) {
+	resp, err := p.query(ctx, epoch, kpki.GetDescriptor, kpki.EncodeHex(identityKey))
+	if err != nil {
+		return nil, nil, err
+	}
+	if resp.Response.Code != 0 {
+		return nil, nil, errors.New(resp.Response.Log)
+	}
+	desc, err := s11n.ParseDescriptor(resp.Response.Value, epoch)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to extract descriptor: %v", err)
+	}
+	if !bytes.Equal(desc.IdentityKey.Bytes(), identityKey) {
+		return nil, nil, fmt.Errorf("retrieved descriptor has wrong identity key")
+	}
+	return desc, resp.Response.Value, nil
+}
+
 // Post posts the node's descriptor to the PKI for the provided epoch.
 func (p *PKIClient) Post(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, d *cpki.MixDescriptor) error {
 	p.log.Debugf("Post descriptor for epoch %d: %v", epoch, d)
@@ -188,6 +253,30 @@ func (p *PKIClient) Post(ctx context.Context, epoch uint64, signingKey *eddsa.Pr
 	return nil
 }
 
+// PostReliabilityReport posts the loop results measured by the node during the
+// epoch of the report.
+func (p *PKIClient) PostReliabilityReport(ctx context.Context, signingKey *eddsa.PrivateKey, report *kpki.ReliabilityReport) error {
+	p.log.Debugf("Post reliability report for epoch %d on %d nodes", report.Epoch, len(report.Nodes))
+
+	// Sign the report with the identity key
+	signed, err := kpki.SignReliabilityReport(signingKey, report)
+	if err != nil {
+		return err
+	}
+
+	// Reports are accepted in the epochs following the report epoch
+	info, err := p.GetEpoch(ctx)
+	if err != nil {
+		return err
+	}
+	tx, err := kpki.FormTransaction(kpki.PostReliability, info.Epoch, kpki.EncodeHex(signed), signingKey)
+	if err != nil {
+		return err
+	}
+	_, err = p.PostTx(ctx, tx)
+	return err
+}
+
 // PostTx posts the transaction to the katzenmint node.
 func (p *PKIClient) PostTx(ctx context.Context, tx []byte) (*ctypes.ResultBroadcastTxCommit, error) {
 
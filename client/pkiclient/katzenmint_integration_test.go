@@ -88,8 +88,9 @@ func TestGetDocument(t *testing.T) {
 	)
 
 	// Get the current epoch
-	epoch, _, err := pkiClient.GetEpoch(context.Background())
+	info, err := pkiClient.GetEpoch(context.Background())
 	require.NoError(err)
+	epoch := info.Epoch
 
 	// Create a document
 	_, docSer := testutil.CreateTestDocument(require, epoch)
@@ -128,8 +129,9 @@ func TestPostDescriptor(t *testing.T) {
 	)
 
 	// Get the upcoming epoch
-	epoch, _, err := pkiClient.GetEpoch(context.Background())
+	info, err := pkiClient.GetEpoch(context.Background())
 	require.NoError(err)
+	epoch := info.Epoch
 	epoch += 1
 
 	// Post test descriptor
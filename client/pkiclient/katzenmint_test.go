@@ -193,6 +193,88 @@ func TestMockPKIClientGetDocument(t *testing.T) {
 	require.Equal(doc, testDoc)
 }
 
+// TestMockPKIClientGetDescriptor tests PKI Client get descriptor and verifies proofs.
+func TestMockPKIClientGetDescriptor(t *testing.T) {
+	var (
+		require            = require.New(t)
+		epoch       uint64 = 1
+		blockHeight int64  = 1
+		key                = []byte{2}
+	)
+
+	// create a test descriptor in an iavl tree
+	desc, signed, _ := testutil.CreateTestDescriptor(require, 0, 0, epoch)
+	tree, err := iavl.NewMutableTree(dbm.NewMemDB(), 100, true)
+	require.NoError(err)
+	_, err = tree.Set(key, signed)
+	require.NoError(err)
+	proof, err := tree.GetMembershipProof(key)
+	require.NoError(err)
+	testOp := &testOp{
+		Tree:  tree,
+		Key:   key,
+		Proof: proof,
+	}
+
+	// mock the abci query
+	rawQuery, err := kpki.EncodeJson(kpki.Query{
+		Version: protocolVersion,
+		Epoch:   epoch,
+		Command: kpki.GetDescriptor,
+		Payload: kpki.EncodeHex(desc.IdentityKey.Bytes()),
+	})
+	require.NoError(err)
+	next := &rpcmock.Client{}
+	next.On(
+		"ABCIQueryWithOptions",
+		context.Background(),
+		mock.AnythingOfType("string"),
+		tmbytes.HexBytes(rawQuery),
+		mock.AnythingOfType("client.ABCIQueryOptions"),
+	).Return(&ctypes.ResultABCIQuery{
+		Response: abci.ResponseQuery{
+			Code:   0,
+			Key:    testOp.GetKey(),
+			Value:  signed,
+			Height: blockHeight,
+			ProofOps: &tmcrypto.ProofOps{
+				Ops: []tmcrypto.ProofOp{testOp.ProofOp()},
+			},
+		},
+	}, nil)
+
+	// initialize pki client with light client
+	lc := &lcmock.LightClient{}
+	rootHash, err := testOp.Run(nil)
+	require.NoError(err)
+	lc.On("VerifyLightBlockAtHeight", context.Background(), int64(2), mock.AnythingOfType("time.Time")).Return(
+		&types.LightBlock{
+			SignedHeader: &types.SignedHeader{
+				Header: &types.Header{AppHash: rootHash},
+			},
+		},
+		nil,
+	)
+	c := lightrpc.NewClient(next, lc,
+		lightrpc.KeyPathFn(func(_ string, key []byte) (merkle.KeyPath, error) {
+			kp := merkle.KeyPath{}
+			kp = kp.AppendKey(key, merkle.KeyEncodingURL)
+			return kp, nil
+		}))
+	logPath := filepath.Join(testDir, "pkiclient_log")
+	logBackend, err := katlog.New(logPath, "INFO", true)
+	require.NoError(err)
+	pkiClient, err := NewPKIClientFromLightClient(c, logBackend)
+	require.NoError(err)
+
+	// test get descriptor with pki client
+	got, raw, err := pkiClient.GetDescriptor(context.Background(), desc.IdentityKey.Bytes(), epoch)
+	require.NoError(err)
+	require.Equal(signed, raw)
+	require.Equal(desc.IdentityKey, got.IdentityKey)
+	require.Equal(desc.Name, got.Name)
+}
+
 // TestMockPKIClientPostTx tests PKI Client post transaction and verifies proofs.
 func TestMockPKIClientPostTx(t *testing.T) {
 	var (
@@ -0,0 +1,183 @@
+// request.go - mixnet client asynchronous requests
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	cConstants "github.com/katzenpost/client/constants"
+)
+
+// TimeoutPolicy returns how long to wait for the reply of a request once it
+// is sent, given the expected round trip time.  A zero timeout waits for the
+// reply until the context of the request is done.
+type TimeoutPolicy func(replyETA time.Duration) time.Duration
+
+// DefaultTimeoutPolicy waits for the expected round trip time and the round
+// trip time slop.
+func DefaultTimeoutPolicy(replyETA time.Duration) time.Duration {
+	return replyETA + cConstants.RoundTripTimeSlop
+}
+
+// ScaledTimeoutPolicy returns a TimeoutPolicy waiting for factor times the
+// expected round trip time and the round trip time slop.
+func ScaledTimeoutPolicy(factor float64) TimeoutPolicy {
+	return func(replyETA time.Duration) time.Duration {
+		return time.Duration(factor*float64(replyETA)) + cConstants.RoundTripTimeSlop
+	}
+}
+
+// FixedTimeoutPolicy returns a TimeoutPolicy waiting for d whatever the
+// expected round trip time.
+func FixedTimeoutPolicy(d time.Duration) TimeoutPolicy {
+	return func(time.Duration) time.Duration {
+		return d
+	}
+}
+
+// RequestOption configures a request.
+type RequestOption func(*Request)
+
+// WithTimeoutPolicy sets the TimeoutPolicy of the request, instead of the
+// DefaultTimeoutPolicy.
+func WithTimeoutPolicy(policy TimeoutPolicy) RequestOption {
+	return func(r *Request) {
+		r.policy = policy
+	}
+}
+
+// Request is a handle to a request sent with SendRequest, completed by its
+// reply, a failure, the timeout or the end of its context.
+type Request struct {
+	// ID is the message identifier of the request.
+	ID *[cConstants.MessageIDLength]byte
+
+	s      *Session
+	policy TimeoutPolicy
+
+	once  sync.Once
+	done  chan struct{}
+	reply []byte
+	err   error
+
+	mu       sync.Mutex
+	unsent   int
+	replyETA time.Duration
+	timer    *time.Timer
+	stopCtx  func() bool
+}
+
+// Done returns a channel closed when the request is completed.
+func (r *Request) Done() <-chan struct{} {
+	return r.done
+}
+
+// Reply waits until the request is completed, and returns the reply.
+func (r *Request) Reply() ([]byte, error) {
+	<-r.done
+	return r.reply, r.err
+}
+
+// Cancel completes the request with context.Canceled, unless it is already
+// completed.  A reply received afterwards is discarded.
+func (r *Request) Cancel() {
+	r.complete(nil, context.Canceled)
+}
+
+func (r *Request) complete(reply []byte, err error) {
+	r.once.Do(func() {
+		r.s.requestMap.Delete(*r.ID)
+		r.mu.Lock()
+		if r.timer != nil {
+			r.timer.Stop()
+		}
+		if r.stopCtx != nil {
+			r.stopCtx()
+		}
+		r.mu.Unlock()
+		r.reply, r.err = reply, err
+		close(r.done)
+	})
+}
+
+// onSent is called once a message of the request is sent, and starts the
+// reply timeout once all of them are.
+func (r *Request) onSent(msg *Message, err error) {
+	if err != nil {
+		r.complete(nil, ErrMessageNotSent)
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if msg.ReplyETA > r.replyETA {
+		r.replyETA = msg.ReplyETA
+	}
+	r.unsent--
+	if r.unsent > 0 {
+		return
+	}
+	select {
+	case <-r.done:
+		return
+	default:
+	}
+	if timeout := r.policy(r.replyETA); timeout > 0 {
+		r.timer = time.AfterFunc(timeout, func() {
+			r.complete(nil, ErrReplyTimeout)
+		})
+	}
+}
+
+// SendRequest asynchronously sends message without any automatic
+// retransmissions, and returns a Request completed by its reply.  The
+// request fails with the error of ctx once ctx is done, and with
+// ErrReplyTimeout when the reply is not received within the timeout of its
+// TimeoutPolicy.  Many requests may be pending at once.
+func (s *Session) SendRequest(ctx context.Context, recipient, provider string, message []byte, opts ...RequestOption) (*Request, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	msgs, err := s.composeMessages(recipient, provider, message, true)
+	if err != nil {
+		return nil, err
+	}
+	r := &Request{
+		ID:     msgs[0].ID,
+		s:      s,
+		policy: DefaultTimeoutPolicy,
+		done:   make(chan struct{}),
+		unsent: len(msgs),
+	}
+	for _, opt := range opts {
+		opt(r)
+	}
+	s.requestMap.Store(*r.ID, r)
+	r.mu.Lock()
+	r.stopCtx = context.AfterFunc(ctx, func() {
+		r.complete(nil, ctx.Err())
+	})
+	r.mu.Unlock()
+
+	// the fragments queued before a failure are still sent
+	if _, err = s.pushMessages(msgs); err != nil {
+		r.complete(nil, err)
+		return nil, err
+	}
+	return r, nil
+}
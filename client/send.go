@@ -17,6 +17,7 @@
 package client
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
@@ -24,14 +25,55 @@ import (
 	"io"
 	"time"
 
+	"github.com/hashcloak/Meson/client/block"
+	"github.com/hashcloak/Meson/fragment"
 	cConstants "github.com/katzenpost/client/constants"
 	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/crypto/rand"
 	sConstants "github.com/katzenpost/core/sphinx/constants"
 )
 
 var ErrReplyTimeout = errors.New("failure waiting for reply, timeout reached")
 var ErrMessageNotSent = errors.New("failure sending message")
+var ErrMaxRetransmissions = errors.New("failure sending reliable message, maximum retransmissions reached")
+
+// retransmitter receives the reliable messages whose reply timed out from the
+// TimerQueue, and queues them again for sending while the retry budget allows.
+type retransmitter struct {
+	s *Session
+}
+
+func (r *retransmitter) Push(i Item) error {
+	msg, ok := i.(*Message)
+	if !ok {
+		return fmt.Errorf("impossible failure, retransmitted item is not a message: %T", i)
+	}
+	r.s.forgetRetransmit(msg)
+	// The reply may have been received in the meantime.
+	if _, ok := r.s.reliableMap.Load(*msg.ID); !ok {
+		return nil
+	}
+	if msg.Retransmissions >= *r.s.cfg.Debug.MaxRetransmissions {
+		r.s.reliableMap.Delete(*msg.ID)
+		r.s.forgetReplies(msg.ID)
+		r.s.log.Debugf("Giving up on reliable message %x after %d retransmissions", *msg.ID, msg.Retransmissions)
+		r.s.eventCh.In() <- &MessageReplyEvent{
+			MessageID: msg.ID,
+			Err:       ErrMaxRetransmissions,
+		}
+		return nil
+	}
+	msg.Retransmissions++
+	r.s.log.Debugf("Retransmitting reliable message %x (%d)", *msg.ID, msg.Retransmissions)
+	if err := r.s.egressQueue.Push(msg); err != nil {
+		// Try again once the egress queue has room.
+		msg.QueuePriority = uint64(time.Now().Add(cConstants.RoundTripTimeSlop).UnixNano())
+		r.s.persistRetransmit(msg)
+		r.s.timerQ.Push(msg)
+	}
+	return nil
+}
 
 func (s *Session) sendNext() {
 	msg, err := s.egressQueue.Peek()
@@ -52,6 +94,12 @@ func (s *Session) sendNext() {
 }
 
 func (s *Session) doSend(msg *Message) {
+	// Reliable messages whose reply was received are not sent again.
+	if msg.Reliable {
+		if _, ok := s.reliableMap.Load(*msg.ID); !ok {
+			return
+		}
+	}
 	surbID := [sConstants.SURBIDLength]byte{}
 	_, err := io.ReadFull(rand.Reader, surbID[:])
 	if err != nil {
@@ -79,21 +127,35 @@ func (s *Session) doSend(msg *Message) {
 			s.log.Debugf("doSend setting ReplyETA to %v", eta)
 			msg.ReplyETA = eta
 			msg.Key = key
-			s.surbIDMap.Store(surbID, msg)
 		}
-		// write to waiting channel or close channel if message failed to send
+		if msg.Reliable {
+			retransmitAt := time.Now().Add(cConstants.RoundTripTimeSlop)
+			if err == nil {
+				retransmitAt = msg.SentAt.Add(msg.ReplyETA).Add(cConstants.RoundTripTimeSlop)
+			}
+			msg.QueuePriority = uint64(retransmitAt.UnixNano())
+		}
+		if err == nil {
+			s.expectReply(&surbID, msg)
+		}
+		// retransmit with a fresh SURB unless the reply arrives in time
+		if msg.Reliable {
+			s.persistRetransmit(msg)
+			s.timerQ.Push(msg)
+			// only the first transmission is reported, the reply event
+			// reports the final status
+			if msg.Retransmissions > 0 || err != nil {
+				return
+			}
+		}
+		// notify the request waiting for the reply
 		if msg.IsBlocking {
-			sentWaitChanRaw, ok := s.sentWaitChanMap.Load(*msg.ID)
+			rawRequest, ok := s.requestMap.Load(*msg.ID)
 			if !ok {
-				s.fatalErrCh <- fmt.Errorf("impossible failure, sentWaitChan not found for message ID %x", *msg.ID)
+				s.log.Debugf("Request %x completed before it was sent", *msg.ID)
 				return
 			}
-			sentWaitChan := sentWaitChanRaw.(chan *Message)
-			if err == nil {
-				sentWaitChan <- msg
-			} else {
-				close(sentWaitChan)
-			}
+			rawRequest.(*Request).onSent(msg, err)
 			return
 		}
 	}
@@ -105,6 +167,31 @@ func (s *Session) doSend(msg *Message) {
 	}
 }
 
+// expectReply records the transmission of msg with the SURB surbID.  Each
+// transmission has its own SURB decryption keys, so that the reply to an
+// earlier transmission of a reliable message can still be decrypted once the
+// message was retransmitted.
+func (s *Session) expectReply(surbID *[sConstants.SURBIDLength]byte, msg *Message) {
+	sent := *msg
+	sent.SURBID = new([sConstants.SURBIDLength]byte)
+	copy(sent.SURBID[:], surbID[:])
+	s.surbIDMap.Store(*surbID, &sent)
+	s.persistSURB(surbID, &sent)
+}
+
+// forgetReplies forgets the SURBs of the transmissions of the message id,
+// whose replies are no longer awaited.
+func (s *Session) forgetReplies(id *[cConstants.MessageIDLength]byte) {
+	s.surbIDMap.Range(func(rawSurbID, rawMessage interface{}) bool {
+		if *rawMessage.(*Message).ID == *id {
+			surbID := rawSurbID.([sConstants.SURBIDLength]byte)
+			s.surbIDMap.Delete(surbID)
+			s.forgetSURB(&surbID)
+		}
+		return true
+	})
+}
+
 func (s *Session) sendDropDecoy() {
 	s.log.Info("sending drop decoy")
 	serviceDesc, err := s.GetService(cConstants.LoopService)
@@ -164,68 +251,131 @@ func (s *Session) composeMessage(recipient, provider string, message []byte, isB
 	payload := make([]byte, constants.UserForwardPayloadLength)
 	binary.BigEndian.PutUint32(payload[:4], uint32(len(message)))
 	copy(payload[4:], message)
+	id, err := newMessageID()
+	if err != nil {
+		return nil, err
+	}
+	return newMessage(id, recipient, provider, payload, isBlocking), nil
+}
+
+// composeMessages composes the message, split into fragments sharing the
+// message ID if it does not fit in a single Sphinx packet.
+func (s *Session) composeMessages(recipient, provider string, message []byte, isBlocking bool) ([]*Message, error) {
+	if len(message) <= constants.UserForwardPayloadLength-4 {
+		msg, err := s.composeMessage(recipient, provider, message, isBlocking)
+		if err != nil {
+			return nil, err
+		}
+		return []*Message{msg}, nil
+	}
+	s.log.Debug("SendMessage with fragmentation")
+	id, err := newMessageID()
+	if err != nil {
+		return nil, err
+	}
+	payloads, err := fragment.Split(id, message)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]*Message, len(payloads))
+	for i, payload := range payloads {
+		msgs[i] = newMessage(id, recipient, provider, payload, isBlocking)
+	}
+	return msgs, nil
+}
+
+func newMessageID() (*[cConstants.MessageIDLength]byte, error) {
 	id := [cConstants.MessageIDLength]byte{}
 	_, err := io.ReadFull(rand.Reader, id[:])
 	if err != nil {
 		return nil, err
 	}
-	var msg = Message{
-		ID:         &id,
+	return &id, nil
+}
+
+func newMessage(id *[cConstants.MessageIDLength]byte, recipient, provider string, payload []byte, isBlocking bool) *Message {
+	return &Message{
+		ID:         id,
 		Recipient:  recipient,
 		Provider:   provider,
 		Payload:    payload[:],
 		WithSURB:   true,
 		IsBlocking: isBlocking,
 	}
-	return &msg, nil
+}
+
+// pushMessages pushes the messages onto the egress queue, and returns the
+// number of messages pushed.
+func (s *Session) pushMessages(msgs []*Message) (int, error) {
+	for i, msg := range msgs {
+		if err := s.egressQueue.Push(msg); err != nil {
+			return i, err
+		}
+	}
+	return len(msgs), nil
 }
 
 // SendUnreliableMessage asynchronously sends message without any automatic retransmissions.
+// Messages which do not fit in a single Sphinx packet are fragmented, a
+// MessageSentEvent is sent for each fragment.
 func (s *Session) SendUnreliableMessage(recipient, provider string, message []byte) (*[cConstants.MessageIDLength]byte, error) {
-	msg, err := s.composeMessage(recipient, provider, message, false)
+	msgs, err := s.composeMessages(recipient, provider, message, false)
 	if err != nil {
 		return nil, err
 	}
-	err = s.egressQueue.Push(msg)
+	_, err = s.pushMessages(msgs)
 	if err != nil {
 		return nil, err
 	}
-	return msg.ID, nil
+	return msgs[0].ID, nil
 }
 
-func (s *Session) BlockingSendUnreliableMessage(recipient, provider string, message []byte) ([]byte, error) {
-	msg, err := s.composeMessage(recipient, provider, message, true)
+// SendEncryptedMessage asynchronously sends message to the spool of the
+// recipient, end to end encrypted to the link key of the recipient.
+func (s *Session) SendEncryptedMessage(recipient, provider string, recipientKey *ecdh.PublicKey, message []byte) (*[cConstants.MessageIDLength]byte, error) {
+	payload, err := block.EncryptBlock(message, s.linkKey, recipientKey)
 	if err != nil {
 		return nil, err
 	}
-	sentWaitChan := make(chan *Message)
-	s.sentWaitChanMap.Store(*msg.ID, sentWaitChan)
-	defer s.sentWaitChanMap.Delete(*msg.ID)
-
-	replyWaitChan := make(chan []byte)
-	s.replyWaitChanMap.Store(*msg.ID, replyWaitChan)
-	defer s.replyWaitChanMap.Delete(*msg.ID)
-
+	id, err := newMessageID()
+	if err != nil {
+		return nil, err
+	}
+	msg := newMessage(id, recipient, provider, payload, false)
 	err = s.egressQueue.Push(msg)
 	if err != nil {
 		return nil, err
 	}
+	return msg.ID, nil
+}
 
-	// wait until sent so that we know the ReplyETA for the waiting below
-	sentMessage := <-sentWaitChan
-
-	// if the message failed to send we will receive a nil message
-	if sentMessage == nil {
-		return nil, ErrMessageNotSent
+// SendReliableMessage asynchronously sends message, and retransmits it with a
+// fresh SURB until its reply is received or the retry budget is exhausted.
+// The final status is reported by a MessageReplyEvent.
+func (s *Session) SendReliableMessage(recipient, provider string, message []byte) (*[cConstants.MessageIDLength]byte, error) {
+	msgs, err := s.composeMessages(recipient, provider, message, false)
+	if err != nil {
+		return nil, err
 	}
+	for _, msg := range msgs {
+		msg.Reliable = true
+	}
+	id := msgs[0].ID
+	s.reliableMap.Store(*id, msgs[0])
+	_, err = s.pushMessages(msgs)
+	if err != nil {
+		s.reliableMap.Delete(*id)
+		return nil, err
+	}
+	return id, nil
+}
 
-	// wait for reply or round trip timeout
-	select {
-	case reply := <-replyWaitChan:
-		return reply, nil
-	// these timeouts are often far too aggressive
-	case <-time.After(sentMessage.ReplyETA + cConstants.RoundTripTimeSlop):
-		return nil, ErrReplyTimeout
+// BlockingSendUnreliableMessage sends message without any automatic
+// retransmissions, and waits for its reply with the DefaultTimeoutPolicy.
+func (s *Session) BlockingSendUnreliableMessage(recipient, provider string, message []byte) ([]byte, error) {
+	r, err := s.SendRequest(context.Background(), recipient, provider, message)
+	if err != nil {
+		return nil, err
 	}
-	// unreachable
+	return r.Reply()
 }
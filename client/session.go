@@ -26,6 +26,7 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/hashcloak/Meson/client/block"
 	"github.com/hashcloak/Meson/client/config"
 	"github.com/hashcloak/Meson/client/minclient"
 	kpki "github.com/hashcloak/Meson/client/pkiclient"
@@ -38,10 +39,19 @@ import (
 	"github.com/katzenpost/core/sphinx"
 	sConstants "github.com/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/core/worker"
+	registration "github.com/katzenpost/registration_client"
 	"gopkg.in/eapache/channels.v1"
 	"gopkg.in/op/go-logging.v1"
 )
 
+// ErrSessionHalted is the error returned when the session is halted.
+var ErrSessionHalted = errors.New("session is halted")
+
+// inboxLength is the number of received messages kept for ReceiveMessage,
+// past which the oldest ones are dropped.  The dropped messages are still
+// reported by their MessageReceivedEvent.
+const inboxLength = 128
+
 // Session is the struct type that keeps state for a given session.
 type Session struct {
 	worker.Worker
@@ -57,15 +67,23 @@ type Session struct {
 	eventCh   channels.Channel
 	EventSink chan Event
 
+	inboxCh channels.Channel
+	// inboxHead holds a message taken by a cancelled stream, which is
+	// received before the ones of inboxCh.
+	inboxHead chan *MessageReceivedEvent
+
 	linkKey   *ecdh.PrivateKey
+	provider  atomic.Value // string
 	onlineAt  time.Time
 	hasPKIDoc bool
 
 	egressQueue EgressQueue
+	timerQ      *TimerQueue
+	store       *store
 
-	surbIDMap        sync.Map // [sConstants.SURBIDLength]byte -> *Message
-	sentWaitChanMap  sync.Map // MessageID -> chan *Message
-	replyWaitChanMap sync.Map // MessageID -> chan []byte
+	surbIDMap   sync.Map // [sConstants.SURBIDLength]byte -> *Message
+	requestMap  sync.Map // MessageID -> *Request
+	reliableMap sync.Map // MessageID -> *Message
 
 	decoyLoopTally uint64
 }
@@ -104,9 +122,35 @@ func NewSession(
 		fatalErrCh:  fatalErrCh,
 		eventCh:     channels.NewInfiniteChannel(),
 		EventSink:   make(chan Event),
+		inboxCh:     channels.NewRingChannel(inboxLength),
+		inboxHead:   make(chan *MessageReceivedEvent, 1),
 		opCh:        make(chan workerOp, 8),
 		egressQueue: new(Queue),
 	}
+	s.timerQ = NewTimerQueue(&retransmitter{s: s})
+	s.provider.Store(cfg.Account.Provider)
+
+	// Resume from the persisted session state if any.
+	if cfg.Persistence != nil {
+		passphrase, err := cfg.Persistence.GetPassphrase()
+		if err != nil {
+			return nil, err
+		}
+		s.store, err = openStore(cfg.Persistence.File, passphrase)
+		if err != nil {
+			return nil, err
+		}
+		queue, err := newPersistentQueue(s.store)
+		if err != nil {
+			s.store.Close()
+			return nil, err
+		}
+		s.egressQueue = queue
+		if err = s.restore(queue); err != nil {
+			s.store.Close()
+			return nil, err
+		}
+	}
 
 	// Configure and bring up the minclient instance.
 	clientCfg := &minclient.ClientConfig{
@@ -120,11 +164,18 @@ func NewSession(
 		OnMessageFn:         s.onMessage,
 		OnACKFn:             s.onACK,
 		OnDocumentFn:        s.onDocument,
+		MaxConnectAttempts:  cfg.Debug.MaxConnectAttempts,
+		FailbackInterval:    time.Duration(cfg.Debug.FailbackInterval) * time.Second,
+		PathSelector:        cfg.PathSelector(),
 		DialContextFn:       proxyCfg.ToDialContext("authority"),
 		PreferedTransports:  cfg.Debug.PreferedTransports,
 		MessagePollInterval: time.Duration(cfg.Debug.PollingInterval) * time.Millisecond,
 		EnableTimeSync:      false, // Be explicit about it.
 	}
+	if cfg.Debug.EnableProviderFailover {
+		clientCfg.RegisterFn = s.onFailover
+		clientCfg.FailoverKeyPins = cfg.Debug.FailoverProviderKeyPins
+	}
 
 	s.Go(s.eventSinkWorker)
 	s.Go(s.garbageCollectionWorker)
@@ -185,6 +236,7 @@ func (s *Session) garbageCollect() {
 		if time.Now().After(message.SentAt.Add(message.ReplyETA).Add(cConstants.RoundTripTimeSlop)) {
 			s.log.Debug("Garbage collecting SURB ID Map entry for Message ID %x", message.ID)
 			s.surbIDMap.Delete(surbID)
+			s.forgetSURB(&surbID)
 			s.eventCh.In() <- &MessageIDGarbageCollected{
 				MessageID: message.ID,
 			}
@@ -241,22 +293,124 @@ func (s *Session) GetService(serviceName string) (*utils.ServiceDescriptor, erro
 // upon connection change status to the Provider
 func (s *Session) onConnection(err error) {
 	s.log.Debugf("onConnection %v", err)
+	if failoverErr, ok := err.(*minclient.FailoverError); ok {
+		s.provider.Store(failoverErr.NextProvider)
+	}
 	s.eventCh.In() <- &ConnectionStatusEvent{
 		IsConnected: err == nil,
 		Err:         err,
+		Provider:    s.Provider(),
 	}
 	s.opCh <- opConnStatusChanged{
 		isConnected: err == nil,
 	}
 }
 
+// Provider returns the Provider the account connects to, which differs from
+// the configured Provider after a failover.
+func (s *Session) Provider() string {
+	return s.provider.Load().(string)
+}
+
+// onFailover will be called by the minclient api to register
+// the account with the Provider it fails over to
+func (s *Session) onFailover(desc *cpki.MixDescriptor) error {
+	if len(desc.RegistrationHTTPAddresses) == 0 {
+		return fmt.Errorf("Provider %v does not accept registrations", desc.Name)
+	}
+	cfgRegistration, err := newRegistration(s.cfg, desc.RegistrationHTTPAddresses[0])
+	if err != nil {
+		return err
+	}
+	client, err := registration.New(cfgRegistration.Address, cfgRegistration.Options)
+	if err != nil {
+		return err
+	}
+	return client.RegisterAccountWithLinkKey(s.cfg.Account.User, s.linkKey.PublicKey())
+}
+
 // OnMessage will be called by the minclient api
 // upon receiving a message
 func (s *Session) onMessage(ciphertextBlock []byte) error {
 	s.log.Debugf("OnMessage")
+	payload, sender, err := block.DecryptBlock(ciphertextBlock, s.linkKey)
+	if err != nil {
+		s.log.Infof("Discarding message, decryption failure: %s", err)
+		return nil
+	}
+	event := &MessageReceivedEvent{
+		Sender:     sender,
+		Payload:    payload,
+		ReceivedAt: time.Now(),
+	}
+	s.eventCh.In() <- event
+	s.inboxCh.In() <- event
 	return nil
 }
 
+// ReceiveMessage blocks until a message delivered to the spool of the
+// account is received, the context is done or the session is halted.  Only
+// the last inboxLength messages received are kept until ReceiveMessage is
+// called.
+func (s *Session) ReceiveMessage(ctx context.Context) (*MessageReceivedEvent, error) {
+	select {
+	case <-s.HaltCh():
+		return nil, ErrSessionHalted
+	case e := <-s.inboxHead:
+		return e, nil
+	default:
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.HaltCh():
+		return nil, ErrSessionHalted
+	case e := <-s.inboxHead:
+		return e, nil
+	case e := <-s.inboxCh.Out():
+		return e.(*MessageReceivedEvent), nil
+	}
+}
+
+// ReceiveMessages returns a channel streaming the messages delivered to the
+// spool of the account, which is closed once the context is done or the
+// session is halted. Each message is received once among all the callers
+// of ReceiveMessage and ReceiveMessages, a message taken by the stream when
+// its context is done is the next one received by the other callers.
+func (s *Session) ReceiveMessages(ctx context.Context) <-chan *MessageReceivedEvent {
+	ch := make(chan *MessageReceivedEvent)
+	go func() {
+		var pending *MessageReceivedEvent
+		defer func() {
+			close(ch)
+			if pending == nil {
+				return
+			}
+			// Hand the message over to the other callers ahead of the
+			// inbox, where it could be evicted by the newer messages.
+			select {
+			case s.inboxHead <- pending:
+			case <-s.HaltCh():
+			}
+		}()
+		for {
+			msg, err := s.ReceiveMessage(ctx)
+			if err != nil {
+				return
+			}
+			select {
+			case ch <- msg:
+			case <-ctx.Done():
+				pending = msg
+				return
+			case <-s.HaltCh():
+				return
+			}
+		}
+	}()
+	return ch
+}
+
 func (s *Session) incrementDecoyLoopTally() {
 	atomic.AddUint64(&s.decoyLoopTally, 1)
 }
@@ -276,12 +430,27 @@ func (s *Session) onACK(surbID *[sConstants.SURBIDLength]byte, ciphertext []byte
 		return nil
 	}
 	s.surbIDMap.Delete(*surbID)
+	s.forgetSURB(surbID)
 	msg := rawMessage.(*Message)
 	plaintext, err := sphinx.DecryptSURBPayload(ciphertext, msg.Key)
 	if err != nil {
 		s.log.Infof("Discarding SURB Reply, decryption failure: %s", err)
 		return nil
 	}
+	if msg.Reliable {
+		// A reply to an earlier transmission may arrive late.
+		rawReliable, ok := s.reliableMap.LoadAndDelete(*msg.ID)
+		if !ok {
+			s.log.Debugf("Discarding SURB %v for reliable message %x: reply already received", idStr, msg.ID)
+			return nil
+		}
+		reliable := rawReliable.(*Message)
+		if err := s.timerQ.Remove(reliable); err != nil {
+			s.log.Debugf("Reliable message %x not pending retransmission: %v", msg.ID, err)
+		}
+		s.forgetRetransmit(reliable)
+		s.forgetReplies(msg.ID)
+	}
 	if len(plaintext) != coreConstants.ForwardPayloadLength {
 		s.log.Warningf("Discarding SURB %v: Invalid payload size: %v", idStr, len(plaintext))
 		return nil
@@ -292,15 +461,13 @@ func (s *Session) onACK(surbID *[sConstants.SURBIDLength]byte, ciphertext []byte
 	}
 
 	if msg.IsBlocking {
-		replyWaitChanRaw, ok := s.replyWaitChanMap.Load(*msg.ID)
+		rawRequest, ok := s.requestMap.Load(*msg.ID)
 		if !ok {
-			//XXX: this can happen if a SURB-ACK arrives after a call to BlockingSendUnreliableMessage has timed-out
-			// because the session.surbIDMap has not been deleted or garbage collected
-			s.log.Warningf("Discarding surb %v for blocking message %x : caller likely timed-out", idStr, msg.ID)
+			// the request timed-out or was cancelled
+			s.log.Warningf("Discarding surb %v for request %x: request already completed", idStr, msg.ID)
 			return nil
 		}
-		replyWaitChan := replyWaitChanRaw.(chan []byte)
-		replyWaitChan <- plaintext[2:]
+		rawRequest.(*Request).complete(plaintext[2:], nil)
 	} else {
 		s.eventCh.In() <- &MessageReplyEvent{
 			MessageID: msg.ID,
@@ -336,6 +503,10 @@ func (s *Session) GetPandaConfig() *config.Panda {
 
 func (s *Session) Shutdown() {
 	s.Halt()
+	s.timerQ.Halt()
 	s.minclient.Shutdown()
 	s.minclient.Wait()
+	if s.store != nil {
+		s.store.Close()
+	}
 }
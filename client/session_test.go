@@ -0,0 +1,377 @@
+// session_test.go - mixnet client session tests
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson/client/block"
+	"github.com/hashcloak/Meson/client/config"
+	"github.com/hashcloak/Meson/client/minclient"
+	"github.com/hashcloak/Meson/fragment"
+	coreConstants "github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/sphinx"
+	"github.com/katzenpost/core/sphinx/commands"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/eapache/channels.v1"
+)
+
+func newTestSession(require *require.Assertions) *Session {
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+	maxRetransmissions := 2
+	s := &Session{
+		cfg:         &config.Config{Debug: &config.Debug{MaxRetransmissions: &maxRetransmissions}},
+		linkKey:     linkKey,
+		log:         logBackend.GetLogger("session_test"),
+		eventCh:     channels.NewInfiniteChannel(),
+		inboxCh:     channels.NewRingChannel(inboxLength),
+		inboxHead:   make(chan *MessageReceivedEvent, 1),
+		opCh:        make(chan workerOp, 8),
+		egressQueue: new(Queue),
+	}
+	s.timerQ = NewTimerQueue(&retransmitter{s: s})
+	s.provider.Store("provider")
+	return s
+}
+
+func TestConnectionFailover(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	s := newTestSession(require)
+	defer s.timerQ.Halt()
+
+	// the failover is reported with the Provider the account switched to
+	s.onConnection(&minclient.FailoverError{Provider: "provider", NextProvider: "provider2"})
+	s.onConnection(nil)
+	assert.Equal("provider2", s.Provider())
+	e := (<-s.eventCh.Out()).(*ConnectionStatusEvent)
+	assert.False(e.IsConnected)
+	assert.IsType(&minclient.FailoverError{}, e.Err)
+	assert.Equal("provider2", e.Provider)
+	e = (<-s.eventCh.Out()).(*ConnectionStatusEvent)
+	assert.True(e.IsConnected)
+	assert.Equal("provider2", e.Provider)
+}
+
+func TestReceiveMessages(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	s := newTestSession(require)
+	sender, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+
+	// messages which fail to decrypt are discarded
+	require.NoError(s.onMessage(make([]byte, block.BlockLength)))
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	_, err = s.ReceiveMessage(ctx)
+	cancel()
+	assert.Equal(context.DeadlineExceeded, err)
+
+	// messages are decrypted and raise an event
+	for _, message := range []string{"first", "second"} {
+		b, err := block.EncryptBlock([]byte(message), sender, s.linkKey.PublicKey())
+		require.NoError(err)
+		require.NoError(s.onMessage(b))
+	}
+	e := (<-s.eventCh.Out()).(*MessageReceivedEvent)
+	assert.Equal([]byte("first"), e.Payload)
+	assert.True(sender.PublicKey().Equal(e.Sender))
+
+	msg, err := s.ReceiveMessage(context.Background())
+	require.NoError(err)
+	assert.Equal([]byte("first"), msg.Payload)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	msgs := s.ReceiveMessages(ctx)
+	msg = <-msgs
+	assert.Equal([]byte("second"), msg.Payload)
+	assert.True(sender.PublicKey().Equal(msg.Sender))
+	cancel()
+	_, ok := <-msgs
+	assert.False(ok)
+
+	// a message taken by a cancelled stream is received next
+	ctx, cancel = context.WithCancel(context.Background())
+	msgs = s.ReceiveMessages(ctx)
+	for _, message := range []string{"third", "fourth"} {
+		b, err := block.EncryptBlock([]byte(message), sender, s.linkKey.PublicKey())
+		require.NoError(err)
+		require.NoError(s.onMessage(b))
+	}
+	require.Eventually(func() bool { return s.inboxCh.Len() == 1 }, time.Second, time.Millisecond)
+	cancel()
+	_, ok = <-msgs
+	assert.False(ok)
+	for _, message := range []string{"third", "fourth"} {
+		msg, err = s.ReceiveMessage(context.Background())
+		require.NoError(err)
+		assert.Equal([]byte(message), msg.Payload)
+	}
+
+	// only the last messages are kept for the receivers
+	for i := 0; i < inboxLength+1; i++ {
+		b, err := block.EncryptBlock([]byte{byte(i)}, sender, s.linkKey.PublicKey())
+		require.NoError(err)
+		require.NoError(s.onMessage(b))
+	}
+	assert.Equal(inboxLength, s.inboxCh.Len())
+	msg, err = s.ReceiveMessage(context.Background())
+	require.NoError(err)
+	assert.Equal([]byte{1}, msg.Payload)
+
+	// the stream closes once the session is halted
+	msgs = s.ReceiveMessages(context.Background())
+	s.Halt()
+	for range msgs {
+	}
+	_, err = s.ReceiveMessage(context.Background())
+	assert.Equal(ErrSessionHalted, err)
+}
+
+func TestReliableMessageRetransmissions(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	s := newTestSession(require)
+	defer s.timerQ.Halt()
+
+	id, err := s.SendReliableMessage("alice", "provider", []byte("tx"))
+	require.NoError(err)
+	item, err := s.egressQueue.Pop()
+	require.NoError(err)
+	msg := item.(*Message)
+	assert.Equal(id, msg.ID)
+	assert.True(msg.Reliable)
+
+	// the message is queued again each time its reply times out
+	for i := 1; i <= *s.cfg.Debug.MaxRetransmissions; i++ {
+		msg.QueuePriority = uint64(time.Now().UnixNano())
+		s.timerQ.Push(msg)
+		require.Eventually(func() bool {
+			_, err := s.egressQueue.Peek()
+			return err == nil
+		}, time.Second, 10*time.Millisecond)
+		_, err = s.egressQueue.Pop()
+		require.NoError(err)
+		assert.Equal(i, msg.Retransmissions)
+	}
+
+	// the failure is reported once the retry budget is exhausted
+	msg.QueuePriority = uint64(time.Now().UnixNano())
+	s.timerQ.Push(msg)
+	e := (<-s.eventCh.Out()).(*MessageReplyEvent)
+	assert.Equal(id, e.MessageID)
+	assert.Equal(ErrMaxRetransmissions, e.Err)
+	_, ok := s.reliableMap.Load(*id)
+	assert.False(ok)
+
+	// messages whose reply was received are not retransmitted
+	id, err = s.SendReliableMessage("alice", "provider", []byte("tx"))
+	require.NoError(err)
+	item, err = s.egressQueue.Pop()
+	require.NoError(err)
+	msg = item.(*Message)
+	s.reliableMap.Delete(*id)
+	msg.QueuePriority = uint64(time.Now().UnixNano())
+	s.timerQ.Push(msg)
+	time.Sleep(100 * time.Millisecond)
+	_, err = s.egressQueue.Peek()
+	assert.Equal(ErrQueueEmpty, err)
+	assert.Equal(0, msg.Retransmissions)
+	assert.Equal(0, s.eventCh.Len())
+
+	// no retransmission is made if they are disabled
+	*s.cfg.Debug.MaxRetransmissions = 0
+	id, err = s.SendReliableMessage("alice", "provider", []byte("tx"))
+	require.NoError(err)
+	item, err = s.egressQueue.Pop()
+	require.NoError(err)
+	msg = item.(*Message)
+	msg.QueuePriority = uint64(time.Now().UnixNano())
+	s.timerQ.Push(msg)
+	e = (<-s.eventCh.Out()).(*MessageReplyEvent)
+	assert.Equal(id, e.MessageID)
+	assert.Equal(ErrMaxRetransmissions, e.Err)
+	assert.Equal(0, msg.Retransmissions)
+}
+
+// newSURBReply returns the decryption keys of a SURB, and the payload of its
+// reply carrying payload.
+func newSURBReply(require *require.Assertions, payload []byte) ([]byte, []byte) {
+	nodeKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+	path := []*sphinx.PathHop{{
+		PublicKey: nodeKey.PublicKey(),
+		Commands:  []commands.RoutingCommand{&commands.Recipient{}, &commands.SURBReply{}},
+	}}
+	surb, keys, err := sphinx.NewSURB(rand.Reader, path)
+	require.NoError(err)
+	pkt, _, err := sphinx.NewPacketFromSURB(surb, payload)
+	require.NoError(err)
+	reply, _, _, err := sphinx.Unwrap(nodeKey, pkt)
+	require.NoError(err)
+	return keys, reply
+}
+
+func TestReliableMessageLateReply(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	s := newTestSession(require)
+	defer s.timerQ.Halt()
+
+	id, err := s.SendReliableMessage("alice", "provider", []byte("tx"))
+	require.NoError(err)
+	item, err := s.egressQueue.Pop()
+	require.NoError(err)
+	msg := item.(*Message)
+	msg.QueuePriority = uint64(time.Now().Add(time.Hour).UnixNano())
+	s.timerQ.Push(msg)
+
+	// the message is retransmitted with a fresh SURB before the reply to
+	// the first transmission arrives
+	payload := make([]byte, coreConstants.ForwardPayloadLength)
+	copy(payload[2:], "rx")
+	surbIDs := [][sConstants.SURBIDLength]byte{{1}, {2}}
+	replies := make([][]byte, len(surbIDs))
+	for i := range surbIDs {
+		msg.Key, replies[i] = newSURBReply(require, payload)
+		msg.Retransmissions = i
+		s.expectReply(&surbIDs[i], msg)
+	}
+
+	// the reply to the first transmission is decrypted with its own keys
+	require.NoError(s.onACK(&surbIDs[0], replies[0]))
+	e := (<-s.eventCh.Out()).(*MessageReplyEvent)
+	assert.Equal(id, e.MessageID)
+	assert.NoError(e.Err)
+	assert.Equal(payload[2:], e.Payload)
+	_, ok := s.reliableMap.Load(*id)
+	assert.False(ok)
+
+	// the SURB of the second transmission is forgotten
+	_, ok = s.surbIDMap.Load(surbIDs[1])
+	assert.False(ok)
+	require.NoError(s.onACK(&surbIDs[1], replies[1]))
+	assert.Equal(0, s.eventCh.Len())
+}
+
+func TestSendFragmentedMessage(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	s := newTestSession(require)
+	defer s.timerQ.Halt()
+
+	// messages fitting in a packet are not fragmented
+	_, err := s.SendUnreliableMessage("alice", "provider", []byte("tx"))
+	require.NoError(err)
+	item, err := s.egressQueue.Pop()
+	require.NoError(err)
+	assert.False(fragment.IsFragment(item.(*Message).Payload))
+
+	// larger messages are split into fragments sharing the message ID
+	id, err := s.SendUnreliableMessage("alice", "provider", make([]byte, 2*fragment.MaxDataLength))
+	require.NoError(err)
+	for i := 0; i < 3; i++ {
+		item, err := s.egressQueue.Pop()
+		require.NoError(err)
+		msg := item.(*Message)
+		assert.Equal(id, msg.ID)
+		f, err := fragment.Parse(msg.Payload)
+		require.NoError(err)
+		assert.Equal(uint16(i), f.Index)
+		assert.Equal(uint16(3), f.Count)
+	}
+	_, err = s.egressQueue.Pop()
+	assert.Equal(ErrQueueEmpty, err)
+
+	_, err = s.SendUnreliableMessage("alice", "provider", make([]byte, fragment.MaxMessageLength+1))
+	assert.Error(err)
+}
+
+func TestSendRequest(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+	s := newTestSession(require)
+	defer s.timerQ.Halt()
+
+	send := func(ctx context.Context, opts ...RequestOption) (*Request, *Message) {
+		r, err := s.SendRequest(ctx, "alice", "provider", []byte("tx"), opts...)
+		require.NoError(err)
+		item, err := s.egressQueue.Pop()
+		require.NoError(err)
+		msg := item.(*Message)
+		assert.Equal(r.ID, msg.ID)
+		return r, msg
+	}
+
+	// requests are completed by their reply
+	r, msg := send(context.Background())
+	r.onSent(msg, nil)
+	rawRequest, ok := s.requestMap.Load(*msg.ID)
+	require.True(ok)
+	rawRequest.(*Request).complete([]byte("reply"), nil)
+	reply, err := r.Reply()
+	require.NoError(err)
+	assert.Equal([]byte("reply"), reply)
+	_, ok = s.requestMap.Load(*msg.ID)
+	assert.False(ok)
+
+	// the reply timeout starts once the request is sent
+	r, msg = send(context.Background(), WithTimeoutPolicy(FixedTimeoutPolicy(50*time.Millisecond)))
+	time.Sleep(100 * time.Millisecond)
+	select {
+	case <-r.Done():
+		t.Fatal("request timed out before it was sent")
+	default:
+	}
+	r.onSent(msg, nil)
+	_, err = r.Reply()
+	assert.Equal(ErrReplyTimeout, err)
+
+	// requests fail when they cannot be sent
+	r, msg = send(context.Background())
+	r.onSent(msg, ErrMessageNotSent)
+	_, err = r.Reply()
+	assert.Equal(ErrMessageNotSent, err)
+
+	// requests are abandoned when their context is done
+	ctx, cancel := context.WithCancel(context.Background())
+	r, msg = send(ctx, WithTimeoutPolicy(FixedTimeoutPolicy(0)))
+	r.onSent(msg, nil)
+	cancel()
+	_, err = r.Reply()
+	assert.Equal(context.Canceled, err)
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	r, _ = send(ctx)
+	_, err = r.Reply()
+	assert.Equal(context.DeadlineExceeded, err)
+	r, _ = send(context.Background())
+	r.Cancel()
+	_, err = r.Reply()
+	assert.Equal(context.Canceled, err)
+
+	// late replies are discarded
+	r.complete([]byte("reply"), nil)
+	_, err = r.Reply()
+	assert.Equal(context.Canceled, err)
+	_, err = s.SendRequest(ctx, "alice", "provider", []byte("tx"))
+	assert.Equal(context.DeadlineExceeded, err)
+}
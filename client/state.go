@@ -0,0 +1,196 @@
+// state.go - persistent client identity and account
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+
+	"github.com/BurntSushi/toml"
+	"github.com/hashcloak/Meson/client/config"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+)
+
+const (
+	stateLinkKeyFile    = "link.private.pem"
+	stateNewLinkKeyFile = "link.private.pem.new"
+	stateAccountFile    = "account.toml"
+)
+
+// accountState is the Provider account saved in the state directory.
+type accountState struct {
+	// User is the account user name.
+	User string
+
+	// Provider is the Provider of the account.
+	Provider string
+
+	// ProviderKeyPin is the Provider signing key.
+	ProviderKeyPin *eddsa.PublicKey
+
+	// RegistrationAddress is the registration URL of the Provider.
+	RegistrationAddress string
+}
+
+func loadAccountState(dir string) (*accountState, error) {
+	account := new(accountState)
+	if _, err := toml.DecodeFile(filepath.Join(dir, stateAccountFile), account); err != nil {
+		return nil, err
+	}
+	if account.User == "" || account.Provider == "" || account.RegistrationAddress == "" {
+		return nil, errors.New("state: account is incomplete")
+	}
+	return account, nil
+}
+
+func (a *accountState) save(dir string) error {
+	f, err := os.OpenFile(filepath.Join(dir, stateAccountFile), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err = toml.NewEncoder(f).Encode(a); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// apply sets the Account and Registration sections of cfg to the account.
+func (a *accountState) apply(cfg *config.Config) error {
+	cfgRegistration, err := newRegistration(cfg, a.RegistrationAddress)
+	if err != nil {
+		return err
+	}
+	cfg.Account = &config.Account{
+		User:           a.User,
+		Provider:       a.Provider,
+		ProviderKeyPin: a.ProviderKeyPin,
+	}
+	cfg.Registration = cfgRegistration
+	return nil
+}
+
+func newAccountState(cfg *config.Config) *accountState {
+	u := &url.URL{
+		Scheme: cfg.Registration.Options.Scheme,
+		Host:   cfg.Registration.Address,
+	}
+	return &accountState{
+		User:                cfg.Account.User,
+		Provider:            cfg.Account.Provider,
+		ProviderKeyPin:      cfg.Account.ProviderKeyPin,
+		RegistrationAddress: u.String(),
+	}
+}
+
+// LoadOrRegisterClient returns the link key saved in the state directory and
+// sets the Account and Registration sections of cfg to the saved account.
+// The link key and the account are only registered when missing.  Without a
+// State section, a random account is registered on every call.
+func LoadOrRegisterClient(cfg *config.Config) (*ecdh.PrivateKey, error) {
+	if cfg.State == nil {
+		return AutoRegisterRandomClient(cfg)
+	}
+	dir := cfg.State.Directory
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	linkKey, err := ecdh.Load(filepath.Join(dir, stateLinkKeyFile), "", rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	account, err := loadAccountState(dir)
+	if err == nil {
+		return linkKey, account.apply(cfg)
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err = registerRandomAccount(cfg, linkKey); err != nil {
+		return nil, err
+	}
+	return linkKey, newAccountState(cfg).save(dir)
+}
+
+// RekeyClient replaces the link key saved in the state directory, and
+// registered with the Provider of the saved account, by a new link key, and
+// returns the new link key.
+func RekeyClient(cfg *config.Config) (*ecdh.PrivateKey, error) {
+	if cfg.State == nil {
+		return nil, errors.New("state: State section is missing")
+	}
+	dir := cfg.State.Directory
+	linkKey, err := ecdh.Load(filepath.Join(dir, stateLinkKeyFile), "", nil)
+	if err != nil {
+		return nil, err
+	}
+	account, err := loadAccountState(dir)
+	if err != nil {
+		return nil, err
+	}
+	if err = account.apply(cfg); err != nil {
+		return nil, err
+	}
+
+	doc, err := currentDocument(cfg)
+	if err != nil {
+		return nil, err
+	}
+	provider, err := doc.GetProvider(account.Provider)
+	if err != nil {
+		return nil, err
+	}
+	if account.ProviderKeyPin != nil && !account.ProviderKeyPin.Equal(provider.IdentityKey) {
+		return nil, fmt.Errorf("state: Provider %v identity key mismatch", account.Provider)
+	}
+
+	return rekeyLinkKey(cfg, dir, linkKey, provider.LinkKey)
+}
+
+// rekeyLinkKey registers a new link key in place of the link key saved in
+// dir, and replaces the saved link key by the new one.
+func rekeyLinkKey(cfg *config.Config, dir string, linkKey *ecdh.PrivateKey, providerLinkKey *ecdh.PublicKey) (*ecdh.PrivateKey, error) {
+	// The new link key is saved before the update, so that an interrupted
+	// update is retried with the same key.
+	linkKeyFile := filepath.Join(dir, stateLinkKeyFile)
+	newLinkKeyFile := filepath.Join(dir, stateNewLinkKeyFile)
+	_, err := os.Stat(newLinkKeyFile)
+	retried := err == nil
+	newLinkKey, err := ecdh.Load(newLinkKeyFile, "", rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	// The update may have been interrupted after the Provider registered
+	// the new link key, in which case only the new link key proves the
+	// ownership of the account.
+	if !retried || UpdateClientLinkKey(cfg, newLinkKey, newLinkKey.PublicKey(), providerLinkKey) != nil {
+		if err = UpdateClientLinkKey(cfg, linkKey, newLinkKey.PublicKey(), providerLinkKey); err != nil {
+			return nil, err
+		}
+	}
+	if err = os.Rename(newLinkKeyFile, linkKeyFile); err != nil {
+		return nil, err
+	}
+	return newLinkKey, nil
+}
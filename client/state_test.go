@@ -0,0 +1,187 @@
+// state_test.go - persistent client identity and account tests
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/hashcloak/Meson/client/config"
+	mRegistration "github.com/hashcloak/Meson/server/registration"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAccountState(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	dir, err := ioutil.TempDir("", "meson_client_state")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	_, err = loadAccountState(dir)
+	assert.True(os.IsNotExist(err))
+
+	identityKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err)
+	account := &accountState{
+		User:                "alice",
+		Provider:            "provider",
+		ProviderKeyPin:      identityKey.PublicKey(),
+		RegistrationAddress: "http://127.0.0.1:36968",
+	}
+	require.NoError(account.save(dir))
+	loaded, err := loadAccountState(dir)
+	require.NoError(err)
+	assert.Equal(account.User, loaded.User)
+	assert.True(account.ProviderKeyPin.Equal(loaded.ProviderKeyPin))
+
+	// the saved account configures the registration with the Provider
+	cfg := &config.Config{UpstreamProxy: &config.UpstreamProxy{Type: "none"}}
+	require.NoError(loaded.apply(cfg))
+	assert.Equal("alice", cfg.Account.User)
+	assert.Equal("provider", cfg.Account.Provider)
+	assert.Equal("127.0.0.1:36968", cfg.Registration.Address)
+	assert.Equal("http", cfg.Registration.Options.Scheme)
+	assert.Equal(account.RegistrationAddress, newAccountState(cfg).RegistrationAddress)
+}
+
+func TestUpdateClientLinkKey(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	providerLinkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+	linkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+	newLinkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+
+	// the Provider verifies the proof with the registered link key
+	var updated *ecdh.PublicKey
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(mRegistration.URLBase, r.URL.Path)
+		assert.Equal(mRegistration.UpdateLinkCommand, r.FormValue(mRegistration.CommandField))
+		key := new(ecdh.PublicKey)
+		assert.NoError(key.FromString(r.FormValue(mRegistration.NewLinkKeyField)))
+		proof, err := hex.DecodeString(r.FormValue(mRegistration.ProofField))
+		assert.NoError(err)
+		var sharedSecret [ecdh.GroupElementLength]byte
+		providerLinkKey.Exp(&sharedSecret, linkKey.PublicKey())
+		if !hmac.Equal(proof, mRegistration.LinkUpdateProof(sharedSecret[:], r.FormValue(mRegistration.UserField), key)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		updated = key
+	}))
+	defer server.Close()
+	u, err := url.Parse(server.URL)
+	require.NoError(err)
+
+	cfg := &config.Config{
+		UpstreamProxy: &config.UpstreamProxy{Type: "none"},
+		Account:       &config.Account{User: "alice", Provider: "provider"},
+	}
+	cfg.Registration, err = newRegistration(cfg, server.URL)
+	require.NoError(err)
+	assert.Equal(u.Host, cfg.Registration.Address)
+
+	require.NoError(UpdateClientLinkKey(cfg, linkKey, newLinkKey.PublicKey(), providerLinkKey.PublicKey()))
+	require.NotNil(updated)
+	assert.True(newLinkKey.PublicKey().Equal(updated))
+
+	// a proof with another link key is rejected
+	updated = nil
+	assert.Error(UpdateClientLinkKey(cfg, newLinkKey, newLinkKey.PublicKey(), providerLinkKey.PublicKey()))
+	assert.Nil(updated)
+}
+
+func TestRekeyLinkKey(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	dir, err := ioutil.TempDir("", "meson_client_rekey")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+
+	providerLinkKey, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+	linkKey, err := ecdh.Load(filepath.Join(dir, stateLinkKeyFile), "", rand.Reader)
+	require.NoError(err)
+
+	// the Provider updates the registered link key given a proof with it
+	registered := linkKey.PublicKey()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := new(ecdh.PublicKey)
+		assert.NoError(key.FromString(r.FormValue(mRegistration.NewLinkKeyField)))
+		proof, err := hex.DecodeString(r.FormValue(mRegistration.ProofField))
+		assert.NoError(err)
+		var sharedSecret [ecdh.GroupElementLength]byte
+		providerLinkKey.Exp(&sharedSecret, registered)
+		if !hmac.Equal(proof, mRegistration.LinkUpdateProof(sharedSecret[:], r.FormValue(mRegistration.UserField), key)) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		registered = key
+	}))
+	defer server.Close()
+	cfg := &config.Config{
+		UpstreamProxy: &config.UpstreamProxy{Type: "none"},
+		Account:       &config.Account{User: "alice", Provider: "provider"},
+	}
+	cfg.Registration, err = newRegistration(cfg, server.URL)
+	require.NoError(err)
+
+	// the new link key replaces the saved one once registered
+	newLinkKey, err := rekeyLinkKey(cfg, dir, linkKey, providerLinkKey.PublicKey())
+	require.NoError(err)
+	assert.True(newLinkKey.PublicKey().Equal(registered))
+	saved, err := ecdh.Load(filepath.Join(dir, stateLinkKeyFile), "", nil)
+	require.NoError(err)
+	assert.True(newLinkKey.PublicKey().Equal(saved.PublicKey()))
+	_, err = os.Stat(filepath.Join(dir, stateNewLinkKeyFile))
+	assert.True(os.IsNotExist(err))
+
+	// an update interrupted after the registration of the new link key is
+	// completed with the new link key
+	linkKey = newLinkKey
+	newLinkKey, err = ecdh.Load(filepath.Join(dir, stateNewLinkKeyFile), "", rand.Reader)
+	require.NoError(err)
+	registered = newLinkKey.PublicKey()
+	rekeyed, err := rekeyLinkKey(cfg, dir, linkKey, providerLinkKey.PublicKey())
+	require.NoError(err)
+	assert.True(newLinkKey.PublicKey().Equal(rekeyed.PublicKey()))
+	assert.True(newLinkKey.PublicKey().Equal(registered))
+
+	// an update interrupted before the registration is retried with the
+	// saved link key
+	linkKey = rekeyed
+	newLinkKey, err = ecdh.Load(filepath.Join(dir, stateNewLinkKeyFile), "", rand.Reader)
+	require.NoError(err)
+	rekeyed, err = rekeyLinkKey(cfg, dir, linkKey, providerLinkKey.PublicKey())
+	require.NoError(err)
+	assert.True(newLinkKey.PublicKey().Equal(rekeyed.PublicKey()))
+	assert.True(newLinkKey.PublicKey().Equal(registered))
+}
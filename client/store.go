@@ -0,0 +1,376 @@
+// store.go - persistent session state
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/katzenpost/client/constants"
+	"github.com/katzenpost/core/crypto/rand"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/ugorji/go/codec"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/nacl/secretbox"
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	storeMetadataBucket   = "metadata"
+	storeEgressBucket     = "egress"
+	storeSURBBucket       = "surbs"
+	storeRetransmitBucket = "retransmit"
+
+	storeVersionKey = "version"
+	storeSaltKey    = "salt"
+	storeCheckKey   = "check"
+
+	storeSaltLength  = 32
+	storeKeyLength   = 32
+	storeNonceLength = 24
+)
+
+// ErrStorePassphrase is the error returned when the store cannot be
+// decrypted with the passphrase.
+var ErrStorePassphrase = errors.New("store: invalid passphrase")
+
+// store persists the egress queue, the SURB decryption keys and the reliable
+// messages pending retransmission, encrypted at rest with a key derived from
+// the passphrase.
+//
+// Every write is synced to the disk before returning, so that the state is
+// not lost on a crash.  The writes go through Batch, so that the concurrent
+// writes share a single sync, but sending a message still takes several:
+// queuing it, dequeuing it, and keeping then forgetting its SURB keys.
+type store struct {
+	db  *bolt.DB
+	key [storeKeyLength]byte
+}
+
+func (s *store) Close() {
+	_ = s.db.Sync()
+	s.db.Close()
+}
+
+func (s *store) seal(plaintext []byte) ([]byte, error) {
+	var nonce [storeNonceLength]byte
+	if _, err := io.ReadFull(rand.Reader, nonce[:]); err != nil {
+		return nil, err
+	}
+	return secretbox.Seal(nonce[:], plaintext, &nonce, &s.key), nil
+}
+
+func (s *store) open(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < storeNonceLength {
+		return nil, ErrStorePassphrase
+	}
+	var nonce [storeNonceLength]byte
+	copy(nonce[:], ciphertext)
+	plaintext, ok := secretbox.Open(nil, ciphertext[storeNonceLength:], &nonce, &s.key)
+	if !ok {
+		return nil, ErrStorePassphrase
+	}
+	return plaintext, nil
+}
+
+func (s *store) put(bucket string, key []byte, msg *Message) error {
+	var raw []byte
+	if err := codec.NewEncoderBytes(&raw, new(codec.CborHandle)).Encode(msg); err != nil {
+		return err
+	}
+	ciphertext, err := s.seal(raw)
+	if err != nil {
+		return err
+	}
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Put(key, ciphertext)
+	})
+}
+
+func (s *store) delete(bucket string, key []byte) error {
+	return s.db.Batch(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).Delete(key)
+	})
+}
+
+// messages returns the messages of the bucket, along with their keys, in key
+// order.
+func (s *store) messages(bucket string) ([][]byte, []*Message, error) {
+	keys := make([][]byte, 0)
+	msgs := make([]*Message, 0)
+	err := s.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(bucket)).ForEach(func(k, v []byte) error {
+			raw, err := s.open(v)
+			if err != nil {
+				return err
+			}
+			msg := new(Message)
+			if err = codec.NewDecoderBytes(raw, new(codec.CborHandle)).Decode(msg); err != nil {
+				return err
+			}
+			keys = append(keys, append([]byte{}, k...))
+			msgs = append(msgs, msg)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return keys, msgs, nil
+}
+
+// retransmitKey returns the key of a reliable message pending retransmission,
+// ordered by retransmission time.
+func retransmitKey(msg *Message) []byte {
+	key := make([]byte, 8+constants.MessageIDLength)
+	binary.BigEndian.PutUint64(key, msg.QueuePriority)
+	copy(key[8:], msg.ID[:])
+	return key
+}
+
+// openStore creates (or loads) the session store with the given file name f.
+func openStore(f, passphrase string) (*store, error) {
+	var err error
+
+	s := new(store)
+	s.db, err = bolt.Open(f, 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.db.Update(func(tx *bolt.Tx) error {
+		// Ensure that all the buckets exists, and grab the metadata bucket.
+		bkt, err := tx.CreateBucketIfNotExists([]byte(storeMetadataBucket))
+		if err != nil {
+			return err
+		}
+		for _, name := range []string{storeEgressBucket, storeSURBBucket, storeRetransmitBucket} {
+			if _, err = tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+
+		if b := bkt.Get([]byte(storeVersionKey)); b != nil {
+			// Well it looks like we loaded as opposed to created.
+			if len(b) != 1 || b[0] != 0 {
+				return fmt.Errorf("store: incompatible version: %d", uint(b[0]))
+			}
+			if err = s.deriveKey(passphrase, bkt.Get([]byte(storeSaltKey))); err != nil {
+				return err
+			}
+			check, err := s.open(bkt.Get([]byte(storeCheckKey)))
+			if err != nil || !bytes.Equal(check, []byte(storeCheckKey)) {
+				return ErrStorePassphrase
+			}
+			return nil
+		}
+
+		// We created a new database, so populate the new `metadata` bucket.
+		salt := make([]byte, storeSaltLength)
+		if _, err = io.ReadFull(rand.Reader, salt); err != nil {
+			return err
+		}
+		if err = s.deriveKey(passphrase, salt); err != nil {
+			return err
+		}
+		check, err := s.seal([]byte(storeCheckKey))
+		if err != nil {
+			return err
+		}
+		_ = bkt.Put([]byte(storeSaltKey), salt)
+		_ = bkt.Put([]byte(storeCheckKey), check)
+		_ = bkt.Put([]byte(storeVersionKey), []byte{0})
+
+		return nil
+	}); err != nil {
+		// The struct isn't getting returned so clean up the database.
+		s.db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *store) deriveKey(passphrase string, salt []byte) error {
+	if len(salt) != storeSaltLength {
+		return errors.New("store: invalid salt")
+	}
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, storeKeyLength)
+	if err != nil {
+		return err
+	}
+	copy(s.key[:], key)
+	return nil
+}
+
+// persistentQueue is the egress FIFO queue backed by the store, mirrored in
+// memory.
+type persistentQueue struct {
+	sync.Mutex
+	store *store
+	keys  [][]byte
+	items []*Message
+	seq   uint64
+}
+
+// newPersistentQueue loads the egress queue from the store. The callers of
+// the blocking sends do not survive a restart, so their messages are sent as
+// non-blocking messages.
+func newPersistentQueue(s *store) (*persistentQueue, error) {
+	keys, msgs, err := s.messages(storeEgressBucket)
+	if err != nil {
+		return nil, err
+	}
+	q := &persistentQueue{
+		store: s,
+		keys:  keys,
+		items: msgs,
+	}
+	for _, msg := range msgs {
+		msg.IsBlocking = false
+	}
+	if len(keys) > 0 {
+		q.seq = binary.BigEndian.Uint64(keys[len(keys)-1]) + 1
+	}
+	return q, nil
+}
+
+// Push pushes the given message ref onto the queue and returns nil
+// on success, otherwise an error is returned.
+func (q *persistentQueue) Push(e Item) error {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.items) >= constants.MaxEgressQueueSize {
+		return ErrQueueFull
+	}
+	msg, ok := e.(*Message)
+	if !ok {
+		return fmt.Errorf("store: cannot persist item: %T", e)
+	}
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, q.seq)
+	if err := q.store.put(storeEgressBucket, key, msg); err != nil {
+		return err
+	}
+	q.seq++
+	q.keys = append(q.keys, key)
+	q.items = append(q.items, msg)
+	return nil
+}
+
+// Pop pops the next message ref off the queue and returns nil
+// upon success, otherwise an error is returned.
+func (q *persistentQueue) Pop() (Item, error) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.items) == 0 {
+		return nil, ErrQueueEmpty
+	}
+	if err := q.store.delete(storeEgressBucket, q.keys[0]); err != nil {
+		return nil, err
+	}
+	result := q.items[0]
+	q.keys = q.keys[1:]
+	q.items = q.items[1:]
+	return result, nil
+}
+
+// Peek returns the next message ref from the queue without
+// modifying the queue.
+func (q *persistentQueue) Peek() (Item, error) {
+	q.Lock()
+	defer q.Unlock()
+	if len(q.items) == 0 {
+		return nil, ErrQueueEmpty
+	}
+	return q.items[0], nil
+}
+
+/*****************************************
+ *          Session persistence          *
+ *****************************************/
+
+// restore resumes the matching of the replies to the messages sent before the
+// restart, and the retransmission of the reliable messages.
+func (s *Session) restore(queue *persistentQueue) error {
+	keys, msgs, err := s.store.messages(storeSURBBucket)
+	if err != nil {
+		return err
+	}
+	for i, msg := range msgs {
+		var surbID [sConstants.SURBIDLength]byte
+		copy(surbID[:], keys[i])
+		msg.IsBlocking = false
+		s.surbIDMap.Store(surbID, msg)
+	}
+	for _, msg := range queue.items {
+		if msg.Reliable {
+			s.reliableMap.Store(*msg.ID, msg)
+		}
+	}
+	_, msgs, err = s.store.messages(storeRetransmitBucket)
+	if err != nil {
+		return err
+	}
+	for _, msg := range msgs {
+		msg.IsBlocking = false
+		s.reliableMap.Store(*msg.ID, msg)
+		s.timerQ.Push(msg)
+	}
+	s.log.Noticef("Restored %d queued messages, %d SURBs and %d reliable messages", len(queue.items), len(keys), len(msgs))
+	return nil
+}
+
+func (s *Session) persistSURB(surbID *[sConstants.SURBIDLength]byte, msg *Message) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.put(storeSURBBucket, surbID[:], msg); err != nil {
+		s.log.Errorf("Failed to persist SURB for message ID %x: %v", *msg.ID, err)
+	}
+}
+
+func (s *Session) forgetSURB(surbID *[sConstants.SURBIDLength]byte) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.delete(storeSURBBucket, surbID[:]); err != nil {
+		s.log.Errorf("Failed to forget SURB: %v", err)
+	}
+}
+
+func (s *Session) persistRetransmit(msg *Message) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.put(storeRetransmitBucket, retransmitKey(msg), msg); err != nil {
+		s.log.Errorf("Failed to persist reliable message ID %x: %v", *msg.ID, err)
+	}
+}
+
+func (s *Session) forgetRetransmit(msg *Message) {
+	if s.store == nil {
+		return
+	}
+	if err := s.store.delete(storeRetransmitBucket, retransmitKey(msg)); err != nil {
+		s.log.Errorf("Failed to forget reliable message ID %x: %v", *msg.ID, err)
+	}
+}
@@ -0,0 +1,150 @@
+// store_test.go - persistent session state tests
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package client
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/katzenpost/client/constants"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPersistentQueue(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	dir, err := ioutil.TempDir("", "meson_client_store")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "session.db")
+
+	s, err := openStore(f, "passphrase")
+	require.NoError(err)
+	q, err := newPersistentQueue(s)
+	require.NoError(err)
+	for i := 0; i < constants.MaxEgressQueueSize; i++ {
+		msg, err := newMessageID()
+		require.NoError(err)
+		require.NoError(q.Push(newMessage(msg, "alice", "provider", []byte{byte(i)}, i == 0)))
+	}
+	id, err := newMessageID()
+	require.NoError(err)
+	assert.Equal(ErrQueueFull, q.Push(newMessage(id, "alice", "provider", []byte{}, false)))
+	item, err := q.Pop()
+	require.NoError(err)
+	assert.Equal([]byte{0}, item.(*Message).Payload)
+	s.Close()
+
+	// the queue is encrypted at rest
+	raw, err := ioutil.ReadFile(f)
+	require.NoError(err)
+	assert.False(bytes.Contains(raw, []byte("provider")))
+	_, err = openStore(f, "wrong passphrase")
+	assert.Equal(ErrStorePassphrase, err)
+
+	// the queue is loaded in order
+	s, err = openStore(f, "passphrase")
+	require.NoError(err)
+	defer s.Close()
+	q, err = newPersistentQueue(s)
+	require.NoError(err)
+	require.NoError(q.Push(newMessage(id, "alice", "provider", []byte{}, false)))
+	for i := 1; i < constants.MaxEgressQueueSize; i++ {
+		item, err := q.Pop()
+		require.NoError(err)
+		msg := item.(*Message)
+		assert.Equal([]byte{byte(i)}, msg.Payload)
+		assert.Equal("alice", msg.Recipient)
+		assert.False(msg.IsBlocking)
+	}
+	item, err = q.Pop()
+	require.NoError(err)
+	assert.Equal(id, item.(*Message).ID)
+	_, err = q.Peek()
+	assert.Equal(ErrQueueEmpty, err)
+}
+
+func TestSessionRestore(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	dir, err := ioutil.TempDir("", "meson_client_store")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "session.db")
+
+	// a reliable message is queued, and another one awaits its reply
+	s := newTestSession(require)
+	s.store, err = openStore(f, "passphrase")
+	require.NoError(err)
+	q, err := newPersistentQueue(s.store)
+	require.NoError(err)
+	s.egressQueue = q
+	queuedID, err := s.SendReliableMessage("alice", "provider", []byte("queued"))
+	require.NoError(err)
+
+	sentID, err := newMessageID()
+	require.NoError(err)
+	sent := newMessage(sentID, "alice", "provider", []byte("sent"), false)
+	sent.Reliable = true
+	sent.Key = []byte("surb keys")
+	sent.SentAt = time.Now()
+	sent.QueuePriority = uint64(time.Now().Add(time.Hour).UnixNano())
+	surbID := [sConstants.SURBIDLength]byte{1}
+	s.persistSURB(&surbID, sent)
+	s.persistRetransmit(sent)
+	s.timerQ.Halt()
+	s.store.Close()
+
+	// a restarted session resumes sending and matching replies
+	s = newTestSession(require)
+	defer s.timerQ.Halt()
+	s.store, err = openStore(f, "passphrase")
+	require.NoError(err)
+	defer s.store.Close()
+	q, err = newPersistentQueue(s.store)
+	require.NoError(err)
+	s.egressQueue = q
+	require.NoError(s.restore(q))
+
+	item, err := s.egressQueue.Peek()
+	require.NoError(err)
+	assert.Equal(queuedID, item.(*Message).ID)
+	_, ok := s.reliableMap.Load(*queuedID)
+	assert.True(ok)
+
+	raw, ok := s.surbIDMap.Load(surbID)
+	require.True(ok)
+	assert.Equal([]byte("surb keys"), raw.(*Message).Key)
+	_, ok = s.reliableMap.Load(*sentID)
+	assert.True(ok)
+
+	// the reply removes the reliable message from the retransmissions
+	s.forgetSURB(&surbID)
+	s.forgetRetransmit(sent)
+	_, msgs, err := s.store.messages(storeSURBBucket)
+	require.NoError(err)
+	assert.Len(msgs, 0)
+	_, msgs, err = s.store.messages(storeRetransmitBucket)
+	require.NoError(err)
+	assert.Len(msgs, 0)
+}
@@ -78,7 +78,7 @@ func (a *TimerQueue) Remove(i Item) error {
 				a.Signal()
 			}
 		} else {
-			priority := mo.Value.(Item).Priority()
+			priority := i.Priority()
 			mo := a.priq.RemovePriority(priority)
 			if mo == nil {
 				return fmt.Errorf("failed to remove item with priority %d", priority)
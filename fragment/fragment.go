@@ -0,0 +1,135 @@
+// fragment.go - message fragmentation
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package fragment implements the fragmentation of messages which do not fit
+// in the user forward payload of a single Sphinx packet.  The wire format is
+// shared by the clients, which split the messages, and the Providers, which
+// reassemble the Kaetzchen requests.
+//
+// A message is length prefixed as an unfragmented payload would be, and the
+// result is split across fragment payloads. Each fragment payload starts with
+// a marker, which an unfragmented payload cannot start with, followed by the
+// message ID, the fragment index, the fragment count and the fragment length.
+// Concatenating the fragments in order gives back the length prefixed
+// message.
+package fragment
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	cConstants "github.com/katzenpost/client/constants"
+	"github.com/katzenpost/core/constants"
+)
+
+const (
+	// marker starts the fragment payloads. The length prefix of an
+	// unfragmented payload is always less than 2^24, so it starts with 0.
+	marker = 0xff
+
+	// lengthPrefixLength is the length of the message length prefix.
+	lengthPrefixLength = 4
+
+	// HeaderLength is the length of the fragment header.
+	HeaderLength = 1 + cConstants.MessageIDLength + 2 + 2 + 4
+
+	// PayloadLength is the length of a fragment payload.
+	PayloadLength = constants.UserForwardPayloadLength
+
+	// MaxDataLength is the maximum length of the data carried by a fragment.
+	MaxDataLength = PayloadLength - HeaderLength
+
+	// MaxFragments is the maximum number of fragments of a message.
+	MaxFragments = 32
+
+	// MaxMessageLength is the maximum length of a fragmented message.
+	MaxMessageLength = MaxFragments*MaxDataLength - lengthPrefixLength
+)
+
+// ErrInvalidFragment is the error returned when the fragment is malformed.
+var ErrInvalidFragment = errors.New("fragment: invalid fragment")
+
+// Fragment is a part of a message.
+type Fragment struct {
+	// ID is the message identifier shared by all the fragments.
+	ID [cConstants.MessageIDLength]byte
+
+	// Index is the position of the fragment in the message.
+	Index uint16
+
+	// Count is the number of fragments of the message.
+	Count uint16
+
+	// Data is the fragment of the length prefixed message.
+	Data []byte
+}
+
+// IsFragment returns whether the payload is a fragment payload.
+func IsFragment(payload []byte) bool {
+	return len(payload) > 0 && payload[0] == marker
+}
+
+// Split splits the message into fragment payloads.
+func Split(id *[cConstants.MessageIDLength]byte, message []byte) ([][]byte, error) {
+	if len(message) > MaxMessageLength {
+		return nil, fmt.Errorf("fragment: invalid message size: %v", len(message))
+	}
+	data := make([]byte, lengthPrefixLength+len(message))
+	binary.BigEndian.PutUint32(data[:lengthPrefixLength], uint32(len(message)))
+	copy(data[lengthPrefixLength:], message)
+
+	count := (len(data) + MaxDataLength - 1) / MaxDataLength
+	payloads := make([][]byte, count)
+	for i := range payloads {
+		end := (i + 1) * MaxDataLength
+		if end > len(data) {
+			end = len(data)
+		}
+		chunk := data[i*MaxDataLength : end]
+		payload := make([]byte, PayloadLength)
+		payload[0] = marker
+		copy(payload[1:], id[:])
+		off := 1 + cConstants.MessageIDLength
+		binary.BigEndian.PutUint16(payload[off:], uint16(i))
+		binary.BigEndian.PutUint16(payload[off+2:], uint16(count))
+		binary.BigEndian.PutUint32(payload[off+4:], uint32(len(chunk)))
+		copy(payload[HeaderLength:], chunk)
+		payloads[i] = payload
+	}
+	return payloads, nil
+}
+
+// Parse parses a fragment payload.
+func Parse(payload []byte) (*Fragment, error) {
+	if len(payload) < HeaderLength || !IsFragment(payload) {
+		return nil, ErrInvalidFragment
+	}
+	f := new(Fragment)
+	copy(f.ID[:], payload[1:])
+	off := 1 + cConstants.MessageIDLength
+	f.Index = binary.BigEndian.Uint16(payload[off:])
+	f.Count = binary.BigEndian.Uint16(payload[off+2:])
+	length := binary.BigEndian.Uint32(payload[off+4:])
+	if f.Count == 0 || f.Count > MaxFragments || f.Index >= f.Count {
+		return nil, ErrInvalidFragment
+	}
+	if length > MaxDataLength || int(length) > len(payload)-HeaderLength {
+		return nil, ErrInvalidFragment
+	}
+	f.Data = payload[HeaderLength : HeaderLength+int(length)]
+	return f, nil
+}
@@ -0,0 +1,81 @@
+// fragment_test.go - message fragmentation tests
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package fragment
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+
+	cConstants "github.com/katzenpost/client/constants"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSplitAndParse(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	id := new([cConstants.MessageIDLength]byte)
+	_, err := io.ReadFull(rand.Reader, id[:])
+	require.NoError(err)
+	message := make([]byte, 2*MaxDataLength+100)
+	_, err = io.ReadFull(rand.Reader, message)
+	require.NoError(err)
+
+	payloads, err := Split(id, message)
+	require.NoError(err)
+	require.Len(payloads, 3)
+
+	// the fragments concatenate to the length prefixed message
+	data := make([]byte, 0)
+	for i, payload := range payloads {
+		assert.Len(payload, PayloadLength)
+		assert.True(IsFragment(payload))
+		f, err := Parse(payload)
+		require.NoError(err)
+		assert.Equal(*id, f.ID)
+		assert.Equal(uint16(i), f.Index)
+		assert.Equal(uint16(3), f.Count)
+		data = append(data, f.Data...)
+	}
+	require.Len(data, 4+len(message))
+	assert.Equal(uint32(len(message)), binary.BigEndian.Uint32(data[:4]))
+	assert.Equal(message, data[4:])
+
+	// unfragmented payloads are not fragments
+	payload := make([]byte, PayloadLength)
+	binary.BigEndian.PutUint32(payload[:4], uint32(PayloadLength-4))
+	assert.False(IsFragment(payload))
+	_, err = Parse(payload)
+	assert.Equal(ErrInvalidFragment, err)
+
+	// malformed headers are rejected
+	payload = append([]byte{}, payloads[2]...)
+	binary.BigEndian.PutUint16(payload[1+cConstants.MessageIDLength:], 3)
+	_, err = Parse(payload)
+	assert.Equal(ErrInvalidFragment, err)
+	_, err = Parse(payloads[0][:HeaderLength-1])
+	assert.Equal(ErrInvalidFragment, err)
+
+	// messages are limited to the maximum number of fragments
+	payloads, err = Split(id, make([]byte, MaxMessageLength))
+	require.NoError(err)
+	assert.Len(payloads, MaxFragments)
+	_, err = Split(id, make([]byte, MaxMessageLength+1))
+	assert.Error(err)
+}
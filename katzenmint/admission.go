@@ -0,0 +1,298 @@
+package katzenmint
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	ics23 "github.com/confio/ics23/go"
+	"github.com/hashcloak/Meson/katzenmint/config"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/pki"
+)
+
+const registrationContext = "katzenmint-mix-registration-v0"
+
+// AllowlistVote represents the vote of an authority to add or remove a mix
+// identity key from the allowlist.
+type AllowlistVote struct {
+	// IdentityKey is the identity key of the mix.
+	IdentityKey []byte
+
+	// Allowed is whether the key should be in the allowlist.
+	Allowed bool
+}
+
+// MixRegistration represents the registration of a mix identity key to the
+// operator signing the transaction.
+type MixRegistration struct {
+	// IdentityKey is the identity key of the mix.
+	IdentityKey []byte
+
+	// Signature is the signature of the operator public key by the identity
+	// key, which proves that the operator controls the mix.
+	Signature []byte
+}
+
+// AdmissionDecision represents the admission of a mix descriptor for an epoch.
+type AdmissionDecision struct {
+	// IdentityKey is the identity key of the mix.
+	IdentityKey []byte
+
+	// Epoch is the epoch of the admitted descriptor.
+	Epoch uint64
+
+	// Operator is the public key of the registered operator of the mix, if
+	// any.
+	Operator []byte
+
+	// Policies are the admission policies the descriptor satisfied.
+	Policies []string
+}
+
+// admissionPolicy decides whether a descriptor published by the operator is
+// admitted for the epoch.
+type admissionPolicy interface {
+	name() string
+	admit(state *KatzenmintState, desc *pki.MixDescriptor, operator []byte, epoch uint64) error
+}
+
+func newAdmissionPolicies(cfg *config.AdmissionConfig) []admissionPolicy {
+	policies := make([]admissionPolicy, 0, len(cfg.Policies))
+	for _, policy := range cfg.Policies {
+		switch policy {
+		case config.AdmissionAllowlist:
+			policies = append(policies, allowlistPolicy{})
+		case config.AdmissionRegistration:
+			policies = append(policies, registrationPolicy{})
+		case config.AdmissionOperatorCap:
+			policies = append(policies, operatorCapPolicy{max: uint64(cfg.MaxDescriptorsPerOperator)})
+		}
+	}
+	return policies
+}
+
+// allowlistPolicy admits the identity keys voted in by the authorities.
+type allowlistPolicy struct{}
+
+func (allowlistPolicy) name() string {
+	return config.AdmissionAllowlist
+}
+
+func (allowlistPolicy) admit(state *KatzenmintState, desc *pki.MixDescriptor, operator []byte, epoch uint64) error {
+	if _, err := state.get(storageKey(allowlistBucket, desc.IdentityKey.Bytes(), 0)); err != nil {
+		return fmt.Errorf("identity key (%x) is not in the allowlist", desc.IdentityKey.Bytes())
+	}
+	return nil
+}
+
+// registrationPolicy admits the identity keys registered by an operator.
+type registrationPolicy struct{}
+
+func (registrationPolicy) name() string {
+	return config.AdmissionRegistration
+}
+
+func (registrationPolicy) admit(state *KatzenmintState, desc *pki.MixDescriptor, operator []byte, epoch uint64) error {
+	if _, err := state.get(storageKey(registrationsBucket, desc.IdentityKey.Bytes(), 0)); err != nil {
+		return fmt.Errorf("identity key (%x) is not registered", desc.IdentityKey.Bytes())
+	}
+	return nil
+}
+
+// operatorCapPolicy caps the number of descriptors of an operator per epoch.
+type operatorCapPolicy struct {
+	max uint64
+}
+
+func (operatorCapPolicy) name() string {
+	return config.AdmissionOperatorCap
+}
+
+func (p operatorCapPolicy) admit(state *KatzenmintState, desc *pki.MixDescriptor, operator []byte, epoch uint64) error {
+	if operator == nil {
+		return fmt.Errorf("identity key (%x) has no registered operator", desc.IdentityKey.Bytes())
+	}
+	if count := state.operatorDescriptors(operator, epoch); count >= p.max {
+		return fmt.Errorf("operator (%x) exceeds %d descriptors for epoch (%d)", operator, p.max, epoch)
+	}
+	return nil
+}
+
+/*****************************************
+ *            Admission State            *
+ *****************************************/
+
+// descriptorOperator returns the registered operator of the descriptor, or
+// nil if the identity key is not registered.
+func (state *KatzenmintState) descriptorOperator(desc *pki.MixDescriptor) []byte {
+	operator, err := state.get(storageKey(registrationsBucket, desc.IdentityKey.Bytes(), 0))
+	if err != nil {
+		return nil
+	}
+	return operator
+}
+
+func (state *KatzenmintState) operatorDescriptors(operator []byte, epoch uint64) uint64 {
+	val, err := state.get(storageKey(operatorsBucket, operator, epoch))
+	if err != nil || len(val) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(val)
+}
+
+// checkDescriptorAdmission returns the reason for which the descriptor is not
+// admitted, if any.
+func (state *KatzenmintState) checkDescriptorAdmission(desc *pki.MixDescriptor, operator []byte, epoch uint64) error {
+	for _, policy := range state.admission {
+		if err := policy.admit(state, desc, operator, epoch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// recordAdmission saves the admission decision of the descriptor and counts it
+// for the operator.
+func (state *KatzenmintState) recordAdmission(desc *pki.MixDescriptor, operator []byte, epoch uint64) error {
+	decision := &AdmissionDecision{
+		IdentityKey: desc.IdentityKey.Bytes(),
+		Epoch:       epoch,
+		Operator:    operator,
+		Policies:    make([]string, 0, len(state.admission)),
+	}
+	for _, policy := range state.admission {
+		decision.Policies = append(decision.Policies, policy.name())
+	}
+	raw, err := EncodeJson(decision)
+	if err != nil {
+		return err
+	}
+	if err = state.set(storageKey(admissionBucket, decision.IdentityKey, epoch), raw); err != nil {
+		return err
+	}
+	if operator == nil {
+		return nil
+	}
+	count := make([]byte, 8)
+	binary.BigEndian.PutUint64(count, state.operatorDescriptors(operator, epoch)+1)
+	return state.set(storageKey(operatorsBucket, operator, epoch), count)
+}
+
+// updateRegistration registers the identity key of a mix to the operator.
+func (state *KatzenmintState) updateRegistration(identityKey []byte, operator []byte) error {
+	key := storageKey(registrationsBucket, identityKey, 0)
+	if registered, err := state.get(key); err == nil {
+		if bytes.Equal(registered, operator) {
+			return fmt.Errorf("identity key (%x) is already registered", identityKey)
+		}
+		return fmt.Errorf("identity key (%x) is registered by another operator", identityKey)
+	}
+	return state.set(key, operator)
+}
+
+// updateAllowlistVote records the vote of the authority, and applies the
+// change to the allowlist once it is approved by the quorum.
+func (state *KatzenmintState) updateAllowlistVote(addr string, vote *AllowlistVote) (bool, error) {
+	voteKey := func(allowed bool) []byte {
+		id := append([]byte{0}, vote.IdentityKey...)
+		if allowed {
+			id[0] = 1
+		}
+		return storageKey(allowlistVotesBucket, id, 0)
+	}
+	key := voteKey(vote.Allowed)
+	voters := make([][]byte, 0)
+	if raw, err := state.get(key); err == nil {
+		if err = DecodeJson(raw, &voters); err != nil {
+			return false, err
+		}
+	}
+	addrs := make([]string, 0, len(voters)+1)
+	for _, voter := range voters {
+		if string(voter) == addr {
+			return false, fmt.Errorf("duplicated allowlist vote from (%x)", addr)
+		}
+		addrs = append(addrs, string(voter))
+	}
+	voters = append(voters, []byte(addr))
+	addrs = append(addrs, addr)
+
+	if !state.hasQuorum(addrs) {
+		raw, err := EncodeJson(voters)
+		if err != nil {
+			return false, err
+		}
+		return false, state.set(key, raw)
+	}
+
+	// Approved, clear the votes on the identity key and apply the change.
+	for _, allowed := range []bool{true, false} {
+		if err := state.delete(voteKey(allowed)); err != nil {
+			return false, err
+		}
+	}
+	allowlistKey := storageKey(allowlistBucket, vote.IdentityKey, 0)
+	if vote.Allowed {
+		return true, state.set(allowlistKey, []byte{1})
+	}
+	return true, state.delete(allowlistKey)
+}
+
+// GetAdmission returns the admission decision of the descriptor for the epoch
+// along with its proof.
+func (state *KatzenmintState) GetAdmission(identityKey []byte, epoch uint64, height int64) ([]byte, *ics23.CommitmentProof, error) {
+	key := storageKey(admissionBucket, identityKey, epoch)
+	val, proof, err := state.getProof(key, height)
+	if err == errProofNotFound {
+		return nil, nil, ErrQueryNoAdmission
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return val, proof, nil
+}
+
+// registrationMessage returns the message signed by the identity key of a mix
+// to register it to the operator.
+func registrationMessage(operator []byte) []byte {
+	return append([]byte(registrationContext), operator...)
+}
+
+// SignMixRegistration returns the payload registering the mix identity key to
+// the operator.
+func SignMixRegistration(identityKey *eddsa.PrivateKey, operator []byte) ([]byte, error) {
+	return EncodeJson(&MixRegistration{
+		IdentityKey: identityKey.PublicKey().Bytes(),
+		Signature:   identityKey.Sign(registrationMessage(operator)),
+	})
+}
+
+// VerifyAndParseMixRegistration parses the mix registration in the payload,
+// and verifies that it is signed by the identity key for the operator.
+func VerifyAndParseMixRegistration(payload []byte, operator []byte) (*MixRegistration, error) {
+	reg := new(MixRegistration)
+	if err := DecodeJson(payload, reg); err != nil {
+		return nil, err
+	}
+	identityKey := new(eddsa.PublicKey)
+	if err := identityKey.FromBytes(reg.IdentityKey); err != nil {
+		return nil, fmt.Errorf("invalid identity key: %v", err)
+	}
+	if !identityKey.Verify(reg.Signature, registrationMessage(operator)) {
+		return nil, fmt.Errorf("registration is not signed by the identity key (%x)", reg.IdentityKey)
+	}
+	return reg, nil
+}
+
+// VerifyAndParseAllowlistVote parses the allowlist vote in the payload.
+func VerifyAndParseAllowlistVote(payload []byte) (*AllowlistVote, error) {
+	vote := new(AllowlistVote)
+	if err := DecodeJson(payload, vote); err != nil {
+		return nil, err
+	}
+	if len(vote.IdentityKey) != eddsa.PublicKeySize {
+		return nil, fmt.Errorf("invalid identity key size (%d)", len(vote.IdentityKey))
+	}
+	return vote, nil
+}
@@ -6,6 +6,7 @@ import (
 	"sort"
 
 	dbm "github.com/cometbft/cometbft-db"
+	ics23 "github.com/confio/ics23/go"
 	costypes "github.com/cosmos/cosmos-sdk/store/types"
 	"github.com/hashcloak/Meson/katzenmint/cert"
 	"github.com/hashcloak/Meson/katzenmint/config"
@@ -36,14 +37,19 @@ type katzenmintVersion struct {
 type KatzenmintApplication struct {
 	state *KatzenmintState
 
+	// State sync snapshots
+	snapshots *snapshotStore
+	restore   *snapshotRestore
+
 	logger log.Logger
 }
 
 func NewKatzenmintApplication(kConfig *config.Config, db dbm.DB, dbCacheSize int, logger log.Logger) *KatzenmintApplication {
 	state := NewKatzenmintState(kConfig, db, dbCacheSize)
 	return &KatzenmintApplication{
-		state:  state,
-		logger: logger,
+		state:     state,
+		snapshots: newSnapshotStore(kConfig, db),
+		logger:    logger,
 	}
 }
 
@@ -116,7 +122,9 @@ func (app *KatzenmintApplication) isTxValid(rawTx []byte) (
 			err = ErrTxDescFalseVerification
 			return
 		}
-		if !app.state.isDescriptorAuthorized(desc) {
+		operator := app.state.descriptorOperator(desc)
+		if reason := app.state.checkDescriptorAdmission(desc, operator, tx.Epoch); reason != nil {
+			app.logger.Debug("descriptor is not admitted", "epoch", tx.Epoch, "reason", reason)
 			err = ErrTxDescNotAuthorized
 			return
 		}
@@ -136,6 +144,105 @@ func (app *KatzenmintApplication) isTxValid(rawTx []byte) (
 			err = ErrTxAuthorityNotAuthorized
 			return
 		}
+
+	case RemoveAuthority, UpdateAuthorityPower:
+		var change *AuthorityChange
+		payload = DecodeHex(tx.Payload)
+		change, err = app.state.verifyAuthorityChange(payload)
+		if err != nil {
+			return
+		}
+		if change.Epoch != tx.Epoch || (change.Power == 0) != (tx.Command == RemoveAuthority) {
+			err = ErrAuthorityChangeParse
+			return
+		}
+		if change.Sequence != app.state.authorityChangeSequence() {
+			err = ErrAuthorityChangeSequence
+			return
+		}
+		addr := change.Address()
+		if !app.state.isAuthority(addr) {
+			err = ErrAuthorityNotFound
+			return
+		}
+		if !app.state.isWithinPowerCap(addr, change.Power) {
+			err = ErrAuthorityPowerCap
+			return
+		}
+		auth = &AuthorityChecked{Val: change.ValidatorUpdate()}
+
+	case CommitSharedRandom, RevealSharedRandom:
+		payload = DecodeHex(tx.Payload)
+		if len(payload) != SharedRandomLength {
+			err = ErrTxSrvInvalidLength
+			return
+		}
+		if !app.state.isAuthority(tx.Address()) {
+			err = ErrTxSrvNotAuthorized
+			return
+		}
+
+	case RegisterMixNode:
+		payload = []byte(tx.Payload)
+		if _, err = VerifyAndParseMixRegistration(payload, tx.PublicKeyBytes()); err != nil {
+			err = ErrTxRegistrationParse
+			return
+		}
+
+	case VoteAllowlist:
+		payload = []byte(tx.Payload)
+		if _, err = VerifyAndParseAllowlistVote(payload); err != nil {
+			err = ErrTxVoteParse
+			return
+		}
+		if !app.state.isAuthority(tx.Address()) {
+			err = ErrTxVoteNotAuthorized
+			return
+		}
+
+	case ProposeParameters:
+		payload = []byte(tx.Payload)
+		if _, err = VerifyAndParseParameters(payload); err != nil {
+			err = ErrTxProposalParse
+			return
+		}
+		if !app.state.isAuthority(tx.Address()) {
+			err = ErrTxVoteNotAuthorized
+			return
+		}
+
+	case VoteParameters:
+		payload = DecodeHex(tx.Payload)
+		if len(payload) != ProposalIDLength {
+			err = ErrTxProposalParse
+			return
+		}
+		if !app.state.isAuthority(tx.Address()) {
+			err = ErrTxVoteNotAuthorized
+			return
+		}
+
+	case PostReliability:
+		var report *ReliabilityReport
+		payload = DecodeHex(tx.Payload)
+		report, err = VerifyAndParseReliabilityReport(payload)
+		if err != nil {
+			err = ErrReliabilityReportParse
+			return
+		}
+		if report.Epoch >= tx.Epoch {
+			err = ErrReliabilityReportParse
+			return
+		}
+		if report.Epoch+1 != app.state.currentEpoch {
+			err = ErrReliabilityReportEpoch
+			return
+		}
+		if !app.state.isReporterListed(report) {
+			err = ErrReliabilityReporterUnknown
+			return
+		}
+
 	default:
 		err = ErrTxCommandNotFound
 	}
@@ -160,12 +267,72 @@ func (app *KatzenmintApplication) executeTx(
 			app.logger.Error("failed to publish descriptor", "epoch", tx.Epoch, "error", err)
 			return ErrTxUpdateDesc
 		}
+		operator := app.state.descriptorOperator(desc)
+		err = app.state.recordAdmission(desc, operator, tx.Epoch)
+		if err != nil {
+			app.logger.Error("failed to record admission", "epoch", tx.Epoch, "error", err)
+			return ErrTxUpdateDesc
+		}
 	case AddNewAuthority:
 		err := app.state.updateAuthority(payload, *auth.Val)
 		if err != nil {
 			app.logger.Error("failed to add new authority", "epoch", app.state.currentEpoch, "error", err)
 			return ErrTxUpdateAuth
 		}
+	case RemoveAuthority, UpdateAuthorityPower:
+		err := app.state.updateAuthorityPower(*auth.Val)
+		if err != nil {
+			app.logger.Error("failed to change authority", "epoch", app.state.currentEpoch, "error", err)
+			return ErrTxUpdateAuth
+		}
+	case CommitSharedRandom:
+		err := app.state.updateSharedRandomCommit(tx.Address(), payload, tx.Epoch)
+		if err != nil {
+			app.logger.Error("failed to commit shared random", "epoch", tx.Epoch, "error", err)
+			return ErrTxUpdateSrv
+		}
+	case RevealSharedRandom:
+		err := app.state.updateSharedRandomReveal(tx.Address(), payload, tx.Epoch)
+		if err != nil {
+			app.logger.Error("failed to reveal shared random", "epoch", tx.Epoch, "error", err)
+			return ErrTxUpdateSrv
+		}
+	case RegisterMixNode:
+		reg, _ := VerifyAndParseMixRegistration(payload, tx.PublicKeyBytes())
+		err := app.state.updateRegistration(reg.IdentityKey, tx.PublicKeyBytes())
+		if err != nil {
+			app.logger.Error("failed to register mix", "epoch", tx.Epoch, "error", err)
+			return ErrTxUpdateReg
+		}
+	case VoteAllowlist:
+		vote, _ := VerifyAndParseAllowlistVote(payload)
+		applied, err := app.state.updateAllowlistVote(tx.Address(), vote)
+		if err != nil {
+			app.logger.Error("failed to vote allowlist", "epoch", tx.Epoch, "error", err)
+			return ErrTxUpdateVote
+		}
+		if applied {
+			app.logger.Info("allowlist updated", "identity", vote.IdentityKey, "allowed", vote.Allowed)
+		}
+	case ProposeParameters:
+		err := app.state.updateParameterProposal(tx.Address(), payload)
+		if err != nil {
+			app.logger.Error("failed to propose parameters", "epoch", app.state.currentEpoch, "error", err)
+			return ErrTxUpdateProp
+		}
+	case VoteParameters:
+		err := app.state.updateParameterVote(tx.Address(), payload)
+		if err != nil {
+			app.logger.Error("failed to vote parameters", "epoch", app.state.currentEpoch, "error", err)
+			return ErrTxUpdateProp
+		}
+	case PostReliability:
+		report, _ := VerifyAndParseReliabilityReport(payload)
+		err := app.state.updateReliabilityReport(payload, report)
+		if err != nil {
+			app.logger.Error("failed to post reliability report", "epoch", app.state.currentEpoch, "error", err)
+			return ErrTxUpdateRep
+		}
 	default:
 		return ErrTxCommandNotFound
 	}
@@ -205,9 +372,26 @@ func (app *KatzenmintApplication) Commit() abcitypes.ResponseCommit {
 			app.logger.Error("commit failed", "epoch", app.state.currentEpoch, "height", app.state.blockHeight, "error", err)
 		}
 	}
+	if appHash != nil && app.snapshots.shouldTake(app.state.blockHeight) {
+		app.takeSnapshot(app.state.blockHeight)
+	}
 	return abcitypes.ResponseCommit{Data: appHash}
 }
 
+func (app *KatzenmintApplication) takeSnapshot(height int64) {
+	payload, err := app.state.exportSnapshot(height)
+	if err != nil {
+		app.logger.Error("failed to export snapshot", "height", height, "error", err)
+		return
+	}
+	snapshot, err := app.snapshots.save(uint64(height), payload)
+	if err != nil {
+		app.logger.Error("failed to save snapshot", "height", height, "error", err)
+		return
+	}
+	app.logger.Info("snapshot taken", "height", height, "chunks", snapshot.Chunks)
+}
+
 func (app *KatzenmintApplication) Query(rquery abcitypes.RequestQuery) (resQuery abcitypes.ResponseQuery) {
 
 	kquery := new(Query)
@@ -254,7 +438,7 @@ func (app *KatzenmintApplication) Query(rquery abcitypes.RequestQuery) (resQuery
 			} else if err == ErrQueryNoDocument {
 				app.logger.Error("warn: detected a skipped document", "miss", kquery.Epoch, "now", app.state.currentEpoch)
 				parseErrorResponse(err.(KatzenmintError), &resQuery)
-			} else if err == ErrQueryDocumentNotReady {
+			} else if err == ErrQueryDocumentNotReady || err == ErrQueryDocumentPruned {
 				parseErrorResponse(err.(KatzenmintError), &resQuery)
 			} else {
 				parseErrorResponse(ErrQueryDocumentUnknown, &resQuery)
@@ -272,16 +456,64 @@ func (app *KatzenmintApplication) Query(rquery abcitypes.RequestQuery) (resQuery
 		resQuery.ProofOps = &tmcrypto.ProofOps{
 			Ops: []tmcrypto.ProofOp{op.ProofOp()},
 		}
+
+	case GetAdmission:
+		resQuery.Height = app.state.blockHeight - 1
+		identityKey := DecodeHex(kquery.Payload)
+		decision, proof, err := app.state.GetAdmission(identityKey, kquery.Epoch, resQuery.Height)
+		app.parseProofResponse(decision, proof, err, &resQuery)
+
+	case GetAuthorities:
+		resQuery.Height = app.state.blockHeight - 1
+		auths, proof, err := app.state.GetAuthorities(resQuery.Height)
+		app.parseProofResponse(auths, proof, err, &resQuery)
+
+	case GetDescriptors:
+		resQuery.Height = app.state.blockHeight - 1
+		index, proof, err := app.state.GetDescriptors(kquery.Epoch, resQuery.Height)
+		app.parseProofResponse(index, proof, err, &resQuery)
+
+	case GetDescriptor:
+		resQuery.Height = app.state.blockHeight - 1
+		identityKey := DecodeHex(kquery.Payload)
+		desc, proof, err := app.state.GetDescriptor(identityKey, kquery.Epoch, resQuery.Height)
+		app.parseProofResponse(desc, proof, err, &resQuery)
 	}
 	return
 }
 
+// parseProofResponse fills the query response with the value and its proof,
+// or with the error.
+func (app *KatzenmintApplication) parseProofResponse(value []byte, proof *ics23.CommitmentProof, err error, resp *abcitypes.ResponseQuery) {
+	if err != nil {
+		if kerr, ok := err.(KatzenmintError); ok {
+			parseErrorResponse(kerr, resp)
+		} else if err == errStateClosed {
+			parseErrorResponse(ErrQueryAppClosed, resp)
+		} else {
+			app.logger.Error("peer: failed to query", "height", resp.Height, "error", err)
+			parseErrorResponse(ErrQueryUnsupported, resp)
+		}
+		return
+	}
+	existProof := proof.GetExist()
+	op := costypes.NewIavlCommitmentOp(existProof.Key, proof)
+	resp.Key = existProof.Key
+	resp.Value = value
+	resp.ProofOps = &tmcrypto.ProofOps{
+		Ops: []tmcrypto.ProofOp{op.ProofOp()},
+	}
+}
+
 func (app *KatzenmintApplication) InitChain(req abcitypes.RequestInitChain) abcitypes.ResponseInitChain {
 	if app.state.currentEpoch != GenesisEpoch ||
 		app.state.blockHeight != app.state.epochStartHeight {
 		panic("state is already initialized")
 	}
-	app.state.BeginBlock()
+	app.state.BeginBlock(req.Time)
+	if err := app.state.initGenesisState(req.AppStateBytes); err != nil {
+		panic(err)
+	}
 	sort.Sort(abcitypes.ValidatorUpdates(req.Validators))
 	for _, v := range req.Validators {
 		err := app.state.updateAuthority(nil, v)
@@ -296,7 +528,7 @@ func (app *KatzenmintApplication) InitChain(req abcitypes.RequestInitChain) abci
 
 // Track the block hash and header information
 func (app *KatzenmintApplication) BeginBlock(req abcitypes.RequestBeginBlock) abcitypes.ResponseBeginBlock {
-	app.state.BeginBlock()
+	app.state.BeginBlock(req.Header.Time)
 
 	// Punish validators who committed equivocation.
 	for _, ev := range req.ByzantineValidators {
@@ -325,21 +557,88 @@ func (app *KatzenmintApplication) EndBlock(req abcitypes.RequestEndBlock) abcity
 	}
 }
 
-// TODO: state sync connection
 func (app *KatzenmintApplication) ListSnapshots(req abcitypes.RequestListSnapshots) (res abcitypes.ResponseListSnapshots) {
+	snapshots, err := app.snapshots.list()
+	if err != nil {
+		app.logger.Error("failed to list snapshots", "error", err)
+		return
+	}
+	res.Snapshots = snapshots
 	return
 }
 
 func (app *KatzenmintApplication) OfferSnapshot(req abcitypes.RequestOfferSnapshot) (res abcitypes.ResponseOfferSnapshot) {
-	res.Result = abcitypes.ResponseOfferSnapshot_ABORT
+	app.restore = nil
+	if req.Snapshot == nil || req.Snapshot.Chunks == 0 {
+		res.Result = abcitypes.ResponseOfferSnapshot_REJECT
+		return
+	}
+	if req.Snapshot.Format != SnapshotFormat {
+		res.Result = abcitypes.ResponseOfferSnapshot_REJECT_FORMAT
+		return
+	}
+	metadata, err := decodeSnapshotMetadata(req.Snapshot)
+	if err != nil {
+		app.logger.Error("invalid snapshot metadata", "height", req.Snapshot.Height, "error", err)
+		res.Result = abcitypes.ResponseOfferSnapshot_REJECT
+		return
+	}
+	app.restore = &snapshotRestore{
+		snapshot: req.Snapshot,
+		metadata: metadata,
+		appHash:  req.AppHash,
+		chunks:   make([][]byte, 0, req.Snapshot.Chunks),
+	}
+	res.Result = abcitypes.ResponseOfferSnapshot_ACCEPT
 	return
 }
 
 func (app *KatzenmintApplication) LoadSnapshotChunk(req abcitypes.RequestLoadSnapshotChunk) (res abcitypes.ResponseLoadSnapshotChunk) {
+	chunk, err := app.snapshots.loadChunk(req.Height, req.Format, req.Chunk)
+	if err != nil {
+		app.logger.Error("failed to load snapshot chunk", "height", req.Height, "chunk", req.Chunk, "error", err)
+		return
+	}
+	res.Chunk = chunk
 	return
 }
 
 func (app *KatzenmintApplication) ApplySnapshotChunk(req abcitypes.RequestApplySnapshotChunk) (res abcitypes.ResponseApplySnapshotChunk) {
-	res.Result = abcitypes.ResponseApplySnapshotChunk_ABORT
+	if app.restore == nil {
+		res.Result = abcitypes.ResponseApplySnapshotChunk_ABORT
+		return
+	}
+	done, err := app.restore.apply(req.Index, req.Chunk)
+	if err != nil {
+		app.logger.Error("failed to apply snapshot chunk", "chunk", req.Index, "sender", req.Sender, "error", err)
+		res.Result = abcitypes.ResponseApplySnapshotChunk_RETRY
+		res.RefetchChunks = []uint32{req.Index}
+		if req.Sender != "" {
+			res.RejectSenders = []string{req.Sender}
+		}
+		return
+	}
+	if !done {
+		res.Result = abcitypes.ResponseApplySnapshotChunk_ACCEPT
+		return
+	}
+
+	// All chunks received, restore the state
+	restore := app.restore
+	app.restore = nil
+	payload, err := restore.payload()
+	if err != nil {
+		app.logger.Error("failed to restore snapshot", "height", restore.snapshot.Height, "error", err)
+		res.Result = abcitypes.ResponseApplySnapshotChunk_REJECT_SNAPSHOT
+		return
+	}
+	err = app.state.restoreSnapshot(int64(restore.snapshot.Height), payload, restore.appHash)
+	if err != nil {
+		app.logger.Error("failed to restore snapshot", "height", restore.snapshot.Height, "error", err)
+		res.Result = abcitypes.ResponseApplySnapshotChunk_REJECT_SNAPSHOT
+		return
+	}
+	app.logger.Info("state restored from snapshot", "height", restore.snapshot.Height, "epoch", app.state.currentEpoch)
+	res.Result = abcitypes.ResponseApplySnapshotChunk_ACCEPT
 	return
 }
@@ -11,6 +11,8 @@ import (
 
 	dbm "github.com/cometbft/cometbft-db"
 	costypes "github.com/cosmos/cosmos-sdk/store/types"
+	"github.com/hashcloak/Meson/katzenmint/cert"
+	"github.com/hashcloak/Meson/katzenmint/config"
 	"github.com/hashcloak/Meson/katzenmint/s11n"
 	"github.com/hashcloak/Meson/katzenmint/testutil"
 	"github.com/katzenpost/core/crypto/eddsa"
@@ -41,7 +43,7 @@ func TestGetEpoch(t *testing.T) {
 	m := mock.ABCIApp{
 		App: app,
 	}
-	m.App.BeginBlock(abcitypes.RequestBeginBlock{})
+	m.App.BeginBlock(testBeginBlock(app.state))
 	m.App.Commit()
 
 	// fetch abci info
@@ -49,7 +51,7 @@ func TestGetEpoch(t *testing.T) {
 	require.Nil(err)
 
 	// advance block height
-	m.App.BeginBlock(abcitypes.RequestBeginBlock{})
+	m.App.BeginBlock(testBeginBlock(app.state))
 	m.App.Commit()
 
 	// get epoch
@@ -64,8 +66,11 @@ func TestGetEpoch(t *testing.T) {
 	}
 	resp := m.App.Query(abcitypes.RequestQuery{Data: query})
 	require.True(resp.IsOK(), resp.Log)
-	expectEpoch, _ := binary.Uvarint(resp.Value[:8])
-	require.Equal(appinfo.Response.Data, fmt.Sprint(expectEpoch))
+	info, err := ParseEpochInfo(resp.Value)
+	require.Nil(err)
+	require.Equal(appinfo.Response.Data, fmt.Sprint(info.Epoch))
+	require.Equal(testGenesisTime, info.StartTime)
+	require.Equal(config.DefaultEpochDuration, info.Duration)
 }
 
 func TestAddAuthority(t *testing.T) {
@@ -99,7 +104,7 @@ func TestAddAuthority(t *testing.T) {
 	}
 
 	// post transaction to app
-	m.App.BeginBlock(abcitypes.RequestBeginBlock{})
+	m.App.BeginBlock(testBeginBlock(app.state))
 	res, err := m.BroadcastTxCommit(context.Background(), tx)
 	require.Nil(err)
 	assert.True(res.CheckTx.IsOK())
@@ -168,7 +173,7 @@ func TestPostDescriptorAndCommit(t *testing.T) {
 	}
 
 	// post descriptor transactions to app
-	m.App.BeginBlock(abcitypes.RequestBeginBlock{})
+	m.App.BeginBlock(testBeginBlock(app.state))
 	for _, tx := range transactions {
 		res, err := m.BroadcastTxCommit(context.Background(), tx)
 		require.Nil(err)
@@ -178,9 +183,10 @@ func TestPostDescriptorAndCommit(t *testing.T) {
 	}
 	m.App.Commit()
 
-	// commit through the epoch, and add one more
-	for i := 0; i < int(EpochInterval); i++ {
-		m.App.BeginBlock(abcitypes.RequestBeginBlock{})
+	// commit through the epoch, and add one more, the block reaching the end of
+	// the epoch generates the document
+	for i := 0; i < int(EpochInterval)+1; i++ {
+		m.App.BeginBlock(testBeginBlock(app.state))
 		m.App.Commit()
 	}
 
@@ -212,7 +218,7 @@ func TestPostDescriptorAndCommit(t *testing.T) {
 	apphash := appinfo.Response.LastBlockAppHash
 	key := storageKey(documentsBucket, []byte{}, epoch)
 	keyPath := "/" + url.PathEscape(string(key))
-	m.App.BeginBlock(abcitypes.RequestBeginBlock{})
+	m.App.BeginBlock(testBeginBlock(app.state))
 	m.App.Commit()
 
 	// make a query for the doc
@@ -235,3 +241,1082 @@ func TestPostDescriptorAndCommit(t *testing.T) {
 	err = verifier.VerifyValue(rsp.Response.ProofOps, apphash, keyPath, rsp.Response.Value)
 	require.Nil(err, "Invalid proof for app responses")
 }
+
+func TestStateSyncFromSnapshot(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	// setup application taking snapshots with small chunks
+	snapConfig := *kConfig
+	// the first epoch starts with the first block, the document is generated
+	// by the block reaching the end of the epoch
+	snapConfig.SnapshotInterval = EpochInterval + 1
+	snapConfig.SnapshotChunkSize = 512
+	db := dbm.NewMemDB()
+	defer db.Close()
+	logger := newDiscardLogger()
+	app := NewKatzenmintApplication(&snapConfig, db, testDBCacheSize, logger)
+	m := mock.ABCIApp{
+		App: app,
+	}
+
+	// post descriptors of providers and mixs
+	epoch := app.state.currentEpoch
+	privKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "GenerateKey()")
+	m.App.BeginBlock(testBeginBlock(app.state))
+	for layer := 0; layer <= app.state.layers; layer++ {
+		descLayer := 0
+		if layer == app.state.layers {
+			descLayer = pki.LayerProvider
+		}
+		for i := 0; i < app.state.minNodesPerLayer; i++ {
+			_, rawDesc, _ := testutil.CreateTestDescriptor(require, i, descLayer, epoch)
+			tx, err := FormTransaction(PublishMixDescriptor, epoch, EncodeHex(rawDesc), privKey)
+			require.NoError(err)
+			res, err := m.BroadcastTxCommit(context.Background(), tx)
+			require.Nil(err)
+			require.True(res.DeliverTx.IsOK(), res.DeliverTx.Log)
+		}
+	}
+	m.App.Commit()
+
+	// commit through the epoch so that a document is generated and snapshotted
+	for i := 0; i < int(EpochInterval); i++ {
+		m.App.BeginBlock(testBeginBlock(app.state))
+		m.App.Commit()
+	}
+	snapshots := app.ListSnapshots(abcitypes.RequestListSnapshots{}).Snapshots
+	require.Len(snapshots, 1)
+	snapshot := snapshots[0]
+	require.Equal(uint64(EpochInterval+1), snapshot.Height)
+	require.True(snapshot.Chunks > 1, "snapshot should be split into several chunks")
+	itree, err := app.state.tree.GetImmutable(int64(snapshot.Height))
+	require.Nil(err)
+	trustedHash, err := itree.Hash()
+	require.Nil(err)
+
+	// bring up a fresh application from the snapshot
+	freshDB := dbm.NewMemDB()
+	defer freshDB.Close()
+	fresh := NewKatzenmintApplication(kConfig, freshDB, testDBCacheSize, logger)
+	offer := fresh.OfferSnapshot(abcitypes.RequestOfferSnapshot{Snapshot: snapshot, AppHash: trustedHash})
+	require.Equal(abcitypes.ResponseOfferSnapshot_ACCEPT, offer.Result)
+	for index := uint32(0); index < snapshot.Chunks; index++ {
+		chunk := app.LoadSnapshotChunk(abcitypes.RequestLoadSnapshotChunk{
+			Height: snapshot.Height,
+			Format: snapshot.Format,
+			Chunk:  index,
+		}).Chunk
+		require.NotEmpty(chunk)
+
+		// a corrupted chunk should be refetched
+		if index == 0 {
+			corrupted := append([]byte{}, chunk...)
+			corrupted[0] ^= 0xFF
+			res := fresh.ApplySnapshotChunk(abcitypes.RequestApplySnapshotChunk{Index: index, Chunk: corrupted, Sender: "bad"})
+			require.Equal(abcitypes.ResponseApplySnapshotChunk_RETRY, res.Result)
+			require.Equal([]uint32{index}, res.RefetchChunks)
+			require.Equal([]string{"bad"}, res.RejectSenders)
+		}
+		res := fresh.ApplySnapshotChunk(abcitypes.RequestApplySnapshotChunk{Index: index, Chunk: chunk})
+		require.Equal(abcitypes.ResponseApplySnapshotChunk_ACCEPT, res.Result)
+	}
+
+	// check the restored state
+	info := fresh.Info(abcitypes.RequestInfo{})
+	assert.Equal(int64(snapshot.Height), info.LastBlockHeight)
+	assert.Equal(trustedHash, info.LastBlockAppHash)
+	assert.Equal(epoch+1, fresh.state.currentEpoch)
+	assert.Equal(int64(snapshot.Height), fresh.state.epochStartHeight)
+	require.NotNil(fresh.state.prevDocument)
+	assert.Equal(app.state.prevDocument.String(), fresh.state.prevDocument.String())
+
+	// the fresh application keeps committing blocks
+	fresh.BeginBlock(testBeginBlock(fresh.state))
+	fresh.Commit()
+	query, err := EncodeJson(Query{
+		Version: protocolVersion,
+		Epoch:   epoch,
+		Command: GetConsensus,
+		Payload: "",
+	})
+	require.Nil(err)
+	resp := fresh.Query(abcitypes.RequestQuery{Data: query})
+	require.True(resp.IsOK(), resp.Log)
+	_, err = s11n.VerifyAndParseDocument(resp.Value, fresh.state.currentEpoch)
+	require.Nil(err)
+}
+
+func TestOfferSnapshotRejectsMismatchedAppHash(t *testing.T) {
+	require := require.New(t)
+
+	// setup application taking a snapshot
+	snapConfig := *kConfig
+	snapConfig.SnapshotInterval = 1
+	db := dbm.NewMemDB()
+	defer db.Close()
+	logger := newDiscardLogger()
+	app := NewKatzenmintApplication(&snapConfig, db, testDBCacheSize, logger)
+	app.BeginBlock(testBeginBlock(app.state))
+	app.Commit()
+	snapshots := app.ListSnapshots(abcitypes.RequestListSnapshots{}).Snapshots
+	require.Len(snapshots, 1)
+	snapshot := snapshots[0]
+
+	// offer it to a fresh application with a wrong app hash
+	freshDB := dbm.NewMemDB()
+	defer freshDB.Close()
+	fresh := NewKatzenmintApplication(kConfig, freshDB, testDBCacheSize, logger)
+	offer := fresh.OfferSnapshot(abcitypes.RequestOfferSnapshot{Snapshot: snapshot, AppHash: []byte("wrong")})
+	require.Equal(abcitypes.ResponseOfferSnapshot_ACCEPT, offer.Result)
+	chunk := app.LoadSnapshotChunk(abcitypes.RequestLoadSnapshotChunk{Height: snapshot.Height, Format: snapshot.Format}).Chunk
+	res := fresh.ApplySnapshotChunk(abcitypes.RequestApplySnapshotChunk{Index: 0, Chunk: chunk})
+	require.Equal(abcitypes.ResponseApplySnapshotChunk_REJECT_SNAPSHOT, res.Result)
+	require.Equal(int64(0), fresh.state.blockHeight)
+}
+
+func TestSharedRandomValue(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	// setup application with two genesis validators
+	db := dbm.NewMemDB()
+	defer db.Close()
+	logger := newDiscardLogger()
+	app := NewKatzenmintApplication(kConfig, db, testDBCacheSize, logger)
+	m := mock.ABCIApp{
+		App: app,
+	}
+	privKeys := make([]*eddsa.PrivateKey, 3)
+	validators := make([]abcitypes.ValidatorUpdate, 0)
+	for i := range privKeys {
+		privKey, err := eddsa.NewKeypair(rand.Reader)
+		require.NoError(err, "eddsa.NewKeypair()")
+		privKeys[i] = privKey
+		if i < 2 {
+			validators = append(validators, abcitypes.UpdateValidator(privKey.PublicKey().Bytes(), 1, ""))
+		}
+	}
+	m.App.InitChain(abcitypes.RequestInitChain{Validators: validators})
+	epoch := app.state.currentEpoch
+	reveals := make([][]byte, len(privKeys))
+	for i := range reveals {
+		reveals[i] = make([]byte, SharedRandomLength)
+		_, err := rand.Reader.Read(reveals[i])
+		require.NoError(err)
+	}
+	post := func(command Command, idx int, payload []byte) *abcitypes.ResponseDeliverTx {
+		tx, err := FormTransaction(command, epoch, EncodeHex(payload), privKeys[idx])
+		require.NoError(err)
+		res, err := m.BroadcastTxCommit(context.Background(), tx)
+		require.Nil(err)
+		if !res.CheckTx.IsOK() {
+			return &abcitypes.ResponseDeliverTx{Code: res.CheckTx.Code, Log: res.CheckTx.Log}
+		}
+		return &res.DeliverTx
+	}
+	address := func(idx int) []byte {
+		tx := &Transaction{PublicKey: EncodeHex(privKeys[idx].PublicKey().Bytes())}
+		return []byte(tx.Address())
+	}
+
+	// commit phase, along with the descriptors for the document
+	m.App.BeginBlock(testBeginBlock(app.state))
+	for layer := 0; layer <= app.state.layers; layer++ {
+		descLayer := 0
+		if layer == app.state.layers {
+			descLayer = pki.LayerProvider
+		}
+		for i := 0; i < app.state.minNodesPerLayer; i++ {
+			_, rawDesc, _ := testutil.CreateTestDescriptor(require, i, descLayer, epoch)
+			res := post(PublishMixDescriptor, 0, rawDesc)
+			require.True(res.IsOK(), res.Log)
+		}
+	}
+	for i := range privKeys {
+		res := post(CommitSharedRandom, i, SharedRandomCommit(epoch, address(i), reveals[i]))
+		if i < 2 {
+			require.True(res.IsOK(), res.Log)
+		} else {
+			require.Equal(ErrTxSrvNotAuthorized.Code, res.Code)
+		}
+	}
+	res := post(RevealSharedRandom, 0, reveals[0])
+	require.Equal(ErrTxUpdateSrv.Code, res.Code, "reveal should not be accepted in commit phase")
+	res = post(CommitSharedRandom, 0, []byte("short"))
+	require.Equal(ErrTxSrvInvalidLength.Code, res.Code)
+	m.App.Commit()
+
+	// reveal phase
+	for IsSharedRandomCommitPhase(testBlockTime(app.state).Sub(app.state.epochStartTime), app.state.epochDuration) {
+		m.App.BeginBlock(testBeginBlock(app.state))
+		m.App.Commit()
+	}
+	m.App.BeginBlock(testBeginBlock(app.state))
+	res = post(CommitSharedRandom, 1, SharedRandomCommit(epoch, address(1), reveals[1]))
+	require.Equal(ErrTxUpdateSrv.Code, res.Code, "commit should not be accepted in reveal phase")
+	res = post(RevealSharedRandom, 1, reveals[0])
+	require.Equal(ErrTxUpdateSrv.Code, res.Code, "reveal should match the commit")
+	for i := 0; i < 2; i++ {
+		res = post(RevealSharedRandom, i, reveals[i])
+		require.True(res.IsOK(), res.Log)
+	}
+	m.App.Commit()
+
+	// finish the epoch
+	for app.state.currentEpoch == epoch {
+		m.App.BeginBlock(testBeginBlock(app.state))
+		m.App.Commit()
+	}
+
+	// the shared random value is stored and published in the document
+	srv, err := app.state.get(storageKey(srvBucket, []byte{}, epoch))
+	require.Nil(err)
+	require.Len(srv, SharedRandomLength)
+	doc := app.state.prevDocument
+	require.NotNil(doc)
+	assert.Equal(srv, doc.SharedRandomValue)
+	assert.Nil(VerifyTopology(doc, nil))
+
+	// the next document is assigned based on the previous one
+	epoch = app.state.currentEpoch
+	m.App.BeginBlock(testBeginBlock(app.state))
+	for layer := 0; layer <= app.state.layers; layer++ {
+		descLayer := 0
+		if layer == app.state.layers {
+			descLayer = pki.LayerProvider
+		}
+		for i := 0; i < app.state.minNodesPerLayer+1; i++ {
+			_, rawDesc, _ := testutil.CreateTestDescriptor(require, i, descLayer, epoch)
+			res := post(PublishMixDescriptor, 0, rawDesc)
+			require.True(res.IsOK(), res.Log)
+		}
+	}
+	m.App.Commit()
+	for app.state.currentEpoch == epoch {
+		m.App.BeginBlock(testBeginBlock(app.state))
+		m.App.Commit()
+	}
+	nextDoc := app.state.prevDocument
+	assert.NotEqual(srv, nextDoc.SharedRandomValue)
+	assert.Nil(VerifyTopology(nextDoc, doc))
+
+	// a tampered layer assignment is detected
+	nextDoc.Topology[0][0], nextDoc.Topology[1][0] = nextDoc.Topology[1][0], nextDoc.Topology[0][0]
+	assert.NotNil(VerifyTopology(nextDoc, doc))
+}
+
+func TestDescriptorAdmission(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	// setup application with all the admission policies and three validators
+	db := dbm.NewMemDB()
+	defer db.Close()
+	logger := newDiscardLogger()
+	genesis := config.DefaultGenesisState()
+	genesis.Admission = config.AdmissionConfig{
+		Policies: []string{
+			config.AdmissionAllowlist,
+			config.AdmissionRegistration,
+			config.AdmissionOperatorCap,
+		},
+		MaxDescriptorsPerOperator: 1,
+	}
+	appState, err := EncodeJson(genesis)
+	require.NoError(err)
+	app := NewKatzenmintApplication(kConfig, db, testDBCacheSize, logger)
+	m := mock.ABCIApp{
+		App: app,
+	}
+	privKeys := make([]*eddsa.PrivateKey, 3)
+	validators := make([]abcitypes.ValidatorUpdate, 0)
+	for i := range privKeys {
+		privKey, err := eddsa.NewKeypair(rand.Reader)
+		require.NoError(err, "eddsa.NewKeypair()")
+		privKeys[i] = privKey
+		validators = append(validators, abcitypes.UpdateValidator(privKey.PublicKey().Bytes(), 1, ""))
+	}
+	m.App.InitChain(abcitypes.RequestInitChain{Validators: validators, AppStateBytes: appState})
+	m.App.BeginBlock(testBeginBlock(app.state))
+	m.App.Commit()
+	epoch := app.state.currentEpoch
+	operator, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+	post := func(command Command, privKey *eddsa.PrivateKey, payload string) *abcitypes.ResponseDeliverTx {
+		tx, err := FormTransaction(command, epoch, payload, privKey)
+		require.NoError(err)
+		m.App.BeginBlock(testBeginBlock(app.state))
+		defer m.App.Commit()
+		res, err := m.BroadcastTxCommit(context.Background(), tx)
+		require.Nil(err)
+		if !res.CheckTx.IsOK() {
+			return &abcitypes.ResponseDeliverTx{Code: res.CheckTx.Code, Log: res.CheckTx.Log}
+		}
+		return &res.DeliverTx
+	}
+	vote := func(privKey *eddsa.PrivateKey, identityKey []byte, allowed bool) *abcitypes.ResponseDeliverTx {
+		raw, err := EncodeJson(&AllowlistVote{IdentityKey: identityKey, Allowed: allowed})
+		require.NoError(err)
+		return post(VoteAllowlist, privKey, string(raw))
+	}
+	descA, rawDescA, keyA := testutil.CreateTestDescriptor(require, 0, 0, epoch)
+	descB, rawDescB, keyB := testutil.CreateTestDescriptor(require, 1, 0, epoch)
+	idA, idB := descA.IdentityKey.Bytes(), descB.IdentityKey.Bytes()
+	register := func(privKey *eddsa.PrivateKey, identityKey *eddsa.PrivateKey, operator []byte) *abcitypes.ResponseDeliverTx {
+		raw, err := SignMixRegistration(identityKey, operator)
+		require.NoError(err)
+		return post(RegisterMixNode, privKey, string(raw))
+	}
+
+	// the descriptor is not admitted before being allowlisted
+	res := post(PublishMixDescriptor, operator, EncodeHex(rawDescA))
+	require.Equal(ErrTxDescNotAuthorized.Code, res.Code)
+
+	// the allowlist changes with more than two thirds of the voting power
+	res = vote(operator, idA, true)
+	require.Equal(ErrTxVoteNotAuthorized.Code, res.Code)
+	for i := range privKeys {
+		res = vote(privKeys[i], idA, true)
+		require.True(res.IsOK(), res.Log)
+		_, err = app.state.get(storageKey(allowlistBucket, idA, 0))
+		assert.Equal(i == len(privKeys)-1, err == nil, "allowlisted after %d votes", i+1)
+	}
+	res = vote(privKeys[0], idA, true)
+	require.True(res.IsOK(), "votes should be cleared once applied")
+	for i := range privKeys {
+		res = vote(privKeys[i], idB, true)
+		require.True(res.IsOK(), res.Log)
+	}
+
+	// the descriptor is not admitted before being registered
+	res = post(PublishMixDescriptor, operator, EncodeHex(rawDescA))
+	require.Equal(ErrTxDescNotAuthorized.Code, res.Code)
+	res = register(operator, &keyA, privKeys[0].PublicKey().Bytes())
+	require.Equal(ErrTxRegistrationParse.Code, res.Code, "signed for another operator")
+	for _, key := range []*eddsa.PrivateKey{&keyA, &keyB} {
+		res = register(operator, key, operator.PublicKey().Bytes())
+		require.True(res.IsOK(), res.Log)
+	}
+	res = register(privKeys[0], &keyA, privKeys[0].PublicKey().Bytes())
+	require.Equal(ErrTxUpdateReg.Code, res.Code, "registered by another operator")
+	res = post(RegisterMixNode, operator, EncodeHex([]byte("short")))
+	require.Equal(ErrTxRegistrationParse.Code, res.Code)
+
+	// the registered operator is capped regardless of the signer
+	res = post(PublishMixDescriptor, privKeys[0], EncodeHex(rawDescA))
+	require.True(res.IsOK(), res.Log)
+	res = post(PublishMixDescriptor, privKeys[1], EncodeHex(rawDescB))
+	require.Equal(ErrTxDescNotAuthorized.Code, res.Code)
+
+	// query the admission decisions
+	query := func(identityKey []byte) abcitypes.ResponseQuery {
+		query, err := EncodeJson(&Query{
+			Version: protocolVersion,
+			Epoch:   epoch,
+			Command: GetAdmission,
+			Payload: EncodeHex(identityKey),
+		})
+		require.NoError(err)
+		return m.App.Query(abcitypes.RequestQuery{Data: query})
+	}
+	m.App.BeginBlock(testBeginBlock(app.state))
+	m.App.Commit()
+	resp := query(idA)
+	require.True(resp.IsOK(), resp.Log)
+	require.NotNil(resp.ProofOps)
+	decision := new(AdmissionDecision)
+	require.NoError(DecodeJson(resp.Value, decision))
+	assert.Equal(idA, decision.IdentityKey)
+	assert.Equal(epoch, decision.Epoch)
+	assert.Equal(operator.PublicKey().Bytes(), decision.Operator)
+	assert.Equal(genesis.Admission.Policies, decision.Policies)
+	resp = query(idB)
+	assert.Equal(ErrQueryNoAdmission.Code, resp.Code)
+}
+
+func TestParameterGovernance(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	// setup application with three validators
+	db := dbm.NewMemDB()
+	defer db.Close()
+	logger := newDiscardLogger()
+	cfg := *kConfig
+	app := NewKatzenmintApplication(&cfg, db, testDBCacheSize, logger)
+	m := mock.ABCIApp{
+		App: app,
+	}
+	privKeys := make([]*eddsa.PrivateKey, 4)
+	validators := make([]abcitypes.ValidatorUpdate, 0)
+	for i := range privKeys {
+		privKey, err := eddsa.NewKeypair(rand.Reader)
+		require.NoError(err, "eddsa.NewKeypair()")
+		privKeys[i] = privKey
+		if i < 3 {
+			validators = append(validators, abcitypes.UpdateValidator(privKey.PublicKey().Bytes(), 1, ""))
+		}
+	}
+	m.App.InitChain(abcitypes.RequestInitChain{Validators: validators})
+	epoch := app.state.currentEpoch
+	post := func(command Command, idx int, txEpoch uint64, payload string) *abcitypes.ResponseDeliverTx {
+		tx, err := FormTransaction(command, txEpoch, payload, privKeys[idx])
+		require.NoError(err)
+		res, err := m.BroadcastTxCommit(context.Background(), tx)
+		require.Nil(err)
+		if !res.CheckTx.IsOK() {
+			return &abcitypes.ResponseDeliverTx{Code: res.CheckTx.Code, Log: res.CheckTx.Log}
+		}
+		return &res.DeliverTx
+	}
+	propose := func(idx int, params *MixnetParameters) (*abcitypes.ResponseDeliverTx, []byte) {
+		raw, err := EncodeJson(params)
+		require.NoError(err)
+		return post(ProposeParameters, idx, epoch, string(raw)), ParameterProposalID(raw)
+	}
+
+	// descriptors for two epochs, along with the proposals
+	m.App.BeginBlock(testBeginBlock(app.state))
+	for e := epoch; e < epoch+2; e++ {
+		for layer := 0; layer <= app.state.layers; layer++ {
+			descLayer := 0
+			if layer == app.state.layers {
+				descLayer = pki.LayerProvider
+			}
+			for i := 0; i < app.state.minNodesPerLayer; i++ {
+				_, rawDesc, _ := testutil.CreateTestDescriptor(require, i, descLayer, e)
+				res := post(PublishMixDescriptor, 0, e, EncodeHex(rawDesc))
+				require.True(res.IsOK(), res.Log)
+			}
+		}
+	}
+	oldParams := *app.state.parameters
+	adopted := &MixnetParameters{
+		Layers:           app.state.layers,
+		MinNodesPerLayer: app.state.minNodesPerLayer,
+		Parameters:       oldParams,
+	}
+	adopted.Parameters.SendRatePerMinute = oldParams.SendRatePerMinute + 1
+	adopted.Parameters.LambdaP = oldParams.LambdaP * 2
+	rejected := &MixnetParameters{
+		Layers:           app.state.layers,
+		MinNodesPerLayer: app.state.minNodesPerLayer,
+		Parameters:       oldParams,
+	}
+	rejected.Parameters.SendRatePerMinute = oldParams.SendRatePerMinute + 2
+	res, adoptedID := propose(0, adopted)
+	require.True(res.IsOK(), res.Log)
+	res, rejectedID := propose(1, rejected)
+	require.True(res.IsOK(), res.Log)
+	res, _ = propose(0, adopted)
+	require.Equal(ErrTxUpdateProp.Code, res.Code, "duplicated proposal")
+	res, _ = propose(3, rejected)
+	require.Equal(ErrTxVoteNotAuthorized.Code, res.Code)
+	res, _ = propose(0, &MixnetParameters{Parameters: oldParams})
+	require.Equal(ErrTxProposalParse.Code, res.Code)
+
+	// votes of two thirds of the voting power do not suffice
+	res = post(VoteParameters, 1, epoch, EncodeHex(adoptedID))
+	require.True(res.IsOK(), res.Log)
+	res = post(VoteParameters, 1, epoch, EncodeHex(adoptedID))
+	require.Equal(ErrTxUpdateProp.Code, res.Code, "duplicated vote")
+	res = post(VoteParameters, 2, epoch, EncodeHex(adoptedID))
+	require.True(res.IsOK(), res.Log)
+	res = post(VoteParameters, 2, epoch, EncodeHex(ParameterProposalID([]byte("unknown"))))
+	require.Equal(ErrTxUpdateProp.Code, res.Code)
+	res = post(VoteParameters, 3, epoch, EncodeHex(rejectedID))
+	require.Equal(ErrTxVoteNotAuthorized.Code, res.Code)
+	res = post(VoteParameters, 0, epoch, EncodeHex(rejectedID))
+	require.True(res.IsOK(), res.Log)
+	m.App.Commit()
+
+	// the parameters are tallied at the end of the epoch
+	for app.state.currentEpoch == epoch {
+		require.Equal(oldParams, *app.state.parameters)
+		m.App.BeginBlock(testBeginBlock(app.state))
+		m.App.Commit()
+	}
+	require.NotNil(app.state.prevDocument)
+	assert.Equal(oldParams.SendRatePerMinute, app.state.prevDocument.SendRatePerMinute)
+	assert.Equal(adopted.Parameters, *app.state.parameters)
+	for _, id := range [][]byte{adoptedID, rejectedID} {
+		_, err := app.state.get(storageKey(proposalsBucket, id, epoch))
+		assert.NotNil(err, "proposals should be removed after the tally")
+	}
+
+	// the next document uses the adopted parameters
+	for app.state.currentEpoch == epoch+1 {
+		m.App.BeginBlock(testBeginBlock(app.state))
+		m.App.Commit()
+	}
+	require.NotNil(app.state.prevDocument)
+	assert.Equal(adopted.Parameters.SendRatePerMinute, app.state.prevDocument.SendRatePerMinute)
+	assert.Equal(adopted.Parameters.LambdaP, app.state.prevDocument.LambdaP)
+
+	// the parameters are loaded back from the tree
+	state := NewKatzenmintState(&cfg, db, testDBCacheSize)
+	assert.Equal(adopted.Parameters, *state.parameters)
+}
+
+func TestParameterGovernanceLayers(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	// setup application with three validators
+	db := dbm.NewMemDB()
+	defer db.Close()
+	logger := newDiscardLogger()
+	cfg := *kConfig
+	app := NewKatzenmintApplication(&cfg, db, testDBCacheSize, logger)
+	m := mock.ABCIApp{
+		App: app,
+	}
+	privKeys := make([]*eddsa.PrivateKey, 3)
+	validators := make([]abcitypes.ValidatorUpdate, 0)
+	for i := range privKeys {
+		privKey, err := eddsa.NewKeypair(rand.Reader)
+		require.NoError(err, "eddsa.NewKeypair()")
+		privKeys[i] = privKey
+		validators = append(validators, abcitypes.UpdateValidator(privKey.PublicKey().Bytes(), 1, ""))
+	}
+	m.App.InitChain(abcitypes.RequestInitChain{Validators: validators})
+	epoch := app.state.currentEpoch
+	post := func(command Command, idx int, payload string) *abcitypes.ResponseDeliverTx {
+		tx, err := FormTransaction(command, app.state.currentEpoch, payload, privKeys[idx])
+		require.NoError(err)
+		res, err := m.BroadcastTxCommit(context.Background(), tx)
+		require.Nil(err)
+		if !res.CheckTx.IsOK() {
+			return &abcitypes.ResponseDeliverTx{Code: res.CheckTx.Code, Log: res.CheckTx.Log}
+		}
+		return &res.DeliverTx
+	}
+	publish := func(e uint64, mixes int) {
+		for i := 0; i < mixes+1; i++ {
+			layer := 0
+			if i == mixes {
+				layer = pki.LayerProvider
+			}
+			_, rawDesc, _ := testutil.CreateTestDescriptor(require, i, layer, e)
+			tx, err := FormTransaction(PublishMixDescriptor, e, EncodeHex(rawDesc), privKeys[0])
+			require.NoError(err)
+			res, err := m.BroadcastTxCommit(context.Background(), tx)
+			require.Nil(err)
+			require.True(res.DeliverTx.IsOK(), res.DeliverTx.Log)
+		}
+	}
+	adopt := func(params *MixnetParameters) {
+		raw, err := EncodeJson(params)
+		require.NoError(err)
+		res := post(ProposeParameters, 0, string(raw))
+		require.True(res.IsOK(), res.Log)
+		for i := 1; i < len(privKeys); i++ {
+			res = post(VoteParameters, i, EncodeHex(ParameterProposalID(raw)))
+			require.True(res.IsOK(), res.Log)
+		}
+	}
+	finishEpoch := func(e uint64) {
+		for i := 0; app.state.currentEpoch == e; i++ {
+			require.Less(i, 1000, "epoch (%d) is stalled", e)
+			m.App.BeginBlock(testBeginBlock(app.state))
+			m.App.Commit()
+		}
+	}
+	mixes := cfg.Layers * cfg.MinNodesPerLayer
+
+	// the first document has the configured layers
+	m.App.BeginBlock(testBeginBlock(app.state))
+	publish(epoch, mixes)
+	publish(epoch+1, mixes)
+	m.App.Commit()
+	finishEpoch(epoch)
+	doc := app.state.prevDocument
+	require.NotNil(doc)
+	require.Len(doc.Topology, cfg.Layers)
+
+	// parameters the network cannot meet are rejected
+	raw, err := EncodeJson(&MixnetParameters{
+		Layers:           cfg.Layers,
+		MinNodesPerLayer: cfg.MinNodesPerLayer + 1,
+		Parameters:       *app.state.parameters,
+	})
+	require.NoError(err)
+	m.App.BeginBlock(testBeginBlock(app.state))
+	res := post(ProposeParameters, 0, string(raw))
+	require.Equal(ErrTxUpdateProp.Code, res.Code)
+
+	// the layers shrink through governance
+	adopt(&MixnetParameters{
+		Layers:           cfg.Layers - 1,
+		MinNodesPerLayer: cfg.MinNodesPerLayer,
+		Parameters:       *app.state.parameters,
+	})
+	m.App.Commit()
+	finishEpoch(epoch + 1)
+	require.Equal(cfg.Layers-1, app.state.layers)
+
+	// the next document is assigned from scratch on the new layers
+	m.App.BeginBlock(testBeginBlock(app.state))
+	publish(epoch+2, mixes)
+	m.App.Commit()
+	prevDoc := app.state.prevDocument
+	finishEpoch(epoch + 2)
+	doc = app.state.prevDocument
+	require.Len(doc.Topology, cfg.Layers-1)
+	nodes := 0
+	for _, layer := range doc.Topology {
+		assert.GreaterOrEqual(len(layer), cfg.MinNodesPerLayer)
+		nodes += len(layer)
+	}
+	assert.Equal(mixes, nodes)
+	assert.Nil(VerifyTopology(doc, prevDoc))
+
+	// a stalled epoch is recovered by adopting parameters during the epoch
+	epoch = app.state.currentEpoch
+	m.App.BeginBlock(testBeginBlock(app.state))
+	publish(epoch, cfg.Layers-1)
+	m.App.Commit()
+	for !app.state.newDocumentRequired() {
+		m.App.BeginBlock(testBeginBlock(app.state))
+		m.App.Commit()
+	}
+	m.App.BeginBlock(testBeginBlock(app.state))
+	m.App.Commit()
+	require.Equal(epoch, app.state.currentEpoch, "epoch should be stalled")
+	m.App.BeginBlock(testBeginBlock(app.state))
+	adopt(&MixnetParameters{
+		Layers:           cfg.Layers - 1,
+		MinNodesPerLayer: 1,
+		Parameters:       *app.state.parameters,
+	})
+	m.App.Commit()
+	finishEpoch(epoch)
+	require.Equal(1, app.state.minNodesPerLayer)
+}
+
+func TestAuthorityChanges(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	// setup application with six validators
+	db := dbm.NewMemDB()
+	defer db.Close()
+	logger := newDiscardLogger()
+	app := NewKatzenmintApplication(kConfig, db, testDBCacheSize, logger)
+	m := mock.ABCIApp{
+		App: app,
+	}
+	privKeys := make([]*eddsa.PrivateKey, 6)
+	validators := make([]abcitypes.ValidatorUpdate, 0)
+	for i := range privKeys {
+		privKey, err := eddsa.NewKeypair(rand.Reader)
+		require.NoError(err, "eddsa.NewKeypair()")
+		privKeys[i] = privKey
+		validators = append(validators, abcitypes.UpdateValidator(privKey.PublicKey().Bytes(), 1, ""))
+	}
+	m.App.InitChain(abcitypes.RequestInitChain{Validators: validators})
+	m.App.BeginBlock(testBeginBlock(app.state))
+	m.App.Commit()
+	epoch := app.state.currentEpoch
+	broadcast := func(command Command, signer int, rawCert []byte) *abcitypes.ResponseDeliverTx {
+		tx, err := FormTransaction(command, epoch, EncodeHex(rawCert), privKeys[signer])
+		require.NoError(err)
+		res, err := m.BroadcastTxCommit(context.Background(), tx)
+		require.Nil(err)
+		if !res.CheckTx.IsOK() {
+			return &abcitypes.ResponseDeliverTx{Code: res.CheckTx.Code, Log: res.CheckTx.Log}
+		}
+		return &res.DeliverTx
+	}
+	post := func(command Command, target int, power int64, signers ...int) *abcitypes.ResponseDeliverTx {
+		change := &AuthorityChange{
+			PubKey:   privKeys[target].PublicKey().Bytes(),
+			Power:    power,
+			Epoch:    epoch,
+			Sequence: app.state.authorityChangeSequence(),
+		}
+		rawCert, err := SignAuthorityChange(privKeys[signers[0]], change)
+		require.NoError(err)
+		for _, signer := range signers[1:] {
+			rawCert, err = cert.SignMulti(privKeys[signer], rawCert)
+			require.NoError(err)
+		}
+		return broadcast(command, signers[0], rawCert)
+	}
+	power := func(idx int) int64 {
+		tx := &Transaction{PublicKey: EncodeHex(privKeys[idx].PublicKey().Bytes())}
+		val, err := app.state.get(storageKey(authoritiesBucket, []byte(tx.Address()), 0))
+		if err != nil {
+			return 0
+		}
+		auth, err := VerifyAndParseAuthority(val)
+		require.NoError(err)
+		return auth.Val.Power
+	}
+
+	// changes require more than two thirds of the voting power
+	m.App.BeginBlock(testBeginBlock(app.state))
+	res := post(UpdateAuthorityPower, 0, 2, 0, 1, 2, 3)
+	require.Equal(ErrAuthorityChangeNoQuorum.Code, res.Code)
+	res = post(UpdateAuthorityPower, 0, 2, 0, 1, 2, 3, 4)
+	require.True(res.IsOK(), res.Log)
+	assert.Equal(int64(2), power(0))
+
+	// no authority may exceed one third of the voting power
+	res = post(UpdateAuthorityPower, 0, 3, 0, 1, 2, 3, 4, 5)
+	require.Equal(ErrAuthorityPowerCap.Code, res.Code)
+	res = post(UpdateAuthorityPower, 1, 0, 0, 1, 2, 3, 4, 5)
+	require.Equal(ErrAuthorityChangeParse.Code, res.Code, "power update cannot remove")
+
+	// removal of an authority
+	res = post(RemoveAuthority, 5, 1, 0, 1, 2, 3)
+	require.Equal(ErrAuthorityChangeParse.Code, res.Code, "removal cannot update power")
+	res = post(RemoveAuthority, 5, 0, 0, 1, 2, 3)
+	require.True(res.IsOK(), res.Log)
+	assert.Equal(int64(0), power(5))
+	res = post(RemoveAuthority, 5, 0, 0, 1, 2, 3, 4)
+	require.Equal(ErrAuthorityNotFound.Code, res.Code)
+	res = post(RemoveAuthority, 4, 0, 5, 0, 1)
+	require.Equal(ErrAuthorityChangeNoQuorum.Code, res.Code, "removed authority cannot sign")
+	res = post(RemoveAuthority, 4, 0, 0, 1, 2, 3, 4)
+	require.Equal(ErrAuthorityPowerCap.Code, res.Code)
+
+	// a certified change cannot be replayed
+	change := &AuthorityChange{
+		PubKey:   privKeys[1].PublicKey().Bytes(),
+		Power:    1,
+		Epoch:    epoch,
+		Sequence: app.state.authorityChangeSequence() - 1,
+	}
+	rawCert, err := SignAuthorityChange(privKeys[0], change)
+	require.NoError(err)
+	for _, signer := range []int{1, 2, 3, 4} {
+		rawCert, err = cert.SignMulti(privKeys[signer], rawCert)
+		require.NoError(err)
+	}
+	res = broadcast(UpdateAuthorityPower, 0, rawCert)
+	require.Equal(ErrAuthorityChangeSequence.Code, res.Code)
+
+	// the changes are passed to tendermint
+	updates := m.App.EndBlock(abcitypes.RequestEndBlock{}).ValidatorUpdates
+	require.Len(updates, 2)
+	assert.Equal(int64(2), updates[0].Power)
+	assert.Equal(int64(0), updates[1].Power)
+	m.App.Commit()
+	assert.Equal(int64(2), power(0))
+	assert.Equal(int64(0), power(5))
+}
+
+func TestAuthorityPowerCapBootstrap(t *testing.T) {
+	require := require.New(t)
+
+	db := dbm.NewMemDB()
+	defer db.Close()
+	logger := newDiscardLogger()
+	app := NewKatzenmintApplication(kConfig, db, testDBCacheSize, logger)
+	privKeys := make([]*eddsa.PrivateKey, 5)
+	addrs := make([]string, len(privKeys))
+	for i := range privKeys {
+		privKey, err := eddsa.NewKeypair(rand.Reader)
+		require.NoError(err, "eddsa.NewKeypair()")
+		privKeys[i] = privKey
+		addrs[i] = (&Transaction{PublicKey: EncodeHex(privKey.PublicKey().Bytes())}).Address()
+	}
+	validator := func(idx int) abcitypes.ValidatorUpdate {
+		return abcitypes.UpdateValidator(privKeys[idx].PublicKey().Bytes(), 1, "")
+	}
+	app.InitChain(abcitypes.RequestInitChain{Validators: []abcitypes.ValidatorUpdate{validator(0)}})
+
+	// the set grows from a single authority
+	for i := 1; i < 4; i++ {
+		require.True(app.state.isWithinPowerCap(addrs[i], 1), "authority %d", i)
+		require.NoError(app.state.updateAuthority(nil, validator(i)))
+	}
+
+	// the cap applies once there are enough authorities
+	require.False(app.state.isWithinPowerCap(addrs[4], 3))
+	require.True(app.state.isWithinPowerCap(addrs[4], 1))
+	require.False(app.state.isWithinPowerCap(addrs[0], 2))
+
+	// and the set shrinks back
+	require.True(app.state.isWithinPowerCap(addrs[3], 0))
+	require.NoError(app.state.updateAuthorityPower(abcitypes.UpdateValidator(privKeys[3].PublicKey().Bytes(), 0, "")))
+	require.True(app.state.isWithinPowerCap(addrs[2], 0))
+	require.NoError(app.state.updateAuthorityPower(abcitypes.UpdateValidator(privKeys[2].PublicKey().Bytes(), 0, "")))
+	require.True(app.state.isWithinPowerCap(addrs[1], 0))
+	require.NoError(app.state.updateAuthorityPower(abcitypes.UpdateValidator(privKeys[1].PublicKey().Bytes(), 0, "")))
+	require.False(app.state.isWithinPowerCap(addrs[0], 0), "the last authority cannot be removed")
+}
+
+func TestAuthorityPowerCapThreeAuthorities(t *testing.T) {
+	require := require.New(t)
+
+	db := dbm.NewMemDB()
+	defer db.Close()
+	logger := newDiscardLogger()
+	app := NewKatzenmintApplication(kConfig, db, testDBCacheSize, logger)
+	privKeys := make([]*eddsa.PrivateKey, 4)
+	addrs := make([]string, len(privKeys))
+	validators := make([]abcitypes.ValidatorUpdate, len(privKeys))
+	for i := range privKeys {
+		privKey, err := eddsa.NewKeypair(rand.Reader)
+		require.NoError(err, "eddsa.NewKeypair()")
+		privKeys[i] = privKey
+		addrs[i] = (&Transaction{PublicKey: EncodeHex(privKey.PublicKey().Bytes())}).Address()
+		validators[i] = abcitypes.UpdateValidator(privKey.PublicKey().Bytes(), 2, "")
+	}
+	validators[3].Power = 1
+	app.InitChain(abcitypes.RequestInitChain{Validators: validators})
+
+	// three authorities only meet the cap with equal powers
+	require.True(app.state.isWithinPowerCap(addrs[3], 0))
+	require.False(app.state.isWithinPowerCap(addrs[0], 0))
+	require.NoError(app.state.updateAuthorityPower(abcitypes.UpdateValidator(privKeys[3].PublicKey().Bytes(), 0, "")))
+	require.False(app.state.isWithinPowerCap(addrs[0], 100))
+	require.False(app.state.isWithinPowerCap(addrs[0], 3))
+	require.False(app.state.isWithinPowerCap(addrs[0], 1))
+	require.True(app.state.isWithinPowerCap(addrs[0], 2))
+
+	// and two authorities as well
+	require.True(app.state.isWithinPowerCap(addrs[2], 0))
+	require.NoError(app.state.updateAuthorityPower(abcitypes.UpdateValidator(privKeys[2].PublicKey().Bytes(), 0, "")))
+	require.False(app.state.isWithinPowerCap(addrs[0], 3))
+	require.True(app.state.isWithinPowerCap(addrs[0], 2))
+}
+
+func TestQueryAuthoritiesAndDescriptors(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	// setup application with two validators
+	db := dbm.NewMemDB()
+	defer db.Close()
+	logger := newDiscardLogger()
+	app := NewKatzenmintApplication(kConfig, db, testDBCacheSize, logger)
+	m := mock.ABCIApp{
+		App: app,
+	}
+	validators := make([]abcitypes.ValidatorUpdate, 0)
+	for i := 0; i < 2; i++ {
+		privKey, err := eddsa.NewKeypair(rand.Reader)
+		require.NoError(err, "eddsa.NewKeypair()")
+		validators = append(validators, abcitypes.UpdateValidator(privKey.PublicKey().Bytes(), int64(i+1), ""))
+	}
+	m.App.InitChain(abcitypes.RequestInitChain{Validators: validators})
+	epoch := app.state.currentEpoch
+
+	// post descriptors
+	m.App.BeginBlock(testBeginBlock(app.state))
+	privKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err)
+	descs := make([]*pki.MixDescriptor, 0)
+	rawDescs := make([][]byte, 0)
+	for i := 0; i < 3; i++ {
+		desc, rawDesc, _ := testutil.CreateTestDescriptor(require, i, 0, epoch)
+		tx, err := FormTransaction(PublishMixDescriptor, epoch, EncodeHex(rawDesc), privKey)
+		require.NoError(err)
+		res, err := m.BroadcastTxCommit(context.Background(), tx)
+		require.Nil(err)
+		require.True(res.DeliverTx.IsOK(), res.DeliverTx.Log)
+		descs = append(descs, desc)
+		rawDescs = append(rawDescs, rawDesc)
+	}
+	m.App.Commit()
+	appinfo, err := m.ABCIInfo(context.Background())
+	require.Nil(err)
+	apphash := appinfo.Response.LastBlockAppHash
+	m.App.BeginBlock(testBeginBlock(app.state))
+	m.App.Commit()
+
+	verifier := merkle.NewProofRuntime()
+	verifier.RegisterOpDecoder(costypes.ProofOpIAVLCommitment, costypes.CommitmentOpDecoder)
+	query := func(command Command, epoch uint64, payload string) abcitypes.ResponseQuery {
+		query, err := EncodeJson(&Query{
+			Version: protocolVersion,
+			Epoch:   epoch,
+			Command: command,
+			Payload: payload,
+		})
+		require.NoError(err)
+		resp := m.App.Query(abcitypes.RequestQuery{Data: query})
+		if resp.IsOK() {
+			keyPath := "/" + url.PathEscape(string(resp.Key))
+			err = verifier.VerifyValue(resp.ProofOps, apphash, keyPath, resp.Value)
+			require.Nil(err, "Invalid proof for app responses")
+		}
+		return resp
+	}
+
+	// authorities with their power
+	resp := query(GetAuthorities, 0, "")
+	require.True(resp.IsOK(), resp.Log)
+	var auths []Authority
+	require.NoError(DecodeJson(resp.Value, &auths))
+	require.Len(auths, 2)
+	for _, val := range validators {
+		found := false
+		for _, auth := range auths {
+			if bytes.Equal(auth.PubKey, val.PubKey.GetEd25519()) {
+				found = true
+				assert.Equal(val.Power, auth.Power)
+			}
+		}
+		assert.True(found)
+	}
+
+	// descriptors of the epoch
+	resp = query(GetDescriptors, epoch, "")
+	require.True(resp.IsOK(), resp.Log)
+	index := make([][]byte, 0)
+	require.NoError(DecodeJson(resp.Value, &index))
+	require.Len(index, len(descs))
+	for i, desc := range descs {
+		assert.Equal(desc.IdentityKey.Bytes(), index[i])
+		resp = query(GetDescriptor, epoch, EncodeHex(desc.IdentityKey.Bytes()))
+		require.True(resp.IsOK(), resp.Log)
+		assert.Equal(rawDescs[i], resp.Value)
+	}
+	resp = query(GetDescriptors, epoch+1, "")
+	assert.Equal(ErrQueryNoDescriptor.Code, resp.Code)
+	resp = query(GetDescriptor, epoch+1, EncodeHex(descs[0].IdentityKey.Bytes()))
+	assert.Equal(ErrQueryNoDescriptor.Code, resp.Code)
+}
+
+func TestReliabilityReports(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	// setup application excluding the nodes returning less than half of the loops
+	db := dbm.NewMemDB()
+	defer db.Close()
+	logger := newDiscardLogger()
+	genesis := config.DefaultGenesisState()
+	genesis.Reliability = config.ReliabilityConfig{Threshold: 0.5, MinSamples: 10}
+	appState, err := EncodeJson(genesis)
+	require.NoError(err)
+	app := NewKatzenmintApplication(kConfig, db, testDBCacheSize, logger)
+	m := mock.ABCIApp{
+		App: app,
+	}
+	m.App.InitChain(abcitypes.RequestInitChain{AppStateBytes: appState})
+	privKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+	post := func(command Command, payload []byte) *abcitypes.ResponseDeliverTx {
+		tx, err := FormTransaction(command, app.state.currentEpoch, EncodeHex(payload), privKey)
+		require.NoError(err)
+		res, err := m.BroadcastTxCommit(context.Background(), tx)
+		require.Nil(err)
+		if !res.CheckTx.IsOK() {
+			return &abcitypes.ResponseDeliverTx{Code: res.CheckTx.Code, Log: res.CheckTx.Log}
+		}
+		return &res.DeliverTx
+	}
+	publish := func(mixes, providers int) ([][]byte, []eddsa.PrivateKey) {
+		epoch := app.state.currentEpoch
+		ids := make([][]byte, 0)
+		keys := make([]eddsa.PrivateKey, 0)
+		m.App.BeginBlock(testBeginBlock(app.state))
+		for i := 0; i < mixes+providers; i++ {
+			layer := 0
+			if i >= mixes {
+				layer = pki.LayerProvider
+			}
+			desc, rawDesc, identityKey := testutil.CreateTestDescriptor(require, i, layer, epoch)
+			res := post(PublishMixDescriptor, rawDesc)
+			require.True(res.IsOK(), res.Log)
+			ids = append(ids, desc.IdentityKey.Bytes())
+			keys = append(keys, identityKey)
+		}
+		m.App.Commit()
+		return ids, keys
+	}
+	finishEpoch := func() {
+		for epoch := app.state.currentEpoch; app.state.currentEpoch == epoch; {
+			m.App.BeginBlock(testBeginBlock(app.state))
+			m.App.Commit()
+		}
+	}
+
+	// the nodes of the first document report on the nodes of the next one
+	minMixes := app.state.layers * app.state.minNodesPerLayer
+	_, reporters := publish(minMixes, 1)
+	finishEpoch()
+	reportEpoch := app.state.currentEpoch - 1
+	ids, _ := publish(minMixes+1, 2)
+	lossy, flaky, lossyProvider := ids[0], ids[1], ids[minMixes+2]
+	report := func(reporter *eddsa.PrivateKey, nodes ...NodeReliability) []byte {
+		rawCert, err := SignReliabilityReport(reporter, &ReliabilityReport{
+			Reporter: reporter.PublicKey().Bytes(),
+			Epoch:    reportEpoch,
+			Nodes:    nodes,
+		})
+		require.NoError(err)
+		return rawCert
+	}
+	m.App.BeginBlock(testBeginBlock(app.state))
+	for i, ratio := range []uint64{1, 2, 20} {
+		res := post(PostReliability, report(&reporters[i],
+			NodeReliability{IdentityKey: lossy, Sent: 20, Received: ratio, SentAvoiding: 40, ReceivedAvoiding: 40},
+			NodeReliability{IdentityKey: flaky, Sent: 20, Received: 4, SentAvoiding: 40, ReceivedAvoiding: 40},
+			NodeReliability{IdentityKey: lossyProvider, Sent: 20, Received: 0, SentAvoiding: 40, ReceivedAvoiding: 40},
+			NodeReliability{IdentityKey: ids[3], Sent: 20, Received: 5, SentAvoiding: 40, ReceivedAvoiding: 10},
+		))
+		require.True(res.IsOK(), res.Log)
+	}
+	res := post(PostReliability, report(&reporters[0]))
+	assert.Equal(ErrTxUpdateRep.Code, res.Code, "a node reports once per epoch")
+
+	// the reports are ignored for self reports, too few loops and no baseline
+	res = post(PostReliability, report(&reporters[3],
+		NodeReliability{IdentityKey: reporters[3].PublicKey().Bytes(), Sent: 20, Received: 0, SentAvoiding: 40, ReceivedAvoiding: 40},
+		NodeReliability{IdentityKey: ids[2], Sent: 9, Received: 0, SentAvoiding: 40, ReceivedAvoiding: 40},
+		NodeReliability{IdentityKey: ids[4], Sent: 20, Received: 0, SentAvoiding: 9, ReceivedAvoiding: 9},
+		NodeReliability{IdentityKey: ids[5], Sent: 20, Received: 0, SentAvoiding: 40, ReceivedAvoiding: 0},
+	))
+	require.True(res.IsOK(), res.Log)
+
+	// the reports are signed by a node of the document
+	stranger, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err, "eddsa.NewKeypair()")
+	res = post(PostReliability, report(stranger))
+	assert.Equal(ErrReliabilityReporterUnknown.Code, res.Code)
+	forged := report(&reporters[4])
+	forged[len(forged)-1] ^= 0xFF
+	res = post(PostReliability, forged)
+	assert.Equal(ErrReliabilityReportParse.Code, res.Code)
+	res = post(PostReliability, []byte("not a report"))
+	assert.Equal(ErrReliabilityReportParse.Code, res.Code)
+	reportEpoch--
+	res = post(PostReliability, report(&reporters[4]))
+	assert.Equal(ErrReliabilityReportEpoch.Code, res.Code, "the reports are on the previous epoch")
+	reportEpoch++
+	m.App.Commit()
+
+	// the losses of the other hops are not attributed to a node
+	reliabilities := app.state.nodeReliabilities(app.state.currentEpoch)
+	assert.Equal(1.0, reliabilities[string(ids[3])])
+	assert.Less(reliabilities[string(lossy)], 0.5)
+	for _, id := range [][]byte{ids[2], ids[4], ids[5]} {
+		assert.NotContains(reliabilities, string(id))
+	}
+
+	// the least reliable nodes are excluded while there are enough nodes
+	finishEpoch()
+	doc := app.state.prevDocument
+	require.NotNil(doc)
+	_, err = doc.GetNodeByKey(lossy)
+	assert.NotNil(err, "the lossy mix should be excluded")
+	_, err = doc.GetNodeByKey(flaky)
+	assert.Nil(err, "the flaky mix is kept for the minimum number of mixes")
+	_, err = doc.GetNodeByKey(ids[2])
+	assert.Nil(err, "reports with too few loops are ignored")
+	_, err = doc.GetProviderByKey(lossyProvider)
+	assert.NotNil(err, "the lossy provider should be excluded")
+	_, err = doc.GetProviderByKey(ids[minMixes+1])
+	assert.Nil(err)
+	nodes := 0
+	for _, layer := range doc.Topology {
+		nodes += len(layer)
+	}
+	assert.Equal(minMixes, nodes)
+
+	// the reports cannot be replayed in the following epochs
+	m.App.BeginBlock(testBeginBlock(app.state))
+	res = post(PostReliability, report(&reporters[0]))
+	assert.Equal(ErrReliabilityReportEpoch.Code, res.Code)
+	m.App.Commit()
+}
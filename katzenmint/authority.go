@@ -1,14 +1,24 @@
 package katzenmint
 
 import (
+	"bytes"
+	"encoding/binary"
 	"fmt"
+	"sort"
 
+	"github.com/hashcloak/Meson/katzenmint/cert"
+	"github.com/katzenpost/core/crypto/eddsa"
 	abcitypes "github.com/tendermint/tendermint/abci/types"
 	"github.com/tendermint/tendermint/crypto/ed25519"
 	cryptoenc "github.com/tendermint/tendermint/crypto/encoding"
+	pc "github.com/tendermint/tendermint/proto/tendermint/crypto"
 	"github.com/ugorji/go/codec"
 )
 
+// minCappedAuthorities is the minimum number of authorities which can meet
+// the voting power cap.
+const minCappedAuthorities = 3
+
 // Authority represents authority in katzenmint.
 type Authority struct {
 	// Auth is the prefix of the authority.
@@ -66,3 +76,262 @@ func VerifyAndParseAuthority(payload []byte) (*AuthorityChecked, error) {
 	}
 	return checked, nil
 }
+
+// AuthorityChange represents a change of the voting power of an existing
+// authority, certified by a quorum of the authorities.
+type AuthorityChange struct {
+	// PubKey is the validator's public key.
+	PubKey []byte
+
+	// Power is the new voting power of the authority, 0 to remove it.
+	Power int64
+
+	// Epoch is the epoch of the transaction carrying the change.
+	Epoch uint64
+
+	// Sequence is the number of authority changes applied before this one,
+	// so that a certified change cannot be replayed.
+	Sequence uint64
+}
+
+// Address returns the address of the authority to change.
+func (change *AuthorityChange) Address() string {
+	return string(ed25519.PubKey(change.PubKey).Address())
+}
+
+// ValidatorUpdate returns the validator update of the change.
+func (change *AuthorityChange) ValidatorUpdate() *abcitypes.ValidatorUpdate {
+	return &abcitypes.ValidatorUpdate{
+		PubKey: pc.PublicKey{
+			Sum: &pc.PublicKey_Ed25519{Ed25519: change.PubKey},
+		},
+		Power: change.Power,
+	}
+}
+
+// SignAuthorityChange creates the certificate of the change, to be signed by
+// the other authorities with cert.SignMulti.
+func SignAuthorityChange(signer cert.Signer, change *AuthorityChange) ([]byte, error) {
+	raw, err := EncodeJson(change)
+	if err != nil {
+		return nil, err
+	}
+	return cert.Sign(signer, raw, change.Epoch+LifeCycle)
+}
+
+// committedVotingPower returns the voting power of the given authorities and
+// of all the authorities committed in the tree.
+func (s *KatzenmintState) committedVotingPower(addrs []string) (power int64, total int64) {
+	// Cannot lock here
+
+	for _, addr := range addrs {
+		val, _ := s.tree.Get(storageKey(authoritiesBucket, []byte(addr), 0))
+		if auth, err := VerifyAndParseAuthority(val); err == nil {
+			power += auth.Val.Power
+		}
+	}
+	begin := storageKey(authoritiesBucket, []byte{}, 0)
+	end := storageKey(authoritiesBucket, []byte{}, 1)
+	_ = s.tree.IterateRange(begin, end, true, func(key, value []byte) bool {
+		if auth, err := VerifyAndParseAuthority(value); err == nil {
+			total += auth.Val.Power
+		}
+		return false
+	})
+	return
+}
+
+// authorities returns the authorities by their storage keys, including the
+// changes not committed yet.
+func (state *KatzenmintState) authorities() map[string]*Authority {
+	state.Lock()
+	defer state.Unlock()
+	auths := make(map[string]*Authority)
+	if state.isClosed() {
+		return auths
+	}
+	parse := func(key, value []byte) {
+		if _, err := VerifyAndParseAuthority(value); err != nil {
+			return
+		}
+		auth := new(Authority)
+		if err := DecodeJson(value, auth); err == nil {
+			auths[string(key)] = auth
+		}
+	}
+	begin := storageKey(authoritiesBucket, []byte{}, 0)
+	end := storageKey(authoritiesBucket, []byte{}, 1)
+	_ = state.tree.IterateRange(begin, end, true, func(key, value []byte) bool {
+		parse(key, value)
+		return false
+	})
+	if iter, err := state.memAdded.Iterator(begin, end); err == nil {
+		for ; iter.Valid(); iter.Next() {
+			parse(iter.Key(), iter.Value())
+		}
+		iter.Close()
+	}
+	if iter, err := state.memRemoved.Iterator(begin, end); err == nil {
+		for ; iter.Valid(); iter.Next() {
+			delete(auths, string(iter.Key()))
+		}
+		iter.Close()
+	}
+	return auths
+}
+
+// hasQuorum returns whether the authorities hold more than two thirds of the
+// total voting power.
+func (state *KatzenmintState) hasQuorum(addrs []string) bool {
+	auths := state.authorities()
+	var power, total int64
+	for _, auth := range auths {
+		total += auth.Power
+	}
+	for _, addr := range addrs {
+		if auth, ok := auths[string(storageKey(authoritiesBucket, []byte(addr), 0))]; ok {
+			power += auth.Power
+		}
+	}
+	return power*3 > total*2
+}
+
+// isWithinPowerCap returns whether no authority holds more than one third of
+// the total voting power of the resulting set once the authority has the
+// given power. The cap cannot be met by fewer than three authorities, so such
+// small sets are held to equal powers instead, which still allows the set to
+// grow from a single authority and shrink back.
+func (state *KatzenmintState) isWithinPowerCap(addr string, power int64) bool {
+	target := string(storageKey(authoritiesBucket, []byte(addr), 0))
+	powers := make([]int64, 0)
+	if power > 0 {
+		powers = append(powers, power)
+	}
+	total := power
+	for key, auth := range state.authorities() {
+		if key != target && auth.Power > 0 {
+			powers = append(powers, auth.Power)
+			total += auth.Power
+		}
+	}
+	if total <= 0 {
+		return false
+	}
+	if len(powers) < minCappedAuthorities {
+		for _, p := range powers {
+			if p != powers[0] {
+				return false
+			}
+		}
+		return true
+	}
+	for _, p := range powers {
+		if p*3 > total {
+			return false
+		}
+	}
+	return true
+}
+
+// authorityChangeSequence returns the number of authority changes applied so
+// far, including the ones not committed yet.
+func (state *KatzenmintState) authorityChangeSequence() uint64 {
+	raw, err := state.get([]byte(authorityChangeSequenceKey))
+	if err != nil || len(raw) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(raw)
+}
+
+// verifyAuthorityChange verifies that the certificate is signed by a quorum of
+// the authorities, and returns the certified change.
+func (state *KatzenmintState) verifyAuthorityChange(rawCert []byte) (*AuthorityChange, error) {
+	certified, err := cert.GetCertified(rawCert)
+	if err != nil {
+		return nil, ErrAuthorityChangeParse
+	}
+	change := new(AuthorityChange)
+	if err = DecodeJson(certified, change); err != nil {
+		return nil, ErrAuthorityChangeParse
+	}
+	if len(change.PubKey) != ed25519.PubKeySize || change.Power < 0 {
+		return nil, ErrAuthorityChangeParse
+	}
+	verifiers := make([]cert.Verifier, 0)
+	for _, auth := range state.authorities() {
+		verifier := new(eddsa.PublicKey)
+		if err = verifier.FromBytes(auth.PubKey); err == nil {
+			verifiers = append(verifiers, verifier)
+		}
+	}
+	if len(verifiers) == 0 {
+		return nil, ErrAuthorityChangeNoQuorum
+	}
+	_, good, _, err := cert.VerifyThreshold(verifiers, 1, rawCert)
+	if err != nil {
+		return nil, ErrAuthorityChangeNoQuorum
+	}
+	signers := make([]string, len(good))
+	for i, verifier := range good {
+		signers[i] = string(ed25519.PubKey(verifier.Identity()).Address())
+	}
+	if !state.hasQuorum(signers) {
+		return nil, ErrAuthorityChangeNoQuorum
+	}
+	return change, nil
+}
+
+// updateAuthorityPower changes the voting power of an existing authority, and
+// removes it if the power is 0. It advances the sequence of the authority
+// changes.
+func (state *KatzenmintState) updateAuthorityPower(v abcitypes.ValidatorUpdate) error {
+	pubkey, err := cryptoenc.PubKeyFromProto(v.PubKey)
+	if err != nil {
+		return fmt.Errorf("can't decode public key: %v", err)
+	}
+	key := storageKey(authoritiesBucket, pubkey.Address(), 0)
+	raw, err := state.get(key)
+	if err != nil {
+		return fmt.Errorf("authority (%x) does not exist", pubkey.Address())
+	}
+	seq := make([]byte, 8)
+	binary.BigEndian.PutUint64(seq, state.authorityChangeSequence()+1)
+	if err = state.set([]byte(authorityChangeSequenceKey), seq); err != nil {
+		return err
+	}
+	if v.Power == 0 {
+		err = state.delete(key)
+	} else {
+		auth := new(Authority)
+		if err = DecodeJson(raw, auth); err != nil {
+			return err
+		}
+		auth.Power = v.Power
+		if raw, err = EncodeJson(auth); err != nil {
+			return err
+		}
+		err = state.set(key, raw)
+	}
+	if err != nil {
+		return err
+	}
+	state.validatorUpdates = append(state.validatorUpdates, v)
+	return state.updateAuthoritySet()
+}
+
+// updateAuthoritySet stores the list of the authorities sorted by public key,
+// so that they can be queried with a single proof.
+func (state *KatzenmintState) updateAuthoritySet() error {
+	auths := make([]Authority, 0)
+	for _, auth := range state.authorities() {
+		auths = append(auths, *auth)
+	}
+	sort.Slice(auths, func(i, j int) bool {
+		return bytes.Compare(auths[i].PubKey, auths[j].PubKey) < 0
+	})
+	raw, err := EncodeJson(auths)
+	if err != nil {
+		return err
+	}
+	return state.set([]byte(authoritySetKey), raw)
+}
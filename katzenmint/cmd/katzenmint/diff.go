@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	"github.com/hashcloak/Meson/client/config"
+	"github.com/hashcloak/Meson/client/pkiclient"
+	"github.com/katzenpost/core/log"
+	"github.com/spf13/cobra"
+)
+
+var (
+	diffClientConfig string
+	diffHistory      bool
+	diffCmd          = &cobra.Command{
+		Use:   "diff <from-epoch> <to-epoch>",
+		Short: "Show the network changes between the documents of two epochs",
+		Args:  cobra.ExactArgs(2),
+		RunE:  diffDocuments,
+	}
+)
+
+// newDiffClient returns a PKI client verifying the documents with the light
+// client of the client configuration.
+func newDiffClient() (*pkiclient.Cache, error) {
+	cfg, err := config.LoadFile(diffClientConfig)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load client config: %v", err)
+	}
+	logBackend, err := log.New("", "ERROR", false)
+	if err != nil {
+		return nil, err
+	}
+	impl, err := cfg.NewPKIClient(logBackend, nil)
+	if err != nil {
+		return nil, err
+	}
+	c, err := pkiclient.NewCacheClient(impl)
+	if err != nil {
+		impl.Shutdown()
+		return nil, err
+	}
+	return c, nil
+}
+
+func diffDocuments(cmd *cobra.Command, args []string) error {
+	epochs := make([]uint64, len(args))
+	for i, arg := range args {
+		epoch, err := strconv.ParseUint(arg, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid epoch %s: %v", arg, err)
+		}
+		epochs[i] = epoch
+	}
+	c, err := newDiffClient()
+	if err != nil {
+		return err
+	}
+	defer c.Shutdown()
+
+	if !diffHistory {
+		diff, err := c.GetDocDiff(context.Background(), epochs[0], epochs[1])
+		if err != nil {
+			return err
+		}
+		fmt.Print(diff.String())
+		return nil
+	}
+	diffs, err := c.GetDocHistory(context.Background(), epochs[0], epochs[1])
+	if err != nil {
+		return err
+	}
+	for _, diff := range diffs {
+		fmt.Print(diff.String())
+	}
+	return nil
+}
@@ -12,6 +12,7 @@ import (
 	dbm "github.com/cometbft/cometbft-db"
 	katzenmint "github.com/hashcloak/Meson/katzenmint"
 	kcfg "github.com/hashcloak/Meson/katzenmint/config"
+	"github.com/katzenpost/core/crypto/eddsa"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	abci "github.com/tendermint/tendermint/abci/types"
@@ -22,6 +23,7 @@ import (
 	"github.com/tendermint/tendermint/p2p"
 	"github.com/tendermint/tendermint/privval"
 	"github.com/tendermint/tendermint/proxy"
+	"github.com/tendermint/tendermint/rpc/client/local"
 )
 
 var (
@@ -115,6 +117,9 @@ func init() {
 	rootCmd.AddCommand(runCmd)
 	rootCmd.AddCommand(registerValidatorCmd)
 	rootCmd.AddCommand(showNodeIDCmd)
+	diffCmd.Flags().StringVar(&diffClientConfig, "client-config", "client.toml", "Path to the client.toml holding the Katzenmint light client settings")
+	diffCmd.Flags().BoolVar(&diffHistory, "history", false, "Show the changes from each epoch to the next")
+	rootCmd.AddCommand(diffCmd)
 }
 
 func initConfig() (kConfig *kcfg.Config, config *cfg.Config, err error) {
@@ -179,6 +184,20 @@ func runNode(cmd *cobra.Command, args []string) error {
 		node.Wait()
 	}()
 
+	// take part in the shared random value protocol
+	pv := privval.LoadFilePV(
+		config.PrivValidatorKeyFile(),
+		config.PrivValidatorStateFile(),
+	)
+	privKey := new(eddsa.PrivateKey)
+	if err = privKey.FromBytes(pv.Key.PrivKey.Bytes()); err != nil {
+		return fmt.Errorf("failed to load validator key: %v", err)
+	}
+	quit := make(chan struct{})
+	defer close(quit)
+	srvWorker := newSharedRandomWorker(local.New(node), privKey, pv.Key.PubKey.Address(), logger.With("module", "srv"))
+	go srvWorker.run(quit)
+
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	<-c
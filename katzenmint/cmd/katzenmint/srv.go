@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	katzenmint "github.com/hashcloak/Meson/katzenmint"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	abci "github.com/tendermint/tendermint/abci/types"
+	"github.com/tendermint/tendermint/libs/log"
+	rpcclient "github.com/tendermint/tendermint/rpc/client"
+)
+
+// sharedRandomWorker takes part in the commit-reveal protocol of the shared
+// random value on behalf of the validator.
+type sharedRandomWorker struct {
+	rpc     rpcclient.Client
+	privKey *eddsa.PrivateKey
+	address []byte
+	logger  log.Logger
+
+	epoch     uint64
+	reveal    []byte
+	committed bool
+	revealed  bool
+}
+
+func newSharedRandomWorker(rpc rpcclient.Client, privKey *eddsa.PrivateKey, address []byte, logger log.Logger) *sharedRandomWorker {
+	return &sharedRandomWorker{
+		rpc:     rpc,
+		privKey: privKey,
+		address: address,
+		logger:  logger,
+	}
+}
+
+func (w *sharedRandomWorker) run(quit <-chan struct{}) {
+	ticker := time.NewTicker(katzenmint.HeightPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+		if err := w.step(); err != nil {
+			w.logger.Debug("shared random worker", "epoch", w.epoch, "error", err)
+		}
+	}
+}
+
+func (w *sharedRandomWorker) step() error {
+	info, err := w.getEpoch()
+	if err != nil {
+		return err
+	}
+	epoch := info.Epoch
+	if epoch != w.epoch {
+		w.epoch = epoch
+		w.reveal = make([]byte, katzenmint.SharedRandomLength)
+		if _, err = rand.Reader.Read(w.reveal); err != nil {
+			return err
+		}
+		w.committed = false
+		w.revealed = false
+	}
+
+	// Each step is tried once per epoch, it fails for non-validators
+	if katzenmint.IsSharedRandomCommitPhase(info.Ellapsed(time.Now()), info.Duration) {
+		if w.committed {
+			return nil
+		}
+		w.committed = true
+		commit := katzenmint.SharedRandomCommit(epoch, w.address, w.reveal)
+		return w.post(katzenmint.CommitSharedRandom, commit)
+	}
+	if !w.committed || w.revealed {
+		return nil
+	}
+	w.revealed = true
+	return w.post(katzenmint.RevealSharedRandom, w.reveal)
+}
+
+func (w *sharedRandomWorker) getEpoch() (*katzenmint.EpochInfo, error) {
+	query, err := katzenmint.EncodeJson(katzenmint.Query{
+		Version: "",
+		Epoch:   0,
+		Command: katzenmint.GetEpoch,
+		Payload: "",
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp, err := w.rpc.ABCIQuery(context.Background(), "", query)
+	if err != nil {
+		return nil, err
+	}
+	if resp.Response.Code != abci.CodeTypeOK {
+		return nil, fmt.Errorf("failed to query epoch: %v", resp.Response.Log)
+	}
+	return katzenmint.ParseEpochInfo(resp.Response.Value)
+}
+
+func (w *sharedRandomWorker) post(command katzenmint.Command, payload []byte) error {
+	tx, err := katzenmint.FormTransaction(command, w.epoch, katzenmint.EncodeHex(payload), w.privKey)
+	if err != nil {
+		return err
+	}
+	resp, err := w.rpc.BroadcastTxSync(context.Background(), tx)
+	if err != nil {
+		return err
+	}
+	if resp.Code != abci.CodeTypeOK {
+		return fmt.Errorf("broadcast tx error: %v", resp.Log)
+	}
+	return nil
+}
@@ -8,4 +8,17 @@ var (
 	AddNewAuthority      Command = 3
 	GetConsensus         Command = 4
 	GetEpoch             Command = 5
+	CommitSharedRandom   Command = 6
+	RevealSharedRandom   Command = 7
+	RegisterMixNode      Command = 8
+	VoteAllowlist        Command = 9
+	GetAdmission         Command = 10
+	ProposeParameters    Command = 11
+	VoteParameters       Command = 12
+	RemoveAuthority      Command = 13
+	UpdateAuthorityPower Command = 14
+	GetAuthorities       Command = 15
+	GetDescriptors       Command = 16
+	GetDescriptor        Command = 17
+	PostReliability      Command = 18
 )
@@ -6,6 +6,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	katconfig "github.com/katzenpost/authority/voting/server/config"
@@ -13,9 +14,20 @@ import (
 )
 
 const (
-	DefaultLayers               = 3
-	DefaultMinNodesPerLayer     = 2
-	defaultTendermintConfigPath = "$HOME/.tendermint/config/config.toml"
+	DefaultLayers                    = 3
+	DefaultMinNodesPerLayer          = 2
+	DefaultEpochDuration             = 10 * time.Second
+	MinEpochDuration                 = 2 * time.Second
+	DefaultSnapshotKeepRecent        = 2
+	DefaultSnapshotChunkSize         = 1 << 20
+	MinDocumentRetention             = 2
+	MinPruneKeepVersions             = 2
+	DefaultMaxDescriptorsPerOperator = 4
+	DefaultReliabilityMinSamples     = 10
+	AdmissionAllowlist               = "allowlist"
+	AdmissionRegistration            = "registration"
+	AdmissionOperatorCap             = "operator_cap"
+	defaultTendermintConfigPath      = "$HOME/.tendermint/config/config.toml"
 	// Note: These values are picked primarily for debugging and need to be changed to something more suitable for a production deployment at some point.
 	defaultSendRatePerMinute    = 100
 	defaultMu                   = 0.00025
@@ -46,12 +58,51 @@ var DefaultParameters = katconfig.Parameters{
 	LambdaMMaxDelay:   uint64(rand.ExpQuantile(defaultLambdaM, defaultLambdaMMaxPercentile)),
 }
 
+// AdmissionConfig is the admission policy of mix descriptors.
+type AdmissionConfig struct {
+	// Policies that every published descriptor has to satisfy, among
+	// "allowlist", "registration" and "operator_cap". An empty list admits
+	// every well formed descriptor.
+	Policies []string
+
+	// MaxDescriptorsPerOperator is the maximum number of descriptors an
+	// operator can publish per epoch under the "operator_cap" policy, which
+	// only admits the descriptors of mixes registered to an operator.
+	MaxDescriptorsPerOperator int
+}
+
+// ReliabilityConfig is the exclusion policy of unreliable nodes from the
+// document.
+type ReliabilityConfig struct {
+	// Threshold is the minimum median ratio of loops returned through a
+	// node for it to be listed in the document, 0 disables the exclusion.
+	Threshold float64
+
+	// MinSamples is the minimum number of loops a reporter has to send
+	// through a node for its report on the node to be counted.
+	MinSamples uint64
+}
+
 type Config struct {
 	TendermintConfigPath string
 	DBPath               string
 	Layers               int
 	MinNodesPerLayer     int
 	Parameters           katconfig.Parameters
+
+	// SnapshotInterval is the number of blocks between state sync
+	// snapshots, 0 disables taking snapshots.
+	SnapshotInterval int64
+
+	// SnapshotKeepRecent is the number of recent snapshots to keep.
+	SnapshotKeepRecent int
+
+	// SnapshotChunkSize is the maximum size in bytes of a snapshot chunk.
+	SnapshotChunkSize int
+
+	// PruneKeepVersions is the number of recent IAVL versions to keep,
+	// 0 keeps all of them.
+	PruneKeepVersions int64
 }
 
 func DefaultConfig() (cfg *Config) {
@@ -76,6 +127,21 @@ func (c *Config) FixupAndValidate() (err error) {
 	if c.MinNodesPerLayer <= 0 {
 		c.MinNodesPerLayer = DefaultMinNodesPerLayer
 	}
+	if c.SnapshotInterval < 0 {
+		return fmt.Errorf("config: SnapshotInterval is negative (%d)", c.SnapshotInterval)
+	}
+	if c.SnapshotKeepRecent <= 0 {
+		c.SnapshotKeepRecent = DefaultSnapshotKeepRecent
+	}
+	if c.SnapshotChunkSize <= 0 {
+		c.SnapshotChunkSize = DefaultSnapshotChunkSize
+	}
+	if c.PruneKeepVersions < 0 {
+		return fmt.Errorf("config: PruneKeepVersions is negative (%d)", c.PruneKeepVersions)
+	}
+	if c.PruneKeepVersions > 0 && c.PruneKeepVersions < MinPruneKeepVersions {
+		return fmt.Errorf("config: PruneKeepVersions should be at least %d versions", MinPruneKeepVersions)
+	}
 	if c.Parameters.SendRatePerMinute <= 0 {
 		c.Parameters.SendRatePerMinute = DefaultParameters.SendRatePerMinute
 	}
@@ -112,6 +178,88 @@ func (c *Config) FixupAndValidate() (err error) {
 	return
 }
 
+// GenesisState is the application state set in the app_state of the genesis
+// file. Unlike the local configuration, it is part of the genesis every
+// validator agrees on, hence it holds the settings which change the app hash.
+type GenesisState struct {
+	// EpochDuration is the duration of an epoch, measured with the block
+	// time.
+	EpochDuration time.Duration
+
+	// DocumentRetention is the number of epochs whose documents and
+	// descriptors are kept in the state, 0 keeps all of them.
+	DocumentRetention uint64
+
+	// Admission is the admission policy of mix descriptors.
+	Admission AdmissionConfig
+
+	// Reliability is the exclusion policy of unreliable nodes.
+	Reliability ReliabilityConfig
+}
+
+// DefaultGenesisState returns the genesis state of an empty app_state.
+func DefaultGenesisState() *GenesisState {
+	g := new(GenesisState)
+	_ = g.FixupAndValidate()
+	return g
+}
+
+// FixupAndValidate applies defaults to the genesis state entries and
+// validates them.
+func (g *GenesisState) FixupAndValidate() error {
+	if g.EpochDuration == 0 {
+		g.EpochDuration = DefaultEpochDuration
+	}
+	if g.EpochDuration < MinEpochDuration {
+		return fmt.Errorf("config: EpochDuration should be at least %v", MinEpochDuration)
+	}
+	if g.DocumentRetention > 0 && g.DocumentRetention < MinDocumentRetention {
+		return fmt.Errorf("config: DocumentRetention should be at least %d epochs", MinDocumentRetention)
+	}
+	for _, policy := range g.Admission.Policies {
+		switch policy {
+		case AdmissionAllowlist, AdmissionRegistration, AdmissionOperatorCap:
+		default:
+			return fmt.Errorf("config: unknown admission policy (%v)", policy)
+		}
+	}
+	if g.Admission.MaxDescriptorsPerOperator <= 0 {
+		g.Admission.MaxDescriptorsPerOperator = DefaultMaxDescriptorsPerOperator
+	}
+	if g.Reliability.Threshold < 0 || g.Reliability.Threshold > 1 {
+		return fmt.Errorf("config: Reliability.Threshold should be within [0, 1] (%v)", g.Reliability.Threshold)
+	}
+	if g.Reliability.MinSamples == 0 {
+		g.Reliability.MinSamples = DefaultReliabilityMinSamples
+	}
+	return nil
+}
+
+// ValidateParameters validates the mixnet parameters proposed on-chain, which
+// unlike the local configuration are never fixed up with defaults.
+func ValidateParameters(layers, minNodesPerLayer int, p *katconfig.Parameters) error {
+	if layers <= 0 {
+		return fmt.Errorf("config: Layers is not positive (%d)", layers)
+	}
+	if minNodesPerLayer <= 0 {
+		return fmt.Errorf("config: MinNodesPerLayer is not positive (%d)", minNodesPerLayer)
+	}
+	if p.SendRatePerMinute == 0 {
+		return fmt.Errorf("config: SendRatePerMinute is zero")
+	}
+	for _, rate := range []float64{p.Mu, p.LambdaP, p.LambdaL, p.LambdaD, p.LambdaM} {
+		if rate <= 0 || math.IsInf(rate, 0) || math.IsNaN(rate) {
+			return fmt.Errorf("config: Poisson rate is invalid (%v)", rate)
+		}
+	}
+	for _, delay := range []uint64{p.MuMaxDelay, p.LambdaPMaxDelay, p.LambdaLMaxDelay, p.LambdaDMaxDelay, p.LambdaMMaxDelay} {
+		if delay == 0 || delay > absoluteMaxDelay {
+			return fmt.Errorf("config: max delay is out of range (%d)", delay)
+		}
+	}
+	return nil
+}
+
 // Load parses and validates the provided buffer b as a config file body and
 // returns the Config.
 func Load(b []byte) (*Config, error) {
@@ -0,0 +1,71 @@
+package katzenmint
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+// epochInfoLength is the length of the serialized epoch information.
+const epochInfoLength = 32
+
+// EpochInfo represents the epoch being prepared by katzenmint, as answered to
+// the GetEpoch query.
+type EpochInfo struct {
+	// Epoch is the epoch whose document is being prepared.
+	Epoch uint64
+
+	// StartHeight is the height of the first block of the epoch.
+	StartHeight int64
+
+	// StartTime is the block time at which the epoch started.
+	StartTime time.Time
+
+	// Duration is the duration of an epoch.
+	Duration time.Duration
+}
+
+// Ellapsed returns the time ellapsed since the start of the epoch.
+func (info *EpochInfo) Ellapsed(now time.Time) time.Duration {
+	if now.Before(info.StartTime) {
+		return 0
+	}
+	return now.Sub(info.StartTime)
+}
+
+// Till returns the time left until the end of the epoch.
+func (info *EpochInfo) Till(now time.Time) time.Duration {
+	end := info.StartTime.Add(info.Duration)
+	if now.After(end) {
+		return 0
+	}
+	return end.Sub(now)
+}
+
+func encodeEpochInfo(info *EpochInfo) []byte {
+	raw := make([]byte, epochInfoLength)
+	binary.PutUvarint(raw[:8], info.Epoch)
+	binary.PutVarint(raw[8:16], info.StartHeight)
+	var startTime int64
+	if !info.StartTime.IsZero() {
+		startTime = info.StartTime.UnixNano()
+	}
+	binary.BigEndian.PutUint64(raw[16:24], uint64(startTime))
+	binary.BigEndian.PutUint64(raw[24:32], uint64(info.Duration))
+	return raw
+}
+
+// ParseEpochInfo parses the epoch information answered to the GetEpoch query.
+func ParseEpochInfo(raw []byte) (*EpochInfo, error) {
+	if len(raw) != epochInfoLength {
+		return nil, fmt.Errorf("epoch information has incorrect length (%d)", len(raw))
+	}
+	info := new(EpochInfo)
+	info.Epoch, _ = binary.Uvarint(raw[:8])
+	info.StartHeight, _ = binary.Varint(raw[8:16])
+	if startTime := int64(binary.BigEndian.Uint64(raw[16:24])); startTime != 0 {
+		info.StartTime = time.Unix(0, startTime).UTC()
+	}
+	info.Duration = time.Duration(binary.BigEndian.Uint64(raw[24:32]))
+	return info, nil
+}
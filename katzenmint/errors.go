@@ -33,12 +33,23 @@ var (
 	ErrTxAuthorityExists        = KatzenmintError{Code: 0x18, Msg: "authority already existed"}
 	ErrTxAuthorityNotAuthorized = KatzenmintError{Code: 0x19, Msg: "authority is not authorized"}
 	ErrTxCommandNotFound        = KatzenmintError{Code: 0x1A, Msg: "transaction command not found"}
+	ErrTxSrvInvalidLength       = KatzenmintError{Code: 0x1B, Msg: "invalid shared random value length"}
+	ErrTxSrvNotAuthorized       = KatzenmintError{Code: 0x1C, Msg: "shared random value is not from an authority"}
+	ErrTxRegistrationParse      = KatzenmintError{Code: 0x1D, Msg: "cannot parse mix registration"}
+	ErrTxVoteParse              = KatzenmintError{Code: 0x1E, Msg: "cannot parse allowlist vote"}
+	ErrTxVoteNotAuthorized      = KatzenmintError{Code: 0x1F, Msg: "vote is not from an authority"}
+	ErrTxProposalParse          = KatzenmintError{Code: 0x20, Msg: "cannot parse parameter proposal"}
 
 	// Transaction Execution Errors
 	ErrTxWrongEpoch = KatzenmintError{Code: 0x21, Msg: "expect transaction epoch within +-1 to current epoch"}
 	ErrTxUpdateDesc = KatzenmintError{Code: 0x22, Msg: "error updating descriptor"}
 	ErrTxUpdateDoc  = KatzenmintError{Code: 0x23, Msg: "error updating document"}
 	ErrTxUpdateAuth = KatzenmintError{Code: 0x24, Msg: "error updating authority"}
+	ErrTxUpdateSrv  = KatzenmintError{Code: 0x25, Msg: "error updating shared random value"}
+	ErrTxUpdateReg  = KatzenmintError{Code: 0x26, Msg: "error updating mix registration"}
+	ErrTxUpdateVote = KatzenmintError{Code: 0x27, Msg: "error updating allowlist vote"}
+	ErrTxUpdateProp = KatzenmintError{Code: 0x28, Msg: "error updating parameter proposal"}
+	ErrTxUpdateRep  = KatzenmintError{Code: 0x29, Msg: "error updating reliability report"}
 
 	// Query Errors
 	ErrQueryInvalidFormat    = KatzenmintError{Code: 0x31, Msg: "error query format"}
@@ -48,9 +59,23 @@ var (
 	ErrQueryDocumentNotReady = KatzenmintError{Code: 0x35, Msg: "document for requested epoch is not ready yet"}
 	ErrQueryDocumentUnknown  = KatzenmintError{Code: 0x36, Msg: "unknown failure for document query"}
 	ErrQueryAppClosed        = KatzenmintError{Code: 0x37, Msg: "application has been closed"}
+	ErrQueryDocumentPruned   = KatzenmintError{Code: 0x38, Msg: "document for requested epoch has been pruned"}
+	ErrQueryNoAdmission      = KatzenmintError{Code: 0x39, Msg: "no admission decision for requested descriptor"}
+	ErrQueryNoDescriptor     = KatzenmintError{Code: 0x3A, Msg: "no descriptor for requested epoch"}
+	ErrQueryNoAuthority      = KatzenmintError{Code: 0x3B, Msg: "no authority has been added"}
 
 	// Authority Errors
 	ErrAuthorityKeyTypeNotSupported = KatzenmintError{Code: 0x41, Msg: "authority key type is not supported"}
+	ErrAuthorityChangeParse         = KatzenmintError{Code: 0x42, Msg: "cannot parse authority change"}
+	ErrAuthorityChangeNoQuorum      = KatzenmintError{Code: 0x43, Msg: "authority change is not signed by a quorum"}
+	ErrAuthorityPowerCap            = KatzenmintError{Code: 0x44, Msg: "authority voting power exceeds one third"}
+	ErrAuthorityNotFound            = KatzenmintError{Code: 0x45, Msg: "authority not found"}
+	ErrAuthorityChangeSequence      = KatzenmintError{Code: 0x46, Msg: "authority change has a stale or future sequence"}
+
+	// Reliability Errors
+	ErrReliabilityReportParse     = KatzenmintError{Code: 0x51, Msg: "cannot parse reliability report"}
+	ErrReliabilityReporterUnknown = KatzenmintError{Code: 0x52, Msg: "reporter is not listed in the document of the report epoch"}
+	ErrReliabilityReportEpoch     = KatzenmintError{Code: 0x53, Msg: "reliability report is not for the previous epoch"}
 )
 
 func parseErrorResponse(err KatzenmintError, resp *abcitypes.ResponseQuery) {
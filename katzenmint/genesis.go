@@ -0,0 +1,68 @@
+package katzenmint
+
+import (
+	"bytes"
+	"fmt"
+
+	"github.com/hashcloak/Meson/katzenmint/config"
+)
+
+// ParseGenesisState parses and validates the app_state of the genesis, an
+// empty one stands for the default genesis state.
+func ParseGenesisState(appState []byte) (*config.GenesisState, error) {
+	genesis := new(config.GenesisState)
+	if len(bytes.TrimSpace(appState)) > 0 {
+		if err := DecodeJson(appState, genesis); err != nil {
+			return nil, err
+		}
+	}
+	if err := genesis.FixupAndValidate(); err != nil {
+		return nil, err
+	}
+	return genesis, nil
+}
+
+/*****************************************
+ *             Genesis State             *
+ *****************************************/
+
+// initGenesisState applies the genesis state and stages it to be saved with
+// the first block, so that a restarted node does not depend on its local
+// copy of the genesis file.
+func (state *KatzenmintState) initGenesisState(appState []byte) error {
+	genesis, err := ParseGenesisState(appState)
+	if err != nil {
+		return fmt.Errorf("failed to parse genesis app state: %v", err)
+	}
+	raw, err := EncodeJson(genesis)
+	if err != nil {
+		return err
+	}
+	if err = state.set([]byte(genesisStateKey), raw); err != nil {
+		return err
+	}
+	state.applyGenesisState(genesis)
+	return nil
+}
+
+// loadGenesisState loads the genesis state saved with the first block, or the
+// default one before it.
+func (state *KatzenmintState) loadGenesisState() error {
+	raw, err := state.tree.Get([]byte(genesisStateKey))
+	if err != nil {
+		return fmt.Errorf("failed to get genesis state %s: %v", genesisStateKey, err)
+	}
+	genesis, err := ParseGenesisState(raw)
+	if err != nil {
+		return fmt.Errorf("failed to parse genesis state %s: %v", genesisStateKey, err)
+	}
+	state.applyGenesisState(genesis)
+	return nil
+}
+
+func (state *KatzenmintState) applyGenesisState(genesis *config.GenesisState) {
+	state.epochDuration = genesis.EpochDuration
+	state.documentRetention = genesis.DocumentRetention
+	state.admission = newAdmissionPolicies(&genesis.Admission)
+	state.reliability = genesis.Reliability
+}
@@ -0,0 +1,248 @@
+package katzenmint
+
+import (
+	"crypto/sha256"
+	"fmt"
+
+	"github.com/hashcloak/Meson/katzenmint/config"
+	"github.com/hashcloak/Meson/katzenmint/s11n"
+	katvoting "github.com/katzenpost/authority/voting/server/config"
+	"github.com/katzenpost/core/pki"
+)
+
+// ProposalIDLength is the length of the identifier of a parameter proposal.
+const ProposalIDLength = sha256.Size
+
+// MixnetParameters represents the mixnet parameters agreed on-chain.
+type MixnetParameters struct {
+	// Layers is the number of non-provider layers in the network topology.
+	Layers int
+
+	// MinNodesPerLayer is the minimum number of nodes per layer.
+	MinNodesPerLayer int
+
+	// Parameters are the Poisson parameters published in the document.
+	Parameters katvoting.Parameters
+}
+
+// ParameterProposalID returns the identifier of the proposal with the given
+// payload.
+func ParameterProposalID(payload []byte) []byte {
+	id := sha256.Sum256(payload)
+	return id[:]
+}
+
+// VerifyAndParseParameters parses and validates the proposed parameters.
+func VerifyAndParseParameters(payload []byte) (*MixnetParameters, error) {
+	params := new(MixnetParameters)
+	if err := DecodeJson(payload, params); err != nil {
+		return nil, err
+	}
+	if err := config.ValidateParameters(params.Layers, params.MinNodesPerLayer, &params.Parameters); err != nil {
+		return nil, err
+	}
+	return params, nil
+}
+
+/*****************************************
+ *            Governance State           *
+ *****************************************/
+
+// updateParameterProposal records the proposal of the authority for the
+// current epoch, along with the vote of the proposer.
+func (state *KatzenmintState) updateParameterProposal(addr string, payload []byte) error {
+	params, err := VerifyAndParseParameters(payload)
+	if err != nil {
+		return err
+	}
+	if err = state.checkParametersSatisfiable(params); err != nil {
+		return err
+	}
+	id := ParameterProposalID(payload)
+	key := storageKey(proposalsBucket, id, state.currentEpoch)
+	if _, err := state.get(key); err == nil {
+		return fmt.Errorf("duplicated parameter proposal (%x) for epoch (%d)", id, state.currentEpoch)
+	}
+	if err := state.set(key, payload); err != nil {
+		return err
+	}
+	return state.updateParameterVote(addr, id)
+}
+
+// updateParameterVote records the vote of the authority for a proposal of the
+// current epoch.
+func (state *KatzenmintState) updateParameterVote(addr string, id []byte) error {
+	payload, err := state.get(storageKey(proposalsBucket, id, state.currentEpoch))
+	if err != nil {
+		return fmt.Errorf("no parameter proposal (%x) for epoch (%d)", id, state.currentEpoch)
+	}
+	params, err := VerifyAndParseParameters(payload)
+	if err != nil {
+		return err
+	}
+	if err = state.checkParametersSatisfiable(params); err != nil {
+		return err
+	}
+	key := storageKey(proposalVotesBucket, id, state.currentEpoch)
+	voters := make([][]byte, 0)
+	if raw, err := state.get(key); err == nil {
+		if err = DecodeJson(raw, &voters); err != nil {
+			return err
+		}
+	}
+	for _, voter := range voters {
+		if string(voter) == addr {
+			return fmt.Errorf("duplicated parameter vote from (%x)", addr)
+		}
+	}
+	raw, err := EncodeJson(append(voters, []byte(addr)))
+	if err != nil {
+		return err
+	}
+	return state.set(key, raw)
+}
+
+// checkParametersSatisfiable returns an error if the network does not have
+// enough mix nodes for the layers of the parameters, as adopting them would
+// stall the epochs.
+func (state *KatzenmintState) checkParametersSatisfiable(params *MixnetParameters) error {
+	state.Lock()
+	defer state.Unlock()
+	if state.isClosed() {
+		return errStateClosed
+	}
+	return state.parametersSatisfiable(params)
+}
+
+func (s *KatzenmintState) parametersSatisfiable(params *MixnetParameters) error {
+	// Cannot lock here
+
+	required := params.Layers * params.MinNodesPerLayer
+	if nodes := s.availableMixNodes(); required > nodes {
+		return fmt.Errorf("parameters require %d mix nodes, only %d are available", required, nodes)
+	}
+	return nil
+}
+
+// availableMixNodes returns the number of mix nodes of the previous document,
+// or the number of mix descriptors published for the current epoch, including
+// the ones of the current block, if it is more.
+func (s *KatzenmintState) availableMixNodes() int {
+	// Cannot lock here
+
+	published := 0
+	countMix := func(value []byte) {
+		if desc, err := s11n.ParseDescriptor(value, s.currentEpoch); err == nil && desc.Layer != pki.LayerProvider {
+			published++
+		}
+	}
+	begin := storageKey(descriptorsBucket, []byte{}, s.currentEpoch)
+	end := storageKey(descriptorsBucket, []byte{}, s.currentEpoch+1)
+	_ = s.tree.IterateRange(begin, end, true, func(key, value []byte) bool {
+		countMix(value)
+		return false
+	})
+	if iter, err := s.memAdded.Iterator(begin, end); err == nil {
+		for ; iter.Valid(); iter.Next() {
+			countMix(iter.Value())
+		}
+		iter.Close()
+	}
+	if s.prevDocument == nil {
+		return published
+	}
+	nodes := 0
+	for _, layer := range s.prevDocument.Topology {
+		nodes += len(layer)
+	}
+	if published > nodes {
+		return published
+	}
+	return nodes
+}
+
+// tallyParameterProposals adopts the proposal of the given epoch approved by
+// more than two thirds of the voting power, the one with most power if there
+// are several, and removes the proposals of the epoch. If the tally is not
+// final, as when no document could be generated at the end of the epoch, the
+// proposals are only removed once one is adopted so that the authorities can
+// keep voting on them.
+func (s *KatzenmintState) tallyParameterProposals(epoch uint64, final bool) error {
+	// Cannot lock here
+
+	var adopted []byte
+	var adoptedPower int64
+	keys := make([][]byte, 0)
+	begin := storageKey(proposalsBucket, []byte{}, epoch)
+	end := storageKey(proposalsBucket, []byte{}, epoch+1)
+	_ = s.tree.IterateRange(begin, end, true, func(key, value []byte) bool {
+		keys = append(keys, append([]byte{}, key...))
+		id := ParameterProposalID(value)
+		voteKey := storageKey(proposalVotesBucket, id, epoch)
+		keys = append(keys, voteKey)
+		rawVoters, _ := s.tree.Get(voteKey)
+		voters := make([][]byte, 0)
+		if err := DecodeJson(rawVoters, &voters); err != nil {
+			return false
+		}
+		addrs := make([]string, len(voters))
+		for i, voter := range voters {
+			addrs[i] = string(voter)
+		}
+		power, total := s.committedVotingPower(addrs)
+		if power*3 > total*2 && power > adoptedPower && s.isProposalSatisfiable(value) {
+			adopted = append([]byte{}, value...)
+			adoptedPower = power
+		}
+		return false
+	})
+	if adopted == nil && !final {
+		return nil
+	}
+	for _, key := range keys {
+		if _, _, err := s.tree.Remove(key); err != nil {
+			return err
+		}
+	}
+	if adopted == nil {
+		return nil
+	}
+	params, err := VerifyAndParseParameters(adopted)
+	if err != nil {
+		return err
+	}
+	if _, err = s.tree.Set([]byte(parametersKey), adopted); err != nil {
+		return err
+	}
+	s.applyParameters(params)
+	return nil
+}
+
+func (s *KatzenmintState) isProposalSatisfiable(payload []byte) bool {
+	params, err := VerifyAndParseParameters(payload)
+	return err == nil && s.parametersSatisfiable(params) == nil
+}
+
+// loadParameters loads the parameters adopted on-chain, if any, in place of
+// the local configuration.
+func (state *KatzenmintState) loadParameters() error {
+	raw, err := state.tree.Get([]byte(parametersKey))
+	if err != nil {
+		return fmt.Errorf("failed to get parameters %s: %v", parametersKey, err)
+	}
+	if raw == nil {
+		return nil
+	}
+	params, err := VerifyAndParseParameters(raw)
+	if err != nil {
+		return fmt.Errorf("failed to parse parameters %s: %v", parametersKey, err)
+	}
+	state.applyParameters(params)
+	return nil
+}
+
+func (state *KatzenmintState) applyParameters(params *MixnetParameters) {
+	state.layers = params.Layers
+	state.minNodesPerLayer = params.MinNodesPerLayer
+	state.parameters = &params.Parameters
+}
@@ -0,0 +1,208 @@
+package katzenmint
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/hashcloak/Meson/katzenmint/cert"
+	"github.com/hashcloak/Meson/katzenmint/s11n"
+	"github.com/katzenpost/core/crypto/eddsa"
+)
+
+// NodeReliability represents the loops sent by a reporter through a node, and
+// the ones which avoided it to tell the losses of the node from the losses of
+// the other hops.
+type NodeReliability struct {
+	// IdentityKey is the identity key of the node.
+	IdentityKey []byte
+
+	// Sent is the number of loops sent through the node.
+	Sent uint64
+
+	// Received is the number of loops sent through the node which returned.
+	Received uint64
+
+	// SentAvoiding is the number of loops sent which avoided the node.
+	SentAvoiding uint64
+
+	// ReceivedAvoiding is the number of loops which avoided the node and
+	// returned.
+	ReceivedAvoiding uint64
+}
+
+// HopReliability estimates the ratio of the loops the node forwards, as the
+// ratio of the loops through the node which returned relative to the one of
+// the loops which avoided it, so that the losses of the other hops are not
+// attributed to the node.  It returns false if there is no baseline to
+// compare with.
+func (node *NodeReliability) HopReliability() (float64, bool) {
+	if node.Sent == 0 || node.SentAvoiding == 0 || node.ReceivedAvoiding == 0 {
+		return 0, false
+	}
+	through := float64(node.Received) / float64(node.Sent)
+	avoiding := float64(node.ReceivedAvoiding) / float64(node.SentAvoiding)
+	return math.Min(1, through/avoiding), true
+}
+
+// ReliabilityReport represents the loop results measured by a node during an
+// epoch, signed with its identity key.
+type ReliabilityReport struct {
+	// Reporter is the identity key of the reporting node.
+	Reporter []byte
+
+	// Epoch is the epoch of the document the loops were sent with, the
+	// report is only accepted during the following epoch.
+	Epoch uint64
+
+	// Nodes are the loop results per node.
+	Nodes []NodeReliability
+}
+
+// SignReliabilityReport creates the certificate of the report, signed with
+// the identity key of the reporter.
+func SignReliabilityReport(signer cert.Signer, report *ReliabilityReport) ([]byte, error) {
+	raw, err := EncodeJson(report)
+	if err != nil {
+		return nil, err
+	}
+	return cert.Sign(signer, raw, report.Epoch+LifeCycle)
+}
+
+// VerifyAndParseReliabilityReport verifies that the report is signed by the
+// reporter and parses it.
+func VerifyAndParseReliabilityReport(rawCert []byte) (*ReliabilityReport, error) {
+	certified, err := cert.GetCertified(rawCert)
+	if err != nil {
+		return nil, err
+	}
+	report := new(ReliabilityReport)
+	if err = DecodeJson(certified, report); err != nil {
+		return nil, err
+	}
+	verifier := new(eddsa.PublicKey)
+	if err = verifier.FromBytes(report.Reporter); err != nil {
+		return nil, err
+	}
+	if _, err = cert.Verify(verifier, rawCert); err != nil {
+		return nil, err
+	}
+	for _, node := range report.Nodes {
+		if node.Received > node.Sent || node.ReceivedAvoiding > node.SentAvoiding {
+			return nil, fmt.Errorf("node (%x) received more loops than sent", node.IdentityKey)
+		}
+	}
+	return report, nil
+}
+
+/*****************************************
+ *           Reliability State           *
+ *****************************************/
+
+// isReporterListed returns whether the reporter is listed in the document of
+// the report epoch.
+func (state *KatzenmintState) isReporterListed(report *ReliabilityReport) bool {
+	raw, err := state.get(storageKey(documentsBucket, []byte{}, report.Epoch))
+	if err != nil {
+		return false
+	}
+	doc, err := s11n.VerifyAndParseDocument(raw, report.Epoch)
+	if err != nil {
+		return false
+	}
+	_, err = doc.GetNodeByKey(report.Reporter)
+	return err == nil
+}
+
+// updateReliabilityReport records the report of the node for the document of
+// the current epoch, a node reports once per epoch on the previous epoch so
+// that an earlier report cannot be counted again.
+func (state *KatzenmintState) updateReliabilityReport(payload []byte, report *ReliabilityReport) error {
+	if report.Epoch+1 != state.currentEpoch {
+		return fmt.Errorf("reliability report from (%x) for epoch (%d) is not for the previous epoch", report.Reporter, report.Epoch)
+	}
+	key := storageKey(reliabilityBucket, report.Reporter, state.currentEpoch)
+	if _, err := state.get(key); err == nil {
+		return fmt.Errorf("duplicated reliability report from (%x) for epoch (%d)", report.Reporter, state.currentEpoch)
+	}
+	return state.set(key, payload)
+}
+
+// nodeReliabilities returns the median of the hop reliabilities reported for
+// each node during the epoch. Self reports and reports with less than the
+// minimum number of loops through or avoiding the node are ignored.
+func (s *KatzenmintState) nodeReliabilities(epoch uint64) map[string]float64 {
+	// Cannot lock here
+
+	ratios := make(map[string][]float64)
+	begin := storageKey(reliabilityBucket, []byte{}, epoch)
+	end := storageKey(reliabilityBucket, []byte{}, epoch+1)
+	_ = s.tree.IterateRange(begin, end, true, func(key, value []byte) bool {
+		report, err := VerifyAndParseReliabilityReport(value)
+		if err != nil {
+			return false
+		}
+		for _, node := range report.Nodes {
+			if node.Sent < s.reliability.MinSamples || node.SentAvoiding < s.reliability.MinSamples || bytes.Equal(node.IdentityKey, report.Reporter) {
+				continue
+			}
+			r, ok := node.HopReliability()
+			if !ok {
+				continue
+			}
+			id := string(node.IdentityKey)
+			ratios[id] = append(ratios[id], r)
+		}
+		return false
+	})
+	reliabilities := make(map[string]float64, len(ratios))
+	for id, r := range ratios {
+		sort.Float64s(r)
+		if len(r)%2 == 1 {
+			reliabilities[id] = r[len(r)/2]
+		} else {
+			reliabilities[id] = (r[len(r)/2-1] + r[len(r)/2]) / 2
+		}
+	}
+	return reliabilities
+}
+
+// excludeUnreliable removes the nodes whose reliability falls below the
+// threshold, the least reliable first, while more than min nodes remain.
+func (s *KatzenmintState) excludeUnreliable(nodes []*descriptor, reliabilities map[string]float64, min int) []*descriptor {
+	if s.reliability.Threshold <= 0 {
+		return nodes
+	}
+	unreliable := make([]*descriptor, 0)
+	for _, v := range nodes {
+		if r, ok := reliabilities[string(v.desc.IdentityKey.Bytes())]; ok && r < s.reliability.Threshold {
+			unreliable = append(unreliable, v)
+		}
+	}
+	sort.SliceStable(unreliable, func(i, j int) bool {
+		ri := reliabilities[string(unreliable[i].desc.IdentityKey.Bytes())]
+		rj := reliabilities[string(unreliable[j].desc.IdentityKey.Bytes())]
+		if ri != rj {
+			return ri < rj
+		}
+		return bytes.Compare(unreliable[i].desc.IdentityKey.Bytes(), unreliable[j].desc.IdentityKey.Bytes()) < 0
+	})
+	excluded := make(map[*descriptor]bool)
+	for _, v := range unreliable {
+		if len(nodes)-len(excluded) <= min {
+			break
+		}
+		excluded[v] = true
+	}
+	if len(excluded) == 0 {
+		return nodes
+	}
+	kept := make([]*descriptor, 0, len(nodes)-len(excluded))
+	for _, v := range nodes {
+		if !excluded[v] {
+			kept = append(kept, v)
+		}
+	}
+	return kept
+}
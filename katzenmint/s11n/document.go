@@ -59,6 +59,9 @@ type Document struct {
 
 	Topology  [][][]byte
 	Providers [][]byte
+
+	// SharedRandomValue seeds the layer assignment of the Topology.
+	SharedRandomValue []byte
 }
 
 func SerializeDocument(d *Document) ([]byte, error) {
@@ -104,6 +107,7 @@ func VerifyAndParseDocument(payload []byte, epochNow uint64) (*pki.Document, err
 		LambdaMMaxDelay:   d.LambdaDMaxDelay,
 		Topology:          make([][]*pki.MixDescriptor, len(d.Topology)),
 		Providers:         make([]*pki.MixDescriptor, 0, len(d.Providers)),
+		SharedRandomValue: d.SharedRandomValue,
 	}
 
 	for layer, nodes := range d.Topology {
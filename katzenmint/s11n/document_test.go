@@ -80,6 +80,7 @@ func TestDocument(t *testing.T) {
 		MuMaxDelay:        23,
 		LambdaP:           0.69,
 		LambdaPMaxDelay:   17,
+		SharedRandomValue: []byte("katzenmint shared random value!!"),
 	}
 	idx := 1
 	for l := 0; l < 3; l++ {
@@ -114,6 +115,7 @@ func TestDocument(t *testing.T) {
 	require.Equal(doc.LambdaDMaxDelay, ddoc.LambdaDMaxDelay, "VerifyAndParseDocument(): LambdaDMaxDelay")
 	require.Equal(doc.LambdaM, ddoc.LambdaM, "VerifyAndParseDocument(): LambdaM")
 	require.Equal(doc.LambdaMMaxDelay, ddoc.LambdaMMaxDelay, "VerifyAndParseDocument(): LambdaMMaxDelay")
+	require.Equal(doc.SharedRandomValue, ddoc.SharedRandomValue, "VerifyAndParseDocument(): SharedRandomValue")
 
 	t.Logf("Deserialized document: '%v'", ddoc)
 
@@ -0,0 +1,356 @@
+package katzenmint
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	dbm "github.com/cometbft/cometbft-db"
+	"github.com/cosmos/iavl"
+	"github.com/hashcloak/Meson/katzenmint/config"
+	abcitypes "github.com/tendermint/tendermint/abci/types"
+)
+
+const (
+	// SnapshotFormat is the version of the snapshot encoding.
+	SnapshotFormat uint32 = 1
+
+	snapshotsPrefix  = "k_snapshots:"
+	snapshotMetaKey  = "meta:"
+	snapshotChunkKey = "chunk:"
+)
+
+var (
+	errSnapshotNotFound     = errors.New("snapshot not found")
+	errSnapshotInvalidChunk = errors.New("snapshot chunk is invalid")
+)
+
+// snapshotMetadata is carried along with the abci snapshot so that every
+// chunk can be verified before being applied.
+type snapshotMetadata struct {
+	ChunkHashes [][]byte
+}
+
+// snapshotStore keeps the state sync snapshots taken from the katzenmint
+// state, chunked and hashed.
+type snapshotStore struct {
+	db         dbm.DB
+	interval   int64
+	keepRecent int
+	chunkSize  int
+}
+
+func newSnapshotStore(kConfig *config.Config, db dbm.DB) *snapshotStore {
+	return &snapshotStore{
+		db:         dbm.NewPrefixDB(db, []byte(snapshotsPrefix)),
+		interval:   kConfig.SnapshotInterval,
+		keepRecent: kConfig.SnapshotKeepRecent,
+		chunkSize:  kConfig.SnapshotChunkSize,
+	}
+}
+
+func snapshotKey(prefix string, height uint64) []byte {
+	key := make([]byte, len(prefix)+8)
+	copy(key, prefix)
+	binary.BigEndian.PutUint64(key[len(prefix):], height)
+	return key
+}
+
+func snapshotChunkStorageKey(height uint64, index uint32) []byte {
+	key := snapshotKey(snapshotChunkKey, height)
+	idx := make([]byte, 4)
+	binary.BigEndian.PutUint32(idx, index)
+	return append(key, idx...)
+}
+
+func decodeSnapshotMetadata(snapshot *abcitypes.Snapshot) (*snapshotMetadata, error) {
+	metadata := new(snapshotMetadata)
+	if err := DecodeJson(snapshot.Metadata, metadata); err != nil {
+		return nil, err
+	}
+	if len(metadata.ChunkHashes) != int(snapshot.Chunks) {
+		return nil, fmt.Errorf("snapshot has %d chunks but %d chunk hashes", snapshot.Chunks, len(metadata.ChunkHashes))
+	}
+	return metadata, nil
+}
+
+// shouldTake returns whether a snapshot should be taken at the given height.
+func (s *snapshotStore) shouldTake(height int64) bool {
+	return s.interval > 0 && height > 0 && height%s.interval == 0
+}
+
+// save splits the payload into chunks and saves them along with the snapshot.
+func (s *snapshotStore) save(height uint64, payload []byte) (*abcitypes.Snapshot, error) {
+	hash := sha256.Sum256(payload)
+	metadata := &snapshotMetadata{}
+	batch := s.db.NewBatch()
+	defer batch.Close()
+	for index := uint32(0); len(payload) > 0 || index == 0; index++ {
+		size := s.chunkSize
+		if size > len(payload) {
+			size = len(payload)
+		}
+		chunk := payload[:size]
+		payload = payload[size:]
+		chunkHash := sha256.Sum256(chunk)
+		metadata.ChunkHashes = append(metadata.ChunkHashes, chunkHash[:])
+		if err := batch.Set(snapshotChunkStorageKey(height, index), chunk); err != nil {
+			return nil, err
+		}
+	}
+	rawMetadata, err := EncodeJson(metadata)
+	if err != nil {
+		return nil, err
+	}
+	snapshot := &abcitypes.Snapshot{
+		Height:   height,
+		Format:   SnapshotFormat,
+		Chunks:   uint32(len(metadata.ChunkHashes)),
+		Hash:     hash[:],
+		Metadata: rawMetadata,
+	}
+	rawSnapshot, err := snapshot.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	if err = batch.Set(snapshotKey(snapshotMetaKey, height), rawSnapshot); err != nil {
+		return nil, err
+	}
+	if err = batch.WriteSync(); err != nil {
+		return nil, err
+	}
+	return snapshot, s.prune()
+}
+
+// list returns the stored snapshots in ascending order of height.
+func (s *snapshotStore) list() ([]*abcitypes.Snapshot, error) {
+	iter, err := dbm.IteratePrefix(s.db, []byte(snapshotMetaKey))
+	if err != nil {
+		return nil, err
+	}
+	defer iter.Close()
+	snapshots := make([]*abcitypes.Snapshot, 0)
+	for ; iter.Valid(); iter.Next() {
+		snapshot := new(abcitypes.Snapshot)
+		if err := snapshot.Unmarshal(iter.Value()); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	return snapshots, iter.Error()
+}
+
+// loadChunk returns the chunk of the snapshot at the given height.
+func (s *snapshotStore) loadChunk(height uint64, format uint32, index uint32) ([]byte, error) {
+	if format != SnapshotFormat {
+		return nil, fmt.Errorf("unsupported snapshot format (%d)", format)
+	}
+	chunk, err := s.db.Get(snapshotChunkStorageKey(height, index))
+	if err != nil {
+		return nil, err
+	}
+	if chunk == nil {
+		return nil, errSnapshotNotFound
+	}
+	return chunk, nil
+}
+
+// prune deletes all but the most recent snapshots.
+func (s *snapshotStore) prune() error {
+	snapshots, err := s.list()
+	if err != nil {
+		return err
+	}
+	for len(snapshots) > s.keepRecent {
+		snapshot := snapshots[0]
+		snapshots = snapshots[1:]
+		if err = s.db.Delete(snapshotKey(snapshotMetaKey, snapshot.Height)); err != nil {
+			return err
+		}
+		for index := uint32(0); index < snapshot.Chunks; index++ {
+			if err = s.db.Delete(snapshotChunkStorageKey(snapshot.Height, index)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// snapshotRestore tracks a snapshot being restored from state sync.
+type snapshotRestore struct {
+	snapshot *abcitypes.Snapshot
+	metadata *snapshotMetadata
+	appHash  []byte
+	chunks   [][]byte
+}
+
+// apply verifies and buffers the chunk, it returns whether all the chunks
+// have been received.
+func (r *snapshotRestore) apply(index uint32, chunk []byte) (bool, error) {
+	if int(index) != len(r.chunks) {
+		return false, fmt.Errorf("unexpected snapshot chunk (%d), expected (%d)", index, len(r.chunks))
+	}
+	hash := sha256.Sum256(chunk)
+	if !bytes.Equal(hash[:], r.metadata.ChunkHashes[index]) {
+		return false, errSnapshotInvalidChunk
+	}
+	r.chunks = append(r.chunks, chunk)
+	return len(r.chunks) == int(r.snapshot.Chunks), nil
+}
+
+// payload returns the verified snapshot payload once all chunks are applied.
+func (r *snapshotRestore) payload() ([]byte, error) {
+	payload := bytes.Join(r.chunks, nil)
+	hash := sha256.Sum256(payload)
+	if !bytes.Equal(hash[:], r.snapshot.Hash) {
+		return nil, fmt.Errorf("snapshot hash mismatch at height (%d)", r.snapshot.Height)
+	}
+	return payload, nil
+}
+
+/*****************************************
+ *        Snapshot Export & Import       *
+ *****************************************/
+
+func writeExportNode(w *bytes.Buffer, node *iavl.ExportNode) {
+	buf := make([]byte, binary.MaxVarintLen64)
+	_ = w.WriteByte(byte(node.Height))
+	w.Write(buf[:binary.PutVarint(buf, node.Version)])
+	w.Write(buf[:binary.PutUvarint(buf, uint64(len(node.Key)))])
+	w.Write(node.Key)
+	// inner nodes carry no value, which has to be distinguished from an
+	// empty value of a leaf node
+	if node.Value == nil {
+		w.Write(buf[:binary.PutUvarint(buf, 0)])
+	} else {
+		w.Write(buf[:binary.PutUvarint(buf, uint64(len(node.Value))+1)])
+		w.Write(node.Value)
+	}
+}
+
+func readExportNode(r *bytes.Reader) (*iavl.ExportNode, error) {
+	height, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	node := &iavl.ExportNode{Height: int8(height)}
+	if node.Version, err = binary.ReadVarint(r); err != nil {
+		return nil, err
+	}
+	keyLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if keyLen > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	node.Key = make([]byte, keyLen)
+	if _, err = io.ReadFull(r, node.Key); err != nil {
+		return nil, err
+	}
+	valueLen, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if valueLen > 0 {
+		if valueLen-1 > uint64(r.Len()) {
+			return nil, io.ErrUnexpectedEOF
+		}
+		node.Value = make([]byte, valueLen-1)
+		if _, err = io.ReadFull(r, node.Value); err != nil {
+			return nil, err
+		}
+	}
+	return node, nil
+}
+
+func importExportNodes(tree *iavl.MutableTree, version int64, payload []byte) error {
+	importer, err := tree.Import(version)
+	if err != nil {
+		return err
+	}
+	defer importer.Close()
+	r := bytes.NewReader(payload)
+	for r.Len() > 0 {
+		node, err := readExportNode(r)
+		if err != nil {
+			return fmt.Errorf("failed to decode snapshot node: %v", err)
+		}
+		if err = importer.Add(node); err != nil {
+			return err
+		}
+	}
+	return importer.Commit()
+}
+
+// exportSnapshot serializes the tree of the given version.
+func (state *KatzenmintState) exportSnapshot(version int64) ([]byte, error) {
+	state.Lock()
+	defer state.Unlock()
+	if state.isClosed() {
+		return nil, errStateClosed
+	}
+	itree, err := state.tree.GetImmutable(version)
+	if err != nil {
+		return nil, err
+	}
+	exporter, err := itree.Export()
+	if err != nil {
+		return nil, err
+	}
+	defer exporter.Close()
+	payload := new(bytes.Buffer)
+	for {
+		node, err := exporter.Next()
+		if err == iavl.ErrorExportDone {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		writeExportNode(payload, node)
+	}
+	return payload.Bytes(), nil
+}
+
+// restoreSnapshot imports the serialized tree of the given version into an
+// empty state, and reloads the epoch information from it. The payload is
+// checked against the trusted app hash before touching the state.
+func (state *KatzenmintState) restoreSnapshot(version int64, payload []byte, appHash []byte) error {
+	state.Lock()
+	defer state.Unlock()
+	if state.isClosed() {
+		return errStateClosed
+	}
+	if state.blockHeight != 0 {
+		return fmt.Errorf("cannot restore snapshot onto a non-empty state at height (%d)", state.blockHeight)
+	}
+
+	// Verify the app hash with a scratch tree
+	scratch, err := iavl.NewMutableTree(dbm.NewMemDB(), 0, true)
+	if err != nil {
+		return err
+	}
+	if err = importExportNodes(scratch, version, payload); err != nil {
+		return err
+	}
+	hash, err := scratch.Hash()
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(hash, appHash) {
+		return fmt.Errorf("snapshot app hash (%x) mismatch with trusted app hash (%x)", hash, appHash)
+	}
+
+	// Import into the persistent tree
+	if err = importExportNodes(state.tree, version, payload); err != nil {
+		return err
+	}
+	state.appHash = hash
+	state.blockHeight = version
+	state.loadPrunedVersion()
+	return state.loadEpochInfo()
+}
@@ -0,0 +1,172 @@
+package katzenmint
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"time"
+
+	"github.com/katzenpost/core/pki"
+)
+
+const (
+	// SharedRandomLength is the length of the reveal and shared random values.
+	SharedRandomLength = sha256.Size
+
+	sharedRandomCommitContext = "katzenmint-srv-commit-v0"
+	sharedRandomValueContext  = "katzenmint-srv-value-v0"
+)
+
+// SharedRandomCommit returns the commitment that an authority publishes in
+// the commit phase of the epoch before revealing its random value.
+func SharedRandomCommit(epoch uint64, address []byte, reveal []byte) []byte {
+	epochBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(epochBytes, epoch)
+	h := sha256.New()
+	h.Write([]byte(sharedRandomCommitContext))
+	h.Write(epochBytes)
+	h.Write(address)
+	h.Write(reveal)
+	return h.Sum(nil)
+}
+
+// IsSharedRandomCommitPhase returns whether commits are accepted at the
+// ellapsed time of an epoch, reveals are accepted for the rest of it.
+func IsSharedRandomCommitPhase(ellapsed time.Duration, epochDuration time.Duration) bool {
+	return ellapsed < epochDuration/2
+}
+
+// sharedRandomSource is a deterministic rand.Source expanding the shared
+// random value with SHA-256 in counter mode.
+type sharedRandomSource struct {
+	seed    []byte
+	counter uint64
+	buf     []byte
+}
+
+func (s *sharedRandomSource) Uint64() uint64 {
+	if len(s.buf) < 8 {
+		ctr := make([]byte, 8)
+		binary.BigEndian.PutUint64(ctr, s.counter)
+		s.counter++
+		h := sha256.Sum256(append(append([]byte{}, s.seed...), ctr...))
+		s.buf = h[:]
+	}
+	v := binary.BigEndian.Uint64(s.buf[:8])
+	s.buf = s.buf[8:]
+	return v
+}
+
+func (s *sharedRandomSource) Int63() int64 {
+	return int64(s.Uint64() & (1<<63 - 1))
+}
+
+func (s *sharedRandomSource) Seed(int64) {}
+
+func newSharedRandomRng(srv []byte) *rand.Rand {
+	return rand.New(&sharedRandomSource{seed: srv})
+}
+
+// VerifyTopology recomputes the layer assignment from the shared random value
+// of the document and the document of the previous epoch (nil if there was
+// none), and checks it against the published topology.
+func VerifyTopology(doc *pki.Document, prevDoc *pki.Document) error {
+	if len(doc.SharedRandomValue) != SharedRandomLength {
+		return fmt.Errorf("document has invalid shared random value length (%d)", len(doc.SharedRandomValue))
+	}
+	if prevDoc != nil && prevDoc.Epoch+1 != doc.Epoch {
+		return fmt.Errorf("previous document has wrong epoch (%d)", prevDoc.Epoch)
+	}
+	nodes := make([]*descriptor, 0)
+	for _, layer := range doc.Topology {
+		for _, desc := range layer {
+			nodes = append(nodes, &descriptor{desc: desc})
+		}
+	}
+	sortNodesByPublicKey(nodes)
+	var topology [][]*descriptor
+	if prevDoc != nil {
+		topology = generateTopology(nodes, prevDoc, len(doc.Topology), doc.SharedRandomValue)
+	} else {
+		topology = generateRandomTopology(nodes, len(doc.Topology), doc.SharedRandomValue)
+	}
+	for layer, nodes := range doc.Topology {
+		if len(nodes) != len(topology[layer]) {
+			return fmt.Errorf("layer %d has %d nodes, expected %d", layer, len(nodes), len(topology[layer]))
+		}
+		for idx, desc := range nodes {
+			if !desc.IdentityKey.Equal(topology[layer][idx].desc.IdentityKey) {
+				return fmt.Errorf("node %v is not expected at layer %d", desc.IdentityKey, layer)
+			}
+		}
+	}
+	return nil
+}
+
+/*****************************************
+ *       Shared Random Value State       *
+ *****************************************/
+
+func (state *KatzenmintState) isAuthority(addr string) bool {
+	_, err := state.GetAuthority(addr)
+	return err == nil
+}
+
+func (state *KatzenmintState) updateSharedRandomCommit(addr string, commit []byte, epoch uint64) error {
+	if epoch != state.currentEpoch {
+		return fmt.Errorf("shared random commit for epoch (%d) is not in the current epoch", epoch)
+	}
+	if !IsSharedRandomCommitPhase(state.ellapsedTime(), state.epochDuration) {
+		return fmt.Errorf("shared random commit phase of epoch (%d) is over", epoch)
+	}
+	key := storageKey(srvCommitsBucket, []byte(addr), epoch)
+	if _, err := state.get(key); err == nil {
+		return fmt.Errorf("duplicated shared random commit from (%x) for epoch (%d)", addr, epoch)
+	}
+	return state.set(key, commit)
+}
+
+func (state *KatzenmintState) updateSharedRandomReveal(addr string, reveal []byte, epoch uint64) error {
+	if epoch != state.currentEpoch {
+		return fmt.Errorf("shared random reveal for epoch (%d) is not in the current epoch", epoch)
+	}
+	if IsSharedRandomCommitPhase(state.ellapsedTime(), state.epochDuration) {
+		return fmt.Errorf("shared random reveal phase of epoch (%d) has not started", epoch)
+	}
+	commit, err := state.get(storageKey(srvCommitsBucket, []byte(addr), epoch))
+	if err != nil {
+		return fmt.Errorf("no shared random commit from (%x) for epoch (%d)", addr, epoch)
+	}
+	if !bytes.Equal(commit, SharedRandomCommit(epoch, []byte(addr), reveal)) {
+		return fmt.Errorf("shared random reveal from (%x) does not match its commit", addr)
+	}
+	key := storageKey(srvRevealsBucket, []byte(addr), epoch)
+	if _, err := state.get(key); err == nil {
+		return fmt.Errorf("duplicated shared random reveal from (%x) for epoch (%d)", addr, epoch)
+	}
+	return state.set(key, reveal)
+}
+
+// computeSharedRandom derives the shared random value of the current epoch
+// from the previous value and the reveals ordered by the authority address.
+func (s *KatzenmintState) computeSharedRandom() []byte {
+	// Cannot lock here
+
+	epochBytes := make([]byte, 8)
+	binary.BigEndian.PutUint64(epochBytes, s.currentEpoch)
+	prev, _ := s.tree.Get(storageKey(srvBucket, []byte{}, s.currentEpoch-1))
+	h := sha256.New()
+	h.Write([]byte(sharedRandomValueContext))
+	h.Write(epochBytes)
+	h.Write(prev)
+	begin := storageKey(srvRevealsBucket, []byte{}, s.currentEpoch)
+	end := storageKey(srvRevealsBucket, []byte{}, s.currentEpoch+1)
+	_ = s.tree.IterateRange(begin, end, true, func(key, value []byte) bool {
+		h.Write(key)
+		h.Write(value)
+		return false
+	})
+	return h.Sum(nil)
+}
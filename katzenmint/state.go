@@ -1,7 +1,6 @@
 package katzenmint
 
 import (
-	"encoding/binary"
 	"errors"
 	"fmt"
 	"sync"
@@ -22,16 +21,21 @@ import (
 )
 
 const (
-	GenesisEpoch  uint64        = 1
+	GenesisEpoch uint64 = 1
+	LifeCycle    uint64 = 3
+
+	// HeightPeriod is the expected period between blocks, and EpochInterval
+	// the expected number of blocks in an epoch of the default duration.
+	// Epochs are driven by the block time, see config.GenesisState.
 	EpochInterval int64         = 10
 	HeightPeriod  time.Duration = 1 * time.Second
-	LifeCycle     uint64        = 3
 )
 
 var (
 	errStateClosed               = errors.New("katzenmint state is closed")
 	errDocInsufficientDescriptor = errors.New("insufficient descriptors uploaded")
 	errDocInsufficientProvider   = errors.New("no providers uploaded")
+	errProofNotFound             = errors.New("existence proof not found")
 )
 
 type descriptor struct {
@@ -53,12 +57,23 @@ type KatzenmintState struct {
 	blockHeight      int64
 	currentEpoch     uint64
 	epochStartHeight int64
+	epochStartTime   time.Time
+	epochDuration    time.Duration
+	blockTime        time.Time
 	layers           int
 	minNodesPerLayer int
 	parameters       *katvoting.Parameters
+	admission        []admissionPolicy
+	reliability      config.ReliabilityConfig
+
+	// Pruning
+	documentRetention uint64
+	keepVersions      int64
+	prunedVersion     int64
 
 	// Changes to be made
 	memAdded         *dbm.MemDB
+	memRemoved       *dbm.MemDB
 	validatorUpdates []abcitypes.ValidatorUpdate
 
 	// Cached information
@@ -90,28 +105,56 @@ func NewKatzenmintState(kConfig *config.Config, db dbm.DB, dbCacheSize int) *Kat
 		layers:           kConfig.Layers,
 		minNodesPerLayer: kConfig.MinNodesPerLayer,
 		parameters:       &kConfig.Parameters,
+		keepVersions:     kConfig.PruneKeepVersions,
+		memAdded:         dbm.NewMemDB(),
+		memRemoved:       dbm.NewMemDB(),
 		prevCommitError:  nil,
 	}
+	if err = state.loadEpochInfo(); err != nil {
+		panic(err)
+	}
+	state.loadPrunedVersion()
+	return state
+}
+
+// loadPrunedVersion restores the pruning watermark from the oldest version
+// still stored in the tree, so that a restarted node does not try to delete
+// the versions it has already pruned.
+func (state *KatzenmintState) loadPrunedVersion() {
+	state.prunedVersion = 0
+	if versions := state.tree.AvailableVersions(); len(versions) > 0 {
+		state.prunedVersion = int64(versions[0])
+	}
+}
+
+// loadEpochInfo rebuilds the current epoch, its starting height and time, the previous
+// document, the genesis state and the adopted parameters from the tree at the
+// current block height.
+func (state *KatzenmintState) loadEpochInfo() error {
 	epochInfoValue, err := state.tree.Get([]byte(epochInfoKey))
 	if err != nil {
-		panic(fmt.Errorf("failed to get epoch %s: %v", epochInfoKey, err))
+		return fmt.Errorf("failed to get epoch %s: %v", epochInfoKey, err)
 	}
-	if version == 0 {
+	if state.blockHeight == 0 {
 		state.currentEpoch = GenesisEpoch
 		state.epochStartHeight = state.blockHeight
-	} else if epochInfoValue == nil || len(epochInfoValue) != 16 {
-		panic(fmt.Errorf("failed to load the current epoch number and its starting height (%x)", epochInfoValue))
+	} else if info, err := ParseEpochInfo(epochInfoValue); err != nil {
+		return fmt.Errorf("failed to load the current epoch number and its starting height (%x)", epochInfoValue)
 	} else {
-		state.currentEpoch, _ = binary.Uvarint(epochInfoValue[:8])
-		state.epochStartHeight, _ = binary.Varint(epochInfoValue[8:])
+		state.currentEpoch = info.Epoch
+		state.epochStartHeight = info.StartHeight
+		state.epochStartTime = info.StartTime
 	}
 	keyDoc := storageKey(documentsBucket, []byte{}, state.currentEpoch-1)
 	rawDoc, err := state.tree.Get(keyDoc)
 	if err != nil {
-		panic(fmt.Errorf("failed to get document (%d): %v", state.currentEpoch-1, err))
+		return fmt.Errorf("failed to get document (%d): %v", state.currentEpoch-1, err)
 	}
 	state.prevDocument, _ = s11n.VerifyAndParseDocument(rawDoc, state.currentEpoch)
-	return state
+	if err = state.loadGenesisState(); err != nil {
+		return err
+	}
+	return state.loadParameters()
 }
 
 func (state *KatzenmintState) Commit() ([]byte, error) {
@@ -133,6 +176,19 @@ func (state *KatzenmintState) Commit() ([]byte, error) {
 	}
 	iter.Close()
 	state.memAdded.Close()
+	state.memAdded = dbm.NewMemDB()
+
+	// Remove staged deletions persistently
+	iter, _ = state.memRemoved.Iterator(nil, nil)
+	for ; iter.Valid(); iter.Next() {
+		_, _, dbErr = state.tree.Remove(iter.Key())
+		if dbErr != nil {
+			return nil, dbErr
+		}
+	}
+	iter.Close()
+	state.memRemoved.Close()
+	state.memRemoved = dbm.NewMemDB()
 
 	// Generate and save document persistently
 	if state.newDocumentRequired() {
@@ -144,17 +200,35 @@ func (state *KatzenmintState) Commit() ([]byte, error) {
 			if dbErr != nil {
 				return nil, dbErr
 			}
+			key = storageKey(srvBucket, []byte{}, state.currentEpoch)
+			_, dbErr = state.tree.Set(key, doc.doc.SharedRandomValue)
+			if dbErr != nil {
+				return nil, dbErr
+			}
 			state.currentEpoch++
 			state.epochStartHeight = state.blockHeight + 1
+			state.epochStartTime = state.nextEpochStartTime()
+			if dbErr = state.tallyParameterProposals(state.currentEpoch-1, true); dbErr != nil {
+				return nil, dbErr
+			}
+			if dbErr = state.pruneDocuments(); dbErr != nil {
+				return nil, dbErr
+			}
+		} else if dbErr = state.tallyParameterProposals(state.currentEpoch, false); dbErr != nil {
+			// The epoch is stalled, the proposals are still tallied so that
+			// the authorities can adopt parameters the network can meet.
+			return nil, dbErr
 		}
-		// TODO: state.pruneDocument()
 	}
 
 	// Save epoch info persistently
 	state.blockHeight++
-	epochInfoValue := make([]byte, 16)
-	binary.PutUvarint(epochInfoValue[:8], state.currentEpoch)
-	binary.PutVarint(epochInfoValue[8:], state.epochStartHeight)
+	epochInfoValue := encodeEpochInfo(&EpochInfo{
+		Epoch:       state.currentEpoch,
+		StartHeight: state.epochStartHeight,
+		StartTime:   state.epochStartTime,
+		Duration:    state.epochDuration,
+	})
 	_, dbErr = state.tree.Set([]byte(epochInfoKey), epochInfoValue)
 	if dbErr != nil {
 		return nil, dbErr
@@ -166,12 +240,86 @@ func (state *KatzenmintState) Commit() ([]byte, error) {
 		return nil, errSave
 	}
 	state.appHash = appHash
+	if errPrune := state.pruneVersions(); errPrune != nil {
+		return appHash, errPrune
+	}
 	if err != state.prevCommitError {
 		state.prevCommitError = err
 	}
 	return appHash, err
 }
 
+// pruneDocuments removes the documents and descriptors of the epochs out of
+// the retention window. The window depends on the current epoch and on the
+// retention of the genesis state, hence the deletions are the same across
+// validators.
+func (state *KatzenmintState) pruneDocuments() error {
+	if state.documentRetention == 0 || state.currentEpoch <= state.documentRetention {
+		return nil
+	}
+	cutoff := state.currentEpoch - state.documentRetention
+	for _, bucket := range []string{descriptorsBucket, descriptorIndexBucket, documentsBucket, srvCommitsBucket, srvRevealsBucket, srvBucket, admissionBucket, operatorsBucket, reliabilityBucket} {
+		keys := make([][]byte, 0)
+		begin := storageKey(bucket, []byte{}, 0)
+		end := storageKey(bucket, []byte{}, cutoff)
+		_ = state.tree.IterateRange(begin, end, true, func(key, value []byte) bool {
+			keys = append(keys, append([]byte{}, key...))
+			return false
+		})
+		for _, key := range keys {
+			if _, _, err := state.tree.Remove(key); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// pruneVersions deletes the IAVL versions older than the recent ones. It does
+// not change the app hash.
+func (state *KatzenmintState) pruneVersions() error {
+	if state.keepVersions == 0 || state.blockHeight <= state.keepVersions {
+		return nil
+	}
+	toVersion := state.blockHeight - state.keepVersions + 1
+	if toVersion <= state.prunedVersion {
+		return nil
+	}
+	if err := state.tree.DeleteVersionsRange(state.prunedVersion, toVersion); err != nil {
+		return fmt.Errorf("failed to prune versions [%d, %d): %v", state.prunedVersion, toVersion, err)
+	}
+	state.prunedVersion = toVersion
+	return nil
+}
+
+// isDocumentPruned returns whether the document of the epoch is out of the
+// retention window at the given height, where 0 is the latest height.
+func (state *KatzenmintState) isDocumentPruned(epoch uint64, height int64) bool {
+	if state.documentRetention == 0 {
+		return false
+	}
+	return epoch+state.documentRetention < state.epochAt(height)
+}
+
+// epochAt returns the current epoch at the given height, where 0 is the
+// latest height.
+func (state *KatzenmintState) epochAt(height int64) uint64 {
+	state.RLock()
+	defer state.RUnlock()
+	if height == 0 || height >= state.blockHeight || state.isClosed() {
+		return state.currentEpoch
+	}
+	raw, err := state.tree.GetVersioned([]byte(epochInfoKey), height)
+	if err != nil {
+		return state.currentEpoch
+	}
+	info, err := ParseEpochInfo(raw)
+	if err != nil {
+		return state.currentEpoch
+	}
+	return info.Epoch
+}
+
 func (state *KatzenmintState) Close() {
 	state.Lock()
 	defer state.Unlock()
@@ -179,6 +327,9 @@ func (state *KatzenmintState) Close() {
 	if state.memAdded != nil {
 		_ = state.memAdded.Close()
 	}
+	if state.memRemoved != nil {
+		_ = state.memRemoved.Close()
+	}
 }
 
 func (state *KatzenmintState) isClosed() bool {
@@ -189,9 +340,15 @@ func (state *KatzenmintState) isClosed() bool {
  *              Modify State             *
  *****************************************/
 
-func (state *KatzenmintState) BeginBlock() {
-	state.memAdded = dbm.NewMemDB()
+// BeginBlock keeps the changes staged before the block, eg: the genesis
+// validators from InitChain, to be saved with the block. The block time drives
+// the epoch transitions, the first epoch starts with the first block time.
+func (state *KatzenmintState) BeginBlock(blockTime time.Time) {
 	state.validatorUpdates = make([]abcitypes.ValidatorUpdate, 0)
+	state.blockTime = blockTime
+	if state.epochStartTime.IsZero() {
+		state.epochStartTime = blockTime
+	}
 }
 
 // Epoch has to be in [current epoch, current epoch + LifeCycle].
@@ -211,13 +368,28 @@ func (state *KatzenmintState) updateMixDescriptor(rawDesc []byte, desc *pki.MixD
 		return fmt.Errorf("early descriptor upload with key (%x) for epoch (%d)", desc.IdentityKey.Bytes(), epoch)
 	}
 
-	// Save it to memory db.
-	return state.set(key, rawDesc)
+	// Save it to memory db, along with the index of the epoch.
+	if err = state.set(key, rawDesc); err != nil {
+		return err
+	}
+	indexKey := storageKey(descriptorIndexBucket, []byte{}, epoch)
+	index := make([][]byte, 0)
+	if raw, err := state.get(indexKey); err == nil {
+		if err = DecodeJson(raw, &index); err != nil {
+			return err
+		}
+	}
+	raw, err := EncodeJson(append(index, desc.IdentityKey.Bytes()))
+	if err != nil {
+		return err
+	}
+	return state.set(indexKey, raw)
 }
 
+// updateAuthority adds or overwrites the authority, the power cap is checked
+// along with the transactions since it does not apply to the genesis and
+// punished validators.
 func (state *KatzenmintState) updateAuthority(rawAuth []byte, v abcitypes.ValidatorUpdate) error {
-	// TODO: make sure the voting power not exceed 1/3
-
 	pubkey, err := cryptoenc.PubKeyFromProto(v.PubKey)
 	if err != nil {
 		return fmt.Errorf("can't decode public key: %v", err)
@@ -241,26 +413,51 @@ func (state *KatzenmintState) updateAuthority(rawAuth []byte, v abcitypes.Valida
 		return err
 	}
 	state.validatorUpdates = append(state.validatorUpdates, v)
-	return nil
+	return state.updateAuthoritySet()
 }
 
 /*****************************************
  *        Criteria of State Change       *
  *****************************************/
 
+// newDocumentRequired returns whether the block time reaches the end of the
+// current epoch.
 func (state *KatzenmintState) newDocumentRequired() bool {
-	// TODO: determine when to finish the current epoch
-	return state.blockHeight >= state.epochStartHeight+EpochInterval-1
+	if state.epochStartTime.IsZero() {
+		return false
+	}
+	return !state.blockTime.Before(state.epochStartTime.Add(state.epochDuration))
 }
 
-func (state *KatzenmintState) isDescriptorAuthorized(desc *pki.MixDescriptor) bool {
-	// TODO: determine the criteria to prevent sybil attacks
-	return true
+// nextEpochStartTime returns the scheduled end of the current epoch, so that
+// slow blocks do not make the epochs drift, or the block time if the schedule
+// is behind by more than an epoch.
+func (state *KatzenmintState) nextEpochStartTime() time.Time {
+	next := state.epochStartTime.Add(state.epochDuration)
+	if !state.blockTime.Before(next.Add(state.epochDuration)) {
+		return state.blockTime
+	}
+	return next
+}
+
+// ellapsedTime returns the block time ellapsed in the current epoch.
+func (state *KatzenmintState) ellapsedTime() time.Duration {
+	if state.epochStartTime.IsZero() {
+		return 0
+	}
+	return state.blockTime.Sub(state.epochStartTime)
 }
 
 func (state *KatzenmintState) isAuthorityAuthorized(addr string, auth *AuthorityChecked) bool {
 	// TODO: determine the criteria to prevent sybil attacks
-	return auth.Val.Power <= 1
+	if auth.Val.Power > 1 {
+		return false
+	}
+	pubkey, err := cryptoenc.PubKeyFromProto(auth.Val.PubKey)
+	if err != nil {
+		return false
+	}
+	return state.isWithinPowerCap(string(pubkey.Address()), auth.Val.Power)
 }
 
 func (state *KatzenmintState) isAuthorityNew(auth *AuthorityChecked) bool {
@@ -284,6 +481,13 @@ func (state *KatzenmintState) get(key []byte) (val []byte, err error) {
 		return nil, errStateClosed
 	}
 
+	removed, err := state.memRemoved.Has(key)
+	if err != nil {
+		return nil, err
+	}
+	if removed {
+		return nil, fmt.Errorf("key (%v) does not exist", key)
+	}
 	has, err := state.memAdded.Has(key)
 	if err != nil {
 		return nil, err
@@ -313,7 +517,7 @@ func (state *KatzenmintState) getProof(key []byte, height int64) ([]byte, *ics23
 	}
 	existProof := proof.GetExist()
 	if existProof == nil {
-		return nil, nil, fmt.Errorf("proof (%v) not found at (%d)", key, height)
+		return nil, nil, errProofNotFound
 	}
 	return existProof.Value, proof, err
 }
@@ -324,9 +528,24 @@ func (state *KatzenmintState) set(key []byte, value []byte) error {
 	if state.isClosed() {
 		return errStateClosed
 	}
+	if err := state.memRemoved.Delete(key); err != nil {
+		return err
+	}
 	return state.memAdded.Set(key, value)
 }
 
+func (state *KatzenmintState) delete(key []byte) error {
+	state.Lock()
+	defer state.Unlock()
+	if state.isClosed() {
+		return errStateClosed
+	}
+	if err := state.memAdded.Delete(key); err != nil {
+		return err
+	}
+	return state.memRemoved.Set(key, []byte{})
+}
+
 /*****************************************
  *           External Getter             *
  *****************************************/
@@ -350,12 +569,52 @@ func (state *KatzenmintState) GetEpoch(height int64) ([]byte, *ics23.CommitmentP
 	if err != nil {
 		return nil, nil, err
 	}
-	if len(val) != 16 {
+	if len(val) != epochInfoLength {
 		return nil, nil, fmt.Errorf("failed to fetching latest epoch for height (%v)", height)
 	}
 	return val, proof, nil
 }
 
+// GetAuthorities returns the set of authorities along with its proof.
+func (state *KatzenmintState) GetAuthorities(height int64) ([]byte, *ics23.CommitmentProof, error) {
+	val, proof, err := state.getProof([]byte(authoritySetKey), height)
+	if err == errProofNotFound {
+		return nil, nil, ErrQueryNoAuthority
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return val, proof, nil
+}
+
+// GetDescriptors returns the identity keys of the descriptors uploaded for the
+// epoch along with its proof.
+func (state *KatzenmintState) GetDescriptors(epoch uint64, height int64) ([]byte, *ics23.CommitmentProof, error) {
+	key := storageKey(descriptorIndexBucket, []byte{}, epoch)
+	val, proof, err := state.getProof(key, height)
+	if err == errProofNotFound {
+		return nil, nil, ErrQueryNoDescriptor
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return val, proof, nil
+}
+
+// GetDescriptor returns the raw descriptor uploaded for the epoch along with
+// its proof.
+func (state *KatzenmintState) GetDescriptor(identityKey []byte, epoch uint64, height int64) ([]byte, *ics23.CommitmentProof, error) {
+	key := storageKey(descriptorsBucket, identityKey, epoch)
+	val, proof, err := state.getProof(key, height)
+	if err == errProofNotFound {
+		return nil, nil, ErrQueryNoDescriptor
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return val, proof, nil
+}
+
 func (state *KatzenmintState) GetDocument(epoch uint64, height int64) ([]byte, *ics23.CommitmentProof, error) {
 	// TODO: postpone the document for some blocks?
 	// var postponDeadline = 10
@@ -365,10 +624,13 @@ func (state *KatzenmintState) GetDocument(epoch uint64, height int64) ([]byte, *
 	}
 	key := storageKey(documentsBucket, []byte{}, epoch)
 	doc, proof, err := state.getProof(key, height)
-	if err != nil {
+	if err != nil && err != errProofNotFound {
 		return nil, nil, err
 	}
 	if doc == nil {
+		if state.isDocumentPruned(epoch, height) {
+			return nil, nil, ErrQueryDocumentPruned
+		}
 		if epoch < state.currentEpoch {
 			return nil, nil, ErrQueryNoDocument
 		}
@@ -407,16 +669,26 @@ func (s *KatzenmintState) generateDocument() (*document, error) {
 		return false
 	})
 
-	// Assign nodes to layers. # No randomness yet.
-	var topology [][][]byte
+	// Assign nodes to layers with the shared random value, excluding the
+	// unreliable nodes as long as there are enough nodes left.
+	var layered [][]*descriptor
 	if len(nodesDesc) < s.layers*s.minNodesPerLayer {
 		return nil, errDocInsufficientDescriptor
 	}
+	reliabilities := s.nodeReliabilities(s.currentEpoch)
+	nodesDesc = s.excludeUnreliable(nodesDesc, reliabilities, s.layers*s.minNodesPerLayer)
+	srv := s.computeSharedRandom()
 	sortNodesByPublicKey(nodesDesc)
 	if s.prevDocument != nil {
-		topology = generateTopology(nodesDesc, s.prevDocument, s.layers)
+		layered = generateTopology(nodesDesc, s.prevDocument, s.layers, srv)
 	} else {
-		topology = generateRandomTopology(nodesDesc, s.layers)
+		layered = generateRandomTopology(nodesDesc, s.layers, srv)
+	}
+	topology := make([][][]byte, len(layered))
+	for layer, nodes := range layered {
+		for _, v := range nodes {
+			topology[layer] = append(topology[layer], v.raw)
+		}
 	}
 
 	// Sort the providers
@@ -424,6 +696,7 @@ func (s *KatzenmintState) generateDocument() (*document, error) {
 	if len(providersDesc) == 0 {
 		return nil, errDocInsufficientProvider
 	}
+	providersDesc = s.excludeUnreliable(providersDesc, reliabilities, 1)
 	sortNodesByPublicKey(providersDesc)
 	for _, v := range providersDesc {
 		providers = append(providers, v.raw)
@@ -446,10 +719,9 @@ func (s *KatzenmintState) generateDocument() (*document, error) {
 		LambdaMMaxDelay:   s.parameters.LambdaMMaxDelay,
 		Topology:          topology,
 		Providers:         providers,
+		SharedRandomValue: srv,
 	}
 
-	// TODO: what to do with shared random value?
-
 	// Serialize the Document.
 	serialized, err := s11n.SerializeDocument(doc)
 	if err != nil {
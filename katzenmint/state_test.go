@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"testing"
+	"time"
 
 	dbm "github.com/cometbft/cometbft-db"
 	"github.com/hashcloak/Meson/katzenmint/config"
@@ -14,6 +15,7 @@ import (
 	"github.com/katzenpost/core/pki"
 	abcitypes "github.com/tendermint/tendermint/abci/types"
 	cryptoenc "github.com/tendermint/tendermint/crypto/encoding"
+	tmproto "github.com/tendermint/tendermint/proto/tendermint/types"
 
 	// "github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -24,10 +26,27 @@ const testDBCacheSize = 100
 
 var kConfig *config.Config
 
+// testGenesisTime is the time of the first block in tests, the following
+// blocks are produced every HeightPeriod.
+var testGenesisTime = time.Date(2021, time.January, 1, 0, 0, 0, 0, time.UTC)
+
 func init() {
 	kConfig = config.DefaultConfig()
 }
 
+func testBlockTime(state *KatzenmintState) time.Time {
+	return testGenesisTime.Add(HeightPeriod * time.Duration(state.blockHeight))
+}
+
+func testBeginBlock(state *KatzenmintState) abcitypes.RequestBeginBlock {
+	return abcitypes.RequestBeginBlock{
+		Header: tmproto.Header{
+			Height: state.blockHeight + 1,
+			Time:   testBlockTime(state),
+		},
+	}
+}
+
 func TestNewStateBasic(t *testing.T) {
 	require := require.New(t)
 
@@ -38,7 +57,7 @@ func TestNewStateBasic(t *testing.T) {
 
 	// advance block height
 	require.Equal(int64(0), state.blockHeight)
-	state.BeginBlock()
+	state.BeginBlock(testBlockTime(state))
 	_, _ = state.Commit()
 	require.Equal(int64(1), state.blockHeight)
 
@@ -49,6 +68,35 @@ func TestNewStateBasic(t *testing.T) {
 	require.Equal(int64(0), state.epochStartHeight)
 }
 
+func TestGenesisState(t *testing.T) {
+	require := require.New(t)
+
+	// create katzenmint state
+	db := dbm.NewMemDB()
+	defer db.Close()
+	state := NewKatzenmintState(kConfig, db, testDBCacheSize)
+	require.Empty(state.admission)
+	require.Equal(config.DefaultEpochDuration, state.epochDuration)
+
+	// an invalid app state is rejected
+	state.BeginBlock(testBlockTime(state))
+	require.NotNil(state.initGenesisState([]byte(`{"Admission":{"Policies":["unknown"]}}`)))
+	require.NotNil(state.initGenesisState([]byte(`{"EpochDuration":1000000000}`)))
+
+	// the genesis state is saved with the first block
+	require.Nil(state.initGenesisState([]byte(`{"EpochDuration":60000000000,"Admission":{"Policies":["allowlist"]}}`)))
+	require.Len(state.admission, 1)
+	require.Equal(time.Minute, state.epochDuration)
+	_, err := state.Commit()
+	require.Nil(err)
+
+	// test that the genesis state is rebuilt without the genesis file
+	state = NewKatzenmintState(kConfig, db, testDBCacheSize)
+	require.Len(state.admission, 1)
+	require.Equal(config.AdmissionAllowlist, state.admission[0].name())
+	require.Equal(time.Minute, state.epochDuration)
+}
+
 func TestUpdateDescriptor(t *testing.T) {
 	require := require.New(t)
 
@@ -61,7 +109,7 @@ func TestUpdateDescriptor(t *testing.T) {
 	desc, rawDesc, _ := testutil.CreateTestDescriptor(require, 1, pki.LayerProvider, testEpoch)
 
 	// update test descriptor
-	state.BeginBlock()
+	state.BeginBlock(testBlockTime(state))
 	err := state.updateMixDescriptor(rawDesc, desc, testEpoch)
 	if err != nil {
 		t.Fatalf("Failed to update test descriptor: %+v\n", err)
@@ -105,7 +153,7 @@ func TestUpdateAuthority(t *testing.T) {
 	}
 
 	// update authority
-	state.BeginBlock()
+	state.BeginBlock(testBlockTime(state))
 	validator := abcitypes.UpdateValidator(authority.PubKey, authority.Power, authority.KeyType)
 	err = state.updateAuthority(rawAuth, validator)
 	if err != nil {
@@ -159,7 +207,7 @@ func TestDocumentGenerationUponCommit(t *testing.T) {
 	}
 
 	// update part of the descriptors
-	state.BeginBlock()
+	state.BeginBlock(testBlockTime(state))
 	for _, p := range providers {
 		err := state.updateMixDescriptor(p.raw, p.desc, epoch)
 		if err != nil {
@@ -178,12 +226,12 @@ func TestDocumentGenerationUponCommit(t *testing.T) {
 	}
 
 	// proceed with enough block commits to enter the next epoch
-	for i := 0; i < int(EpochInterval-1); i++ {
+	for i := 0; i < int(EpochInterval); i++ {
 		_, err := state.Commit()
 		if err != nil {
 			t.Fatalf("Failed to commit: %v\n", err)
 		}
-		state.BeginBlock()
+		state.BeginBlock(testBlockTime(state))
 	}
 	_, err := state.Commit()
 	if err == nil {
@@ -198,7 +246,7 @@ func TestDocumentGenerationUponCommit(t *testing.T) {
 	}
 
 	// update the remaining descriptors up to the required threshold
-	state.BeginBlock()
+	state.BeginBlock(testBlockTime(state))
 	err = state.updateMixDescriptor(mixs[0].raw, mixs[0].desc, epoch)
 	if err != nil {
 		t.Fatalf("Failed to update mix descriptor: %+v\n", err)
@@ -236,3 +284,136 @@ func TestDocumentGenerationUponCommit(t *testing.T) {
 	_, err = s11n.VerifyAndParseDocument(loaded, state.currentEpoch)
 	require.Nil(err, "Failed to parse pki document: %+v\n", err)
 }
+
+func TestPruneDocumentsAndVersions(t *testing.T) {
+	require := require.New(t)
+
+	// create katzenmint state with pruning enabled
+	pruneConfig := *kConfig
+	pruneConfig.PruneKeepVersions = 2
+	db := dbm.NewMemDB()
+	defer db.Close()
+	state := NewKatzenmintState(&pruneConfig, db, testDBCacheSize)
+	require.Nil(state.initGenesisState([]byte(`{"DocumentRetention":2}`)))
+
+	// proceed with a document for each epoch
+	firstDescKeys := make([][]byte, 0)
+	for epoch := GenesisEpoch; epoch < GenesisEpoch+4; epoch++ {
+		require.Equal(epoch, state.currentEpoch)
+		state.BeginBlock(testBlockTime(state))
+		for layer := 0; layer <= state.layers; layer++ {
+			descLayer := 0
+			if layer == state.layers {
+				descLayer = pki.LayerProvider
+			}
+			for i := 0; i < state.minNodesPerLayer; i++ {
+				desc, rawDesc, _ := testutil.CreateTestDescriptor(require, i, descLayer, epoch)
+				err := state.updateMixDescriptor(rawDesc, desc, epoch)
+				require.Nil(err)
+				if epoch == GenesisEpoch {
+					firstDescKeys = append(firstDescKeys, storageKey(descriptorsBucket, desc.IdentityKey.Bytes(), epoch))
+				}
+			}
+		}
+		for state.currentEpoch == epoch {
+			_, err := state.Commit()
+			require.Nil(err)
+			state.BeginBlock(testBlockTime(state))
+		}
+	}
+	require.Equal(GenesisEpoch+4, state.currentEpoch)
+
+	// documents and descriptors out of the retention window are pruned
+	for epoch := GenesisEpoch; epoch < GenesisEpoch+4; epoch++ {
+		_, err := state.get(storageKey(documentsBucket, []byte{}, epoch))
+		_, _, errQuery := state.GetDocument(epoch, state.blockHeight)
+		if epoch < GenesisEpoch+2 {
+			require.NotNil(err, "document of epoch %d should be pruned", epoch)
+			require.Equal(ErrQueryDocumentPruned, errQuery)
+		} else {
+			require.Nil(err, "document of epoch %d should be retained", epoch)
+			require.Nil(errQuery)
+		}
+	}
+	for _, key := range firstDescKeys {
+		_, err := state.get(key)
+		require.NotNil(err, "descriptor should be pruned")
+	}
+
+	// old versions are pruned while the recent ones are kept
+	require.False(state.tree.VersionExists(1))
+	require.True(state.tree.VersionExists(state.blockHeight - 1))
+	require.True(state.tree.VersionExists(state.blockHeight))
+
+	// the retention window follows the queried height
+	require.False(state.isDocumentPruned(GenesisEpoch+1, state.blockHeight-1))
+	require.True(state.isDocumentPruned(GenesisEpoch+1, state.blockHeight))
+
+	// the pruned state can be reloaded along with its pruning watermark
+	newState := NewKatzenmintState(&pruneConfig, db, testDBCacheSize)
+	require.Equal(state.currentEpoch, newState.currentEpoch)
+	require.NotNil(newState.prevDocument)
+	require.Equal(state.prunedVersion, newState.prunedVersion)
+	require.Equal(uint64(2), newState.documentRetention)
+}
+
+func TestEpochFollowsBlockTime(t *testing.T) {
+	require := require.New(t)
+
+	// create katzenmint state
+	db := dbm.NewMemDB()
+	defer db.Close()
+	state := NewKatzenmintState(kConfig, db, testDBCacheSize)
+	uploadDescriptors := func(epoch uint64) {
+		for layer := 0; layer <= state.layers; layer++ {
+			descLayer := 0
+			if layer == state.layers {
+				descLayer = pki.LayerProvider
+			}
+			for i := 0; i < state.minNodesPerLayer; i++ {
+				desc, rawDesc, _ := testutil.CreateTestDescriptor(require, i, descLayer, epoch)
+				require.Nil(state.updateMixDescriptor(rawDesc, desc, epoch))
+			}
+		}
+	}
+
+	// the first epoch starts with the first block
+	state.BeginBlock(testGenesisTime)
+	uploadDescriptors(GenesisEpoch)
+	_, err := state.Commit()
+	require.Nil(err)
+	require.Equal(testGenesisTime, state.epochStartTime)
+
+	// slow blocks do not stretch the epoch
+	state.BeginBlock(testGenesisTime.Add(config.DefaultEpochDuration / 2))
+	_, err = state.Commit()
+	require.Nil(err)
+	require.Equal(GenesisEpoch, state.currentEpoch)
+	state.BeginBlock(testGenesisTime.Add(config.DefaultEpochDuration + time.Second))
+	_, err = state.Commit()
+	require.Nil(err)
+	require.Equal(GenesisEpoch+1, state.currentEpoch)
+	require.Equal(int64(3), state.epochStartHeight)
+	require.Equal(testGenesisTime.Add(config.DefaultEpochDuration), state.epochStartTime)
+
+	// an epoch is skipped over when the chain halts for longer than an epoch
+	haltedTime := testGenesisTime.Add(4 * config.DefaultEpochDuration)
+	state.BeginBlock(haltedTime)
+	uploadDescriptors(GenesisEpoch + 1)
+	_, err = state.Commit()
+	require.Nil(err)
+	require.Equal(GenesisEpoch+2, state.currentEpoch)
+	require.Equal(haltedTime, state.epochStartTime)
+
+	// the epoch start time is reloaded and answered to queries
+	newState := NewKatzenmintState(kConfig, db, testDBCacheSize)
+	require.Equal(haltedTime, newState.epochStartTime)
+	raw, _, err := newState.GetEpoch(newState.blockHeight)
+	require.Nil(err)
+	info, err := ParseEpochInfo(raw)
+	require.Nil(err)
+	require.Equal(GenesisEpoch+2, info.Epoch)
+	require.Equal(haltedTime, info.StartTime)
+	require.Equal(config.DefaultEpochDuration, info.Duration)
+	require.Equal(config.DefaultEpochDuration/2, info.Till(haltedTime.Add(config.DefaultEpochDuration/2)))
+}
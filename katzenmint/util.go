@@ -5,19 +5,33 @@ package katzenmint
 
 import (
 	"encoding/binary"
-	"math/rand"
 	"sort"
-	"time"
 
 	"github.com/katzenpost/core/pki"
 	"github.com/katzenpost/core/sphinx/constants"
 )
 
 const (
-	descriptorsBucket = "k_descriptors"
-	documentsBucket   = "k_documents"
-	authoritiesBucket = "k_authorities"
-	epochInfoKey      = "k_epoch"
+	descriptorsBucket          = "k_descriptors"
+	descriptorIndexBucket      = "k_descriptor_index"
+	documentsBucket            = "k_documents"
+	authoritiesBucket          = "k_authorities"
+	srvCommitsBucket           = "k_srv_commits"
+	srvRevealsBucket           = "k_srv_reveals"
+	srvBucket                  = "k_srv"
+	allowlistBucket            = "k_allowlist"
+	allowlistVotesBucket       = "k_allowlist_votes"
+	registrationsBucket        = "k_registrations"
+	operatorsBucket            = "k_operators"
+	admissionBucket            = "k_admission"
+	proposalsBucket            = "k_param_proposals"
+	proposalVotesBucket        = "k_param_votes"
+	reliabilityBucket          = "k_reliability"
+	epochInfoKey               = "k_epoch"
+	parametersKey              = "k_parameters"
+	genesisStateKey            = "k_genesis_state"
+	authoritySetKey            = "k_authority_set"
+	authorityChangeSequenceKey = "k_authority_change_seq"
 )
 
 func storageKey(keyPrefix string, keyID []byte, epoch uint64) (key []byte) {
@@ -57,7 +71,13 @@ func sortNodesByPublicKey(nodes []*descriptor) {
 	sort.Slice(nodes, func(i, j int) bool { return dTos(nodes[i]) < dTos(nodes[j]) })
 }
 
-func generateTopology(nodeList []*descriptor, doc *pki.Document, layers int) [][][]byte {
+func generateTopology(nodeList []*descriptor, doc *pki.Document, layers int, srv []byte) [][]*descriptor {
+	// The previous layer assignment is meaningless once the number of layers
+	// changed, so the topology is built from scratch.
+	if len(doc.Topology) != layers {
+		return generateRandomTopology(nodeList, layers, srv)
+	}
+
 	nodeMap := make(map[[constants.NodeIDLength]byte]*descriptor)
 	for _, v := range nodeList {
 		id := v.desc.IdentityKey.ByteArray()
@@ -69,9 +89,9 @@ func generateTopology(nodeList []*descriptor, doc *pki.Document, layers int) [][
 	// approximately equal, and as many nodes as possible retain their existing
 	// layer assignment to minimise network churn.
 
-	rng := rand.New(rand.NewSource(0))
+	rng := newSharedRandomRng(srv)
 	targetNodesPerLayer := len(nodeList) / layers
-	topology := make([][][]byte, layers)
+	topology := make([][]*descriptor, layers)
 
 	// Assign nodes that still exist up to the target size.
 	for layer, nodes := range doc.Topology {
@@ -88,16 +108,19 @@ func generateTopology(nodeList []*descriptor, doc *pki.Document, layers int) [][
 				// There is a new descriptor with the same identity key,
 				// as an existing descriptor in the previous document,
 				// so preserve the layering.
-				topology[layer] = append(topology[layer], n.raw)
+				topology[layer] = append(topology[layer], n)
 				delete(nodeMap, id)
 			}
 		}
 	}
 
-	// Flatten the map containing the nodes pending assignment.
+	// Flatten the map containing the nodes pending assignment, in the
+	// order of the node list to stay deterministic.
 	toAssign := make([]*descriptor, 0, len(nodeMap))
-	for _, n := range nodeMap {
-		toAssign = append(toAssign, n)
+	for _, v := range nodeList {
+		if _, ok := nodeMap[v.desc.IdentityKey.ByteArray()]; ok {
+			toAssign = append(toAssign, v)
+		}
 	}
 	assignIndexes := rng.Perm(len(toAssign))
 
@@ -107,7 +130,7 @@ func generateTopology(nodeList []*descriptor, doc *pki.Document, layers int) [][
 	for layer := range doc.Topology {
 		for len(topology[layer]) < targetNodesPerLayer {
 			n := toAssign[assignIndexes[idx]]
-			topology[layer] = append(topology[layer], n.raw)
+			topology[layer] = append(topology[layer], n)
 			idx++
 		}
 	}
@@ -115,7 +138,7 @@ func generateTopology(nodeList []*descriptor, doc *pki.Document, layers int) [][
 	// Assign the remaining nodes.
 	for layer := 0; idx < len(assignIndexes); idx++ {
 		n := toAssign[assignIndexes[idx]]
-		topology[layer] = append(topology[layer], n.raw)
+		topology[layer] = append(topology[layer], n)
 		layer++
 		layer = layer % len(topology)
 	}
@@ -123,34 +146,20 @@ func generateTopology(nodeList []*descriptor, doc *pki.Document, layers int) [][
 	return topology
 }
 
-func generateRandomTopology(nodes []*descriptor, layers int) [][][]byte {
+func generateRandomTopology(nodes []*descriptor, layers int, srv []byte) [][]*descriptor {
 	// If there is no node history in the form of a previous consensus,
 	// then the simplest thing to do is to randomly assign nodes to the
 	// various layers.
 
-	rng := rand.New(rand.NewSource(0))
+	rng := newSharedRandomRng(srv)
 	nodeIndexes := rng.Perm(len(nodes))
-	topology := make([][][]byte, layers)
+	topology := make([][]*descriptor, layers)
 	for idx, layer := 0, 0; idx < len(nodes); idx++ {
 		n := nodes[nodeIndexes[idx]]
-		topology[layer] = append(topology[layer], n.raw)
+		topology[layer] = append(topology[layer], n)
 		layer++
 		layer = layer % len(topology)
 	}
 
 	return topology
 }
-
-func SinceEpochStart(ellapsedHeight int64) time.Duration {
-	//	if ellapsedHeight > EpochInterval {
-	//		ellapsedHeight = EpochInterval
-	//	}
-	return HeightPeriod * time.Duration(ellapsedHeight)
-}
-
-func TillEpochFinish(ellapsedHeight int64) time.Duration {
-	if ellapsedHeight > EpochInterval {
-		ellapsedHeight = EpochInterval
-	}
-	return HeightPeriod * time.Duration(EpochInterval-ellapsedHeight)
-}
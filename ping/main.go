@@ -25,29 +25,39 @@ import (
 	"github.com/katzenpost/core/crypto/ecdh"
 )
 
-func register(configFile string) (*config.Config, *ecdh.PrivateKey) {
+func register(configFile string, rekey bool) (*config.Config, *ecdh.PrivateKey) {
 	cfg, err := config.LoadFile(configFile)
 	if err != nil {
 		panic(err)
 	}
 	_ = cfg.UpdateTrust()
 	_ = cfg.SaveConfig(configFile)
-	linkKey := client.AutoRegisterRandomClient(cfg)
+	var linkKey *ecdh.PrivateKey
+	if rekey {
+		linkKey, err = client.RekeyClient(cfg)
+	} else {
+		linkKey, err = client.LoadOrRegisterClient(cfg)
+	}
+	if err != nil {
+		panic(err)
+	}
 	return cfg, linkKey
 }
 
 func main() {
 	var configFile string
 	var service string
+	var rekey bool
 	flag.StringVar(&configFile, "c", "client.toml", "configuration file")
 	flag.StringVar(&service, "s", "echo", "service name")
+	flag.BoolVar(&rekey, "rekey", false, "replace the link key of the saved account")
 	flag.Parse()
 
 	if service == "" {
 		panic("must specify service name with -s")
 	}
 
-	cfg, linkKey := register(configFile)
+	cfg, linkKey := register(configFile, rekey)
 
 	// create a client and connect to the mixnet Provider
 	c, err := client.NewFromConfig(cfg, service)
@@ -0,0 +1,223 @@
+// atrest.go - Encryption at rest of the provider databases.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+// Package atrest implements the encryption at rest of the provider databases.
+//
+// The key of each database is derived from an operator secret, either a key
+// file or a passphrase, and a random salt stored in the database header.  The
+// records are sealed with XChaCha20-Poly1305, and the keys of the records
+// that must still be looked up, such as user names, are replaced with their
+// keyed BLAKE2b hash.
+package atrest
+
+import (
+	"crypto/cipher"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/katzenpost/core/crypto/rand"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/chacha20poly1305"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// Overhead is the difference in length between a sealed record and its
+	// plaintext.
+	Overhead = chacha20poly1305.NonceSizeX + chacha20poly1305.Overhead
+
+	// MinKeyFileSize is the minimum size of a key file.
+	MinKeyFileSize = 32
+
+	// IDLength is the length of the record identifiers.
+	IDLength = blake2b.Size256
+
+	saltLength = 32
+	kdfInfo    = "meson-atrest-v0"
+	checkAD    = "meson-atrest-check"
+
+	argonTime    = 3
+	argonMemory  = 64 * 1024 // 64 MiB.
+	argonThreads = 4
+)
+
+// ErrInvalidKey is the error returned when the secret does not match the
+// key of a database.
+var ErrInvalidKey = errors.New("atrest: invalid passphrase or key file")
+
+// Secret is an operator secret the database keys are derived from.
+type Secret struct {
+	material     []byte
+	isPassphrase bool
+}
+
+// NewPassphraseSecret returns the Secret of an operator passphrase.
+func NewPassphraseSecret(passphrase []byte) (*Secret, error) {
+	if len(passphrase) == 0 {
+		return nil, errors.New("atrest: empty passphrase")
+	}
+	return &Secret{
+		material:     append([]byte{}, passphrase...),
+		isPassphrase: true,
+	}, nil
+}
+
+// NewKeyFileSecret returns the Secret of the key file f, which must hold at
+// least MinKeyFileSize bytes of uniformly random key material.
+func NewKeyFileSecret(f string) (*Secret, error) {
+	b, err := ioutil.ReadFile(f)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < MinKeyFileSize {
+		return nil, fmt.Errorf("atrest: key file '%v' is too short: %v bytes", f, len(b))
+	}
+	return &Secret{material: b}, nil
+}
+
+// Replace atomically replaces the plaintext database f with the encrypted
+// database tmp, then overwrites the content of the plaintext database with
+// zeros.  The overwrite is best effort: journaling and copy-on-write
+// filesystems, SSDs and backups may still hold copies of the plaintext.
+func Replace(tmp, f string) error {
+	old, err := os.OpenFile(f, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer old.Close()
+	fi, err := old.Stat()
+	if err != nil {
+		return err
+	}
+	if err = os.Rename(tmp, f); err != nil {
+		return err
+	}
+
+	// The plaintext database is unlinked, but still open.
+	zeros := make([]byte, 64*1024)
+	for n := fi.Size(); n > 0; n -= int64(len(zeros)) {
+		if n < int64(len(zeros)) {
+			zeros = zeros[:n]
+		}
+		if _, err = old.Write(zeros); err != nil {
+			return fmt.Errorf("atrest: failed to wipe the plaintext database: %v", err)
+		}
+	}
+	if err = old.Sync(); err != nil {
+		return fmt.Errorf("atrest: failed to wipe the plaintext database: %v", err)
+	}
+	return nil
+}
+
+// NewKey derives a Key with a fresh salt, and returns it along with the
+// header to store in the database to derive it again with LoadKey.
+func (s *Secret) NewKey() (*Key, []byte, error) {
+	salt := make([]byte, saltLength)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, nil, err
+	}
+	k, err := s.deriveKey(salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	header := append(salt, k.Seal(nil, []byte(checkAD))...)
+	return k, header, nil
+}
+
+// LoadKey derives the Key of a database from its header, and returns
+// ErrInvalidKey if the secret is not the one the database was created with.
+func (s *Secret) LoadKey(header []byte) (*Key, error) {
+	if len(header) != saltLength+Overhead {
+		return nil, fmt.Errorf("atrest: invalid header length: %v", len(header))
+	}
+	k, err := s.deriveKey(header[:saltLength])
+	if err != nil {
+		return nil, err
+	}
+	if _, err = k.Open(header[saltLength:], []byte(checkAD)); err != nil {
+		return nil, ErrInvalidKey
+	}
+	return k, nil
+}
+
+func (s *Secret) deriveKey(salt []byte) (*Key, error) {
+	ikm := s.material
+	if s.isPassphrase {
+		ikm = argon2.IDKey(s.material, salt, argonTime, argonMemory, argonThreads, chacha20poly1305.KeySize)
+	}
+
+	var aeadKey [chacha20poly1305.KeySize]byte
+	k := &Key{idKey: make([]byte, blake2b.Size256)}
+	kdf := hkdf.New(sha256.New, ikm, salt, []byte(kdfInfo))
+	if _, err := io.ReadFull(kdf, aeadKey[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(kdf, k.idKey); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if k.aead, err = chacha20poly1305.NewX(aeadKey[:]); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// Key is the key of an encrypted database.
+type Key struct {
+	aead  cipher.AEAD
+	idKey []byte
+}
+
+// ID returns the identifier of the record key b, which is deterministic so
+// that the record can still be looked up.
+func (k *Key) ID(b []byte) []byte {
+	h, err := blake2b.New256(k.idKey)
+	if err != nil {
+		panic("BUG: atrest: failed to initialize BLAKE2b: " + err.Error())
+	}
+	_, _ = h.Write(b)
+	return h.Sum(nil)
+}
+
+// Seal encrypts and authenticates the record plaintext, bound to the
+// additional data ad.
+func (k *Key) Seal(plaintext, ad []byte) []byte {
+	nonce := make([]byte, chacha20poly1305.NonceSizeX, len(plaintext)+Overhead)
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panic("BUG: atrest: failed to generate nonce: " + err.Error())
+	}
+	return k.aead.Seal(nonce, nonce, plaintext, ad)
+}
+
+// Open authenticates and decrypts the sealed record, bound to the
+// additional data ad.
+func (k *Key) Open(sealed, ad []byte) ([]byte, error) {
+	if len(sealed) < Overhead {
+		return nil, errors.New("atrest: truncated record")
+	}
+	nonce := sealed[:chacha20poly1305.NonceSizeX]
+	b, err := k.aead.Open(nil, nonce, sealed[chacha20poly1305.NonceSizeX:], ad)
+	if err != nil {
+		return nil, errors.New("atrest: failed to open record")
+	}
+	return b, nil
+}
@@ -0,0 +1,111 @@
+// atrest_test.go - Encryption at rest tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package atrest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKey(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	secret, err := NewPassphraseSecret([]byte("passphrase"))
+	require.NoError(err)
+	k, header, err := secret.NewKey()
+	require.NoError(err)
+
+	// the key is derived again from the header
+	loaded, err := secret.LoadKey(header)
+	require.NoError(err)
+	assert.Equal(k.ID([]byte("alice")), loaded.ID([]byte("alice")))
+	assert.NotEqual(k.ID([]byte("alice")), k.ID([]byte("bob")))
+	sealed := k.Seal([]byte("message"), []byte("ad"))
+	assert.Len(sealed, len("message")+Overhead)
+	b, err := loaded.Open(sealed, []byte("ad"))
+	require.NoError(err)
+	assert.Equal([]byte("message"), b)
+	assert.NotEqual(sealed, k.Seal([]byte("message"), []byte("ad")))
+
+	// the records are bound to their additional data
+	_, err = loaded.Open(sealed, []byte("other"))
+	assert.Error(err)
+	_, err = loaded.Open(sealed[:Overhead-1], []byte("ad"))
+	assert.Error(err)
+
+	// the keys of other secrets and databases are distinct
+	other, err := NewPassphraseSecret([]byte("other"))
+	require.NoError(err)
+	_, err = other.LoadKey(header)
+	assert.Equal(ErrInvalidKey, err)
+	k2, _, err := secret.NewKey()
+	require.NoError(err)
+	assert.NotEqual(k.ID([]byte("alice")), k2.ID([]byte("alice")))
+	_, err = NewPassphraseSecret(nil)
+	assert.Error(err)
+
+	// the key files must hold enough key material
+	dir, err := ioutil.TempDir("", "atrest_tests")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "key")
+	require.NoError(ioutil.WriteFile(f, make([]byte, MinKeyFileSize-1), 0600))
+	_, err = NewKeyFileSecret(f)
+	assert.Error(err)
+	require.NoError(ioutil.WriteFile(f, make([]byte, MinKeyFileSize), 0600))
+	_, err = NewKeyFileSecret(f)
+	assert.NoError(err)
+}
+
+func TestReplace(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	dir, err := ioutil.TempDir("", "atrest_test")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	f, tmp, link := filepath.Join(dir, "db"), filepath.Join(dir, "db.encrypted"), filepath.Join(dir, "db.link")
+	plaintext := make([]byte, 100*1024+1)
+	for i := range plaintext {
+		plaintext[i] = 'a'
+	}
+	require.NoError(ioutil.WriteFile(f, plaintext, 0600))
+	require.NoError(ioutil.WriteFile(tmp, []byte("encrypted"), 0600))
+	require.NoError(os.Link(f, link))
+
+	// the database is replaced, and the plaintext overwritten
+	require.NoError(Replace(tmp, f))
+	b, err := ioutil.ReadFile(f)
+	require.NoError(err)
+	assert.Equal([]byte("encrypted"), b)
+	b, err = ioutil.ReadFile(link)
+	require.NoError(err)
+	assert.Equal(make([]byte, len(plaintext)), b)
+	_, err = os.Stat(tmp)
+	assert.True(os.IsNotExist(err))
+
+	// nothing is overwritten when the database can not be replaced
+	require.NoError(ioutil.WriteFile(link, plaintext, 0600))
+	assert.Error(Replace(tmp, link))
+	b, err = ioutil.ReadFile(link)
+	require.NoError(err)
+	assert.Equal(plaintext, b)
+}
@@ -25,13 +25,53 @@ import (
 	"syscall"
 
 	server "github.com/hashcloak/Meson/server"
+	"github.com/hashcloak/Meson/server/atrest"
 	"github.com/hashcloak/Meson/server/config"
+	"github.com/hashcloak/Meson/server/spool/boltspool"
+	"github.com/hashcloak/Meson/server/userdb/boltuserdb"
 )
 
+// encryptDatabases converts the plaintext BoltDB backed user database and
+// spool of the provider into encrypted ones.
+func encryptDatabases(cfg *config.Config) error {
+	if cfg.Provider == nil || cfg.Provider.Encryption == nil {
+		return fmt.Errorf("no Provider.Encryption section configured")
+	}
+	secret, err := cfg.Provider.Encryption.Secret()
+	if err != nil {
+		return err
+	}
+
+	if cfg.Provider.UserDB.Backend == config.BackendBolt {
+		if err = encryptDatabase(cfg.Provider.UserDB.Bolt.UserDB, secret, boltuserdb.Encrypt); err != nil {
+			return err
+		}
+	}
+	if cfg.Provider.SpoolDB.Backend == config.BackendBolt {
+		if err = encryptDatabase(cfg.Provider.SpoolDB.Bolt.SpoolDB, secret, boltspool.Encrypt); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func encryptDatabase(f string, secret *atrest.Secret, encrypt func(string, *atrest.Secret) error) error {
+	if _, err := os.Stat(f); os.IsNotExist(err) {
+		// The database will be created encrypted on startup.
+		return nil
+	}
+	if err := encrypt(f, secret); err != nil {
+		return fmt.Errorf("'%v': %v", f, err)
+	}
+	fmt.Printf("Encrypted '%v'.\n", f)
+	return nil
+}
+
 func main() {
 	cfgFile := flag.String("f", "katzenpost.toml", "Path to the server config file.")
 	genOnly := flag.Bool("g", false, "Generate the keys and exit immediately.")
 	testConfig := flag.Bool("t", false, "Test meson server config.")
+	encryptDB := flag.Bool("encrypt-db", false, "Encrypt the plaintext provider databases with the configured key and exit.")
 	cpuProfilePath := flag.String("cpuprofilepath", "", "Path to the pprof cpu profile")
 	memProfilePath := flag.String("memprofilepath", "", "Path to the pprof memory profile")
 	flag.Parse()
@@ -87,6 +127,13 @@ func main() {
 		fmt.Printf("The Meson server configuration looks good.\n")
 		os.Exit(0)
 	}
+	if *encryptDB {
+		if err := encryptDatabases(cfg); err != nil {
+			fmt.Fprintf(os.Stderr, "Failed to encrypt the databases: %v\n", err)
+			os.Exit(-1)
+		}
+		os.Exit(0)
+	}
 
 	// Setup the signal handling.
 	haltCh := make(chan os.Signal, 1)
@@ -32,6 +32,7 @@ import (
 
 	"github.com/BurntSushi/toml"
 	"github.com/fxamacker/cbor/v2"
+	"github.com/hashcloak/Meson/server/atrest"
 	"github.com/katzenpost/authority/voting/server/config"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/katzenpost/core/crypto/eddsa"
@@ -52,16 +53,20 @@ const (
 	defaultSchedulerMaxBurst   = 16
 	defaultSendSlack           = 50        // 50 ms.
 	defaultDecoySlack          = 15 * 1000 // 15 sec.
+	defaultDecoyLossAlert      = 0.2
 	defaultConnectTimeout      = 60 * 1000 // 60 sec.
 	defaultHandshakeTimeout    = 30 * 1000 // 30 sec.
 	defaultReauthInterval      = 30 * 1000 // 30 sec.
 	defaultProviderDelay       = 500       // 500 ms.
 	defaultKaetzchenDelay      = 750       // 750 ms.
+	defaultReassemblyTimeout   = 60 * 1000 // 60 sec.
 	defaultUserDB              = "users.db"
 	defaultSpoolDB             = "spool.db"
+	defaultSpoolSweepInterval  = 5 * 60 // 5 min.
 	defaultManagementSocket    = "management_sock"
 
-	backendPgx = "pgx"
+	backendPgx    = "pgx"
+	backendSqlite = "sqlite"
 
 	// BackendSQL is a SQL based backend.
 	BackendSQL = "sql"
@@ -71,6 +76,13 @@ const (
 
 	// BackendExtern is a External (RESTful http) backend.
 	BackendExtern = "extern"
+
+	// QuotaPolicyReject rejects the entries exceeding a user's spool quota.
+	QuotaPolicyReject = "reject"
+
+	// QuotaPolicyDropOldest drops the oldest entries of a user's spool to
+	// make room for the entries exceeding its quota.
+	QuotaPolicyDropOldest = "drop_oldest"
 )
 
 var defaultLogging = Logging{
@@ -208,6 +220,11 @@ type Debug struct {
 	// in milliseconds.
 	KaetzchenDelay int
 
+	// KaetzchenReassemblyTimeout is the maximum time the fragments of a
+	// Kaetzchen request are kept waiting for the rest of the request in
+	// milliseconds.
+	KaetzchenReassemblyTimeout int
+
 	// SchedulerSlack is the maximum allowed scheduler slack due to queueing
 	// and or processing in milliseconds.
 	SchedulerSlack int
@@ -239,6 +256,16 @@ type Debug struct {
 	// WARNING: This option will go away once decoy traffic is more concrete.
 	SendDecoyTraffic bool
 
+	// DecoyDiscardRatio is the fraction of the decoy packets sent as discard
+	// packets rather than loop packets.  By default only loop packets are
+	// sent.
+	DecoyDiscardRatio float64
+
+	// DecoyLossAlertThreshold is the estimated ratio of the decoy loops lost
+	// through a node above which an alert is logged for the node.  If unset,
+	// the threshold defaults to 0.2.
+	DecoyLossAlertThreshold float64
+
 	// DisableRateLimit disables the per-client rate limiter.  This option
 	// should only be used for testing.
 	DisableRateLimit bool
@@ -279,6 +306,9 @@ func (dCfg *Debug) applyDefaults() {
 	if dCfg.KaetzchenDelay <= 0 {
 		dCfg.KaetzchenDelay = defaultKaetzchenDelay
 	}
+	if dCfg.KaetzchenReassemblyTimeout <= 0 {
+		dCfg.KaetzchenReassemblyTimeout = defaultReassemblyTimeout
+	}
 	if dCfg.SchedulerSlack < defaultSchedulerSlack {
 		// TODO/perf: Tune this.
 		dCfg.SchedulerSlack = defaultSchedulerSlack
@@ -294,6 +324,9 @@ func (dCfg *Debug) applyDefaults() {
 	if dCfg.DecoySlack <= 0 {
 		dCfg.DecoySlack = defaultDecoySlack
 	}
+	if dCfg.DecoyLossAlertThreshold == 0 {
+		dCfg.DecoyLossAlertThreshold = defaultDecoyLossAlert
+	}
 	if dCfg.ConnectTimeout <= 0 {
 		dCfg.ConnectTimeout = defaultConnectTimeout
 	}
@@ -355,6 +388,11 @@ type Provider struct {
 	// SpoolDB is the user message spool configuration.
 	SpoolDB *SpoolDB
 
+	// Encryption is the encryption at rest configuration of the BoltDB
+	// backed user database and spool.  If left empty, they are stored in
+	// plaintext.
+	Encryption *Encryption
+
 	// BinaryRecipients disables all Provider side recipient pre-processing,
 	// including removing trailing `NUL` bytes, case normalization, and
 	// delimiter support.
@@ -381,19 +419,24 @@ type Provider struct {
 type SQLDB struct {
 	// Backend is the active database backend (driver).
 	//
-	//  - pgx: Postgresql.
+	//  - pgx: Postgresql, with the schema created by
+	//    `create_database-postgresql.sql`.  Databases created before the
+	//    spool quotas must be upgraded with
+	//    `migrate_database-postgresql-v0-v1.sql`.
+	//  - sqlite: SQLite, with the schema created on demand.
 	Backend string
 
 	// DataSourceName is the SQL data source name or URI.  The format
 	// of this parameter is dependent on the database driver being used.
 	//
 	//  - pgx: https://godoc.org/github.com/jackc/pgx#ParseConnectionString
+	//  - sqlite: https://github.com/mattn/go-sqlite3#connection-string
 	DataSourceName string
 }
 
 func (sCfg *SQLDB) validate() error {
 	switch sCfg.Backend {
-	case backendPgx:
+	case backendPgx, backendSqlite:
 	default:
 		return fmt.Errorf("config: SQLDB: Backend '%v' is invalid", sCfg.Backend)
 	}
@@ -438,6 +481,45 @@ type SpoolDB struct {
 
 	// BoltDB backed spool (`bolt`).
 	Bolt *BoltSpoolDB
+
+	// MessageTTL is the time in seconds after which the spooled entries
+	// expire.  If left zero, the entries never expire.
+	MessageTTL int
+
+	// SweepInterval is the interval in seconds at which the expired entries
+	// are removed from the spool.
+	SweepInterval int
+
+	// MaxMessages is the maximum number of entries in a user's spool.  If
+	// left zero, the number of entries is unlimited.
+	MaxMessages int
+
+	// MaxBytes is the maximum total size in bytes of the entries in a user's
+	// spool.  If left zero, the size of the spool is unlimited.
+	MaxBytes int
+
+	// QuotaPolicy is the behavior when an entry would exceed the quota of a
+	// user's spool.  If left empty, the entry is rejected (`reject`),
+	// otherwise the oldest entries are dropped to make room (`drop_oldest`).
+	QuotaPolicy string
+}
+
+func (sCfg *SpoolDB) validate() error {
+	if sCfg.MessageTTL < 0 {
+		return fmt.Errorf("config: Provider: SpoolDB MessageTTL %v is invalid", sCfg.MessageTTL)
+	}
+	if sCfg.MaxMessages < 0 {
+		return fmt.Errorf("config: Provider: SpoolDB MaxMessages %v is invalid", sCfg.MaxMessages)
+	}
+	if sCfg.MaxBytes < 0 {
+		return fmt.Errorf("config: Provider: SpoolDB MaxBytes %v is invalid", sCfg.MaxBytes)
+	}
+	switch sCfg.QuotaPolicy {
+	case QuotaPolicyReject, QuotaPolicyDropOldest:
+	default:
+		return fmt.Errorf("config: Provider: SpoolDB QuotaPolicy '%v' is invalid", sCfg.QuotaPolicy)
+	}
+	return nil
 }
 
 // BoltSpoolDB is the BolTDB implementation of the spool.
@@ -447,6 +529,40 @@ type BoltSpoolDB struct {
 	SpoolDB string
 }
 
+// Encryption is the encryption at rest configuration.
+type Encryption struct {
+	// KeyFile is the path to a file holding at least 32 bytes of uniformly
+	// random key material the keys are derived from.
+	KeyFile string
+
+	// Passphrase is the operator passphrase the keys are derived from, if
+	// no KeyFile is configured.
+	Passphrase string
+}
+
+func (eCfg *Encryption) validate() error {
+	switch {
+	case eCfg.KeyFile != "" && eCfg.Passphrase != "":
+		return fmt.Errorf("config: Provider: Encryption has both a KeyFile and a Passphrase")
+	case eCfg.KeyFile != "":
+		if !filepath.IsAbs(eCfg.KeyFile) {
+			return fmt.Errorf("config: Provider: Encryption KeyFile '%v' is not an absolute path", eCfg.KeyFile)
+		}
+	case eCfg.Passphrase == "":
+		return fmt.Errorf("config: Provider: Encryption requires a KeyFile or a Passphrase")
+	}
+	return nil
+}
+
+// Secret returns the secret the keys of the encrypted databases are derived
+// from.
+func (eCfg *Encryption) Secret() (*atrest.Secret, error) {
+	if eCfg.KeyFile != "" {
+		return atrest.NewKeyFileSecret(eCfg.KeyFile)
+	}
+	return atrest.NewPassphraseSecret([]byte(eCfg.Passphrase))
+}
+
 // Kaetzchen is a Provider auto-responder agent.
 type Kaetzchen struct {
 	// Capability is the capability exposed by the agent.
@@ -560,6 +676,12 @@ func (pCfg *Provider) applyDefaults(sCfg *Server) {
 	if pCfg.SpoolDB.Backend == "" {
 		pCfg.SpoolDB.Backend = BackendBolt
 	}
+	if pCfg.SpoolDB.SweepInterval <= 0 {
+		pCfg.SpoolDB.SweepInterval = defaultSpoolSweepInterval
+	}
+	if pCfg.SpoolDB.QuotaPolicy == "" {
+		pCfg.SpoolDB.QuotaPolicy = QuotaPolicyReject
+	}
 	switch pCfg.SpoolDB.Backend {
 	case BackendBolt:
 		if pCfg.SpoolDB.Bolt == nil {
@@ -625,6 +747,14 @@ func (pCfg *Provider) validate() error {
 		return fmt.Errorf("config: Provider: Invalid UserDB Backend: '%v'", pCfg.UserDB.Backend)
 	}
 
+	if err := pCfg.SpoolDB.validate(); err != nil {
+		return err
+	}
+	if pCfg.Encryption != nil {
+		if err := pCfg.Encryption.validate(); err != nil {
+			return err
+		}
+	}
 	switch pCfg.SpoolDB.Backend {
 	case BackendBolt:
 		if !filepath.IsAbs(pCfg.SpoolDB.Bolt.SpoolDB) {
@@ -878,6 +1008,12 @@ func (cfg *Config) FixupAndValidate() error {
 		return err
 	}
 	cfg.Debug.applyDefaults()
+	if r := cfg.Debug.DecoyDiscardRatio; r < 0 || r > 1 {
+		return fmt.Errorf("config: Debug: DecoyDiscardRatio '%v' is not between 0 and 1", r)
+	}
+	if r := cfg.Debug.DecoyLossAlertThreshold; r < 0 || r > 1 {
+		return fmt.Errorf("config: Debug: DecoyLossAlertThreshold '%v' is not between 0 and 1", r)
+	}
 
 	var err error
 	cfg.Server.Identifier, err = idna.Lookup.ToASCII(cfg.Server.Identifier)
@@ -18,6 +18,7 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -122,3 +123,173 @@ PublicKey = "kAiVchOBwHVtKJVFJLsdCQ9UyN2SlfhLHYqT8ePBetg="
 	require.EqualError(err, "config: Server: Identifier is not set")
 
 }
+
+func TestDecoyDiscardRatio(t *testing.T) {
+	require := require.New(t)
+
+	const decoyConfig = `# A basic configuration example.
+[server]
+Identifier = "katzenpost.example.com"
+Addresses = [ "127.0.0.1:29483" ]
+DataDir = "/var/lib/katzenpost"
+IsProvider = true
+
+[Debug]
+SendDecoyTraffic = true
+DecoyDiscardRatio = %v
+
+[PKI]
+[PKI.Nonvoting]
+Address = "127.0.0.1:6999"
+PublicKey = "kAiVchOBwHVtKJVFJLsdCQ9UyN2SlfhLHYqT8ePBetg="
+`
+
+	cfg, err := Load([]byte(fmt.Sprintf(decoyConfig, 0.25)))
+	require.NoError(err, "Load() with decoy config")
+	require.Equal(0.25, cfg.Debug.DecoyDiscardRatio)
+
+	_, err = Load([]byte(fmt.Sprintf(decoyConfig, 1.5)))
+	require.Error(err, "Load() with invalid DecoyDiscardRatio")
+}
+
+func TestDecoyLossAlertThreshold(t *testing.T) {
+	require := require.New(t)
+
+	const decoyConfig = `# A basic configuration example.
+[server]
+Identifier = "katzenpost.example.com"
+Addresses = [ "127.0.0.1:29483" ]
+DataDir = "/var/lib/katzenpost"
+IsProvider = true
+
+[Debug]
+SendDecoyTraffic = true
+%v
+
+[PKI]
+[PKI.Nonvoting]
+Address = "127.0.0.1:6999"
+PublicKey = "kAiVchOBwHVtKJVFJLsdCQ9UyN2SlfhLHYqT8ePBetg="
+`
+
+	cfg, err := Load([]byte(fmt.Sprintf(decoyConfig, "")))
+	require.NoError(err, "Load() with decoy config")
+	require.Equal(defaultDecoyLossAlert, cfg.Debug.DecoyLossAlertThreshold)
+
+	cfg, err = Load([]byte(fmt.Sprintf(decoyConfig, "DecoyLossAlertThreshold = 0.5")))
+	require.NoError(err, "Load() with decoy config")
+	require.Equal(0.5, cfg.Debug.DecoyLossAlertThreshold)
+
+	_, err = Load([]byte(fmt.Sprintf(decoyConfig, "DecoyLossAlertThreshold = -0.5")))
+	require.Error(err, "Load() with negative DecoyLossAlertThreshold")
+	_, err = Load([]byte(fmt.Sprintf(decoyConfig, "DecoyLossAlertThreshold = 1.5")))
+	require.Error(err, "Load() with invalid DecoyLossAlertThreshold")
+}
+
+func TestSpoolDBLimits(t *testing.T) {
+	require := require.New(t)
+
+	const spoolConfig = `# A basic configuration example.
+[server]
+Identifier = "katzenpost.example.com"
+Addresses = [ "127.0.0.1:29483" ]
+DataDir = "/var/lib/katzenpost"
+IsProvider = true
+
+[Provider]
+[Provider.SpoolDB]
+MessageTTL = 86400
+MaxMessages = 100
+QuotaPolicy = "%v"
+
+[PKI]
+[PKI.Nonvoting]
+Address = "127.0.0.1:6999"
+PublicKey = "kAiVchOBwHVtKJVFJLsdCQ9UyN2SlfhLHYqT8ePBetg="
+`
+
+	cfg, err := Load([]byte(fmt.Sprintf(spoolConfig, "")))
+	require.NoError(err, "Load() with spool limits")
+	require.Equal(QuotaPolicyReject, cfg.Provider.SpoolDB.QuotaPolicy)
+	require.Equal(defaultSpoolSweepInterval, cfg.Provider.SpoolDB.SweepInterval)
+	require.Equal(100, cfg.Provider.SpoolDB.MaxMessages)
+
+	cfg, err = Load([]byte(fmt.Sprintf(spoolConfig, QuotaPolicyDropOldest)))
+	require.NoError(err, "Load() with drop_oldest")
+	require.Equal(QuotaPolicyDropOldest, cfg.Provider.SpoolDB.QuotaPolicy)
+
+	_, err = Load([]byte(fmt.Sprintf(spoolConfig, "drop_newest")))
+	require.Error(err, "Load() with invalid QuotaPolicy")
+}
+
+func TestEncryption(t *testing.T) {
+	require := require.New(t)
+
+	const encryptionConfig = `# A basic configuration example.
+[server]
+Identifier = "katzenpost.example.com"
+Addresses = [ "127.0.0.1:29483" ]
+DataDir = "/var/lib/katzenpost"
+IsProvider = true
+
+[Provider]
+[Provider.Encryption]
+%v
+
+[PKI]
+[PKI.Nonvoting]
+Address = "127.0.0.1:6999"
+PublicKey = "kAiVchOBwHVtKJVFJLsdCQ9UyN2SlfhLHYqT8ePBetg="
+`
+
+	cfg, err := Load([]byte(fmt.Sprintf(encryptionConfig, `Passphrase = "passphrase"`)))
+	require.NoError(err, "Load() with a Passphrase")
+	require.Equal("passphrase", cfg.Provider.Encryption.Passphrase)
+
+	_, err = Load([]byte(fmt.Sprintf(encryptionConfig, `KeyFile = "/var/lib/katzenpost/db.key"`)))
+	require.NoError(err, "Load() with a KeyFile")
+
+	_, err = Load([]byte(fmt.Sprintf(encryptionConfig, `KeyFile = "db.key"`)))
+	require.Error(err, "Load() with a relative KeyFile")
+
+	_, err = Load([]byte(fmt.Sprintf(encryptionConfig, "KeyFile = \"/db.key\"\nPassphrase = \"passphrase\"")))
+	require.Error(err, "Load() with both a KeyFile and a Passphrase")
+
+	_, err = Load([]byte(fmt.Sprintf(encryptionConfig, "")))
+	require.Error(err, "Load() with no secret")
+}
+
+func TestSQLDBBackends(t *testing.T) {
+	require := require.New(t)
+
+	const sqlConfig = `# A basic configuration example.
+[server]
+Identifier = "katzenpost.example.com"
+Addresses = [ "127.0.0.1:29483" ]
+DataDir = "/var/lib/katzenpost"
+IsProvider = true
+
+[Provider]
+[Provider.SQLDB]
+Backend = "%v"
+DataSourceName = "/var/lib/katzenpost/meson.db"
+[Provider.UserDB]
+Backend = "sql"
+[Provider.SpoolDB]
+Backend = "sql"
+
+[PKI]
+[PKI.Nonvoting]
+Address = "127.0.0.1:6999"
+PublicKey = "kAiVchOBwHVtKJVFJLsdCQ9UyN2SlfhLHYqT8ePBetg="
+`
+
+	for _, backend := range []string{backendPgx, backendSqlite} {
+		cfg, err := Load([]byte(fmt.Sprintf(sqlConfig, backend)))
+		require.NoErrorf(err, "Load() with the %v backend", backend)
+		require.Equal(backend, cfg.Provider.SQLDB.Backend)
+	}
+
+	_, err := Load([]byte(fmt.Sprintf(sqlConfig, "mysql")))
+	require.Error(err, "Load() with an invalid backend")
+}
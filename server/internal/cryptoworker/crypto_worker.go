@@ -22,7 +22,6 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/hashcloak/Meson/client/pkiclient/epochtime"
 	"github.com/hashcloak/Meson/server/internal/constants"
 	"github.com/hashcloak/Meson/server/internal/glue"
 	"github.com/hashcloak/Meson/server/internal/mixkey"
@@ -254,7 +253,7 @@ func (w *Worker) worker() {
 
 			// Check and adjust the delay for queue dwell time.
 			pkt.Delay = time.Duration(pkt.NodeDelay.Delay) * time.Millisecond
-			if pkt.Delay > constants.NumMixKeys*epochtime.TestPeriod {
+			if pkt.Delay > constants.NumMixKeys*w.glue.PKI().Period() {
 				w.log.Debugf("Dropping packet: %v (Delay %v is past what is possible)", pkt.ID, pkt.Delay)
 				packetsDropped.Inc()
 				pkt.Dispose()
@@ -325,31 +324,44 @@ func (w *Worker) worker() {
 		}
 
 		// This node is a provider and the packet is not destined for another
-		// node.  Both of the operations here end up hitting up disk among
-		// other things, so are just shunted off to a separate worker so that
-		// packet processing does not get blocked.
+		// node.
+		w.deliverLocally(pkt, now)
+	}
 
-		if pkt.MustForward {
-			w.log.Debugf("Dropping client packet: %v (Send to local user)", pkt.ID)
-			packetsDropped.Inc()
-			pkt.Dispose()
-			continue
-		}
+	// NOTREACHED
+}
 
-		// Toss the packets over to the provider backend.
-		// Note: Callee takes ownership of pkt.
-		if pkt.IsToUser() || pkt.IsUnreliableToUser() || pkt.IsSURBReply() {
-			w.log.Debugf("Handing off user destined packet: %v", pkt.ID)
-			pkt.DispatchAt = now
-			w.glue.Provider().OnPacket(pkt)
-		} else {
-			w.log.Debugf("Dropping user packet: %v (%v)", pkt.ID, pkt.CmdsToString())
-			packetsDropped.Inc()
-			pkt.Dispose()
-		}
+// deliverLocally hands a packet terminating at this Provider over to the
+// decoy instance if it is the reply to one of its loops, and to the provider
+// backend otherwise.  Both of the operations end up hitting up disk among
+// other things, so are just shunted off to a separate worker so that packet
+// processing does not get blocked.
+func (w *Worker) deliverLocally(pkt *packet.Packet, now time.Duration) {
+	if pkt.MustForward {
+		w.log.Debugf("Dropping client packet: %v (Send to local user)", pkt.ID)
+		packetsDropped.Inc()
+		pkt.Dispose()
+		return
 	}
 
-	// NOTREACHED
+	// This may be a decoy traffic response.
+	if w.glue.Decoy().IsDecoyReply(pkt) {
+		w.log.Debugf("Handing off decoy response packet: %v", pkt.ID)
+		w.glue.Decoy().OnPacket(pkt)
+		return
+	}
+
+	// Toss the packets over to the provider backend.
+	// Note: Callee takes ownership of pkt.
+	if pkt.IsToUser() || pkt.IsUnreliableToUser() || pkt.IsSURBReply() {
+		w.log.Debugf("Handing off user destined packet: %v", pkt.ID)
+		pkt.DispatchAt = now
+		w.glue.Provider().OnPacket(pkt)
+	} else {
+		w.log.Debugf("Dropping user packet: %v (%v)", pkt.ID, pkt.CmdsToString())
+		packetsDropped.Inc()
+		pkt.Dispose()
+	}
 }
 
 func (w *Worker) derefKeys() {
@@ -0,0 +1,123 @@
+// crypto_worker_test.go - Katzenpost Sphinx crypto worker tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package cryptoworker
+
+import (
+	"testing"
+
+	"github.com/hashcloak/Meson/katzenmint"
+	"github.com/hashcloak/Meson/server/config"
+	"github.com/hashcloak/Meson/server/internal/glue"
+	"github.com/hashcloak/Meson/server/internal/packet"
+	"github.com/hashcloak/Meson/server/internal/pkicache"
+	"github.com/hashcloak/Meson/server/spool"
+	"github.com/hashcloak/Meson/server/userdb"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/monotime"
+	"github.com/katzenpost/core/sphinx/commands"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/core/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockProvider struct {
+	packets []*packet.Packet
+}
+
+func (p *mockProvider) Halt()                                         {}
+func (p *mockProvider) UserDB() userdb.UserDB                         { return nil }
+func (p *mockProvider) Spool() spool.Spool                            { return nil }
+func (p *mockProvider) AuthenticateClient(*wire.PeerCredentials) bool { return true }
+func (p *mockProvider) OnPacket(pkt *packet.Packet)                   { p.packets = append(p.packets, pkt) }
+func (p *mockProvider) KaetzchenForPKI() (map[string]map[string]interface{}, error) {
+	return nil, nil
+}
+func (p *mockProvider) AdvertiseRegistrationHTTPAddresses() []string { return nil }
+
+// mockDecoy claims the SURB replies to the recipient 1.
+type mockDecoy struct {
+	packets []*packet.Packet
+}
+
+func (d *mockDecoy) Halt()                         {}
+func (d *mockDecoy) OnNewDocument(*pkicache.Entry) {}
+func (d *mockDecoy) IsDecoyReply(pkt *packet.Packet) bool {
+	return pkt.IsSURBReply() && pkt.Recipient.ID[0] == 1
+}
+func (d *mockDecoy) OnPacket(pkt *packet.Packet) { d.packets = append(d.packets, pkt) }
+func (d *mockDecoy) NodeReliabilities(uint64) ([]katzenmint.NodeReliability, bool) {
+	return nil, true
+}
+
+type mockGlue struct {
+	provider *mockProvider
+	decoy    *mockDecoy
+}
+
+func (m *mockGlue) Config() *config.Config         { return &config.Config{} }
+func (m *mockGlue) LogBackend() *log.Backend       { return nil }
+func (m *mockGlue) IdentityKey() *eddsa.PrivateKey { return nil }
+func (m *mockGlue) LinkKey() *ecdh.PrivateKey      { return nil }
+func (m *mockGlue) Management() *thwack.Server     { return nil }
+func (m *mockGlue) MixKeys() glue.MixKeys          { return nil }
+func (m *mockGlue) PKI() glue.PKI                  { return nil }
+func (m *mockGlue) Provider() glue.Provider        { return m.provider }
+func (m *mockGlue) Scheduler() glue.Scheduler      { return nil }
+func (m *mockGlue) Connector() glue.Connector      { return nil }
+func (m *mockGlue) Listeners() []glue.Listener     { return nil }
+func (m *mockGlue) Decoy() glue.Decoy              { return m.decoy }
+func (m *mockGlue) ReshadowCryptoWorkers()         {}
+
+func TestDeliverLocally(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	g := &mockGlue{provider: new(mockProvider), decoy: new(mockDecoy)}
+	w := &Worker{
+		glue: g,
+		log:  logBackend.GetLogger("crypto_worker_test"),
+	}
+	surbReply := func(recipient byte) *packet.Packet {
+		pkt := &packet.Packet{Recipient: &commands.Recipient{}, SurbReply: &commands.SURBReply{}}
+		pkt.Recipient.ID[0] = recipient
+		return pkt
+	}
+
+	// the replies to the decoy loops are handed to the decoy instance
+	w.deliverLocally(surbReply(1), monotime.Now())
+	assert.Len(g.decoy.packets, 1)
+	assert.Empty(g.provider.packets)
+
+	// the replies and messages to the users are handed to the provider
+	w.deliverLocally(surbReply(2), monotime.Now())
+	w.deliverLocally(&packet.Packet{Recipient: &commands.Recipient{}, NodeDelay: &commands.NodeDelay{}}, monotime.Now())
+	w.deliverLocally(&packet.Packet{Recipient: &commands.Recipient{}}, monotime.Now())
+	assert.Len(g.decoy.packets, 1)
+	assert.Len(g.provider.packets, 3)
+
+	// the packets which may not terminate here are dropped
+	pkt := surbReply(1)
+	pkt.MustForward = true
+	w.deliverLocally(pkt, monotime.Now())
+	w.deliverLocally(&packet.Packet{}, monotime.Now())
+	assert.Len(g.decoy.packets, 1)
+	assert.Len(g.provider.packets, 3)
+}
@@ -18,6 +18,7 @@
 package decoy
 
 import (
+	"bytes"
 	"crypto/subtle"
 	"encoding/binary"
 	"errors"
@@ -25,11 +26,12 @@ import (
 	"io"
 	"math"
 	mRand "math/rand"
+	"sort"
 	"sync"
 	"time"
 
 	"git.schwanenlied.me/yawning/avl.git"
-	"github.com/hashcloak/Meson/client/pkiclient/epochtime"
+	"github.com/hashcloak/Meson/katzenmint"
 	internalConstants "github.com/hashcloak/Meson/server/internal/constants"
 	"github.com/hashcloak/Meson/server/internal/glue"
 	"github.com/hashcloak/Meson/server/internal/packet"
@@ -57,9 +59,62 @@ type surbCtx struct {
 	eta     time.Duration
 	sprpKey []byte
 
+	epoch uint64
+	hops  [][sConstants.NodeIDLength]byte
+
 	etaNode *avl.Node
 }
 
+// loopStats are the results of the loops sent through a node, or of all the
+// loops of an epoch.
+type loopStats struct {
+	sent     uint64
+	received uint64
+
+	// delay is the sum of the delays past their ETA of the received loops.
+	delay time.Duration
+}
+
+func (s *loopStats) record(received bool, delay time.Duration) {
+	s.sent++
+	if received {
+		s.received++
+		s.delay += delay
+	}
+}
+
+// avoiding returns the results of the loops of the epoch which avoided the
+// node, given the results of all the loops of the epoch.
+func (s *loopStats) avoiding(total *loopStats) *loopStats {
+	return &loopStats{
+		sent:     total.sent - s.sent,
+		received: total.received - s.received,
+		delay:    total.delay - s.delay,
+	}
+}
+
+// meanDelay returns the mean delay past their ETA of the received loops.
+func (s *loopStats) meanDelay() time.Duration {
+	if s.received == 0 {
+		return 0
+	}
+	return s.delay / time.Duration(s.received)
+}
+
+// reliability returns the results of the loops through the node along with
+// the ones of the loops which avoided it, given the results of all the loops
+// of the epoch.
+func (s *loopStats) reliability(id [sConstants.NodeIDLength]byte, total *loopStats) katzenmint.NodeReliability {
+	avoiding := s.avoiding(total)
+	return katzenmint.NodeReliability{
+		IdentityKey:      append([]byte{}, id[:]...),
+		Sent:             s.sent,
+		Received:         s.received,
+		SentAvoiding:     avoiding.sent,
+		ReceivedAvoiding: avoiding.received,
+	}
+}
+
 type decoy struct {
 	worker.Worker
 	sync.Mutex
@@ -74,6 +129,12 @@ type decoy struct {
 	surbETAs   *avl.Tree
 	surbStore  map[uint64]*surbCtx
 	surbIDBase uint64
+
+	loopStats    map[uint64]map[[sConstants.NodeIDLength]byte]*loopStats
+	loopTotals   map[uint64]*loopStats
+	pendingLoops map[uint64]int
+	foldedLoops  map[uint64]bool
+	estimates    *nodeEstimates
 }
 
 // Prometheus metrics
@@ -109,12 +170,21 @@ func initPrometheus() {
 	prometheus.MustRegister(packetsDropped)
 	prometheus.MustRegister(ignoredPKIDocs)
 	prometheus.MustRegister(pkiDocs)
+	prometheus.MustRegister(nodeLoss)
+	prometheus.MustRegister(nodeDelay)
+	prometheus.MustRegister(nodeLossAlerts)
 }
 
 func (d *decoy) OnNewDocument(ent *pkicache.Entry) {
 	d.docCh <- ent
 }
 
+// IsDecoyReply returns true iff pkt is a SURB Reply addressed to this decoy
+// instance.
+func (d *decoy) IsDecoyReply(pkt *packet.Packet) bool {
+	return pkt.IsSURBReply() && subtle.ConstantTimeCompare(pkt.Recipient.ID[:], d.recipient) == 1
+}
+
 func (d *decoy) OnPacket(pkt *packet.Packet) {
 	// Note: This is called from the crypto worker context, which is "fine".
 	defer pkt.Dispose()
@@ -151,10 +221,15 @@ func (d *decoy) OnPacket(pkt *packet.Packet) {
 	if _, err := sphinx.DecryptSURBPayload(pkt.Payload, ctx.sprpKey); err != nil {
 		d.log.Debugf("Dropping packet: %v (SURB ID: 0x08x%): %v", pkt.ID, id, err)
 		packetsDropped.Inc()
+		d.Lock()
+		d.recordLoop(ctx, false, 0)
+		d.Unlock()
 		return
 	}
+	d.Lock()
+	d.recordLoop(ctx, true, pkt.RecvAt-ctx.eta)
+	d.Unlock()
 
-	// TODO: At some point, this should do more than just log.
 	d.log.Debugf("Response packet: %v (SURB ID: 0x%08x): ETA: %v, Actual: %v (DeltaT: %v)", pkt.ID, id, ctx.eta, pkt.RecvAt, pkt.RecvAt-ctx.eta)
 }
 
@@ -193,13 +268,11 @@ func (d *decoy) worker() {
 				ignoredPKIDocs.Inc()
 				continue
 			}
-			if d.glue.Config().Server.IsProvider {
-				d.log.Debugf("Received PKI document when Provider, ignoring (not supported yet).")
-				ignoredPKIDocs.Inc()
-				continue
-			}
 			d.log.Debugf("Received new PKI document for epoch: %v", now)
 			pkiDocs.With(prometheus.Labels{"epoch": fmt.Sprintf("%v", now)}).Inc()
+			d.Lock()
+			d.estimates.onDocument(newEnt.Document())
+			d.Unlock()
 			docCache = newEnt
 		case <-timer.C:
 			timerFired = true
@@ -230,6 +303,7 @@ func (d *decoy) worker() {
 			d.log.Debugf("Next wakeInterval: %v", wakeInterval)
 
 			d.sweepSURBCtxs()
+			d.foldLoops(now)
 		}
 		if !timerFired && !timer.Stop() {
 			<-timer.C
@@ -241,15 +315,11 @@ func (d *decoy) worker() {
 func (d *decoy) sendDecoyPacket(ent *pkicache.Entry) {
 	// TODO: (#52) Do nothing if the rate limiter would discard the packet(?).
 
-	// TODO: Determine if this should be a loop or discard packet.
-	isLoopPkt := true // HACK HACK HACK HACK.
+	isLoopPkt := d.rng.Float64() >= d.glue.Config().Debug.DecoyDiscardRatio
 
+	// The paths of Providers start at the Provider layer and go through
+	// every mix layer, the loop SURBs bring the replies back the same way.
 	selfDesc := ent.Self()
-	if selfDesc.Layer == pki.LayerProvider {
-		// The code doesn't handle this correctly yet.  It does need to
-		// happen eventually though.
-		panic("BUG: Provider generated decoy traffic not supported yet")
-	}
 	doc := ent.Document()
 
 	// TODO: The path selection maybe should be more strategic/systematic
@@ -302,7 +372,7 @@ func (d *decoy) sendLoopPacket(doc *pki.Document, recipient []byte, src, dst *pk
 			return
 		}
 
-		if deltaT := then.Sub(now); deltaT < epochtime.TestPeriod*2 {
+		if deltaT := then.Sub(now); deltaT < d.glue.PKI().Period()*2 {
 			zeroBytes := make([]byte, constants.UserForwardPayloadLength)
 			payload := make([]byte, 2, 2+sphinx.SURBLength+constants.UserForwardPayloadLength)
 			payload[0] = 1 // Packet has a SURB.
@@ -314,13 +384,12 @@ func (d *decoy) sendLoopPacket(doc *pki.Document, recipient []byte, src, dst *pk
 			payload = append(payload, surb...)
 			payload = append(payload, zeroBytes[:]...)
 
-			// TODO: This should probably also store path information,
-			// so that it's possible to figure out which links/nodes
-			// are causing issues.
 			ctx := &surbCtx{
 				id:      binary.BigEndian.Uint64(surbID[8:]),
 				eta:     monotime.Now() + deltaT,
 				sprpKey: k,
+				epoch:   doc.Epoch,
+				hops:    d.loopHops(src, fwdPath, revPath),
 			}
 			d.storeSURBCtx(ctx)
 
@@ -354,7 +423,7 @@ func (d *decoy) sendDiscardPacket(doc *pki.Document, recipient []byte, src, dst
 			return
 		}
 
-		if then.Sub(now) < epochtime.TestPeriod*2 {
+		if then.Sub(now) < d.glue.PKI().Period()*2 {
 			pkt, err := sphinx.NewPacket(rand.Reader, fwdPath, payload[:])
 			if err != nil {
 				d.log.Debugf("Failed to generate Sphinx packet: %v", err)
@@ -416,6 +485,7 @@ func (d *decoy) storeSURBCtx(ctx *surbCtx) {
 	}
 
 	d.surbStore[ctx.id] = ctx
+	d.pendingLoops[ctx.epoch]++
 }
 
 func (d *decoy) loadAndDeleteSURBCtx(id uint64) *surbCtx {
@@ -474,7 +544,7 @@ func (d *decoy) sweepSURBCtxs() {
 
 		for _, ctx := range surbCtxs {
 			delete(d.surbStore, ctx.id)
-			// TODO: At some point, this should do more than just log.
+			d.recordLoop(ctx, false, 0)
 			d.log.Debugf("Sweep: Lost SURB ID: 0x%08x ETA: %v (DeltaT: %v)", ctx.id, ctx.eta, now-ctx.eta)
 			swept++
 		}
@@ -484,33 +554,151 @@ func (d *decoy) sweepSURBCtxs() {
 	d.log.Debugf("Sweep: Count: %v (Removed: %v, Elapsed: %v)", len(d.surbStore), swept, monotime.Now()-now)
 }
 
+// loopHops returns the nodes other than the source a loop goes through.
+func (d *decoy) loopHops(src *pki.MixDescriptor, paths ...[]*sphinx.PathHop) [][sConstants.NodeIDLength]byte {
+	self := src.IdentityKey.ByteArray()
+	seen := make(map[[sConstants.NodeIDLength]byte]bool)
+	hops := make([][sConstants.NodeIDLength]byte, 0)
+	for _, p := range paths {
+		for _, hop := range p {
+			if hop.ID == self || seen[hop.ID] {
+				continue
+			}
+			seen[hop.ID] = true
+			hops = append(hops, hop.ID)
+		}
+	}
+	return hops
+}
+
+// recordLoop counts the result of the loop, along with its delay past its
+// ETA if received, for the epoch and for each node it went through.  It must
+// be called with the lock held.
+func (d *decoy) recordLoop(ctx *surbCtx, received bool, delay time.Duration) {
+	stats, ok := d.loopStats[ctx.epoch]
+	if !ok {
+		stats = make(map[[sConstants.NodeIDLength]byte]*loopStats)
+		d.loopStats[ctx.epoch] = stats
+	}
+	total, ok := d.loopTotals[ctx.epoch]
+	if !ok {
+		total = new(loopStats)
+		d.loopTotals[ctx.epoch] = total
+	}
+	total.record(received, delay)
+	for _, id := range ctx.hops {
+		s, ok := stats[id]
+		if !ok {
+			s = new(loopStats)
+			stats[id] = s
+		}
+		s.record(received, delay)
+	}
+	if d.pendingLoops[ctx.epoch]--; d.pendingLoops[ctx.epoch] <= 0 {
+		delete(d.pendingLoops, ctx.epoch)
+	}
+}
+
+// foldLoops updates the node estimates with the loops of the past epochs
+// which all returned or were lost.
+func (d *decoy) foldLoops(now uint64) {
+	d.Lock()
+	defer d.Unlock()
+
+	epochs := make([]uint64, 0, len(d.loopStats))
+	for epoch := range d.loopStats {
+		if epoch < now && d.pendingLoops[epoch] <= 0 && !d.foldedLoops[epoch] {
+			epochs = append(epochs, epoch)
+		}
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i] < epochs[j] })
+	for _, epoch := range epochs {
+		d.foldEpoch(epoch)
+	}
+}
+
+// foldEpoch updates the node estimates with the loops of the epoch.  It must
+// be called with the lock held.
+func (d *decoy) foldEpoch(epoch uint64) {
+	if d.foldedLoops[epoch] {
+		return
+	}
+	d.foldedLoops[epoch] = true
+	d.estimates.onEpoch(epoch, d.loopStats[epoch], d.loopTotals[epoch])
+}
+
+// NodeReliabilities returns the results of the loops sent with the document
+// of the epoch through each node and avoiding it, and forgets about them. It
+// returns false while some of the loops are still outstanding.
+func (d *decoy) NodeReliabilities(epoch uint64) ([]katzenmint.NodeReliability, bool) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.pendingLoops[epoch] > 0 {
+		return nil, false
+	}
+	nodes := make([]katzenmint.NodeReliability, 0, len(d.loopStats[epoch]))
+	if total, ok := d.loopTotals[epoch]; ok {
+		for id, s := range d.loopStats[epoch] {
+			nodes = append(nodes, s.reliability(id, total))
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return bytes.Compare(nodes[i].IdentityKey, nodes[j].IdentityKey) < 0
+	})
+	for e := range d.loopStats {
+		if e <= epoch {
+			d.foldEpoch(e)
+			delete(d.loopStats, e)
+			delete(d.loopTotals, e)
+			delete(d.foldedLoops, e)
+		}
+	}
+	return nodes, true
+}
+
+// compareSURBETAs orders the lists of SURB contexts by their ETA.
+func compareSURBETAs(a, b interface{}) int {
+	surbCtxsA, surbCtxsB := a.([]*surbCtx), b.([]*surbCtx)
+	etaA, etaB := surbCtxsA[0].eta, surbCtxsB[0].eta
+	switch {
+	case etaA < etaB:
+		return -1
+	case etaA > etaB:
+		return 1
+	default:
+		return 0
+	}
+}
+
 // New constructs a new decoy instance.
 func New(glue glue.Glue) (glue.Decoy, error) {
 	d := &decoy{
-		glue:      glue,
-		log:       glue.LogBackend().GetLogger("decoy"),
-		recipient: make([]byte, sConstants.RecipientIDLength),
-		rng:       rand.NewMath(),
-		docCh:     make(chan *pkicache.Entry),
-		surbETAs: avl.New(func(a, b interface{}) int {
-			surbCtxsA, surbCtxsB := a.([]*surbCtx), b.([]*surbCtx)
-			etaA, etaB := surbCtxsA[0].eta, surbCtxsB[0].eta
-			switch {
-			case etaA < etaB:
-				return -1
-			case etaA > etaB:
-				return 1
-			default:
-				return 0
-			}
-		}),
-		surbStore:  make(map[uint64]*surbCtx),
-		surbIDBase: uint64(time.Now().Unix()),
+		glue:         glue,
+		log:          glue.LogBackend().GetLogger("decoy"),
+		recipient:    make([]byte, sConstants.RecipientIDLength),
+		rng:          rand.NewMath(),
+		docCh:        make(chan *pkicache.Entry),
+		surbETAs:     avl.New(compareSURBETAs),
+		surbStore:    make(map[uint64]*surbCtx),
+		surbIDBase:   uint64(time.Now().Unix()),
+		loopStats:    make(map[uint64]map[[sConstants.NodeIDLength]byte]*loopStats),
+		loopTotals:   make(map[uint64]*loopStats),
+		pendingLoops: make(map[uint64]int),
+		foldedLoops:  make(map[uint64]bool),
 	}
+	d.estimates = newNodeEstimates(d.log, glue.Config().Debug.DecoyLossAlertThreshold)
 	if _, err := io.ReadFull(rand.Reader, d.recipient); err != nil {
 		return nil, err
 	}
 
+	// Wire in the management related commands.
+	if glue.Config().Management.Enable {
+		const cmdLoopStats = "LOOP_STATS"
+
+		glue.Management().RegisterCommand(cmdLoopStats, d.onLoopStats)
+	}
+
 	d.Go(d.worker)
 	return d, nil
 }
@@ -0,0 +1,167 @@
+// decoy_test.go - Katzenpost server decoy traffic tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package decoy
+
+import (
+	"testing"
+	"time"
+
+	"git.schwanenlied.me/yawning/avl.git"
+	"github.com/hashcloak/Meson/katzenmint/testutil"
+	"github.com/hashcloak/Meson/server/config"
+	"github.com/hashcloak/Meson/server/internal/glue"
+	"github.com/hashcloak/Meson/server/internal/packet"
+	"github.com/hashcloak/Meson/server/internal/pkicache"
+	"github.com/hashcloak/Meson/server/internal/provider/kaetzchen"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/epochtime"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/sphinx/commands"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/thwack"
+	"github.com/katzenpost/core/wire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockPKI struct{}
+
+func (m *mockPKI) Halt()        {}
+func (m *mockPKI) StartWorker() {}
+func (m *mockPKI) OutgoingDestinations() map[[sConstants.NodeIDLength]byte]*pki.MixDescriptor {
+	return nil
+}
+func (m *mockPKI) AuthenticateConnection(*wire.PeerCredentials, bool) (*pki.MixDescriptor, bool, bool) {
+	return nil, false, false
+}
+func (m *mockPKI) GetRawConsensus(uint64) ([]byte, error) { return nil, nil }
+func (m *mockPKI) Now() (uint64, time.Duration, time.Duration, error) {
+	return 0, 0, 0, nil
+}
+func (m *mockPKI) Period() time.Duration { return time.Hour }
+
+type mockConnector struct {
+	packets []*packet.Packet
+}
+
+func (m *mockConnector) Halt()                                                  {}
+func (m *mockConnector) DispatchPacket(pkt *packet.Packet)                      { m.packets = append(m.packets, pkt) }
+func (m *mockConnector) IsValidForwardDest(*[sConstants.NodeIDLength]byte) bool { return true }
+func (m *mockConnector) ForceUpdate()                                           {}
+
+type mockGlue struct {
+	cfg       *config.Config
+	connector *mockConnector
+}
+
+func (m *mockGlue) Config() *config.Config         { return m.cfg }
+func (m *mockGlue) LogBackend() *log.Backend       { return nil }
+func (m *mockGlue) IdentityKey() *eddsa.PrivateKey { return nil }
+func (m *mockGlue) LinkKey() *ecdh.PrivateKey      { return nil }
+func (m *mockGlue) Management() *thwack.Server     { return nil }
+func (m *mockGlue) MixKeys() glue.MixKeys          { return nil }
+func (m *mockGlue) PKI() glue.PKI                  { return &mockPKI{} }
+func (m *mockGlue) Provider() glue.Provider        { return nil }
+func (m *mockGlue) Scheduler() glue.Scheduler      { return nil }
+func (m *mockGlue) Connector() glue.Connector      { return m.connector }
+func (m *mockGlue) Listeners() []glue.Listener     { return nil }
+func (m *mockGlue) Decoy() glue.Decoy              { return nil }
+func (m *mockGlue) ReshadowCryptoWorkers()         {}
+
+func TestProviderDecoyPackets(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	// a network of two mix layers, and two Providers running the loop
+	// service
+	epoch, _, _ := epochtime.Now()
+	var mixes []*pki.MixDescriptor
+	for i := 0; i < 2; i++ {
+		mix, _, _ := testutil.CreateTestDescriptor(require, i, i, epoch)
+		mixes = append(mixes, mix)
+	}
+	var providers []*pki.MixDescriptor
+	var selfKey eddsa.PrivateKey
+	for i := 0; i < 2; i++ {
+		provider, _, key := testutil.CreateTestDescriptor(require, 2+i, pki.LayerProvider, epoch)
+		provider.Kaetzchen[kaetzchen.LoopCapability] = map[string]interface{}{"endpoint": "+loop"}
+		providers = append(providers, provider)
+		if i == 0 {
+			selfKey = key
+		}
+	}
+	doc := &pki.Document{
+		Epoch:      epoch,
+		Mu:         0.01,
+		MuMaxDelay: 100,
+		Topology:   [][]*pki.MixDescriptor{{mixes[0]}, {mixes[1]}},
+		Providers:  providers,
+	}
+	ent, err := pkicache.New(doc, selfKey.PublicKey(), true)
+	require.NoError(err)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	connector := new(mockConnector)
+	cfg := &config.Config{Debug: &config.Debug{}}
+	d := &decoy{
+		glue:         &mockGlue{cfg: cfg, connector: connector},
+		log:          logBackend.GetLogger("decoy_test"),
+		recipient:    make([]byte, sConstants.RecipientIDLength),
+		rng:          rand.NewMath(),
+		surbETAs:     avl.New(compareSURBETAs),
+		surbStore:    make(map[uint64]*surbCtx),
+		surbIDBase:   uint64(time.Now().Unix()),
+		loopStats:    make(map[uint64]map[[sConstants.NodeIDLength]byte]*loopStats),
+		loopTotals:   make(map[uint64]*loopStats),
+		pendingLoops: make(map[uint64]int),
+		foldedLoops:  make(map[uint64]bool),
+		estimates:    newNodeEstimates(logBackend.GetLogger("decoy_test"), 0.5),
+	}
+	d.recipient[0] = 1
+
+	// the loops go through every mix layer and wait for their SURB reply
+	d.sendDecoyPacket(ent)
+	require.Len(connector.packets, 1)
+	assert.Equal(mixes[0].IdentityKey.ByteArray(), connector.packets[0].NextNodeHop.ID)
+	require.Len(d.surbStore, 1)
+	for _, ctx := range d.surbStore {
+		assert.Equal(epoch, ctx.epoch)
+		assert.Contains(ctx.hops, mixes[0].IdentityKey.ByteArray())
+		assert.Contains(ctx.hops, mixes[1].IdentityKey.ByteArray())
+		assert.NotContains(ctx.hops, providers[0].IdentityKey.ByteArray())
+	}
+	assert.Equal(1, d.pendingLoops[epoch])
+
+	// the discards go through every mix layer without a SURB
+	cfg.Debug.DecoyDiscardRatio = 1
+	d.sendDecoyPacket(ent)
+	require.Len(connector.packets, 2)
+	assert.Equal(mixes[0].IdentityKey.ByteArray(), connector.packets[1].NextNodeHop.ID)
+	assert.Len(d.surbStore, 1)
+	assert.Equal(1, d.pendingLoops[epoch])
+
+	// only the SURB replies to the decoy recipient are decoy replies
+	pkt := &packet.Packet{Recipient: &commands.Recipient{}, SurbReply: &commands.SURBReply{}}
+	assert.False(d.IsDecoyReply(pkt))
+	copy(pkt.Recipient.ID[:], d.recipient)
+	assert.True(d.IsDecoyReply(pkt))
+	pkt.SurbReply = nil
+	assert.False(d.IsDecoyReply(pkt))
+}
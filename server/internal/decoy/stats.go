@@ -0,0 +1,205 @@
+// stats.go - Decoy loop statistics.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package decoy
+
+import (
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"time"
+
+	internalConstants "github.com/hashcloak/Meson/server/internal/constants"
+	"github.com/katzenpost/core/pki"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/thwack"
+	"github.com/prometheus/client_golang/prometheus"
+	"gopkg.in/op/go-logging.v1"
+)
+
+// estimateWeight is the weight of the latest epoch in the moving averages of
+// the node estimates.
+const estimateWeight = 0.25
+
+// Prometheus metrics
+var (
+	nodeLoss = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: internalConstants.Namespace,
+			Name:      "node_loss_ratio",
+			Subsystem: internalConstants.DecoySubsystem,
+			Help:      "Estimated ratio of the decoy loops lost by a node, relative to the loops avoiding it",
+		},
+		[]string{"node"},
+	)
+	nodeDelay = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: internalConstants.Namespace,
+			Name:      "node_delay_seconds",
+			Subsystem: internalConstants.DecoySubsystem,
+			Help:      "Estimated delay added by a node to the decoy loops, relative to the loops avoiding it",
+		},
+		[]string{"node"},
+	)
+	nodeLossAlerts = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: internalConstants.Namespace,
+			Name:      "node_loss_alerts_total",
+			Subsystem: internalConstants.DecoySubsystem,
+			Help:      "Number of alerts raised for the estimated loss of a node",
+		},
+		[]string{"node"},
+	)
+)
+
+// nodeEstimate is the reliability of a node estimated from the loops which
+// went through it, relative to the loops which avoided it.
+type nodeEstimate struct {
+	loss     float64
+	delay    time.Duration
+	sent     uint64
+	received uint64
+	epochs   int
+	delays   int
+	alerted  bool
+}
+
+// nodeEstimates estimates the loss and the delay of each hop across epochs.
+// The loops through a node are compared with the loops of the same epoch
+// which avoided it, so that the losses and delays of the other hops of a
+// path are not attributed to the node.
+type nodeEstimates struct {
+	log       *logging.Logger
+	threshold float64
+
+	nodes map[[sConstants.NodeIDLength]byte]*nodeEstimate
+	names map[[sConstants.NodeIDLength]byte]string
+}
+
+func newNodeEstimates(log *logging.Logger, threshold float64) *nodeEstimates {
+	return &nodeEstimates{
+		log:       log,
+		threshold: threshold,
+		nodes:     make(map[[sConstants.NodeIDLength]byte]*nodeEstimate),
+		names:     make(map[[sConstants.NodeIDLength]byte]string),
+	}
+}
+
+func (e *nodeEstimates) get(id [sConstants.NodeIDLength]byte) *nodeEstimate {
+	est, ok := e.nodes[id]
+	if !ok {
+		est = new(nodeEstimate)
+		e.nodes[id] = est
+	}
+	return est
+}
+
+// name returns the name of the node in the PKI documents, or its identity
+// key if unknown.
+func (e *nodeEstimates) name(id [sConstants.NodeIDLength]byte) string {
+	if name, ok := e.names[id]; ok {
+		return name
+	}
+	return hex.EncodeToString(id[:])
+}
+
+// onDocument learns the names of the nodes of the document.
+func (e *nodeEstimates) onDocument(doc *pki.Document) {
+	for _, desc := range doc.Providers {
+		e.names[desc.IdentityKey.ByteArray()] = desc.Name
+	}
+	for _, layer := range doc.Topology {
+		for _, desc := range layer {
+			e.names[desc.IdentityKey.ByteArray()] = desc.Name
+		}
+	}
+}
+
+// onEpoch updates the loss and the delay of the nodes with the loops of an
+// epoch, given the results of all its loops, and raises the alerts.
+func (e *nodeEstimates) onEpoch(epoch uint64, stats map[[sConstants.NodeIDLength]byte]*loopStats, total *loopStats) {
+	if total == nil {
+		return
+	}
+	for id, s := range stats {
+		if s.sent == 0 {
+			continue
+		}
+		est := e.get(id)
+		est.sent += s.sent
+		est.received += s.received
+		name := e.name(id)
+
+		// The delay of the node is the excess of the mean delay of the
+		// loops through it over the one of the loops avoiding it.
+		if avoiding := s.avoiding(total); s.received > 0 && avoiding.received > 0 {
+			delay := s.meanDelay() - avoiding.meanDelay()
+			if delay < 0 {
+				delay = 0
+			}
+			if est.delays == 0 {
+				est.delay = delay
+			} else {
+				est.delay += time.Duration(estimateWeight * float64(delay-est.delay))
+			}
+			est.delays++
+			nodeDelay.With(prometheus.Labels{"node": name}).Set(est.delay.Seconds())
+		}
+
+		reliability := s.reliability(id, total)
+		r, ok := reliability.HopReliability()
+		if !ok {
+			continue
+		}
+		loss := 1 - r
+		if est.epochs == 0 {
+			est.loss = loss
+		} else {
+			est.loss += estimateWeight * (loss - est.loss)
+		}
+		est.epochs++
+
+		nodeLoss.With(prometheus.Labels{"node": name}).Set(est.loss)
+		switch {
+		case est.loss > e.threshold && !est.alerted:
+			est.alerted = true
+			nodeLossAlerts.With(prometheus.Labels{"node": name}).Inc()
+			e.log.Warningf("Node %v is losing %.1f%% of the loops (Epoch: %v, threshold: %.1f%%)", name, 100*est.loss, epoch, 100*e.threshold)
+		case est.loss <= e.threshold && est.alerted:
+			est.alerted = false
+			e.log.Noticef("Node %v recovered, losing %.1f%% of the loops (Epoch: %v)", name, 100*est.loss, epoch)
+		}
+	}
+}
+
+// onLoopStats is the handler of the LOOP_STATS management command, listing
+// the estimates of the nodes.
+func (d *decoy) onLoopStats(c *thwack.Conn, l string) error {
+	d.Lock()
+	lines := make([]string, 0, len(d.estimates.nodes))
+	for id, est := range d.estimates.nodes {
+		lines = append(lines, fmt.Sprintf("%v loss=%.3f delay=%v sent=%v received=%v", d.estimates.name(id), est.loss, est.delay, est.sent, est.received))
+	}
+	d.Unlock()
+	sort.Strings(lines)
+
+	for _, line := range lines {
+		if err := c.Writer().PrintfLine("%v-%v", thwack.StatusOk, line); err != nil {
+			return err
+		}
+	}
+	return c.WriteReply(thwack.StatusOk)
+}
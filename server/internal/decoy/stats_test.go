@@ -0,0 +1,147 @@
+// stats_test.go - Decoy loop statistics tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package decoy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson/katzenmint"
+	"github.com/katzenpost/core/log"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodeEstimates(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	d := &decoy{
+		loopStats:    make(map[uint64]map[[sConstants.NodeIDLength]byte]*loopStats),
+		loopTotals:   make(map[uint64]*loopStats),
+		pendingLoops: make(map[uint64]int),
+		foldedLoops:  make(map[uint64]bool),
+		estimates:    newNodeEstimates(logBackend.GetLogger("decoy_test"), 0.5),
+	}
+	var a, b, c, e [sConstants.NodeIDLength]byte
+	a[0], b[0], c[0], e[0] = 1, 2, 3, 4
+	d.estimates.names[a] = "a"
+	loop := func(epoch uint64, received bool, delay time.Duration, hops ...[sConstants.NodeIDLength]byte) {
+		d.pendingLoops[epoch]++
+		d.recordLoop(&surbCtx{epoch: epoch, hops: hops}, received, delay)
+	}
+
+	// the loops are attributed to their hops once the epoch is over, b
+	// drops every packet
+	loop(1, false, 0, a, b)
+	loop(1, false, 0, c, b)
+	loop(1, true, 100*time.Millisecond, a, c)
+	loop(1, true, 100*time.Millisecond, a, e)
+	loop(1, true, 400*time.Millisecond, c, e)
+	loop(1, false, 0, b, e)
+	d.pendingLoops[1]++
+	d.foldLoops(2)
+	assert.Empty(d.estimates.nodes)
+	d.pendingLoops[1]--
+	d.foldLoops(1)
+	assert.Empty(d.estimates.nodes)
+	d.foldLoops(2)
+	require.Len(d.estimates.nodes, 4)
+
+	// the losses of b are not attributed to the other hops of its paths
+	assert.Equal(0.0, d.estimates.nodes[a].loss)
+	assert.Equal(1.0, d.estimates.nodes[b].loss)
+	assert.Equal(0.0, d.estimates.nodes[c].loss)
+	assert.Equal(0.0, d.estimates.nodes[e].loss)
+	assert.Equal(uint64(3), d.estimates.nodes[a].sent)
+	assert.Equal(uint64(2), d.estimates.nodes[a].received)
+
+	// the delays are the excess over the loops avoiding the node
+	assert.Equal(time.Duration(0), d.estimates.nodes[a].delay)
+	assert.Equal(150*time.Millisecond, d.estimates.nodes[c].delay)
+	assert.Equal(0, d.estimates.nodes[b].delays)
+
+	// nodes losing more loops than the threshold are alerted on
+	assert.False(d.estimates.nodes[a].alerted)
+	assert.True(d.estimates.nodes[b].alerted)
+	assert.False(d.estimates.nodes[c].alerted)
+	assert.Equal("a", d.estimates.name(a))
+	assert.Len(d.estimates.name(b), 2*sConstants.NodeIDLength)
+
+	// the estimates are moving averages across epochs, skipping the epochs
+	// without loops to compare with
+	loop(2, true, 0, b)
+	d.foldLoops(3)
+	assert.Equal(1, d.estimates.nodes[b].epochs)
+	for epoch := uint64(3); epoch < 6; epoch++ {
+		loop(epoch, true, 0, a, b)
+		loop(epoch, true, 0, c)
+	}
+	d.foldLoops(4)
+	assert.Equal(1-estimateWeight, d.estimates.nodes[b].loss)
+	assert.True(d.estimates.nodes[b].alerted)
+	d.foldLoops(6)
+	assert.False(d.estimates.nodes[b].alerted)
+}
+
+func TestNodeReliabilities(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	d := &decoy{
+		loopStats:    make(map[uint64]map[[sConstants.NodeIDLength]byte]*loopStats),
+		loopTotals:   make(map[uint64]*loopStats),
+		pendingLoops: make(map[uint64]int),
+		foldedLoops:  make(map[uint64]bool),
+		estimates:    newNodeEstimates(logBackend.GetLogger("decoy_test"), 0.5),
+	}
+	var a, b [sConstants.NodeIDLength]byte
+	a[0], b[0] = 1, 2
+	send := func(epoch uint64, hops ...[sConstants.NodeIDLength]byte) *surbCtx {
+		ctx := &surbCtx{epoch: epoch, hops: hops}
+		d.pendingLoops[epoch]++
+		return ctx
+	}
+
+	// the report waits for the outstanding loops of the epoch
+	lost := send(1, a, b)
+	returned := send(1, a)
+	d.recordLoop(returned, true, 0)
+	_, ok := d.NodeReliabilities(1)
+	assert.False(ok)
+	d.recordLoop(lost, false, 0)
+	d.recordLoop(send(1, b), true, 0)
+
+	// the loops through each node are reported along with the ones avoiding it
+	nodes, ok := d.NodeReliabilities(1)
+	require.True(ok)
+	require.Len(nodes, 2)
+	assert.Equal(katzenmint.NodeReliability{IdentityKey: a[:], Sent: 2, Received: 1, SentAvoiding: 1, ReceivedAvoiding: 1}, nodes[0])
+	assert.Equal(katzenmint.NodeReliability{IdentityKey: b[:], Sent: 2, Received: 1, SentAvoiding: 1, ReceivedAvoiding: 1}, nodes[1])
+
+	// the results are folded in the estimates and forgotten
+	assert.Equal(uint64(2), d.estimates.nodes[a].sent)
+	assert.Empty(d.loopStats)
+	assert.Empty(d.loopTotals)
+	assert.Empty(d.foldedLoops)
+	nodes, ok = d.NodeReliabilities(1)
+	assert.True(ok)
+	assert.Empty(nodes)
+}
@@ -21,6 +21,7 @@ package glue
 import (
 	"time"
 
+	"github.com/hashcloak/Meson/katzenmint"
 	"github.com/hashcloak/Meson/server/config"
 	"github.com/hashcloak/Meson/server/internal/mixkey"
 	"github.com/hashcloak/Meson/server/internal/packet"
@@ -70,6 +71,7 @@ type PKI interface {
 	AuthenticateConnection(*wire.PeerCredentials, bool) (*pki.MixDescriptor, bool, bool)
 	GetRawConsensus(uint64) ([]byte, error)
 	Now() (epoch uint64, ellapsed time.Duration, till time.Duration, err error)
+	Period() time.Duration
 }
 
 type Provider interface {
@@ -105,5 +107,7 @@ type Listener interface {
 type Decoy interface {
 	Halt()
 	OnNewDocument(*pkicache.Entry)
+	IsDecoyReply(*packet.Packet) bool
 	OnPacket(*packet.Packet)
+	NodeReliabilities(uint64) ([]katzenmint.NodeReliability, bool)
 }
@@ -29,6 +29,8 @@ import (
 
 	kpki "github.com/hashcloak/Meson/client/pkiclient"
 	"github.com/hashcloak/Meson/client/pkiclient/epochtime"
+	"github.com/hashcloak/Meson/katzenmint"
+	"github.com/hashcloak/Meson/katzenmint/config"
 	"github.com/hashcloak/Meson/katzenmint/s11n"
 	"github.com/hashcloak/Meson/server/internal/constants"
 	"github.com/hashcloak/Meson/server/internal/debug"
@@ -63,6 +65,7 @@ type pki struct {
 	lastPublishedEpoch uint64
 	lastWarnedEpoch    uint64
 	lastPublishedTime  time.Time
+	lastReportedEpoch  uint64
 }
 
 var (
@@ -191,7 +194,7 @@ func (p *pki) worker() {
 					if epoch <= now {
 						p.log.Warningf("Failed to fetch PKI for epoch %v: %v", epoch, err)
 						failedFetchPKIDocs.With(prometheus.Labels{"epoch": fmt.Sprintf("%v", epoch)}).Inc()
-						if err == cpki.ErrNoDocument {
+						if errors.Is(err, cpki.ErrNoDocument) {
 							p.setFailedFetch(epoch, err)
 						}
 					}
@@ -241,6 +244,16 @@ func (p *pki) worker() {
 			p.log.Warningf("Failed to post to PKI: %v", err)
 		}
 
+		// Report the results of the decoy loops of the previous epoch.
+		err = p.publishReliabilityReportIfNeeded(pkiCtx)
+		if isCanceled() {
+			// Canceled mid-post
+			return
+		}
+		if err != nil {
+			p.log.Warningf("Failed to post reliability report to PKI: %v", err)
+		}
+
 		// Internal component depend on network wide paramemters, and or the
 		// list of nodes.  Update if there is a new document for the current
 		// epoch.
@@ -343,7 +356,7 @@ func (p *pki) pruneDocuments() {
 }
 
 func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
-	publishGracePeriod := epochtime.TestPeriod / 3
+	publishGracePeriod := p.Period() / 3
 
 	epoch, _, till, err := p.Now()
 	if err != nil {
@@ -479,6 +492,37 @@ func (p *pki) publishDescriptorIfNeeded(pkiCtx context.Context) error {
 	return err
 }
 
+func (p *pki) publishReliabilityReportIfNeeded(pkiCtx context.Context) error {
+	now, _, _, err := p.Now()
+	if err != nil {
+		return err
+	}
+	if now == 0 || now-1 <= p.lastReportedEpoch {
+		return nil
+	}
+	epoch := now - 1
+
+	// Wait for the outstanding loops of the epoch to return or be lost.
+	nodes, ok := p.glue.Decoy().NodeReliabilities(epoch)
+	if !ok {
+		return nil
+	}
+	p.lastReportedEpoch = epoch
+	if len(nodes) == 0 {
+		return nil
+	}
+	report := &katzenmint.ReliabilityReport{
+		Reporter: p.glue.IdentityKey().PublicKey().Bytes(),
+		Epoch:    epoch,
+		Nodes:    nodes,
+	}
+	if err = p.impl.PostReliabilityReport(pkiCtx, p.glue.IdentityKey(), report); err != nil {
+		return err
+	}
+	p.log.Debugf("Posted reliability report for epoch: %v", epoch)
+	return nil
+}
+
 func (p *pki) entryForEpoch(epoch uint64) *pkicache.Entry {
 	p.RLock()
 	defer p.RUnlock()
@@ -694,6 +738,14 @@ func (p *pki) Now() (epoch uint64, ellapsed time.Duration, till time.Duration, e
 	return epochtime.Now(p.impl)
 }
 
+// Period returns the duration of the epochs.
+func (p *pki) Period() time.Duration {
+	if p.impl == nil {
+		return config.DefaultEpochDuration
+	}
+	return epochtime.Period(p.impl)
+}
+
 // New reuturns a new pki.
 func New(glue glue.Glue) (glue.PKI, error) {
 	p := &pki{
@@ -0,0 +1,136 @@
+// pki_test.go - Katzenpost server PKI interface tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package pki
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson/katzenmint"
+	"github.com/hashcloak/Meson/server/config"
+	"github.com/hashcloak/Meson/server/internal/glue"
+	"github.com/hashcloak/Meson/server/internal/packet"
+	"github.com/hashcloak/Meson/server/internal/pkicache"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/eddsa"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	cpki "github.com/katzenpost/core/pki"
+	"github.com/katzenpost/core/thwack"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type mockDecoy struct {
+	nodes map[uint64][]katzenmint.NodeReliability
+}
+
+func (m *mockDecoy) Halt()                            {}
+func (m *mockDecoy) OnNewDocument(*pkicache.Entry)    {}
+func (m *mockDecoy) IsDecoyReply(*packet.Packet) bool { return false }
+func (m *mockDecoy) OnPacket(*packet.Packet)          {}
+func (m *mockDecoy) NodeReliabilities(epoch uint64) ([]katzenmint.NodeReliability, bool) {
+	nodes, ok := m.nodes[epoch]
+	return nodes, ok
+}
+
+type mockGlue struct {
+	identityKey *eddsa.PrivateKey
+	decoy       *mockDecoy
+}
+
+func (m *mockGlue) Config() *config.Config         { return &config.Config{} }
+func (m *mockGlue) LogBackend() *log.Backend       { return nil }
+func (m *mockGlue) IdentityKey() *eddsa.PrivateKey { return m.identityKey }
+func (m *mockGlue) LinkKey() *ecdh.PrivateKey      { return nil }
+func (m *mockGlue) Management() *thwack.Server     { return nil }
+func (m *mockGlue) MixKeys() glue.MixKeys          { return nil }
+func (m *mockGlue) PKI() glue.PKI                  { return nil }
+func (m *mockGlue) Provider() glue.Provider        { return nil }
+func (m *mockGlue) Scheduler() glue.Scheduler      { return nil }
+func (m *mockGlue) Connector() glue.Connector      { return nil }
+func (m *mockGlue) Listeners() []glue.Listener     { return nil }
+func (m *mockGlue) Decoy() glue.Decoy              { return m.decoy }
+func (m *mockGlue) ReshadowCryptoWorkers()         {}
+
+type mockClient struct {
+	epoch   uint64
+	reports []*katzenmint.ReliabilityReport
+}
+
+func (m *mockClient) GetEpoch(ctx context.Context) (*katzenmint.EpochInfo, error) {
+	return &katzenmint.EpochInfo{Epoch: m.epoch + 1, StartTime: time.Now(), Duration: time.Hour}, nil
+}
+
+func (m *mockClient) GetDoc(ctx context.Context, epoch uint64) (*cpki.Document, []byte, error) {
+	return nil, nil, cpki.ErrNoDocument
+}
+
+func (m *mockClient) Post(ctx context.Context, epoch uint64, signingKey *eddsa.PrivateKey, d *cpki.MixDescriptor) error {
+	return nil
+}
+
+func (m *mockClient) PostReliabilityReport(ctx context.Context, signingKey *eddsa.PrivateKey, report *katzenmint.ReliabilityReport) error {
+	m.reports = append(m.reports, report)
+	return nil
+}
+
+func (m *mockClient) Deserialize(raw []byte) (*cpki.Document, error) {
+	return nil, nil
+}
+
+func (m *mockClient) Shutdown() {}
+
+func TestPublishReliabilityReport(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(err)
+	identityKey, err := eddsa.NewKeypair(rand.Reader)
+	require.NoError(err)
+	node := katzenmint.NodeReliability{IdentityKey: []byte{1}, Sent: 2, Received: 1, SentAvoiding: 1, ReceivedAvoiding: 1}
+	d := &mockDecoy{nodes: make(map[uint64][]katzenmint.NodeReliability)}
+	impl := &mockClient{epoch: 1}
+	p := &pki{
+		glue: &mockGlue{identityKey: identityKey, decoy: d},
+		log:  logBackend.GetLogger("pki_test"),
+		impl: impl,
+	}
+
+	// the report of the previous epoch waits for its loops
+	impl.epoch = 2
+	require.NoError(p.publishReliabilityReportIfNeeded(context.Background()))
+	assert.Empty(impl.reports)
+	assert.Equal(uint64(0), p.lastReportedEpoch)
+
+	// the epochs without loops are not reported
+	d.nodes[1] = nil
+	require.NoError(p.publishReliabilityReportIfNeeded(context.Background()))
+	assert.Empty(impl.reports)
+	assert.Equal(uint64(1), p.lastReportedEpoch)
+
+	// the report is signed by the identity key and posted once
+	impl.epoch = 3
+	d.nodes[2] = []katzenmint.NodeReliability{node}
+	require.NoError(p.publishReliabilityReportIfNeeded(context.Background()))
+	require.NoError(p.publishReliabilityReportIfNeeded(context.Background()))
+	require.Len(impl.reports, 1)
+	assert.Equal(identityKey.PublicKey().Bytes(), impl.reports[0].Reporter)
+	assert.Equal(uint64(2), impl.reports[0].Epoch)
+	assert.Equal([]katzenmint.NodeReliability{node}, impl.reports[0].Nodes)
+}
@@ -24,9 +24,11 @@ import (
 	"sync"
 	"time"
 
+	"github.com/hashcloak/Meson/fragment"
 	"github.com/hashcloak/Meson/server/cborplugin"
 	"github.com/hashcloak/Meson/server/internal/glue"
 	"github.com/hashcloak/Meson/server/internal/packet"
+	cConstants "github.com/katzenpost/client/constants"
 	"github.com/katzenpost/core/monotime"
 	sConstants "github.com/katzenpost/core/sphinx/constants"
 	"github.com/katzenpost/core/worker"
@@ -63,6 +65,7 @@ type CBORPluginWorker struct {
 	haltOnce    sync.Once
 	pluginChans PluginChans
 	clients     []*cborplugin.Client
+	reassembler *reassembler
 }
 
 // OnKaetzchen enqueues the pkt for processing by our thread pool of plugins.
@@ -111,6 +114,24 @@ func (k *CBORPluginWorker) worker(recipient [sConstants.RecipientIDLength]byte,
 	}
 }
 
+func (k *CBORPluginWorker) reassemblyWorker() {
+	// Incomplete requests are pruned twice per timeout.
+	ticker := time.NewTicker(k.reassembler.timeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-k.HaltCh():
+			k.log.Debugf("Terminating gracefully.")
+			return
+		case <-ticker.C:
+		}
+		if n := k.reassembler.prune(time.Now()); n > 0 {
+			k.log.Debugf("Dropped %d incomplete Kaetzchen requests", n)
+			kaetzchenRequestsDropped.Add(float64(n))
+		}
+	}
+}
+
 func (k *CBORPluginWorker) haltAllClients() {
 	k.log.Debug("Halting plugin clients.")
 	for _, client := range k.clients {
@@ -130,6 +151,33 @@ func (k *CBORPluginWorker) processKaetzchen(pkt *packet.Packet, pluginClient cbo
 		return
 	}
 
+	// Requests larger than a Sphinx packet are handed to the plugin once
+	// all of their fragments are received, the reply uses the SURB of the
+	// last fragment.  The fragments retransmitted after the request was
+	// completed are answered with the same reply, as the first one may have
+	// been lost.
+	var requestID *[cConstants.MessageIDLength]byte
+	if fragment.IsFragment(ct) {
+		f, err := fragment.Parse(ct)
+		if err != nil {
+			k.log.Debugf("Dropping Kaetzchen request fragment: %v (%v)", pkt.ID, err)
+			kaetzchenRequestsDropped.Inc()
+			return
+		}
+		if resp, ok := k.reassembler.reply(&f.ID); ok {
+			k.log.Debugf("Replying again to Kaetzchen request fragment: %v (%d/%d)", pkt.ID, f.Index+1, f.Count)
+			k.sendReply(pkt, surb, resp)
+			return
+		}
+		payload, ok := k.reassembler.add(f, time.Now())
+		if !ok {
+			k.log.Debugf("Stored Kaetzchen request fragment: %v (%d/%d)", pkt.ID, f.Index+1, f.Count)
+			return
+		}
+		ct = payload
+		requestID = &f.ID
+	}
+
 	resp, err := pluginClient.OnRequest(&cborplugin.Request{
 		ID:      pkt.ID,
 		Payload: ct,
@@ -149,8 +197,14 @@ func (k *CBORPluginWorker) processKaetzchen(pkt *packet.Packet, pluginClient cbo
 		k.log.Debugf("No reply from Kaetzchen: %v", pkt.ID)
 		return
 	}
+	if requestID != nil {
+		k.reassembler.setReply(requestID, resp)
+	}
+	k.sendReply(pkt, surb, resp)
+}
 
-	// Iff there is a SURB, generate a SURB-Reply and schedule.
+// sendReply schedules the reply to the request packet iff it has a SURB.
+func (k *CBORPluginWorker) sendReply(pkt *packet.Packet, surb []byte, resp []byte) {
 	if surb != nil {
 		// Prepend the response header.
 		resp = append([]byte{0x01, 0x00}, resp...)
@@ -210,6 +264,7 @@ func NewCBORPluginWorker(glue glue.Glue) (*CBORPluginWorker, error) {
 		log:         glue.LogBackend().GetLogger("CBOR plugin worker"),
 		pluginChans: make(PluginChans),
 		clients:     make([]*cborplugin.Client, 0),
+		reassembler: newReassembler(time.Duration(glue.Config().Debug.KaetzchenReassemblyTimeout) * time.Millisecond),
 	}
 
 	capaMap := make(map[string]bool)
@@ -278,6 +333,7 @@ func NewCBORPluginWorker(glue glue.Glue) (*CBORPluginWorker, error) {
 
 		capaMap[capa] = true
 	}
+	kaetzchenWorker.Go(kaetzchenWorker.reassemblyWorker)
 
 	return &kaetzchenWorker, nil
 }
@@ -20,6 +20,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/hashcloak/Meson/katzenmint"
 	"github.com/hashcloak/Meson/server/config"
 	"github.com/hashcloak/Meson/server/internal/glue"
 	"github.com/hashcloak/Meson/server/internal/packet"
@@ -81,6 +82,8 @@ func (s *mockSpool) Remove(u []byte) error { return nil }
 
 func (s *mockSpool) Vacuum(udb userdb.UserDB) error { return nil }
 
+func (s *mockSpool) Expire() (int, error) { return 0, nil }
+
 func (s *mockSpool) Close() {}
 
 type mockProvider struct {
@@ -120,8 +123,16 @@ func (d *mockDecoy) Halt() {}
 
 func (d *mockDecoy) OnNewDocument(*pkicache.Entry) {}
 
+func (d *mockDecoy) IsDecoyReply(*packet.Packet) bool {
+	return false
+}
+
 func (d *mockDecoy) OnPacket(*packet.Packet) {}
 
+func (d *mockDecoy) NodeReliabilities(uint64) ([]katzenmint.NodeReliability, bool) {
+	return nil, true
+}
+
 type mockServer struct {
 	cfg         *config.Config
 	logBackend  *log.Backend
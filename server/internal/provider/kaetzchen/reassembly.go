@@ -0,0 +1,162 @@
+// reassembly.go - Kaetzchen request reassembly.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"sync"
+	"time"
+
+	"github.com/hashcloak/Meson/fragment"
+	cConstants "github.com/katzenpost/client/constants"
+)
+
+const (
+	// maxPendingRequests is the maximum number of incomplete requests kept
+	// by the reassembler.
+	maxPendingRequests = 1024
+
+	// maxPendingBytes is the maximum size of the fragments of the incomplete
+	// requests kept by the reassembler.
+	maxPendingBytes = 8 * 1024 * 1024
+)
+
+type pendingRequest struct {
+	fragments [][]byte
+	received  int
+	expiresAt time.Time
+}
+
+type completedRequest struct {
+	reply     []byte
+	expiresAt time.Time
+}
+
+// reassembler collects the fragments of the Kaetzchen requests which do not
+// fit in a single Sphinx packet, until the requests are complete.  The
+// completed requests are remembered until the timeout along with their reply,
+// so that their late fragments do not start the request over and their
+// retransmitted fragments can be answered again if the reply was lost.
+type reassembler struct {
+	sync.Mutex
+
+	timeout   time.Duration
+	pending   map[[cConstants.MessageIDLength]byte]*pendingRequest
+	size      int
+	completed map[[cConstants.MessageIDLength]byte]*completedRequest
+}
+
+func newReassembler(timeout time.Duration) *reassembler {
+	return &reassembler{
+		timeout:   timeout,
+		pending:   make(map[[cConstants.MessageIDLength]byte]*pendingRequest),
+		completed: make(map[[cConstants.MessageIDLength]byte]*completedRequest),
+	}
+}
+
+// reply returns the reply of the completed request, if it is known yet.
+func (r *reassembler) reply(id *[cConstants.MessageIDLength]byte) ([]byte, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	req, ok := r.completed[*id]
+	if !ok || req.reply == nil {
+		return nil, false
+	}
+	return req.reply, true
+}
+
+// setReply records the reply of the completed request until it expires.
+func (r *reassembler) setReply(id *[cConstants.MessageIDLength]byte, reply []byte) {
+	r.Lock()
+	defer r.Unlock()
+
+	if req, ok := r.completed[*id]; ok {
+		req.reply = append([]byte{}, reply...)
+	}
+}
+
+// add adds the fragment, and returns the request payload once all of its
+// fragments were received.
+func (r *reassembler) add(f *fragment.Fragment, now time.Time) ([]byte, bool) {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.completed[f.ID]; ok {
+		return nil, false
+	}
+	if r.size+len(f.Data) > maxPendingBytes {
+		return nil, false
+	}
+	req, ok := r.pending[f.ID]
+	if !ok {
+		if len(r.pending) >= maxPendingRequests {
+			return nil, false
+		}
+		req = &pendingRequest{
+			fragments: make([][]byte, f.Count),
+			expiresAt: now.Add(r.timeout),
+		}
+		r.pending[f.ID] = req
+	}
+	if len(req.fragments) != int(f.Count) || req.fragments[f.Index] != nil {
+		// Fragments of another request, or a retransmission.
+		return nil, false
+	}
+	req.fragments[f.Index] = append([]byte{}, f.Data...)
+	req.received++
+	r.size += len(f.Data)
+	if req.received < len(req.fragments) {
+		return nil, false
+	}
+
+	delete(r.pending, f.ID)
+	r.completed[f.ID] = &completedRequest{expiresAt: now.Add(r.timeout)}
+	size := 0
+	for _, data := range req.fragments {
+		size += len(data)
+	}
+	r.size -= size
+	payload := make([]byte, 0, size)
+	for _, data := range req.fragments {
+		payload = append(payload, data...)
+	}
+	return payload, true
+}
+
+// prune removes the requests which were not completed in time, and returns
+// the number of removed requests.
+func (r *reassembler) prune(now time.Time) int {
+	r.Lock()
+	defer r.Unlock()
+
+	pruned := 0
+	for id, req := range r.pending {
+		if now.After(req.expiresAt) {
+			for _, data := range req.fragments {
+				r.size -= len(data)
+			}
+			delete(r.pending, id)
+			pruned++
+		}
+	}
+	for id, req := range r.completed {
+		if now.After(req.expiresAt) {
+			delete(r.completed, id)
+		}
+	}
+	return pruned
+}
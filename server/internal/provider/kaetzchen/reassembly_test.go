@@ -0,0 +1,115 @@
+// reassembly_test.go - Kaetzchen request reassembly tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package kaetzchen
+
+import (
+	"encoding/binary"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson/fragment"
+	cConstants "github.com/katzenpost/client/constants"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func splitTestRequest(require *require.Assertions, length int) ([]byte, []*fragment.Fragment) {
+	id := new([cConstants.MessageIDLength]byte)
+	_, err := io.ReadFull(rand.Reader, id[:])
+	require.NoError(err)
+	request := make([]byte, length)
+	_, err = io.ReadFull(rand.Reader, request)
+	require.NoError(err)
+	payloads, err := fragment.Split(id, request)
+	require.NoError(err)
+	fragments := make([]*fragment.Fragment, len(payloads))
+	for i, payload := range payloads {
+		fragments[i], err = fragment.Parse(payload)
+		require.NoError(err)
+	}
+	return request, fragments
+}
+
+func TestReassembler(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	now := time.Now()
+	r := newReassembler(time.Minute)
+
+	// fragments complete the request in any order, once each
+	request, fragments := splitTestRequest(require, 2*fragment.MaxDataLength)
+	require.Len(fragments, 3)
+	_, ok := r.add(fragments[2], now)
+	assert.False(ok)
+	_, ok = r.add(fragments[2], now)
+	assert.False(ok)
+	_, ok = r.add(fragments[0], now)
+	assert.False(ok)
+	payload, ok := r.add(fragments[1], now)
+	require.True(ok)
+	assert.Equal(uint32(len(request)), binary.BigEndian.Uint32(payload[:4]))
+	assert.Equal(request, payload[4:])
+	assert.Len(r.pending, 0)
+	assert.Zero(r.size)
+
+	// late fragments of a completed request are dropped until the timeout
+	_, ok = r.add(fragments[0], now)
+	assert.False(ok)
+	assert.Len(r.pending, 0)
+
+	// the retransmitted fragments are answered with the reply of the
+	// request, whose first transmission was lost
+	_, ok = r.reply(&fragments[1].ID)
+	assert.False(ok, "no reply before the request is handled")
+	r.setReply(&fragments[1].ID, []byte("reply"))
+	for _, f := range fragments {
+		reply, ok := r.reply(&f.ID)
+		require.True(ok)
+		assert.Equal([]byte("reply"), reply)
+	}
+	r.prune(now.Add(2 * time.Minute))
+	_, ok = r.reply(&fragments[1].ID)
+	assert.False(ok, "the reply is forgotten after the timeout")
+
+	// incomplete requests are pruned after the timeout
+	_, fragments = splitTestRequest(require, fragment.MaxDataLength)
+	require.Len(fragments, 2)
+	_, ok = r.add(fragments[0], now)
+	assert.False(ok)
+	assert.Equal(0, r.prune(now.Add(time.Minute/2)))
+	assert.Equal(1, r.prune(now.Add(2*time.Minute)))
+	_, ok = r.add(fragments[1], now.Add(2*time.Minute))
+	assert.False(ok)
+	assert.Len(r.pending, 1)
+	assert.Len(r.completed, 0)
+
+	// the fragments kept are bounded in size
+	r = newReassembler(time.Minute)
+	for r.size+fragment.MaxDataLength <= maxPendingBytes {
+		_, fragments = splitTestRequest(require, fragment.MaxDataLength)
+		_, ok = r.add(fragments[0], now)
+		assert.False(ok)
+	}
+	assert.Less(len(r.pending), maxPendingRequests)
+	_, fragments = splitTestRequest(require, fragment.MaxDataLength)
+	_, ok = r.add(fragments[0], now)
+	assert.False(ok)
+	_, ok = r.pending[fragments[0].ID]
+	assert.False(ok)
+}
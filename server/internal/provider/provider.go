@@ -20,6 +20,8 @@ package provider
 import (
 	"bytes"
 	"context"
+	"crypto/hmac"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"net/http"
@@ -28,6 +30,7 @@ import (
 	"sync"
 	"time"
 
+	"github.com/hashcloak/Meson/server/atrest"
 	"github.com/hashcloak/Meson/server/config"
 	internalConstants "github.com/hashcloak/Meson/server/internal/constants"
 	"github.com/hashcloak/Meson/server/internal/debug"
@@ -291,6 +294,33 @@ func (p *provider) worker() {
 	}
 }
 
+func (p *provider) sweeper() {
+	interval := time.Duration(p.glue.Config().Provider.SpoolDB.SweepInterval) * time.Second
+	timer := time.NewTimer(0)
+
+	defer func() {
+		p.log.Debugf("Halting Provider spool sweeper.")
+		timer.Stop()
+	}()
+
+	for {
+		select {
+		case <-p.HaltCh():
+			p.log.Debugf("Terminating gracefully.")
+			return
+		case <-timer.C:
+		}
+
+		// Remove the spooled entries past their TTL.
+		if n, err := p.spool.Expire(); err != nil {
+			p.log.Warningf("Failed to expire spooled entries: %v", err)
+		} else if n > 0 {
+			p.log.Debugf("Expired %v spooled entries.", n)
+		}
+		timer.Reset(interval)
+	}
+}
+
 func (p *provider) onSURBReply(pkt *packet.Packet, recipient []byte) {
 	if len(pkt.Payload) != sphinx.PayloadTagLength+constants.ForwardPayloadLength {
 		p.log.Debugf("Refusing to store mis-sized SURB-Reply: %v (%v)", pkt.ID, len(pkt.Payload))
@@ -585,6 +615,9 @@ func (p *provider) ServeHTTP(response http.ResponseWriter, request *http.Request
 	case registration.RegisterLinkAndIdentityCommand:
 		p.processIdentityRegistration(user, response, request)
 		return
+	case registration.UpdateLinkCommand:
+		p.processLinkUpdate(user, response, request)
+		return
 	default:
 		p.log.Error("Provider ServeHTTP invalid registration type error")
 		response.WriteHeader(http.StatusInternalServerError)
@@ -646,6 +679,63 @@ func (p *provider) processLinkRegistration(user []byte, response http.ResponseWr
 	_, _ = response.Write([]byte(message))
 }
 
+func (p *provider) processLinkUpdate(user []byte, response http.ResponseWriter, request *http.Request) {
+	// Unknown users are rejected as invalid proofs are, so as not to tell
+	// which users exist.
+	if !p.userDB.Exists(user) {
+		p.log.Errorf("Provider ServeHTTP link update unknown user: %s", user)
+		response.WriteHeader(http.StatusForbidden)
+		return
+	}
+	linkKey, err := p.userDB.Link(user)
+	if err != nil {
+		p.log.Errorf("Provider ServeHTTP link update user error: %s", err)
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	rawLinkKey := request.FormValue(registration.NewLinkKeyField)
+	if len(rawLinkKey) == 0 {
+		p.log.Error("Provider ServeHTTP link update zero key error")
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	newLinkKey := new(ecdh.PublicKey)
+	if err := newLinkKey.FromString(rawLinkKey); err != nil {
+		p.log.Errorf("Provider ServeHTTP pub key from string error: %s", err)
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	// The user proves the ownership of the registered link key.
+	proof, err := hex.DecodeString(request.FormValue(registration.ProofField))
+	if err != nil {
+		p.log.Errorf("Provider ServeHTTP link update proof error: %s", err)
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	var sharedSecret [ecdh.GroupElementLength]byte
+	defer utils.ExplicitBzero(sharedSecret[:])
+	p.glue.LinkKey().Exp(&sharedSecret, linkKey)
+	expected := registration.LinkUpdateProof(sharedSecret[:], request.FormValue(registration.UserField), newLinkKey)
+	if !hmac.Equal(proof, expected) {
+		p.log.Errorf("Provider ServeHTTP link update invalid proof: %s", user)
+		response.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	if err := p.userDB.Add(user, newLinkKey, true); err != nil {
+		p.log.Errorf("Provider ServeHTTP user Add error: %s", err)
+		response.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	p.log.Noticef("HTTP Registration updated the link key of user: %s", user)
+
+	// Send a response back to the client.
+	message := "OK\n"
+	_, _ = response.Write([]byte(message))
+}
+
 func (p *provider) processIdentityRegistration(user []byte, response http.ResponseWriter, request *http.Request) {
 	key, _ := p.userDB.Identity(user)
 	if key != nil {
@@ -774,9 +864,19 @@ func New(glue glue.Glue) (glue.Provider, error) {
 		}
 	}
 
+	var secret *atrest.Secret
+	if cfg.Provider.Encryption != nil {
+		if cfg.Provider.UserDB.Backend != config.BackendBolt && cfg.Provider.SpoolDB.Backend != config.BackendBolt {
+			p.log.Warningf("Encryption configured but not used for the User or Spool databases.")
+		}
+		if secret, err = cfg.Provider.Encryption.Secret(); err != nil {
+			return nil, err
+		}
+	}
+
 	switch cfg.Provider.UserDB.Backend {
 	case config.BackendBolt:
-		p.userDB, err = boltuserdb.New(cfg.Provider.UserDB.Bolt.UserDB)
+		p.userDB, err = boltuserdb.New(cfg.Provider.UserDB.Bolt.UserDB, secret)
 	case config.BackendExtern:
 		p.userDB, err = externuserdb.New(cfg.Provider.UserDB.Extern.ProviderURL)
 	case config.BackendSQL:
@@ -792,12 +892,18 @@ func New(glue glue.Glue) (glue.Provider, error) {
 		return nil, err
 	}
 
+	limits := spool.Limits{
+		TTL:         time.Duration(cfg.Provider.SpoolDB.MessageTTL) * time.Second,
+		MaxMessages: cfg.Provider.SpoolDB.MaxMessages,
+		MaxBytes:    cfg.Provider.SpoolDB.MaxBytes,
+		DropOldest:  cfg.Provider.SpoolDB.QuotaPolicy == config.QuotaPolicyDropOldest,
+	}
 	switch cfg.Provider.SpoolDB.Backend {
 	case config.BackendBolt:
-		p.spool, err = boltspool.New(cfg.Provider.SpoolDB.Bolt.SpoolDB)
+		p.spool, err = boltspool.New(cfg.Provider.SpoolDB.Bolt.SpoolDB, limits, secret)
 	case config.BackendSQL:
 		if p.sqlDB != nil {
-			p.spool = p.sqlDB.Spool()
+			p.spool = p.sqlDB.Spool(limits)
 		} else {
 			err = errors.New("provider: SQL SpoolDB backend with no SQL database")
 		}
@@ -812,6 +918,9 @@ func New(glue glue.Glue) (glue.Provider, error) {
 	if err = p.spool.Vacuum(p.userDB); err != nil {
 		return nil, err
 	}
+	if limits.TTL > 0 {
+		p.Go(p.sweeper)
+	}
 
 	// Wire in the management related commands.
 	if cfg.Management.Enable {
@@ -21,7 +21,6 @@ import (
 	"math"
 	"time"
 
-	"github.com/hashcloak/Meson/client/pkiclient/epochtime"
 	"github.com/hashcloak/Meson/server/internal/constants"
 	"github.com/hashcloak/Meson/server/internal/debug"
 	"github.com/hashcloak/Meson/server/internal/glue"
@@ -101,7 +100,7 @@ func (sch *scheduler) OnPacket(pkt *packet.Packet) {
 
 func (sch *scheduler) worker() {
 
-	var absoluteMaxDelay = epochtime.TestPeriod * constants.NumMixKeys
+	absoluteMaxDelay := sch.glue.PKI().Period() * constants.NumMixKeys
 
 	timerSlack := time.Duration(sch.glue.Config().Debug.SchedulerSlack) * time.Millisecond
 	timer := time.NewTimer(math.MaxInt64)
@@ -161,6 +160,7 @@ func (sch *scheduler) worker() {
 			}
 			sch.q.BulkEnqueue(toEnqueue)
 		case newMaxDelay := <-sch.maxDelayCh:
+			absoluteMaxDelay = sch.glue.PKI().Period() * constants.NumMixKeys
 			pkiMaxDelay := time.Duration(newMaxDelay) * time.Millisecond
 			if pkiMaxDelay > absoluteMaxDelay || pkiMaxDelay == 0 {
 				// There is a maximum sensible delay, regardless of what the
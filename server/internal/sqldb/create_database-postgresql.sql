@@ -38,7 +38,7 @@ BEGIN;
   DO $$
   DECLARE
     pgsql_version  integer := current_setting('server_version_num')::integer;
-    schema_version smallint := 0;
+    schema_version smallint := 1;
     spool_only     boolean := current_setting('katzenpost.spool_only')::boolean;
   BEGIN
     -- Ensure that Postgresql is sufficiently recent.
@@ -72,9 +72,11 @@ BEGIN;
       message_id   bigserial PRIMARY KEY,
       user_id      bigint REFERENCES users ON DELETE CASCADE,
       surb_id      bytea,
-      message_body bytea NOT NULL
+      message_body bytea NOT NULL,
+      stored_at    timestamptz NOT NULL DEFAULT now()
     );
     CREATE INDEX ON spool(user_id);
+    CREATE INDEX ON spool(stored_at);
 
     -- Create the functions.
     --
@@ -195,25 +197,77 @@ BEGIN;
       RETURN ret;
     END $SPOOL_GET$ LANGUAGE plpgsql;
 
+    CREATE FUNCTION spool_make_room(uid bigint, msg_length integer, max_messages integer, max_bytes bigint, drop_oldest boolean) RETURNS boolean AS $SPOOL_MAKE_ROOM$
+    DECLARE
+      n_messages    integer;
+      n_bytes       bigint;
+      oldest_length integer;
+    BEGIN
+      IF $3 <= 0 AND $4 <= 0 THEN
+        RETURN true;
+      END IF;
+
+      -- Serialize the stores to the user's spool, so that concurrent stores
+      -- can not both fit in the remaining quota.
+      PERFORM pg_advisory_xact_lock($1);
+
+      SELECT count(*), coalesce(sum(octet_length(message_body)), 0) INTO n_messages, n_bytes FROM spool WHERE spool.user_id = $1;
+      LOOP
+        EXIT WHEN ($3 <= 0 OR n_messages < $3) AND ($4 <= 0 OR n_bytes + $2 <= $4);
+        IF $5 = false OR n_messages = 0 THEN
+          RETURN false;
+        END IF;
+
+        -- Drop the oldest entry of the user's spool to make room.
+        DELETE FROM spool WHERE message_id = (SELECT message_id FROM spool WHERE spool.user_id = $1 ORDER BY message_id LIMIT 1) RETURNING octet_length(message_body) INTO STRICT oldest_length;
+        n_messages := n_messages - 1;
+        n_bytes := n_bytes - oldest_length;
+      END LOOP;
+      RETURN true;
+    END $SPOOL_MAKE_ROOM$ LANGUAGE plpgsql;
+
     IF spool_only = false THEN
 
-      CREATE FUNCTION spool_store(user_name bytea, surb_id bytea, msg bytea) RETURNS void AS $SPOOL_STORE$
+      CREATE FUNCTION spool_store(user_name bytea, surb_id bytea, msg bytea, max_messages integer, max_bytes bigint, drop_oldest boolean) RETURNS boolean AS $SPOOL_STORE$
+      DECLARE
+        uid bigint;
       BEGIN
-        INSERT INTO spool(message_id, user_id, surb_id, message_body) VALUES (DEFAULT, (SELECT user_id FROM users WHERE users.user_name = $1), $2, $3);
+        SELECT user_id INTO STRICT uid FROM users WHERE users.user_name = $1;
+        IF NOT spool_make_room(uid, octet_length($3), $4, $5, $6) THEN
+          RETURN false;
+        END IF;
+        INSERT INTO spool(message_id, user_id, surb_id, message_body) VALUES (DEFAULT, uid, $2, $3);
+        RETURN true;
       END $SPOOL_STORE$ LANGUAGE plpgsql;
 
     ELSE
 
-      CREATE FUNCTION spool_store(user_name bytea, surb_id bytea, msg bytea) RETURNS void AS $SPOOL_STORE$
+      CREATE FUNCTION spool_store(user_name bytea, surb_id bytea, msg bytea, max_messages integer, max_bytes bigint, drop_oldest boolean) RETURNS boolean AS $SPOOL_STORE$
+      DECLARE
+        uid bigint;
       BEGIN
         -- Can't use RETURNING to get the user_id, because when nothing is
         -- updated, nothing is returned.
         INSERT INTO users(user_id, user_name) VALUES (DEFAULT, $1) ON CONFLICT DO NOTHING;
-        INSERT INTO spool(message_id, user_id, surb_id, message_body) VALUES (DEFAULT, (SELECT user_id FROM users WHERE users.user_name = $1), $2, $3);
+        SELECT user_id INTO STRICT uid FROM users WHERE users.user_name = $1;
+        IF NOT spool_make_room(uid, octet_length($3), $4, $5, $6) THEN
+          RETURN false;
+        END IF;
+        INSERT INTO spool(message_id, user_id, surb_id, message_body) VALUES (DEFAULT, uid, $2, $3);
+        RETURN true;
       END $SPOOL_STORE$ LANGUAGE plpgsql;
 
     END IF;
 
+    CREATE FUNCTION spool_expire(ttl bigint) RETURNS integer AS $SPOOL_EXPIRE$
+    DECLARE
+      expired integer;
+    BEGIN
+      DELETE FROM spool WHERE stored_at < now() - make_interval(secs => $1);
+      GET DIAGNOSTICS expired = ROW_COUNT;
+      RETURN expired;
+    END $SPOOL_EXPIRE$ LANGUAGE plpgsql;
+
   END $$ LANGUAGE plpgsql;
 
   -- Dump the created tables.
@@ -0,0 +1,129 @@
+/*
+ * migrate_database-postgresql-v0-v1.sql: Postgresql schema migration.
+ * Copyright (C) 2021  Hashcloak.
+ *
+ * This program is free software: you can redistribute it and/or modify
+ * it under the terms of the GNU Affero General Public License as
+ * published by the Free Software Foundation, either version 3 of the
+ * License, or (at your option) any later version.
+ *
+ * This program is distributed in the hope that it will be useful,
+ * but WITHOUT ANY WARRANTY; without even the implied warranty of
+ * MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+ * GNU Affero General Public License for more details.
+ *
+ * You should have received a copy of the GNU Affero General Public License
+ * along with this program.  If not, see <http://www.gnu.org/licenses/>.
+ */
+
+-- Upgrades a database created with the version 0 schema to the version 1
+-- schema, which adds the spool expiry and the per-user spool quotas.  The
+-- server refuses to start on a version 0 database, so this must be run
+-- once, with the server stopped, before upgrading it:
+--
+--   psql -d katzenpost -f migrate_database-postgresql-v0-v1.sql
+--
+-- The entries already in the spool are considered stored at the time of
+-- the migration for the purpose of the expiry.
+
+-- Tweak some behavior that people may be adding to their psqlrc.
+\set ON_ERROR_STOP 'on'
+\set ON_ERROR_ROLLBACK 'off'
+
+BEGIN;
+  DO $$
+  DECLARE
+    schema_version smallint;
+    spool_only     boolean;
+  BEGIN
+    SELECT metadata.schema_version, metadata.spool_only INTO STRICT schema_version, spool_only FROM metadata FOR UPDATE;
+    IF schema_version != 0 THEN
+      RAISE 'Unexpected schema version: %', schema_version USING HINT = 'only version 0 databases can be migrated';
+    END IF;
+
+    -- Timestamp the spool entries.
+    ALTER TABLE spool ADD COLUMN stored_at timestamptz NOT NULL DEFAULT now();
+    CREATE INDEX ON spool(stored_at);
+
+    -- Replace the store function with the one enforcing the quotas.
+    DROP FUNCTION spool_store(bytea, bytea, bytea);
+
+    CREATE FUNCTION spool_make_room(uid bigint, msg_length integer, max_messages integer, max_bytes bigint, drop_oldest boolean) RETURNS boolean AS $SPOOL_MAKE_ROOM$
+    DECLARE
+      n_messages    integer;
+      n_bytes       bigint;
+      oldest_length integer;
+    BEGIN
+      IF $3 <= 0 AND $4 <= 0 THEN
+        RETURN true;
+      END IF;
+
+      -- Serialize the stores to the user's spool, so that concurrent stores
+      -- can not both fit in the remaining quota.
+      PERFORM pg_advisory_xact_lock($1);
+
+      SELECT count(*), coalesce(sum(octet_length(message_body)), 0) INTO n_messages, n_bytes FROM spool WHERE spool.user_id = $1;
+      LOOP
+        EXIT WHEN ($3 <= 0 OR n_messages < $3) AND ($4 <= 0 OR n_bytes + $2 <= $4);
+        IF $5 = false OR n_messages = 0 THEN
+          RETURN false;
+        END IF;
+
+        -- Drop the oldest entry of the user's spool to make room.
+        DELETE FROM spool WHERE message_id = (SELECT message_id FROM spool WHERE spool.user_id = $1 ORDER BY message_id LIMIT 1) RETURNING octet_length(message_body) INTO STRICT oldest_length;
+        n_messages := n_messages - 1;
+        n_bytes := n_bytes - oldest_length;
+      END LOOP;
+      RETURN true;
+    END $SPOOL_MAKE_ROOM$ LANGUAGE plpgsql;
+
+    IF spool_only = false THEN
+
+      CREATE FUNCTION spool_store(user_name bytea, surb_id bytea, msg bytea, max_messages integer, max_bytes bigint, drop_oldest boolean) RETURNS boolean AS $SPOOL_STORE$
+      DECLARE
+        uid bigint;
+      BEGIN
+        SELECT user_id INTO STRICT uid FROM users WHERE users.user_name = $1;
+        IF NOT spool_make_room(uid, octet_length($3), $4, $5, $6) THEN
+          RETURN false;
+        END IF;
+        INSERT INTO spool(message_id, user_id, surb_id, message_body) VALUES (DEFAULT, uid, $2, $3);
+        RETURN true;
+      END $SPOOL_STORE$ LANGUAGE plpgsql;
+
+    ELSE
+
+      CREATE FUNCTION spool_store(user_name bytea, surb_id bytea, msg bytea, max_messages integer, max_bytes bigint, drop_oldest boolean) RETURNS boolean AS $SPOOL_STORE$
+      DECLARE
+        uid bigint;
+      BEGIN
+        -- Can't use RETURNING to get the user_id, because when nothing is
+        -- updated, nothing is returned.
+        INSERT INTO users(user_id, user_name) VALUES (DEFAULT, $1) ON CONFLICT DO NOTHING;
+        SELECT user_id INTO STRICT uid FROM users WHERE users.user_name = $1;
+        IF NOT spool_make_room(uid, octet_length($3), $4, $5, $6) THEN
+          RETURN false;
+        END IF;
+        INSERT INTO spool(message_id, user_id, surb_id, message_body) VALUES (DEFAULT, uid, $2, $3);
+        RETURN true;
+      END $SPOOL_STORE$ LANGUAGE plpgsql;
+
+    END IF;
+
+    CREATE FUNCTION spool_expire(ttl bigint) RETURNS integer AS $SPOOL_EXPIRE$
+    DECLARE
+      expired integer;
+    BEGIN
+      DELETE FROM spool WHERE stored_at < now() - make_interval(secs => $1);
+      GET DIAGNOSTICS expired = ROW_COUNT;
+      RETURN expired;
+    END $SPOOL_EXPIRE$ LANGUAGE plpgsql;
+
+    UPDATE metadata SET schema_version = 1;
+  END $$ LANGUAGE plpgsql;
+
+  -- Dump the migrated tables.
+  \d spool
+  \df
+
+COMMIT;
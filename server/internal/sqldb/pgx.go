@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/hashcloak/Meson/server/spool"
 	"github.com/hashcloak/Meson/server/userdb"
@@ -41,6 +42,7 @@ const (
 	pgxTagUserSetIdentKey = "user_set_identity_key"
 	pgxTagSpoolStore      = "spool_store"
 	pgxTagSpoolGet        = "spool_get"
+	pgxTagSpoolExpire     = "spool_expire"
 
 	pgCodeNoDataFound = "P0002" // `no_data_found`
 )
@@ -64,8 +66,8 @@ func (p *pgxImpl) UserDB() (userdb.UserDB, error) {
 	return newPgxUserDB(p), nil
 }
 
-func (p *pgxImpl) Spool() spool.Spool {
-	return newPgxSpool(p)
+func (p *pgxImpl) Spool(limits spool.Limits) spool.Spool {
+	return newPgxSpool(p, limits)
 }
 
 func (p *pgxImpl) Close() {
@@ -99,7 +101,7 @@ func (p *pgxImpl) Log(level pgx.LogLevel, msg string, data map[string]interface{
 func (p *pgxImpl) initMetadata() error {
 	const (
 		metadataQuery    = "SELECT * FROM metadata_get() AS (schema_version smallint, spool_only boolean);"
-		pgxSchemaVersion = 0
+		pgxSchemaVersion = 1
 	)
 
 	var schemaVersion int
@@ -110,6 +112,9 @@ func (p *pgxImpl) initMetadata() error {
 	case err != nil:
 		return fmt.Errorf("sql/pgx: metadata_get() failed: %v", err)
 	default:
+		if schemaVersion == 0 {
+			return fmt.Errorf("sql/pgx: outdated schema version: %v, run migrate_database-postgresql-v0-v1.sql", schemaVersion)
+		}
 		if schemaVersion != pgxSchemaVersion {
 			return fmt.Errorf("sql/pgx: invalid schema version: %v", schemaVersion)
 		}
@@ -127,8 +132,9 @@ func (p *pgxImpl) initStatements() error {
 		{pgxTagUserSetAuthKey, "SELECT user_set_authentication_key($1, $2, $3);"},
 		{pgxTagUserGetIdentKey, "SELECT user_get_identity_key($1);"},
 		{pgxTagUserSetIdentKey, "SELECT user_set_identity_key($1, $2);"},
-		{pgxTagSpoolStore, "SELECT spool_store($1, $2, $3);"},
+		{pgxTagSpoolStore, "SELECT spool_store($1, $2, $3, $4, $5, $6);"},
 		{pgxTagSpoolGet, "SELECT * FROM spool_get($1, $2) AS (message_body bytea, surb_id bytea, remaining integer);"},
+		{pgxTagSpoolExpire, "SELECT spool_expire($1);"},
 	}
 
 	for _, v := range stmts {
@@ -295,7 +301,8 @@ func newPgxUserDB(p *pgxImpl) *pgxUserDB {
 }
 
 type pgxSpool struct {
-	pgx *pgxImpl
+	pgx    *pgxImpl
+	limits spool.Limits
 }
 
 func (s *pgxSpool) StoreMessage(u, msg []byte) error {
@@ -316,8 +323,16 @@ func (s *pgxSpool) StoreSURBReply(u []byte, id *[sConstants.SURBIDLength]byte, m
 }
 
 func (s *pgxSpool) doStore(u, id, msg []byte) error {
-	_, err := s.pgx.pool.Exec(pgxTagSpoolStore, u, id, msg)
-	return err
+	var stored bool
+	err := s.pgx.pool.QueryRow(pgxTagSpoolStore, u, id, msg, s.limits.MaxMessages, s.limits.MaxBytes, s.limits.DropOldest).Scan(&stored)
+	switch {
+	case err != nil:
+		return err
+	case !stored:
+		return spool.ErrQuotaExceeded
+	default:
+		return nil
+	}
 }
 
 func (s *pgxSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining int, err error) {
@@ -349,13 +364,27 @@ func (s *pgxSpool) Vacuum(udb userdb.UserDB) error {
 	return nil
 }
 
+func (s *pgxSpool) Expire() (int, error) {
+	if s.limits.TTL <= 0 {
+		return 0, nil
+	}
+
+	var expired int
+	ttl := int64(s.limits.TTL / time.Second)
+	if err := s.pgx.pool.QueryRow(pgxTagSpoolExpire, ttl).Scan(&expired); err != nil {
+		return 0, err
+	}
+	return expired, nil
+}
+
 func (s *pgxSpool) Close() {
 	// Nothing to do.
 }
 
-func newPgxSpool(p *pgxImpl) *pgxSpool {
+func newPgxSpool(p *pgxImpl, limits spool.Limits) *pgxSpool {
 	return &pgxSpool{
-		pgx: p,
+		pgx:    p,
+		limits: limits,
 	}
 }
 
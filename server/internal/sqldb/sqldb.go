@@ -20,6 +20,7 @@ package sqldb
 import (
 	"fmt"
 
+	"github.com/hashcloak/Meson/server/config"
 	"github.com/hashcloak/Meson/server/internal/glue"
 	"github.com/hashcloak/Meson/server/spool"
 	"github.com/hashcloak/Meson/server/userdb"
@@ -29,7 +30,7 @@ import (
 type dbImpl interface {
 	IsSpoolOnly() bool
 	UserDB() (userdb.UserDB, error)
-	Spool() spool.Spool
+	Spool(limits spool.Limits) spool.Spool
 	Close()
 }
 
@@ -52,9 +53,10 @@ func (d *SQLDB) UserDB() (userdb.UserDB, error) {
 	return d.impl.UserDB()
 }
 
-// Spool returns a spool.Spool instance backed by the SQL database.
-func (d *SQLDB) Spool() spool.Spool {
-	return d.impl.Spool()
+// Spool returns a spool.Spool instance backed by the SQL database, enforcing
+// the given limits.
+func (d *SQLDB) Spool(limits spool.Limits) spool.Spool {
+	return d.impl.Spool(limits)
 }
 
 // Close closes the SQL database connection(s).
@@ -71,16 +73,21 @@ func New(glue glue.Glue) (*SQLDB, error) {
 
 	sCfg := glue.Config().Provider.SQLDB
 
+	var err error
 	switch sCfg.Backend {
 	case implPgx:
-		var err error
 		db.impl, err = newPgxImpl(db, sCfg.DataSourceName)
-		if err != nil {
-			return nil, err
-		}
+	case implSqlite:
+		// The database is only used as the spool, unless configured as the
+		// user database too.
+		spoolOnly := glue.Config().Provider.UserDB.Backend != config.BackendSQL
+		db.impl, err = newSqliteImpl(db, sCfg.DataSourceName, spoolOnly)
 	default:
 		return nil, fmt.Errorf("sqldb: Invalid backend: '%v'", sCfg.Backend)
 	}
+	if err != nil {
+		return nil, err
+	}
 
 	return db, nil
 }
@@ -0,0 +1,490 @@
+// sqlite.go - SQLite database support.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sqldb
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/hashcloak/Meson/server/spool"
+	"github.com/hashcloak/Meson/server/userdb"
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/sphinx"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/katzenpost/core/utils"
+
+	// Register the `sqlite3` database/sql driver.
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const implSqlite = "sqlite"
+
+// sqliteMigrations are the schema migrations, the i-th one upgrading the
+// schema from version i to version i+1.
+//
+// The schema mirrors the Postgresql one, except that the authentication key
+// is nullable for spool only databases, and that the time of storage of the
+// spooled entries is a UNIX timestamp.
+var sqliteMigrations = []string{
+	`CREATE TABLE users (
+		user_id            INTEGER PRIMARY KEY,
+		user_name          BLOB NOT NULL UNIQUE,
+		authentication_key BLOB,
+		identity_key       BLOB
+	);
+	CREATE TABLE spool (
+		message_id   INTEGER PRIMARY KEY AUTOINCREMENT,
+		user_id      INTEGER NOT NULL REFERENCES users ON DELETE CASCADE,
+		surb_id      BLOB,
+		message_body BLOB NOT NULL,
+		stored_at    INTEGER NOT NULL
+	);
+	CREATE INDEX spool_user_id ON spool(user_id);
+	CREATE INDEX spool_stored_at ON spool(stored_at);`,
+}
+
+type sqliteImpl struct {
+	d *SQLDB
+
+	db *sql.DB
+
+	spoolOnly bool
+}
+
+func (s *sqliteImpl) IsSpoolOnly() bool {
+	return s.spoolOnly
+}
+
+func (s *sqliteImpl) UserDB() (userdb.UserDB, error) {
+	if s.IsSpoolOnly() {
+		return nil, errors.New("sql/sqlite: UserDB() called for spool only database")
+	}
+	return &sqliteUserDB{sqlite: s}, nil
+}
+
+func (s *sqliteImpl) Spool(limits spool.Limits) spool.Spool {
+	return &sqliteSpool{
+		sqlite: s,
+		limits: limits,
+		now:    time.Now,
+	}
+}
+
+func (s *sqliteImpl) Close() {
+	s.db.Close()
+}
+
+// initSchema creates the schema of a new database, or migrates the schema of
+// an existing one to the latest version.
+func (s *sqliteImpl) initSchema(spoolOnly bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	if _, err = tx.Exec("CREATE TABLE IF NOT EXISTS metadata (schema_version INTEGER NOT NULL, spool_only INTEGER NOT NULL);"); err != nil {
+		return err
+	}
+
+	var schemaVersion int
+	err = tx.QueryRow("SELECT schema_version, spool_only FROM metadata;").Scan(&schemaVersion, &s.spoolOnly)
+	switch {
+	case err == sql.ErrNoRows:
+		// We created a new database, so populate the metadata.
+		s.spoolOnly = spoolOnly
+		if _, err = tx.Exec("INSERT INTO metadata(schema_version, spool_only) VALUES (0, ?);", spoolOnly); err != nil {
+			return err
+		}
+	case err != nil:
+		return fmt.Errorf("sql/sqlite: failed to query metadata: %v", err)
+	case schemaVersion > len(sqliteMigrations):
+		return fmt.Errorf("sql/sqlite: invalid schema version: %v", schemaVersion)
+	}
+
+	for ; schemaVersion < len(sqliteMigrations); schemaVersion++ {
+		s.d.log.Noticef("Migrating the database schema to version %v.", schemaVersion+1)
+		if _, err = tx.Exec(sqliteMigrations[schemaVersion]); err != nil {
+			return fmt.Errorf("sql/sqlite: failed to migrate to schema version %v: %v", schemaVersion+1, err)
+		}
+	}
+	if _, err = tx.Exec("UPDATE metadata SET schema_version = ?;", schemaVersion); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// doUserDelete removes the user and the user's spool.
+func (s *sqliteImpl) doUserDelete(u []byte) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// The foreign key constraints are only enforced when enabled for each
+	// connection, so remove the user's spool explicitly.
+	if _, err = tx.Exec("DELETE FROM spool WHERE user_id = (SELECT user_id FROM users WHERE user_name = ?);", u); err != nil {
+		return err
+	}
+	res, err := tx.Exec("DELETE FROM users WHERE user_name = ?;", u)
+	if err != nil {
+		return err
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return userdb.ErrNoSuchUser
+	}
+
+	return tx.Commit()
+}
+
+func newSqliteImpl(db *SQLDB, dataSourceName string, spoolOnly bool) (dbImpl, error) {
+	s := &sqliteImpl{
+		d: db,
+	}
+
+	var err error
+	if s.db, err = sql.Open("sqlite3", dataSourceName); err != nil {
+		return nil, err
+	}
+
+	// SQLite only supports a single writer at a time, so serialize the
+	// accesses in process instead of failing with `SQLITE_BUSY`, which
+	// also keeps in-memory databases on a single connection.
+	s.db.SetMaxOpenConns(1)
+
+	if err = s.initSchema(spoolOnly); err != nil {
+		s.db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+type sqliteUserDB struct {
+	sqlite *sqliteImpl
+}
+
+func (d *sqliteUserDB) Exists(u []byte) bool {
+	return d.getAuthKey(u) != nil
+}
+
+func (d *sqliteUserDB) IsValid(u []byte, k *ecdh.PublicKey) bool {
+	dbKey := d.getAuthKey(u)
+	if dbKey == nil {
+		return false
+	}
+	return dbKey.Equal(k)
+}
+
+func (d *sqliteUserDB) getAuthKey(u []byte) *ecdh.PublicKey {
+	var raw []byte
+	if err := d.sqlite.db.QueryRow("SELECT authentication_key FROM users WHERE user_name = ?;", u).Scan(&raw); err != nil {
+		d.sqlite.d.log.Debugf("Failed to query authentication key: %v", err)
+		return nil
+	}
+
+	pk := new(ecdh.PublicKey)
+	if err := pk.FromBytes(raw); err != nil {
+		d.sqlite.d.log.Warningf("Failed to deserialize authentication key for user '%v': %v", utils.ASCIIBytesToPrintString(u), err)
+		return nil
+	}
+
+	return pk
+}
+
+func (d *sqliteUserDB) Add(u []byte, k *ecdh.PublicKey, update bool) error {
+	if !update {
+		_, err := d.sqlite.db.Exec("INSERT INTO users(user_name, authentication_key) VALUES (?, ?);", u, k.Bytes())
+		return err
+	}
+
+	res, err := d.sqlite.db.Exec("UPDATE users SET authentication_key = ? WHERE user_name = ?;", k.Bytes(), u)
+	if err != nil {
+		return err
+	}
+	return errNoSuchUserIfNone(res)
+}
+
+func (d *sqliteUserDB) SetIdentity(u []byte, k *ecdh.PublicKey) error {
+	var kBytes []byte
+	if k != nil {
+		kBytes = k.Bytes()
+	}
+
+	res, err := d.sqlite.db.Exec("UPDATE users SET identity_key = ? WHERE user_name = ?;", kBytes, u)
+	if err != nil {
+		return err
+	}
+	return errNoSuchUserIfNone(res)
+}
+
+func (d *sqliteUserDB) Link(u []byte) (*ecdh.PublicKey, error) {
+	key := d.getAuthKey(u)
+	if key == nil {
+		return nil, userdb.ErrNoSuchUser
+	}
+	return key, nil
+}
+
+func (d *sqliteUserDB) Identity(u []byte) (*ecdh.PublicKey, error) {
+	var raw []byte
+	if err := d.sqlite.db.QueryRow("SELECT identity_key FROM users WHERE user_name = ?;", u).Scan(&raw); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, userdb.ErrNoSuchUser
+		}
+		return nil, err
+	}
+	if raw == nil {
+		return nil, userdb.ErrNoIdentity
+	}
+
+	pk := new(ecdh.PublicKey)
+	if err := pk.FromBytes(raw); err != nil {
+		return nil, err
+	}
+
+	return pk, nil
+}
+
+func (d *sqliteUserDB) Remove(u []byte) error {
+	return d.sqlite.doUserDelete(u)
+}
+
+func (d *sqliteUserDB) Close() {
+	// Nothing to do.
+}
+
+func errNoSuchUserIfNone(res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return userdb.ErrNoSuchUser
+	}
+	return nil
+}
+
+type sqliteSpool struct {
+	sqlite *sqliteImpl
+	limits spool.Limits
+	now    func() time.Time
+}
+
+func (s *sqliteSpool) StoreMessage(u, msg []byte) error {
+	if len(msg) != constants.UserForwardPayloadLength {
+		return fmt.Errorf("sqlite/spool: invalid user message size: %d", len(msg))
+	}
+	return s.doStore(u, nil, msg)
+}
+
+func (s *sqliteSpool) StoreSURBReply(u []byte, id *[sConstants.SURBIDLength]byte, msg []byte) error {
+	if len(msg) != sphinx.PayloadTagLength+constants.ForwardPayloadLength {
+		return fmt.Errorf("sqlite/spool: invalid SURBReply message size: %d", len(msg))
+	}
+	if id == nil {
+		return fmt.Errorf("sqlite/spool: SURBReply is missing ID")
+	}
+	return s.doStore(u, id[:], msg)
+}
+
+func (s *sqliteSpool) doStore(u, id, msg []byte) error {
+	tx, err := s.sqlite.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// The users of a spool only database are created on demand.
+	if s.sqlite.IsSpoolOnly() {
+		if _, err = tx.Exec("INSERT OR IGNORE INTO users(user_name) VALUES (?);", u); err != nil {
+			return err
+		}
+	}
+	var userID int64
+	if err = tx.QueryRow("SELECT user_id FROM users WHERE user_name = ?;", u).Scan(&userID); err != nil {
+		if err == sql.ErrNoRows {
+			return userdb.ErrNoSuchUser
+		}
+		return err
+	}
+
+	// Make room for this message, if the user's spool is at its quota.
+	if s.limits.MaxMessages > 0 || s.limits.MaxBytes > 0 {
+		var count, size int
+		if err = tx.QueryRow("SELECT count(*), coalesce(sum(length(message_body)), 0) FROM spool WHERE user_id = ?;", userID).Scan(&count, &size); err != nil {
+			return err
+		}
+		for s.limits.IsQuotaExceeded(count, size, len(msg)) {
+			if !s.limits.DropOldest || count == 0 {
+				return spool.ErrQuotaExceeded
+			}
+			var msgID int64
+			var msgSize int
+			if err = tx.QueryRow("SELECT message_id, length(message_body) FROM spool WHERE user_id = ? ORDER BY message_id LIMIT 1;", userID).Scan(&msgID, &msgSize); err != nil {
+				return err
+			}
+			if _, err = tx.Exec("DELETE FROM spool WHERE message_id = ?;", msgID); err != nil {
+				return err
+			}
+			count--
+			size -= msgSize
+		}
+	}
+
+	if _, err = tx.Exec("INSERT INTO spool(user_id, surb_id, message_body, stored_at) VALUES (?, ?, ?, ?);", userID, id, msg, s.now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining int, err error) {
+	var tx *sql.Tx
+	if tx, err = s.sqlite.db.Begin(); err != nil {
+		return
+	}
+	defer func() {
+		_ = tx.Rollback()
+	}()
+
+	// Grab the head of the user's spool, and the entry after it, if any.
+	type entry struct {
+		id           int64
+		surbID, body []byte
+	}
+	var entries []entry
+	rows, err := tx.Query("SELECT message_id, surb_id, message_body FROM spool WHERE user_id = (SELECT user_id FROM users WHERE user_name = ?) ORDER BY message_id LIMIT 3;", u)
+	if err != nil {
+		return
+	}
+	for rows.Next() {
+		var e entry
+		if err = rows.Scan(&e.id, &e.surbID, &e.body); err != nil {
+			rows.Close()
+			return
+		}
+		entries = append(entries, e)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return
+	}
+
+	if len(entries) == 0 {
+		// The user's spool is empty.
+		return
+	}
+	if advance {
+		// Delete the 0th message.
+		if _, err = tx.Exec("DELETE FROM spool WHERE message_id = ?;", entries[0].id); err != nil {
+			return
+		}
+		entries = entries[1:]
+		if err = tx.Commit(); err != nil || len(entries) == 0 {
+			// Deleting the message drained the queue.
+			return
+		}
+	}
+
+	msg, surbID = entries[0].body, entries[0].surbID
+	if len(entries) > 1 {
+		// "excluding the current message".
+		remaining = 1
+	}
+	return
+}
+
+func (s *sqliteSpool) Remove(u []byte) error {
+	// Removal is handled by removing from the UserDB, iff the database
+	// is acting as both.
+	if !s.sqlite.IsSpoolOnly() {
+		return nil
+	}
+
+	if err := s.sqlite.doUserDelete(u); err != userdb.ErrNoSuchUser {
+		return err
+	}
+	return nil
+}
+
+func (s *sqliteSpool) Vacuum(udb userdb.UserDB) error {
+	// This never needs to happen iff the database is acting as both the
+	// UserDB and spool.
+	if !s.sqlite.IsSpoolOnly() {
+		return nil
+	}
+
+	rows, err := s.sqlite.db.Query("SELECT user_name FROM users;")
+	if err != nil {
+		return err
+	}
+	var users [][]byte
+	for rows.Next() {
+		var u []byte
+		if err = rows.Scan(&u); err != nil {
+			rows.Close()
+			return err
+		}
+		users = append(users, u)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for _, u := range users {
+		// Note: If the provided UserDB doesn't do something intelligent
+		// like cache the valid users, this will really suck.
+		if udb.Exists(u) {
+			continue
+		}
+		if err = s.sqlite.doUserDelete(u); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteSpool) Expire() (int, error) {
+	if s.limits.TTL <= 0 {
+		return 0, nil
+	}
+
+	res, err := s.sqlite.db.Exec("DELETE FROM spool WHERE stored_at <= ?;", s.now().Add(-s.limits.TTL).Unix())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (s *sqliteSpool) Close() {
+	// Nothing to do.
+}
@@ -0,0 +1,192 @@
+// sqlite_test.go - SQLite database tests.
+// Copyright (C) 2021  Hashcloak.
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as
+// published by the Free Software Foundation, either version 3 of the
+// License, or (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+
+package sqldb
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hashcloak/Meson/server/spool"
+	"github.com/hashcloak/Meson/server/userdb"
+	"github.com/katzenpost/core/constants"
+	"github.com/katzenpost/core/crypto/ecdh"
+	"github.com/katzenpost/core/crypto/rand"
+	"github.com/katzenpost/core/log"
+	"github.com/katzenpost/core/sphinx"
+	sConstants "github.com/katzenpost/core/sphinx/constants"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSqlite(t *testing.T, f string, spoolOnly bool) *sqliteImpl {
+	logBackend, err := log.New("", "DEBUG", false)
+	require.NoError(t, err)
+	db := &SQLDB{log: logBackend.GetLogger("sqldb_test")}
+	impl, err := newSqliteImpl(db, f, spoolOnly)
+	require.NoError(t, err)
+	return impl.(*sqliteImpl)
+}
+
+func TestSqliteUserDB(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	dir, err := ioutil.TempDir("", "sqlite_tests")
+	require.NoError(err)
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, "meson.db")
+
+	s := newTestSqlite(t, f, false)
+	d, err := s.UserDB()
+	require.NoError(err)
+	alice, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+	bob, err := ecdh.NewKeypair(rand.Reader)
+	require.NoError(err)
+
+	require.NoError(d.Add([]byte("alice"), alice.PublicKey(), false))
+	assert.Error(d.Add([]byte("alice"), alice.PublicKey(), false))
+	assert.Equal(userdb.ErrNoSuchUser, d.Add([]byte("bob"), bob.PublicKey(), true))
+	assert.True(d.Exists([]byte("alice")))
+	assert.False(d.Exists([]byte("bob")))
+	assert.True(d.IsValid([]byte("alice"), alice.PublicKey()))
+	assert.False(d.IsValid([]byte("alice"), bob.PublicKey()))
+	link, err := d.Link([]byte("alice"))
+	require.NoError(err)
+	assert.True(link.Equal(alice.PublicKey()))
+	_, err = d.Link([]byte("bob"))
+	assert.Equal(userdb.ErrNoSuchUser, err)
+
+	_, err = d.Identity([]byte("alice"))
+	assert.Equal(userdb.ErrNoIdentity, err)
+	_, err = d.Identity([]byte("bob"))
+	assert.Equal(userdb.ErrNoSuchUser, err)
+	assert.Equal(userdb.ErrNoSuchUser, d.SetIdentity([]byte("bob"), bob.PublicKey()))
+	require.NoError(d.SetIdentity([]byte("alice"), bob.PublicKey()))
+	identity, err := d.Identity([]byte("alice"))
+	require.NoError(err)
+	assert.True(identity.Equal(bob.PublicKey()))
+	require.NoError(d.SetIdentity([]byte("alice"), nil))
+	_, err = d.Identity([]byte("alice"))
+	assert.Equal(userdb.ErrNoIdentity, err)
+
+	require.NoError(d.Add([]byte("alice"), bob.PublicKey(), true))
+	assert.True(d.IsValid([]byte("alice"), bob.PublicKey()))
+
+	// The database is loaded with its schema and users.
+	s.Close()
+	s = newTestSqlite(t, f, true)
+	defer s.Close()
+	assert.False(s.IsSpoolOnly())
+	d, err = s.UserDB()
+	require.NoError(err)
+	assert.True(d.Exists([]byte("alice")))
+
+	// Removing a user removes the user's spool.
+	sp := s.Spool(spool.Limits{})
+	msg := make([]byte, constants.UserForwardPayloadLength)
+	assert.Equal(userdb.ErrNoSuchUser, sp.StoreMessage([]byte("bob"), msg))
+	require.NoError(sp.StoreMessage([]byte("alice"), msg))
+	require.NoError(d.Remove([]byte("alice")))
+	assert.Equal(userdb.ErrNoSuchUser, d.Remove([]byte("alice")))
+	require.NoError(d.Add([]byte("alice"), alice.PublicKey(), false))
+	m, _, _, err := sp.Get([]byte("alice"), false)
+	require.NoError(err)
+	assert.Nil(m)
+}
+
+func TestSqliteSpool(t *testing.T) {
+	assert, require := assert.New(t), require.New(t)
+
+	s := newTestSqlite(t, ":memory:", true)
+	defer s.Close()
+	assert.True(s.IsSpoolOnly())
+	_, err := s.UserDB()
+	assert.Error(err)
+
+	msgs := make([][]byte, 4)
+	for i := range msgs {
+		msgs[i] = make([]byte, constants.UserForwardPayloadLength)
+		msgs[i][0] = byte(i)
+	}
+	var surbID [sConstants.SURBIDLength]byte
+	surbID[0] = 1
+	surbMsg := make([]byte, sphinx.PayloadTagLength+constants.ForwardPayloadLength)
+
+	// The entries are retrieved in order.
+	sp := s.Spool(spool.Limits{})
+	assert.Error(sp.StoreMessage([]byte("alice"), surbMsg))
+	require.NoError(sp.StoreMessage([]byte("alice"), msgs[0]))
+	require.NoError(sp.StoreSURBReply([]byte("alice"), &surbID, surbMsg))
+	msg, id, remaining, err := sp.Get([]byte("alice"), false)
+	require.NoError(err)
+	assert.Equal(msgs[0], msg)
+	assert.Nil(id)
+	assert.Equal(1, remaining)
+	for i := 0; i < 2; i++ {
+		msg, id, remaining, err = sp.Get([]byte("alice"), i != 1)
+		require.NoError(err)
+		assert.Equal(surbMsg, msg)
+		assert.Equal(surbID[:], id)
+		assert.Equal(0, remaining)
+	}
+	msg, id, remaining, err = sp.Get([]byte("alice"), true)
+	require.NoError(err)
+	assert.Nil(msg)
+	assert.Nil(id)
+	assert.Equal(0, remaining)
+
+	// The quotas are enforced per user.
+	sp = s.Spool(spool.Limits{MaxMessages: 2, TTL: time.Hour})
+	require.NoError(sp.StoreMessage([]byte("alice"), msgs[0]))
+	require.NoError(sp.StoreMessage([]byte("alice"), msgs[1]))
+	assert.Equal(spool.ErrQuotaExceeded, sp.StoreMessage([]byte("alice"), msgs[2]))
+	require.NoError(sp.StoreMessage([]byte("bob"), msgs[2]))
+	sp = s.Spool(spool.Limits{MaxBytes: 2 * constants.UserForwardPayloadLength, DropOldest: true})
+	require.NoError(sp.StoreMessage([]byte("alice"), msgs[3]))
+	msg, _, _, err = sp.Get([]byte("alice"), false)
+	require.NoError(err)
+	assert.Equal(msgs[1], msg)
+
+	// The entries past their TTL expire.
+	sp = s.Spool(spool.Limits{TTL: time.Hour})
+	now := time.Now()
+	sp.(*sqliteSpool).now = func() time.Time { return now.Add(time.Hour) }
+	require.NoError(sp.StoreMessage([]byte("carol"), msgs[0]))
+	n, err := sp.Expire()
+	require.NoError(err)
+	assert.Equal(3, n)
+	msg, _, _, err = sp.Get([]byte("carol"), false)
+	require.NoError(err)
+	assert.Equal(msgs[0], msg)
+
+	// The spools of the removed users are vacuumed.
+	require.NoError(sp.Vacuum(&mockUserDB{users: map[string]bool{"alice": true}}))
+	msg, _, _, err = sp.Get([]byte("carol"), false)
+	require.NoError(err)
+	assert.Nil(msg)
+	require.NoError(sp.Remove([]byte("carol")))
+}
+
+type mockUserDB struct {
+	userdb.UserDB
+	users map[string]bool
+}
+
+func (d *mockUserDB) Exists(u []byte) bool { return d.users[string(u)] }
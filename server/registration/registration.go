@@ -17,6 +17,13 @@
 // Package provides registration protocol constants
 package registration
 
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+
+	"github.com/katzenpost/core/crypto/ecdh"
+)
+
 const (
 	URLBase = "/registration"
 	Version = "0"
@@ -27,8 +34,23 @@ const (
 	UserField        = "user"
 	LinkKeyField     = "link_key"
 	IdentityKeyField = "identity_key"
+	NewLinkKeyField  = "new_link_key"
+	ProofField       = "proof"
 
 	// registration types
 	RegisterLinkCommand            = "register_link_key"
 	RegisterLinkAndIdentityCommand = "register_link_and_identity_key"
+	UpdateLinkCommand              = "update_link_key"
 )
+
+// LinkUpdateProof returns the proof that the user owns its registered link
+// key, authorizing the replacement of the link key by newLinkKey.  The proof
+// is keyed by the shared secret of the registered link key and the Provider
+// link key.
+func LinkUpdateProof(sharedSecret []byte, user string, newLinkKey *ecdh.PublicKey) []byte {
+	mac := hmac.New(sha256.New, sharedSecret)
+	mac.Write([]byte(UpdateLinkCommand))
+	mac.Write([]byte(user))
+	mac.Write(newLinkKey.Bytes())
+	return mac.Sum(nil)
+}
@@ -20,8 +20,12 @@ package boltspool
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"os"
+	"time"
 
+	"github.com/hashcloak/Meson/server/atrest"
 	"github.com/hashcloak/Meson/server/spool"
 	"github.com/hashcloak/Meson/server/userdb"
 	"github.com/katzenpost/core/constants"
@@ -31,13 +35,26 @@ import (
 )
 
 const (
-	usersBucket = "users"
-	msgKey      = "message"
-	surbIDKey   = "surbID"
+	metadataBucket = "metadata"
+	versionKey     = "version"
+	encryptionKey  = "encryption"
+	usersBucket    = "users"
+	namesBucket    = "names"
+	countersBucket = "counters"
+	nameKey        = "name"
+	msgKey         = "message"
+	surbIDKey      = "surbID"
+	storedKey      = "stored"
+
+	versionPlaintext = 0
+	versionEncrypted = 1
 )
 
 type boltSpool struct {
-	db *bolt.DB
+	db     *bolt.DB
+	key    *atrest.Key
+	limits spool.Limits
+	now    func() time.Time
 }
 
 func (s *boltSpool) Close() {
@@ -68,37 +85,148 @@ func (s *boltSpool) doStore(u []byte, id *[sConstants.SURBIDLength]byte, msg []b
 		return fmt.Errorf("spool: invalid username: `%v`", u)
 	}
 
+	var surbID []byte
+	if id != nil {
+		surbID = id[:]
+	}
 	return s.db.Update(func(tx *bolt.Tx) error {
-		// Grab the `users` bucket.
-		uBkt := tx.Bucket([]byte(usersBucket))
+		return s.store(tx, u, surbID, msg, s.now())
+	})
+}
 
-		// Grab or create the user's spool bucket.
-		sBkt, err := uBkt.CreateBucketIfNotExists(u)
-		if err != nil {
-			return err
-		}
+func (s *boltSpool) store(tx *bolt.Tx, u, surbID, msg []byte, stored time.Time) error {
+	// Grab the `users` bucket.
+	uBkt := tx.Bucket([]byte(usersBucket))
 
-		// Allocate a unique identifier for this message.
-		seq, err := sBkt.NextSequence()
-		if err != nil {
-			return err
-		}
-		var msgID [8]byte
-		binary.BigEndian.PutUint64(msgID[:], seq)
+	// Grab or create the user's spool bucket.
+	uKey := s.userKey(u)
+	sBkt, err := uBkt.CreateBucketIfNotExists(uKey)
+	if err != nil {
+		return err
+	}
 
-		// Create a bucket for this message.
-		mBkt, err := sBkt.CreateBucket(msgID[:])
-		if err != nil {
-			return err
+	// Keep the sealed user name, for Vacuum().
+	if s.key != nil {
+		nBkt := tx.Bucket([]byte(namesBucket))
+		if nBkt.Get(uKey) == nil {
+			if err = nBkt.Put(uKey, s.seal(uKey, nil, nameKey, u)); err != nil {
+				return err
+			}
 		}
+	}
+
+	// Make room for this message, if the user's spool is at its quota.
+	count, size := s.tally(tx, uKey, sBkt)
+	if err = s.makeRoom(sBkt, &count, &size, len(msg)); err != nil {
+		return err
+	}
+
+	// Allocate a unique identifier for this message.
+	seq, err := sBkt.NextSequence()
+	if err != nil {
+		return err
+	}
+	var msgID [8]byte
+	binary.BigEndian.PutUint64(msgID[:], seq)
 
-		// Store the message and (optional) SURB ID.
-		_ = mBkt.Put([]byte(msgKey), msg)
-		if id != nil {
-			_ = mBkt.Put([]byte(surbIDKey), id[:])
+	// Create a bucket for this message.
+	mBkt, err := sBkt.CreateBucket(msgID[:])
+	if err != nil {
+		return err
+	}
+
+	// Store the message, (optional) SURB ID, and the time of storage.
+	_ = mBkt.Put([]byte(msgKey), s.seal(uKey, msgID[:], msgKey, msg))
+	if surbID != nil {
+		_ = mBkt.Put([]byte(surbIDKey), s.seal(uKey, msgID[:], surbIDKey, surbID))
+	}
+	_ = mBkt.Put([]byte(storedKey), s.seal(uKey, msgID[:], storedKey, encodeTime(stored)))
+	return s.setTally(tx, uKey, count+1, size+len(msg))
+}
+
+// userKey returns the key of the user's spool bucket, which is the user name
+// unless the spool is encrypted.
+func (s *boltSpool) userKey(u []byte) []byte {
+	if s.key == nil {
+		return u
+	}
+	return s.key.ID(u)
+}
+
+// seal returns the stored value of a field of a message, or of the user's
+// spool if mKey is nil.
+func (s *boltSpool) seal(uKey, mKey []byte, field string, v []byte) []byte {
+	if s.key == nil {
+		return v
+	}
+	return s.key.Seal(v, recordAD(uKey, mKey, field))
+}
+
+// open returns the value of a field of a message from its stored value.
+func (s *boltSpool) open(uKey, mKey []byte, field string, v []byte) ([]byte, error) {
+	if s.key == nil || v == nil {
+		return v, nil
+	}
+	return s.key.Open(v, recordAD(uKey, mKey, field))
+}
+
+// msgSize returns the size of a message from its stored value.
+func (s *boltSpool) msgSize(v []byte) int {
+	if s.key == nil || len(v) < atrest.Overhead {
+		return len(v)
+	}
+	return len(v) - atrest.Overhead
+}
+
+func recordAD(uKey, mKey []byte, field string) []byte {
+	ad := make([]byte, 0, len(uKey)+len(mKey)+len(field))
+	ad = append(ad, uKey...)
+	ad = append(ad, mKey...)
+	return append(ad, field...)
+}
+
+// tally returns the number of entries of the user's spool and their total
+// size.  The spools created by older versions have no counters, so they are
+// tallied the first time.
+func (s *boltSpool) tally(tx *bolt.Tx, uKey []byte, sBkt *bolt.Bucket) (count, size int) {
+	if b := tx.Bucket([]byte(countersBucket)).Get(uKey); len(b) == 16 {
+		return int(binary.BigEndian.Uint64(b[:8])), int(binary.BigEndian.Uint64(b[8:]))
+	}
+	if sBkt == nil {
+		return 0, 0
+	}
+	cur := sBkt.Cursor()
+	for mKey, _ := cur.First(); mKey != nil; mKey, _ = cur.Next() {
+		count++
+		size += s.msgSize(sBkt.Bucket(mKey).Get([]byte(msgKey)))
+	}
+	return count, size
+}
+
+// setTally updates the counters of the user's spool.
+func (s *boltSpool) setTally(tx *bolt.Tx, uKey []byte, count, size int) error {
+	var b [16]byte
+	binary.BigEndian.PutUint64(b[:8], uint64(count))
+	binary.BigEndian.PutUint64(b[8:], uint64(size))
+	return tx.Bucket([]byte(countersBucket)).Put(uKey, b[:])
+}
+
+// makeRoom drops the oldest entries of the user's spool until an entry of
+// size n fits in its quota, updating count and size accordingly.
+func (s *boltSpool) makeRoom(sBkt *bolt.Bucket, count, size *int, n int) error {
+	cur := sBkt.Cursor()
+	for s.limits.IsQuotaExceeded(*count, *size, n) {
+		mKey, _ := cur.First()
+		if !s.limits.DropOldest || mKey == nil {
+			return spool.ErrQuotaExceeded
 		}
-		return nil
-	})
+		*size -= s.msgSize(sBkt.Bucket(mKey).Get([]byte(msgKey)))
+		*count--
+		if err := sBkt.DeleteBucket(mKey); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (s *boltSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining int, err error) {
@@ -123,7 +251,8 @@ func (s *boltSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining i
 	uBkt := tx.Bucket([]byte(usersBucket))
 
 	// Grab the user's spool bucket.
-	sBkt := uBkt.Bucket(u)
+	uKey := s.userKey(u)
+	sBkt := uBkt.Bucket(uKey)
 	if sBkt == nil {
 		// If the user's spool bucket is missing, the spool is empty.
 		return
@@ -145,9 +274,14 @@ func (s *boltSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining i
 
 	if advance {
 		// Delete the 0th message.
+		count, size := s.tally(tx, uKey, sBkt)
+		size -= s.msgSize(sBkt.Bucket(mKey).Get([]byte(msgKey)))
 		if err = sBkt.DeleteBucket(mKey); err != nil {
 			return
 		}
+		if err = s.setTally(tx, uKey, count-1, size); err != nil {
+			return
+		}
 
 		if next == nil {
 			// Deleting the message drained the queue.
@@ -167,11 +301,19 @@ func (s *boltSpool) Get(u []byte, advance bool) (msg, surbID []byte, remaining i
 
 	// Retrieve the stored message and (optional) SURB ID.
 	mBkt := sBkt.Bucket(mKey)
-	if m := mBkt.Get([]byte(msgKey)); m != nil {
+	m, err := s.open(uKey, mKey, msgKey, mBkt.Get([]byte(msgKey)))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if m != nil {
 		msg = make([]byte, 0, len(m))
 		msg = append(msg, m...)
 	}
-	if id := mBkt.Get([]byte(surbIDKey)); id != nil {
+	id, err := s.open(uKey, mKey, surbIDKey, mBkt.Get([]byte(surbIDKey)))
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	if id != nil {
 		surbID = make([]byte, 0, len(id))
 		surbID = append(surbID, id...)
 	}
@@ -189,13 +331,22 @@ func (s *boltSpool) Remove(u []byte) error {
 		uBkt := tx.Bucket([]byte(usersBucket))
 
 		// Grab the user's spool bucket.
-		sBkt := uBkt.Bucket(u)
+		uKey := s.userKey(u)
+		sBkt := uBkt.Bucket(uKey)
 		if sBkt == nil {
 			// If the user's spool bucket is missing, just return.
 			return nil
 		}
 
-		return uBkt.DeleteBucket(u)
+		if s.key != nil {
+			if err := tx.Bucket([]byte(namesBucket)).Delete(uKey); err != nil {
+				return err
+			}
+		}
+		if err := tx.Bucket([]byte(countersBucket)).Delete(uKey); err != nil {
+			return err
+		}
+		return uBkt.DeleteBucket(uKey)
 	})
 }
 
@@ -205,13 +356,32 @@ func (s *boltSpool) Vacuum(udb userdb.UserDB) error {
 		uBkt := tx.Bucket([]byte(usersBucket))
 
 		cur := uBkt.Cursor()
-		for u, _ := cur.First(); u != nil; u, _ = cur.Next() {
+		for uKey, _ := cur.First(); uKey != nil; uKey, _ = cur.Next() {
+			// The user names of an encrypted spool are sealed in the
+			// `names` bucket.
+			u := uKey
+			if s.key != nil {
+				var err error
+				nBkt := tx.Bucket([]byte(namesBucket))
+				if u, err = s.open(uKey, nil, nameKey, nBkt.Get(uKey)); err != nil {
+					return err
+				}
+			}
+
 			// Note: If the provided UserDB doesn't do something intelligent
 			// like cache the valid users, this will really suck.
-			if udb.Exists(u) {
+			if u != nil && udb.Exists(u) {
 				continue
 			}
-			if err := uBkt.DeleteBucket(u); err != nil {
+			if s.key != nil {
+				if err := tx.Bucket([]byte(namesBucket)).Delete(uKey); err != nil {
+					return err
+				}
+			}
+			if err := tx.Bucket([]byte(countersBucket)).Delete(uKey); err != nil {
+				return err
+			}
+			if err := uBkt.DeleteBucket(uKey); err != nil {
 				return err
 			}
 		}
@@ -219,16 +389,101 @@ func (s *boltSpool) Vacuum(udb userdb.UserDB) error {
 	})
 }
 
-// New creates (or loads) a user message spool with the given file name f.
-func New(f string) (spool.Spool, error) {
-	const (
-		metadataBucket = "metadata"
-		versionKey     = "version"
-	)
+func (s *boltSpool) Expire() (int, error) {
+	if s.limits.TTL <= 0 {
+		return 0, nil
+	}
+
+	now := s.now()
+	expired := 0
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		// Grab the `users` bucket.
+		uBkt := tx.Bucket([]byte(usersBucket))
+
+		cur := uBkt.Cursor()
+		for uKey, _ := cur.First(); uKey != nil; uKey, _ = cur.Next() {
+			sBkt := uBkt.Bucket(uKey)
+			if sBkt == nil {
+				continue
+			}
+
+			// The messages are stored in order, so the expired ones are
+			// at the head of the user's spool.
+			count, size := s.tally(tx, uKey, sBkt)
+			before := count
+			sCur := sBkt.Cursor()
+			mKey, _ := sCur.First()
+			for mKey != nil {
+				mBkt := sBkt.Bucket(mKey)
+				b, err := s.open(uKey, mKey, storedKey, mBkt.Get([]byte(storedKey)))
+				if err != nil {
+					return err
+				}
+				stored, ok := decodeTime(b)
+				if !ok {
+					// Entries spooled by older versions have no time of
+					// storage, so start their TTL now.
+					if err = mBkt.Put([]byte(storedKey), s.seal(uKey, mKey, storedKey, encodeTime(now))); err != nil {
+						return err
+					}
+					mKey, _ = sCur.Next()
+					continue
+				}
+				if now.Sub(stored) < s.limits.TTL {
+					break
+				}
+				size -= s.msgSize(mBkt.Get([]byte(msgKey)))
+				count--
+				if err = sBkt.DeleteBucket(mKey); err != nil {
+					return err
+				}
+				expired++
+				mKey, _ = sCur.Seek(mKey)
+			}
+			if first, _ := sCur.First(); first == nil {
+				_ = sBkt.SetSequence(0) // Don't keep a lifetime message count.
+			}
+			if count != before {
+				if err := s.setTally(tx, uKey, count, size); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return expired, nil
+}
+
+func encodeTime(t time.Time) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], uint64(t.UnixNano()))
+	return b[:]
+}
+
+func decodeTime(b []byte) (time.Time, bool) {
+	if len(b) != 8 {
+		return time.Time{}, false
+	}
+	return time.Unix(0, int64(binary.BigEndian.Uint64(b))), true
+}
+
+// New creates (or loads) a user message spool with the given file name f,
+// enforcing the given limits.  If secret is not nil, the spool is encrypted
+// with a key derived from it.
+func New(f string, limits spool.Limits, secret *atrest.Secret) (spool.Spool, error) {
+	return newBoltSpool(f, limits, secret)
+}
 
+func newBoltSpool(f string, limits spool.Limits, secret *atrest.Secret) (*boltSpool, error) {
 	var err error
 
-	s := new(boltSpool)
+	s := &boltSpool{
+		limits: limits,
+		now:    time.Now,
+	}
 	s.db, err = bolt.Open(f, 0600, nil)
 	if err != nil {
 		return nil, err
@@ -240,20 +495,53 @@ func New(f string) (spool.Spool, error) {
 		if err != nil {
 			return err
 		}
-		if _, err = tx.CreateBucketIfNotExists([]byte(usersBucket)); err != nil {
+		uBkt, err := tx.CreateBucketIfNotExists([]byte(usersBucket))
+		if err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists([]byte(countersBucket)); err != nil {
 			return err
 		}
 
 		if b := bkt.Get([]byte(versionKey)); b != nil {
 			// Well it looks like we loaded as opposed to created.
-			if len(b) != 1 || b[0] != 0 {
+			if len(b) != 1 {
+				return fmt.Errorf("spool: incompatible version: %d", uint(b[0]))
+			}
+			switch b[0] {
+			case versionPlaintext:
+				if secret == nil {
+					return nil
+				}
+				if k, _ := uBkt.Cursor().First(); k != nil {
+					return errors.New("spool: database is not encrypted, it must be migrated")
+				}
+				// The spool is empty, so just encrypt it from now on.
+			case versionEncrypted:
+				if secret == nil {
+					return errors.New("spool: database is encrypted, but no key is configured")
+				}
+				s.key, err = secret.LoadKey(bkt.Get([]byte(encryptionKey)))
+				return err
+			default:
 				return fmt.Errorf("spool: incompatible version: %d", uint(b[0]))
 			}
-			return nil
 		}
 
 		// We created a new database, so populate the new `metadata` bucket.
-		_ = bkt.Put([]byte(versionKey), []byte{0})
+		if secret == nil {
+			_ = bkt.Put([]byte(versionKey), []byte{versionPlaintext})
+			return nil
+		}
+		var header []byte
+		if s.key, header, err = secret.NewKey(); err != nil {
+			return err
+		}
+		if _, err = tx.CreateBucketIfNotExists([]byte(namesBucket)); err != nil {
+			return err
+		}
+		_ = bkt.Put([]byte(encryptionKey), header)
+		_ = bkt.Put([]byte(versionKey), []byte{versionEncrypted})
 
 		return nil
 	}); err != nil {
@@ -264,3 +552,57 @@ func New(f string) (spool.Spool, error) {
 
 	return s, nil
 }
+
+// Encrypt converts the plaintext user message spool with the given file name
+// f into a spool encrypted with a key derived from secret.  The plaintext
+// spool is overwritten once replaced, as far as atrest.Replace can.
+func Encrypt(f string, secret *atrest.Secret) error {
+	src, err := bolt.Open(f, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Build the encrypted spool next to the plaintext one.
+	tmp := f + ".encrypted"
+	if _, err = os.Stat(tmp); err == nil {
+		return fmt.Errorf("spool: '%v' already exists", tmp)
+	}
+	dst, err := newBoltSpool(tmp, spool.Limits{}, secret)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if err = src.View(func(srcTx *bolt.Tx) error {
+		if b := srcTx.Bucket([]byte(metadataBucket)).Get([]byte(versionKey)); len(b) != 1 || b[0] != versionPlaintext {
+			return errors.New("spool: database is not a plaintext spool")
+		}
+		return dst.db.Update(func(tx *bolt.Tx) error {
+			// Copy the messages of each user's spool in order.
+			return srcTx.Bucket([]byte(usersBucket)).ForEach(func(u, _ []byte) error {
+				sBkt := srcTx.Bucket([]byte(usersBucket)).Bucket(u)
+				return sBkt.ForEach(func(mKey, _ []byte) error {
+					mBkt := sBkt.Bucket(mKey)
+					stored, ok := decodeTime(mBkt.Get([]byte(storedKey)))
+					if !ok {
+						stored = now
+					}
+					return dst.store(tx, u, mBkt.Get([]byte(surbIDKey)), mBkt.Get([]byte(msgKey)), stored)
+				})
+			})
+		})
+	}); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	dst.Close()
+	src.Close()
+	if err = atrest.Replace(tmp, f); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
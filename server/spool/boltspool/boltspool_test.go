@@ -17,17 +17,23 @@
 package boltspool
 
 import (
+	"bytes"
 	"crypto/rand"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/hashcloak/Meson/server/atrest"
+	"github.com/hashcloak/Meson/server/spool"
+	"github.com/hashcloak/Meson/server/userdb"
 	"github.com/katzenpost/core/constants"
 	"github.com/katzenpost/core/sphinx"
 	sConstants "github.com/katzenpost/core/sphinx/constants"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	bolt "go.etcd.io/bbolt"
 )
 
 const (
@@ -74,7 +80,7 @@ func doTestCreate(t *testing.T) {
 	require := require.New(t)
 	assert := assert.New(t)
 
-	s, err := New(testSpoolPath)
+	s, err := New(testSpoolPath, spool.Limits{}, nil)
 	require.NoError(err, "New()")
 	defer s.Close()
 
@@ -89,7 +95,7 @@ func doTestLoad(t *testing.T) {
 	require := require.New(t)
 	assert := assert.New(t)
 
-	s, err := New(testSpoolPath)
+	s, err := New(testSpoolPath, spool.Limits{}, nil)
 	require.NoError(err, "New()")
 	defer s.Close()
 
@@ -123,6 +129,165 @@ func doTestLoad(t *testing.T) {
 	assert.NoError(err, "Delete(u)")
 }
 
+func TestBoltSpoolLimits(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "boltspool_limits_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+
+	msgs := make([][]byte, 4)
+	for i := range msgs {
+		msgs[i] = make([]byte, constants.UserForwardPayloadLength)
+		msgs[i][0] = byte(i)
+	}
+	head := func(s spool.Spool, u string) []byte {
+		msg, _, _, err := s.Get([]byte(u), false)
+		require.NoError(err, "Get()")
+		return msg
+	}
+
+	// Reject new messages once the quota is hit.
+	limits := spool.Limits{MaxMessages: 2, TTL: time.Hour}
+	s, err := New(filepath.Join(dir, "reject.db"), limits, nil)
+	require.NoError(err, "New()")
+	defer s.Close()
+	for _, msg := range msgs[:2] {
+		require.NoError(s.StoreMessage([]byte(testUser), msg), "StoreMessage()")
+	}
+	assert.Equal(spool.ErrQuotaExceeded, s.StoreMessage([]byte(testUser), msgs[2]))
+	assert.Equal(msgs[0], head(s, testUser))
+	err = s.StoreSURBReply([]byte("other"), &testSurbID, make([]byte, sphinx.PayloadTagLength+constants.ForwardPayloadLength))
+	assert.NoError(err, "the quotas are per user")
+
+	// Expire the messages past their TTL.
+	now := time.Now()
+	s.(*boltSpool).now = func() time.Time { return now.Add(time.Hour) }
+	require.NoError(s.StoreMessage([]byte("third"), msgs[3]), "StoreMessage()")
+	n, err := s.Expire()
+	require.NoError(err, "Expire()")
+	assert.Equal(3, n, "Expire()")
+	assert.Nil(head(s, testUser))
+	assert.Equal(msgs[3], head(s, "third"))
+
+	// The quotas are tracked as the entries are retrieved or expired, and
+	// recovered for the spools without counters.
+	for _, msg := range msgs[:2] {
+		require.NoError(s.StoreMessage([]byte(testUser), msg), "StoreMessage()")
+	}
+	_, _, _, err = s.Get([]byte(testUser), true)
+	require.NoError(err, "Get()")
+	require.NoError(s.StoreMessage([]byte(testUser), msgs[2]), "StoreMessage()")
+	err = s.(*boltSpool).db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(countersBucket)).Delete([]byte(testUser))
+	})
+	require.NoError(err, "Update()")
+	assert.Equal(spool.ErrQuotaExceeded, s.StoreMessage([]byte(testUser), msgs[3]))
+
+	// Drop the oldest messages once the quota is hit.
+	limits = spool.Limits{MaxBytes: 3 * constants.UserForwardPayloadLength, DropOldest: true}
+	s, err = New(filepath.Join(dir, "drop.db"), limits, nil)
+	require.NoError(err, "New()")
+	defer s.Close()
+	for _, msg := range msgs {
+		require.NoError(s.StoreMessage([]byte(testUser), msg), "StoreMessage()")
+	}
+	assert.Equal(msgs[1], head(s, testUser))
+	n, err = s.Expire()
+	assert.NoError(err, "Expire()")
+	assert.Zero(n, "Expire() without a TTL")
+
+	// Entries larger than the quota are rejected regardless.
+	s.(*boltSpool).limits.MaxBytes = constants.UserForwardPayloadLength - 1
+	assert.Equal(spool.ErrQuotaExceeded, s.StoreMessage([]byte(testUser), msgs[0]))
+}
+
+type mockUserDB struct {
+	userdb.UserDB
+	users map[string]bool
+}
+
+func (d *mockUserDB) Exists(u []byte) bool { return d.users[string(u)] }
+
+func TestBoltSpoolEncrypt(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "boltspool_encrypt_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, testSpool)
+	keyFile := filepath.Join(dir, "spool.key")
+	key := make([]byte, atrest.MinKeyFileSize)
+	_, err = rand.Read(key)
+	require.NoError(err, "rand.Read(key)")
+	require.NoError(ioutil.WriteFile(keyFile, key, 0600), "WriteFile(key)")
+
+	msg := make([]byte, constants.UserForwardPayloadLength)
+	_, err = rand.Read(msg)
+	require.NoError(err, "rand.Read(msg)")
+	surbMsg := make([]byte, sphinx.PayloadTagLength+constants.ForwardPayloadLength)
+	_, err = rand.Read(surbMsg)
+	require.NoError(err, "rand.Read(surbMsg)")
+
+	// Populate a plaintext spool.
+	s, err := New(f, spool.Limits{}, nil)
+	require.NoError(err, "New()")
+	require.NoError(s.StoreMessage([]byte(testUser), msg), "StoreMessage()")
+	require.NoError(s.StoreSURBReply([]byte(testUser), &testSurbID, surbMsg), "StoreSURBReply()")
+	require.NoError(s.StoreMessage([]byte("removed"), msg), "StoreMessage()")
+	s.Close()
+
+	// Migrate it, and ensure that the user names are no longer stored.
+	secret, err := atrest.NewKeyFileSecret(keyFile)
+	require.NoError(err, "NewKeyFileSecret()")
+	_, err = New(f, spool.Limits{}, secret)
+	assert.Error(err, "New() with a key for a plaintext spool")
+	require.NoError(Encrypt(f, secret), "Encrypt()")
+	b, err := ioutil.ReadFile(f)
+	require.NoError(err, "ReadFile()")
+	assert.False(bytes.Contains(b, []byte(testUser)), "user name in the encrypted spool")
+	assert.False(bytes.Contains(b, msg), "message in the encrypted spool")
+	_, err = New(f, spool.Limits{}, nil)
+	assert.Error(err, "New() without a key for an encrypted spool")
+
+	// The messages are retrieved in order.
+	s, err = New(f, spool.Limits{MaxMessages: 2, TTL: time.Hour}, secret)
+	require.NoError(err, "New() with the key")
+	defer s.Close()
+	m, id, remaining, err := s.Get([]byte(testUser), false)
+	require.NoError(err, "Get()")
+	assert.Equal(msg, m)
+	assert.Nil(id)
+	assert.Equal(1, remaining)
+	m, id, remaining, err = s.Get([]byte(testUser), true)
+	require.NoError(err, "Get()")
+	assert.Equal(surbMsg, m)
+	assert.Equal(testSurbID[:], id)
+	assert.Equal(0, remaining)
+
+	// The limits are enforced on the encrypted entries.
+	require.NoError(s.StoreMessage([]byte(testUser), msg), "StoreMessage()")
+	assert.Equal(spool.ErrQuotaExceeded, s.StoreMessage([]byte(testUser), msg))
+	now := time.Now()
+	s.(*boltSpool).now = func() time.Time { return now.Add(2 * time.Hour) }
+	n, err := s.Expire()
+	require.NoError(err, "Expire()")
+	assert.Equal(3, n, "Expire()")
+
+	// The spools of the removed users are vacuumed by their user name.
+	require.NoError(s.StoreMessage([]byte(testUser), msg), "StoreMessage()")
+	require.NoError(s.StoreMessage([]byte("removed"), msg), "StoreMessage()")
+	require.NoError(s.Vacuum(&mockUserDB{users: map[string]bool{testUser: true}}), "Vacuum()")
+	m, _, _, err = s.Get([]byte(testUser), false)
+	require.NoError(err, "Get()")
+	assert.Equal(msg, m)
+	m, _, _, err = s.Get([]byte("removed"), false)
+	require.NoError(err, "Get()")
+	assert.Nil(m)
+}
+
 func init() {
 	var err error
 	tmpDir, err = ioutil.TempDir("", "boltspool_tests")
@@ -19,10 +19,48 @@
 package spool
 
 import (
+	"errors"
+	"time"
+
 	"github.com/hashcloak/Meson/server/userdb"
 	"github.com/katzenpost/core/sphinx/constants"
 )
 
+// ErrQuotaExceeded is the error returned when storing an entry would exceed
+// the quota of the user's spool, and the quota is not enforced by dropping
+// the oldest entries.
+var ErrQuotaExceeded = errors.New("spool: user quota exceeded")
+
+// Limits are the limits of the user spools.  The zero value is unlimited.
+type Limits struct {
+	// TTL is the duration after which a stored entry expires, and is
+	// removed by Expire.
+	TTL time.Duration
+
+	// MaxMessages is the maximum number of entries in a user's spool.
+	MaxMessages int
+
+	// MaxBytes is the maximum total size of the entries in a user's spool.
+	MaxBytes int
+
+	// DropOldest enforces the quotas by dropping the oldest entries of the
+	// user's spool to make room for the new one, instead of rejecting it.
+	//
+	// Note: Get advances the spool by position, so a client may lose an
+	// entry it has not seen yet when the oldest one is dropped while being
+	// retrieved.
+	DropOldest bool
+}
+
+// IsQuotaExceeded returns true iff an entry of size n can not be added to a
+// spool of count entries totalling size bytes.
+func (l *Limits) IsQuotaExceeded(count, size, n int) bool {
+	if l.MaxMessages > 0 && count+1 > l.MaxMessages {
+		return true
+	}
+	return l.MaxBytes > 0 && size+n > l.MaxBytes
+}
+
 // Spool is the interface provided by all user messgage spool implementations.
 type Spool interface {
 	// StoreMessage stores a message in the user's spool.
@@ -42,6 +80,10 @@ type Spool interface {
 	// provided UserDB.
 	Vacuum(udb userdb.UserDB) error
 
+	// Expire removes the entries stored for longer than the TTL of the
+	// spool, and returns the number of entries removed.
+	Expire() (int, error)
+
 	// Close closes the Spool instance.
 	Close()
 }
@@ -20,32 +20,68 @@ package boltuserdb
 
 import (
 	"crypto/subtle"
+	"errors"
 	"fmt"
+	"os"
 	"sync"
 
+	"github.com/hashcloak/Meson/server/atrest"
 	"github.com/hashcloak/Meson/server/userdb"
 	"github.com/katzenpost/core/crypto/ecdh"
 	bolt "go.etcd.io/bbolt"
 )
 
 const (
+	metadataBucket   = "metadata"
+	versionKey       = "version"
+	encryptionKey    = "encryption"
 	usersBucket      = "users"
 	identitiesBucket = "identities"
+
+	versionPlaintext = 0
+	versionEncrypted = 1
 )
 
 type boltUserDB struct {
 	sync.RWMutex
 
 	db        *bolt.DB
+	key       *atrest.Key
 	userCache map[[userdb.MaxUsernameSize]byte]bool
 }
 
+// userKey returns the key of the user's entries, which is the user name
+// unless the database is encrypted.
+func (d *boltUserDB) userKey(u []byte) []byte {
+	if d.key == nil {
+		return u
+	}
+	return d.key.ID(u)
+}
+
+// get returns the value of the user's entry in the bucket bkt.
+func (d *boltUserDB) get(tx *bolt.Tx, bkt string, uKey []byte) ([]byte, error) {
+	v := tx.Bucket([]byte(bkt)).Get(uKey)
+	if d.key == nil || v == nil {
+		return v, nil
+	}
+	return d.key.Open(v, append(append([]byte{}, uKey...), bkt...))
+}
+
+// put sets the value of the user's entry in the bucket bkt.
+func (d *boltUserDB) put(tx *bolt.Tx, bkt string, uKey, v []byte) error {
+	if d.key != nil {
+		v = d.key.Seal(v, append(append([]byte{}, uKey...), bkt...))
+	}
+	return tx.Bucket([]byte(bkt)).Put(uKey, v)
+}
+
 func (d *boltUserDB) Exists(u []byte) bool {
 	if !userOk(u) {
 		return false
 	}
 
-	k := userToCacheKey(u)
+	k := userToCacheKey(d.userKey(u))
 
 	d.RLock()
 	defer d.RUnlock()
@@ -62,10 +98,11 @@ func (d *boltUserDB) IsValid(u []byte, k *ecdh.PublicKey) bool {
 	// keys match.
 	isValid := false
 	if err := d.db.View(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket([]byte(usersBucket))
-
 		// If the user exists in the `users` bucket, then compare public keys.
-		rawPubKey := bkt.Get(u)
+		rawPubKey, err := d.get(tx, usersBucket, d.userKey(u))
+		if err != nil {
+			return err
+		}
 		if rawPubKey != nil {
 			isValid = subtle.ConstantTimeCompare(rawPubKey, k.Bytes()) == 1
 		}
@@ -94,12 +131,12 @@ func (d *boltUserDB) Add(u []byte, k *ecdh.PublicKey, update bool) error {
 		}
 	}
 
+	uKey := d.userKey(u)
 	err := d.db.Update(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket([]byte(usersBucket))
-		return bkt.Put(u, k.Bytes())
+		return d.put(tx, usersBucket, uKey, k.Bytes())
 	})
 	if err == nil {
-		k := userToCacheKey(u)
+		k := userToCacheKey(uKey)
 
 		d.Lock()
 		defer d.Unlock()
@@ -115,17 +152,17 @@ func (d *boltUserDB) SetIdentity(u []byte, k *ecdh.PublicKey) error {
 		return fmt.Errorf("userdb: invalid username: `%v`", u)
 	}
 
+	uKey := d.userKey(u)
 	return d.db.Update(func(tx *bolt.Tx) error {
 		uBkt := tx.Bucket([]byte(usersBucket))
-		if uEnt := uBkt.Get(u); uEnt == nil {
+		if uEnt := uBkt.Get(uKey); uEnt == nil {
 			return userdb.ErrNoSuchUser
 		}
 
-		iBkt := tx.Bucket([]byte(identitiesBucket))
 		if k == nil {
-			return iBkt.Delete(u)
+			return tx.Bucket([]byte(identitiesBucket)).Delete(uKey)
 		}
-		return iBkt.Put(u, k.Bytes())
+		return d.put(tx, identitiesBucket, uKey, k.Bytes())
 	})
 }
 
@@ -139,8 +176,10 @@ func (d *boltUserDB) Link(u []byte) (*ecdh.PublicKey, error) {
 
 	var pubKey *ecdh.PublicKey
 	err := d.db.View(func(tx *bolt.Tx) error {
-		bkt := tx.Bucket([]byte(usersBucket))
-		rawPubKey := bkt.Get(u)
+		rawPubKey, err := d.get(tx, usersBucket, d.userKey(u))
+		if err != nil {
+			return err
+		}
 		if rawPubKey == nil {
 			return fmt.Errorf("userdb: user %s does not have a link key", u)
 		}
@@ -156,14 +195,17 @@ func (d *boltUserDB) Identity(u []byte) (*ecdh.PublicKey, error) {
 	}
 
 	var pubKey *ecdh.PublicKey
+	uKey := d.userKey(u)
 	err := d.db.View(func(tx *bolt.Tx) error {
 		uBkt := tx.Bucket([]byte(usersBucket))
-		if uEnt := uBkt.Get(u); uEnt == nil {
+		if uEnt := uBkt.Get(uKey); uEnt == nil {
 			return userdb.ErrNoSuchUser
 		}
 
-		iBkt := tx.Bucket([]byte(identitiesBucket))
-		rawPubKey := iBkt.Get(u)
+		rawPubKey, err := d.get(tx, identitiesBucket, uKey)
+		if err != nil {
+			return err
+		}
 		if rawPubKey == nil {
 			return userdb.ErrNoIdentity
 		}
@@ -180,17 +222,18 @@ func (d *boltUserDB) Remove(u []byte) error {
 		return fmt.Errorf("userdb: invalid username: `%v`", u)
 	}
 
+	uKey := d.userKey(u)
 	err := d.db.Update(func(tx *bolt.Tx) error {
 		bkt := tx.Bucket([]byte(usersBucket))
 
 		// Delete the user's entry iff it exists.
-		if ent := bkt.Get(u); ent == nil {
+		if ent := bkt.Get(uKey); ent == nil {
 			return userdb.ErrNoSuchUser
 		}
-		return bkt.Delete(u)
+		return bkt.Delete(uKey)
 	})
 	if err == nil {
-		k := userToCacheKey(u)
+		k := userToCacheKey(uKey)
 
 		d.Lock()
 		defer d.Unlock()
@@ -205,13 +248,13 @@ func (d *boltUserDB) Close() {
 	d.db.Close()
 }
 
-// New creates (or loads) a user database with the given file name f.
-func New(f string) (userdb.UserDB, error) {
-	const (
-		metadataBucket = "metadata"
-		versionKey     = "version"
-	)
+// New creates (or loads) a user database with the given file name f.  If
+// secret is not nil, the database is encrypted with a key derived from it.
+func New(f string, secret *atrest.Secret) (userdb.UserDB, error) {
+	return newBoltUserDB(f, secret)
+}
 
+func newBoltUserDB(f string, secret *atrest.Secret) (*boltUserDB, error) {
 	var err error
 
 	d := new(boltUserDB)
@@ -237,7 +280,26 @@ func New(f string) (userdb.UserDB, error) {
 
 		if b := bkt.Get([]byte(versionKey)); b != nil {
 			// Well it looks like we loaded as opposed to created.
-			if len(b) != 1 || b[0] != 0 {
+			if len(b) != 1 {
+				return fmt.Errorf("userdb: incompatible version: %d", uint(b[0]))
+			}
+			switch b[0] {
+			case versionPlaintext:
+				if secret != nil {
+					if k, _ := uBkt.Cursor().First(); k != nil {
+						return errors.New("userdb: database is not encrypted, it must be migrated")
+					}
+					// The database is empty, so just encrypt it from now on.
+					return d.initEncryption(bkt, secret)
+				}
+			case versionEncrypted:
+				if secret == nil {
+					return errors.New("userdb: database is encrypted, but no key is configured")
+				}
+				if d.key, err = secret.LoadKey(bkt.Get([]byte(encryptionKey))); err != nil {
+					return err
+				}
+			default:
 				return fmt.Errorf("userdb: incompatible version: %d", uint(b[0]))
 			}
 
@@ -252,7 +314,10 @@ func New(f string) (userdb.UserDB, error) {
 		}
 
 		// We created a new database, so populate the new `metadata` bucket.
-		_ = bkt.Put([]byte(versionKey), []byte{0})
+		if secret != nil {
+			return d.initEncryption(bkt, secret)
+		}
+		_ = bkt.Put([]byte(versionKey), []byte{versionPlaintext})
 
 		return nil
 	}); err != nil {
@@ -264,6 +329,68 @@ func New(f string) (userdb.UserDB, error) {
 	return d, nil
 }
 
+func (d *boltUserDB) initEncryption(bkt *bolt.Bucket, secret *atrest.Secret) error {
+	var (
+		header []byte
+		err    error
+	)
+	if d.key, header, err = secret.NewKey(); err != nil {
+		return err
+	}
+	_ = bkt.Put([]byte(encryptionKey), header)
+	_ = bkt.Put([]byte(versionKey), []byte{versionEncrypted})
+	return nil
+}
+
+// Encrypt converts the plaintext user database with the given file name f
+// into a database encrypted with a key derived from secret.  The plaintext
+// database is overwritten once replaced, as far as atrest.Replace can.
+func Encrypt(f string, secret *atrest.Secret) error {
+	src, err := bolt.Open(f, 0600, &bolt.Options{ReadOnly: true})
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// Build the encrypted database next to the plaintext one.
+	tmp := f + ".encrypted"
+	if _, err = os.Stat(tmp); err == nil {
+		return fmt.Errorf("userdb: '%v' already exists", tmp)
+	}
+	dst, err := newBoltUserDB(tmp, secret)
+	if err != nil {
+		return err
+	}
+
+	if err = src.View(func(srcTx *bolt.Tx) error {
+		if b := srcTx.Bucket([]byte(metadataBucket)).Get([]byte(versionKey)); len(b) != 1 || b[0] != versionPlaintext {
+			return errors.New("userdb: database is not a plaintext user database")
+		}
+		return dst.db.Update(func(tx *bolt.Tx) error {
+			for _, bkt := range []string{usersBucket, identitiesBucket} {
+				if err := srcTx.Bucket([]byte(bkt)).ForEach(func(u, v []byte) error {
+					return dst.put(tx, bkt, dst.userKey(u), v)
+				}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}); err != nil {
+		dst.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	dst.Close()
+	src.Close()
+	if err = atrest.Replace(tmp, f); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
 func userToCacheKey(u []byte) [userdb.MaxUsernameSize]byte {
 	var k [userdb.MaxUsernameSize]byte
 	copy(k[:], u)
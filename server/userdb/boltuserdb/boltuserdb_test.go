@@ -17,12 +17,14 @@
 package boltuserdb
 
 import (
+	"bytes"
 	"crypto/rand"
 	"io/ioutil"
 	"os"
 	"path/filepath"
 	"testing"
 
+	"github.com/hashcloak/Meson/server/atrest"
 	"github.com/katzenpost/core/crypto/ecdh"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -53,7 +55,7 @@ func doTestCreate(t *testing.T) {
 	require := require.New(t)
 	assert := assert.New(t)
 
-	d, err := New(testDBPath)
+	d, err := New(testDBPath, nil)
 	require.NoError(err, "New()")
 	defer d.Close()
 
@@ -74,7 +76,7 @@ func doTestLoad(t *testing.T) {
 	require := require.New(t)
 	assert := assert.New(t)
 
-	d, err := New(testDBPath)
+	d, err := New(testDBPath, nil)
 	require.NoError(err, "New() load")
 	defer d.Close()
 
@@ -89,6 +91,58 @@ func doTestLoad(t *testing.T) {
 	assert.Error(err, "Add('alice', k, false)")
 }
 
+func TestBoltUserDBEncrypt(t *testing.T) {
+	require := require.New(t)
+	assert := assert.New(t)
+
+	dir, err := ioutil.TempDir("", "boltuserdb_encrypt_tests")
+	require.NoError(err, "TempDir()")
+	defer os.RemoveAll(dir)
+	f := filepath.Join(dir, testDB)
+
+	// Populate a plaintext database.
+	d, err := New(f, nil)
+	require.NoError(err, "New()")
+	require.NoError(d.Add([]byte("alice"), testUsers["alice"], false), "Add()")
+	require.NoError(d.SetIdentity([]byte("alice"), testUsers["bob"]), "SetIdentity()")
+	d.Close()
+
+	secret, err := atrest.NewPassphraseSecret([]byte("correct horse battery staple"))
+	require.NoError(err, "NewPassphraseSecret()")
+	_, err = New(f, secret)
+	assert.Error(err, "New() with a key for a plaintext database")
+
+	// Migrate it, and ensure that the user names are no longer stored.
+	require.NoError(Encrypt(f, secret), "Encrypt()")
+	assert.Error(Encrypt(f, secret), "Encrypt() an encrypted database")
+	b, err := ioutil.ReadFile(f)
+	require.NoError(err, "ReadFile()")
+	assert.False(bytes.Contains(b, []byte("alice")), "user name in the encrypted database")
+	assert.False(bytes.Contains(b, testUsers["alice"].Bytes()), "link key in the encrypted database")
+
+	_, err = New(f, nil)
+	assert.Error(err, "New() without a key for an encrypted database")
+	wrong, err := atrest.NewPassphraseSecret([]byte("wrong"))
+	require.NoError(err, "NewPassphraseSecret()")
+	_, err = New(f, wrong)
+	assert.Equal(atrest.ErrInvalidKey, err, "New() with the wrong key")
+
+	d, err = New(f, secret)
+	require.NoError(err, "New() with the key")
+	defer d.Close()
+	assert.True(d.Exists([]byte("alice")), "Exists('alice')")
+	assert.True(d.IsValid([]byte("alice"), testUsers["alice"]), "IsValid('alice', k)")
+	assert.False(d.Exists([]byte("bob")), "Exists('bob')")
+	identity, err := d.Identity([]byte("alice"))
+	require.NoError(err, "Identity('alice')")
+	assert.Equal(testUsers["bob"].Bytes(), identity.Bytes())
+
+	require.NoError(d.Add([]byte("bob"), testUsers["bob"], false), "Add('bob')")
+	assert.True(d.IsValid([]byte("bob"), testUsers["bob"]), "IsValid('bob', k)")
+	require.NoError(d.Remove([]byte("alice")), "Remove('alice')")
+	assert.False(d.Exists([]byte("alice")), "Exists('alice')")
+}
+
 func init() {
 	var err error
 	tmpDir, err = ioutil.TempDir("", "boltuserdb_tests")